@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// benchmarkMatrix lists the settings compared by -optimize-benchmark.
+func benchmarkMatrix() []optimize.Settings {
+	var m []optimize.Settings
+	for _, interp := range []string{"catmullrom", "bilinear", "approxbilinear", "nearest"} {
+		for _, format := range []string{"webp", "jpeg"} {
+			for _, q := range []int{60, 75, optimize.DefaultQuality, 95} {
+				m = append(m, optimize.Settings{Format: format, Quality: q, Interpolator: interp})
+			}
+		}
+		m = append(m, optimize.Settings{Format: "png", Interpolator: interp})
+	}
+	return m
+}
+
+// optimizeBenchmark runs every image in dir through optimize.ForTerminalWith
+// for each setting in the matrix and writes average output size and time per
+// setting to w. Files that are not decodable images are skipped. Nothing is
+// written to the catalog or image directory.
+func optimizeBenchmark(dir string, maxWidth int, w io.Writer) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	matrix := benchmarkMatrix()
+	bytesOut := make([]int64, len(matrix))
+	elapsed := make([]time.Duration, len(matrix))
+	var images, skipped int
+	var bytesIn int64
+
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		if optimize.Sniff(data) == "" {
+			skipped++
+			continue
+		}
+
+		var outs []int
+		var times []time.Duration
+		for _, s := range matrix {
+			start := time.Now()
+			out, _, _, err := optimize.ForTerminalWith(data, maxWidth, s)
+			if err != nil {
+				break
+			}
+			outs = append(outs, len(out))
+			times = append(times, time.Since(start))
+		}
+		if len(outs) != len(matrix) {
+			skipped++
+			continue
+		}
+		for i := range matrix {
+			bytesOut[i] += int64(outs[i])
+			elapsed[i] += times[i]
+		}
+		images++
+		bytesIn += int64(len(data))
+	}
+	if images == 0 {
+		return fmt.Errorf("no decodable images in %s (%d skipped)", dir, skipped)
+	}
+
+	fmt.Fprintf(w, "%d images (%d skipped), avg input %.1f KiB, max width %d\n\n",
+		images, skipped, float64(bytesIn)/float64(images)/1024, maxWidth)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "format\tquality\tinterpolator\tavg KiB\tavg ms\t")
+	for i, s := range matrix {
+		q := "-"
+		if s.Format != "png" {
+			q = fmt.Sprint(s.Quality)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%.1f\t\n", s.Format, q, s.Interpolator,
+			float64(bytesOut[i])/float64(images)/1024,
+			float64(elapsed[i].Microseconds())/float64(images)/1000)
+	}
+	return tw.Flush()
+}
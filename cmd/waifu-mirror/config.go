@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// secretFlags and secretEnv hold values that -print-config must not reveal.
+var (
+	secretFlags = map[string]bool{"auth-token": true}
+	secretEnv   = map[string]bool{"WAIFU_MIRROR_AUTH_TOKEN": true, "TS_AUTHKEY": true}
+)
+
+// configEnv lists environment variables that influence the effective
+// configuration, directly or through defaults.
+var configEnv = []string{"XDG_DATA_HOME", "HOME", "WAIFU_MIRROR_AUTH_TOKEN", "TS_AUTHKEY"}
+
+// effectiveConfig is the JSON document written by -print-config.
+type effectiveConfig struct {
+	Version  string            `json:"version"`
+	Flags    map[string]string `json:"flags"`
+	FlagsSet []string          `json:"flags_set"`
+	Env      map[string]string `json:"env"`
+	Paths    map[string]string `json:"paths"`
+}
+
+// redact hides a secret value while still showing whether it is set.
+func redact(v string) string {
+	if v == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// printConfig writes every resolved flag value, the environment that feeds
+// the defaults, and the paths derived from dataDir. It reads state only.
+func printConfig(w io.Writer, dataDir string) error {
+	cfg := effectiveConfig{
+		Version:  version,
+		Flags:    make(map[string]string),
+		FlagsSet: []string{},
+		Env:      make(map[string]string),
+		Paths: map[string]string{
+			"data":    dataDir,
+			"images":  filepath.Join(dataDir, "images"),
+			"catalog": filepath.Join(dataDir, "catalog.db"),
+			"tsnet":   filepath.Join(dataDir, "tsnet"),
+		},
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] {
+			v = redact(v)
+		}
+		cfg.Flags[f.Name] = v
+	})
+	flag.Visit(func(f *flag.Flag) { cfg.FlagsSet = append(cfg.FlagsSet, f.Name) })
+	for _, k := range configEnv {
+		v, ok := os.LookupEnv(k)
+		if !ok {
+			continue
+		}
+		if secretEnv[k] {
+			v = redact(v)
+		}
+		cfg.Env[k] = v
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(cfg)
+}
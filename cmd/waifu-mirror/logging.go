@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// checkLogFormat validates a -log-format value.
+func checkLogFormat(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// setupLogging applies -log-format. Text keeps the standard log output,
+// which slog's default handler also writes through, so log.Printf lines read
+// as before and structured ones gain key=value fields. JSON sends both to w
+// as one object per line, with the log.Printf text as msg, for log
+// shippers.
+func setupLogging(format string, w io.Writer) {
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, nil)))
+	}
+}
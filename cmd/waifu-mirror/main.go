@@ -1,6 +1,6 @@
 // waifu-mirror is a tailnet-only image mirror service that fetches waifu
-// images from upstream APIs (waifu.im, waifu.pics), pre-optimizes them for
-// terminal rendering, and serves them via a simple HTTP API.
+// images from upstream APIs (waifu.im, waifu.pics, nekos.best), pre-optimizes
+// them for terminal rendering, and serves them via a simple HTTP API.
 //
 // Design goals:
 //   - Tailnet-only: binds to Tailscale IP by default (no public exposure)
@@ -9,15 +9,151 @@
 //
 // Usage:
 //
-//	waifu-mirror [flags]
+//	waifu-mirror [flags] [command]
+//
+// Commands:
+//
+//	prune [-dry-run]
+//	                Delete image files no catalog row references and rows whose
+//	                file is missing, print a summary, then exit. -dry-run only
+//	                reports what would change
 //
 // Flags:
 //
+//	-config string  JSON file of settings keyed by flag name, e.g.
+//	                {"data": "/srv/waifu", "cron": "30m", "tailnet-only": true};
+//	                flags on the command line override it
 //	-addr string    Listen address (default ":8420")
 //	-data string    Data directory for images and catalog (default "~/.local/share/waifu-mirror")
 //	-ingest         Run one ingest cycle then exit
+//	-ingest-urls string
+//	                Store the images listed in a file ("URL [category]" per line)
+//	                with source "manual", then exit
+//	-fsck           Check catalog rows against image files, report, and exit
+//	-fsck-fix       With -fsck, delete rows whose file is missing or corrupt and
+//	                files no row references
+//	-repair-filenames
+//	                Point rows with a missing file at a lone hash.* match, then exit
+//	-migrate-layout Move stored images into the -layout arrangement, then exit
+//	-pregen-thumbs  Generate missing or stale 128px-wide thumbnails, then exit
+//	-compact        Hard-link catalog files with identical contents, report space
+//	                reclaimed, then exit
+//	-backfill-orig-size
+//	                Re-probe source URLs for images missing their original size, then exit
+//	-maintenance-concurrency int
+//	                Workers for -pregen-thumbs, -compact and -backfill-orig-size
+//	                (default: CPUs)
+//	-rebuild-index  Rebuild catalog indexes and planner statistics, then exit
+//	-recompute-stats
+//	                Rebuild the cached catalog statistics behind /api/health, then exit
+//	-optimize-benchmark string
+//	                Compare optimize settings on the images in a directory, then exit
+//	-webp-quality int
+//	                Lossy quality 1-100 for stored images (default 85)
+//	-hash-algo string
+//	                Content hash naming stored images: sha256, blake3 or xxhash
+//	                (default "sha256"); fixed once a catalog holds images
+//	-layout string  Where new images go under the image directory: flat, or
+//	                sharded into <first two hash digits>/ subdirectories
+//	                (default "flat"); existing images move with -migrate-layout
+//	-near-dup-distance int
+//	                Skip images within this many perceptual hash bits of a stored
+//	                one (default 5, -1 = exact duplicates only)
+//	-url-dedup string
+//	                Skip image URLs already delivered by any source ("global",
+//	                the default), saving the download, or only by the same
+//	                source ("per-source"), downloading a shared URL once more
+//	                to record both sources
+//	-waifu-im-pages int
+//	                waifu.im result pages fetched per category per cycle (default 1)
+//	-ingest-timeout duration
+//	                Cancel an ingest cycle running longer than this (0 = no limit)
+//	-allowed-hosts string
+//	                Comma-separated image hosts downloads may reach; a leading "."
+//	                also allows subdomains, "" allows any (default
+//	                ".waifu.im,.waifu.pics,.nekos.best")
+//	-download-rates string
+//	                Per-source image download limits in req/sec, e.g.
+//	                "waifu.pics=2,manual=1"; others share 10 req/sec
+//	-allow-private-downloads
+//	                Let image downloads reach loopback, private and tailnet addresses
+//	-ttfb-timeout duration
+//	                Retry a download whose first byte takes longer than this (default 15s, 0 = off)
+//	-max-image-bytes int
+//	                Skip image downloads larger than this (default 10 MiB, 0 = unlimited)
 //	-cron string    Ingest interval for continuous mode (default "1h")
+//	-target-count int
+//	                Pause ingest while the catalog holds this many images (0 = off)
+//	-max-count int  Evict oldest images beyond this many after ingest (0 = unlimited)
+//	-category-max-count string
+//	                Per-category caps, e.g. "sfw=5000,nsfw=200"
+//	-category-max-bytes string
+//	                Per-category byte caps, evicting the oldest images of a
+//	                category beyond them, e.g. "sfw=5000000000,nsfw=500000000"
+//	-max-age duration
+//	                Delete images stored longer ago than this (0 = keep forever)
+//	-max-bytes int  Delete the oldest images while stored images total more than
+//	                this many bytes (0 = unlimited)
+//	-db-max-open int
+//	                Max open catalog connections (0 = unlimited; 4 recommended)
+//	-db-max-idle int
+//	                Max idle catalog connections (default 4)
+//	-db-conn-lifetime duration
+//	                Recycle catalog connections after this long (0 = never)
+//	-random-strategy string
+//	                Random pick: offset, rowid, orderby (default "offset"; rowid recommended)
 //	-tailnet-only   Bind only to Tailscale interface (default true)
+//	-funnel         Also serve publicly via Tailscale Funnel on :443
+//	-log-format string
+//	                Log output: text, or json with one object per line for log
+//	                shippers; both carry fields such as source, count and
+//	                hash, and json adds a line per HTTP request with method,
+//	                path, status and latency (default "text")
+//	-nsfw-tag string
+//	                Serve the nsfw category only to tailnet devices with this
+//	                ACL tag, e.g. "tag:nsfw" (default off; needs -tailnet-only)
+//	-watermark string
+//	                Text overlaid on images served publicly (default off)
+//	-watermark-corner string
+//	                Watermark position (default "bottom-right")
+//	-watermark-tailnet
+//	                Also watermark images served on the tailnet
+//	-auth-token string
+//	                Bearer token enabling admin endpoints (default $WAIFU_MIRROR_AUTH_TOKEN)
+//	-transform-concurrency int
+//	                Max concurrent serve-time image transforms (default: CPUs)
+//	-transform-cache-bytes int
+//	                Memory for the most recently used results of serve-time
+//	                transforms such as ?w=&h= or ?grayscale=1 (default 16MiB,
+//	                0 = off)
+//	-max-url-length int
+//	                Reject longer request URIs with 414 (default 2048, 0 = unlimited)
+//	-max-body-bytes int
+//	                Reject larger request bodies with 413 (default 1MiB, 0 = unlimited)
+//	-missing-file-behavior string
+//	                What /api/image/:hash serves when the catalog has the image but
+//	                its file is missing or corrupt: 404, random (another image of
+//	                the same category) or fallback (default "404")
+//	-fallback-image string
+//	                Image file served by -missing-file-behavior fallback
+//	-near-color-distance float
+//	                Max RGB distance for /api/random?near_color= (default 64)
+//	-max-concurrent-requests int
+//	                Answer 503 beyond this many requests in flight (default 64,
+//	                0 = unlimited; /api/health, /metrics and event streams exempt)
+//	-warm-count int Keep this many most-viewed images in memory (0 = off)
+//	-warm-category string
+//	                Category the warm set is drawn from (default "sfw")
+//	-warm-max-bytes int
+//	                Cap on warm set image bytes (default 32MiB, 0 = no cap)
+//	-warm-refresh duration
+//	                Reload the warm set this often, besides after ingest (default "10m")
+//	-print-config   Print effective settings as JSON (secrets redacted) and exit
+//	-validate-config
+//	                Check flag values, conflicting flags (e.g. two run-once modes,
+//	                -funnel without -tailnet-only) and the URLs in the
+//	                -ingest-urls file, print any problems, then exit; non-zero
+//	                if there are any. The same flag checks run at every start
 //	-version        Print version and exit
 package main
 
@@ -26,16 +162,25 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/config"
+	"github.com/Jesssullivan/waifu-mirror/internal/events"
 	"github.com/Jesssullivan/waifu-mirror/internal/ingest"
+	"github.com/Jesssullivan/waifu-mirror/internal/lockfile"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
 	"github.com/Jesssullivan/waifu-mirror/internal/server"
 	"tailscale.com/tsnet"
 )
@@ -48,19 +193,178 @@ var (
 
 func main() {
 	var (
+		configPath  = flag.String("config", "", "JSON file of settings keyed by flag name; command-line flags override it")
 		addr        = flag.String("addr", ":8420", "Listen address")
 		dataDir     = flag.String("data", defaultDataDir(), "Data directory")
 		runIngest   = flag.Bool("ingest", false, "Run one ingest cycle then exit")
+		urlList     = flag.String("ingest-urls", "", `Store the images listed in this file ("URL [category]" per line), then exit`)
+		runFsck     = flag.Bool("fsck", false, "Check catalog rows against image files, report, and exit")
+		fsckFix     = flag.Bool("fsck-fix", false, "With -fsck, delete rows whose file is missing or corrupt and files no row references")
+		repairFiles = flag.Bool("repair-filenames", false, "Point rows with a missing file at a lone hash.* match, then exit")
+		migrateLay  = flag.Bool("migrate-layout", false, "Move stored images into the -layout arrangement, then exit")
+		pregenThumb = flag.Bool("pregen-thumbs", false, "Generate missing or stale thumbnails, then exit")
+		compact     = flag.Bool("compact", false, "Hard-link catalog files with identical contents, report space reclaimed, then exit")
+		backfillOrg = flag.Bool("backfill-orig-size", false, "Re-probe source URLs for images missing their original size, then exit")
+		maintN      = flag.Int("maintenance-concurrency", runtime.NumCPU(), "Workers for -pregen-thumbs, -compact and -backfill-orig-size")
+		rebuildIdx  = flag.Bool("rebuild-index", false, "Rebuild catalog indexes and planner statistics, then exit")
+		recompStats = flag.Bool("recompute-stats", false, "Rebuild the cached catalog statistics behind /api/health, then exit")
+		benchDir    = flag.String("optimize-benchmark", "", "Compare optimize settings on the images in this directory, then exit")
+		webpQuality = flag.Int("webp-quality", optimize.DefaultQuality, "Lossy quality 1-100 for stored images")
+		hashAlgo    = flag.String("hash-algo", ingest.HashSHA256, "Content hash naming stored images: sha256, blake3, xxhash (fixed per catalog)")
+		layoutName  = flag.String("layout", string(maintenance.LayoutFlat), "Where new images go under the image directory: flat, sharded")
+		nearDup     = flag.Int("near-dup-distance", ingest.DefaultNearDuplicateDistance, "Skip images within this many perceptual hash bits of a stored one (-1 = exact duplicates only)")
+		urlDedupStr = flag.String("url-dedup", string(ingest.URLDedupGlobal), "Skip image URLs already delivered by any source (global) or by the same source (per-source)")
+		waifuImPgs  = flag.Int("waifu-im-pages", 1, "waifu.im result pages fetched per category per cycle")
+		ingestTO    = flag.Duration("ingest-timeout", 0, "Cancel an ingest cycle running longer than this (0 = no limit)")
+		allowHosts  = flag.String("allowed-hosts", strings.Join(ingest.DefaultAllowedHosts, ","), `Comma-separated image hosts downloads may reach ("" = any)`)
+		dlRates     = flag.String("download-rates", "", `Per-source image download limits in req/sec, e.g. "waifu.pics=2" (others share 10)`)
+		allowPriv   = flag.Bool("allow-private-downloads", false, "Let image downloads reach loopback, private and tailnet addresses")
+		ttfbTO      = flag.Duration("ttfb-timeout", 15*time.Second, "Retry a download whose first byte takes longer than this (0 = off)")
+		maxImgBytes = flag.Int64("max-image-bytes", ingest.DefaultMaxImageBytes, "Skip image downloads larger than this many bytes (0 = unlimited)")
 		cronStr     = flag.String("cron", "1h", "Ingest interval for continuous mode")
+		targetCount = flag.Int("target-count", 0, "Pause ingest while the catalog holds this many images (0 = off)")
+		maxCount    = flag.Int("max-count", 0, "Evict oldest images beyond this many after ingest (0 = unlimited)")
+		catMaxCount = flag.String("category-max-count", "", `Per-category image caps, e.g. "sfw=5000,nsfw=200"`)
+		catMaxBytes = flag.String("category-max-bytes", "", `Per-category byte caps, e.g. "sfw=5000000000,nsfw=500000000"`)
+		maxAge      = flag.Duration("max-age", 0, "Delete images stored longer ago than this (0 = keep forever)")
+		maxBytes    = flag.Int64("max-bytes", 0, "Delete the oldest images while stored images total more than this many bytes (0 = unlimited)")
+		dbMaxOpen   = flag.Int("db-max-open", 0, "Max open catalog connections (0 = unlimited; 4 recommended with WAL)")
+		dbMaxIdle   = flag.Int("db-max-idle", 4, "Max idle catalog connections")
+		dbLifetime  = flag.Duration("db-conn-lifetime", 0, "Recycle catalog connections after this long (0 = never)")
+		randomStrat = flag.String("random-strategy", "offset", "Random pick strategy: offset, rowid (recommended for large catalogs), orderby")
 		tailnetOnly = flag.Bool("tailnet-only", true, "Bind only to Tailscale interface")
+		funnel      = flag.Bool("funnel", false, "Also serve publicly via Tailscale Funnel on :443")
+		logFormat   = flag.String("log-format", "text", "Log output: text or json (one object per line, for log shippers)")
+		nsfwTag     = flag.String("nsfw-tag", "", "Serve the nsfw category only to tailnet devices with this ACL tag, e.g. tag:nsfw (empty disables)")
+		wmText      = flag.String("watermark", "", "Text overlaid on images served publicly (empty disables)")
+		wmCorner    = flag.String("watermark-corner", "bottom-right", "Watermark position: bottom-right, bottom-left, top-right, top-left")
+		wmTailnet   = flag.Bool("watermark-tailnet", false, "Also watermark images served on the tailnet")
+		authToken   = flag.String("auth-token", os.Getenv("WAIFU_MIRROR_AUTH_TOKEN"), "Bearer token for admin endpoints (empty disables them)")
+		transformN  = flag.Int("transform-concurrency", runtime.NumCPU(), "Max concurrent serve-time image transforms")
+		tcacheBytes = flag.Int64("transform-cache-bytes", 16<<20, "Memory for caching serve-time transform results (0 = off)")
+		maxURLLen   = flag.Int("max-url-length", server.DefaultMaxURLLength, "Reject longer request URIs with 414 (0 = unlimited)")
+		maxBody     = flag.Int64("max-body-bytes", server.DefaultMaxBodyBytes, "Reject larger request bodies with 413 (0 = unlimited)")
+		missingFile = flag.String("missing-file-behavior", string(server.MissingNotFound), "What /api/image serves for a catalog image whose file is missing: 404, random, fallback")
+		fallbackImg = flag.String("fallback-image", "", "Image file served by -missing-file-behavior fallback")
+		nearColor   = flag.Float64("near-color-distance", server.DefaultNearColorDistance, "Max RGB distance for /api/random?near_color=")
+		maxInFlight = flag.Int("max-concurrent-requests", 64, "Answer 503 beyond this many requests in flight (0 = unlimited)")
+		warmCount   = flag.Int("warm-count", 0, "Keep this many most-viewed images in memory (0 = off)")
+		warmCat     = flag.String("warm-category", "sfw", "Category the warm set is drawn from")
+		warmMax     = flag.Int64("warm-max-bytes", 32<<20, "Cap on warm set image bytes (0 = no cap)")
+		warmEvery   = flag.Duration("warm-refresh", 10*time.Minute, "Reload the warm set this often, besides after ingest")
+		printCfg    = flag.Bool("print-config", false, "Print effective settings as JSON (secrets redacted) and exit")
+		validateCfg = flag.Bool("validate-config", false, "Check flag values, flag combinations and the -ingest-urls file, then exit (1 if any problem)")
 		showVersion = flag.Bool("version", false, "Print version and exit")
 	)
 	flag.Parse()
+	if *configPath != "" {
+		values, err := config.Load(*configPath)
+		if err == nil {
+			err = config.Apply(flag.CommandLine, values)
+		}
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	setupLogging(*logFormat, os.Stderr)
+
+	// Commands follow the global flags, e.g. "waifu-mirror -data DIR prune".
+	var pruneCmd, pruneDryRun bool
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "prune":
+		sub := flag.NewFlagSet("prune", flag.ExitOnError)
+		dryRun := sub.Bool("dry-run", false, "Report what would be removed without removing it")
+		sub.Parse(flag.Args()[1:])
+		pruneCmd, pruneDryRun = true, *dryRun
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
 
 	if *showVersion {
 		fmt.Printf("waifu-mirror %s (%s) built %s\n", version, commit, date)
 		os.Exit(0)
 	}
+	if *printCfg {
+		if err := printConfig(os.Stdout, *dataDir); err != nil {
+			log.Fatalf("print config: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Catch conflicting settings before doing any work.
+	problems := validateConfig(flag.CommandLine)
+	if *validateCfg {
+		problems = append(problems, checkURLList(*urlList, *allowHosts)...)
+	}
+	for _, p := range problems {
+		log.Printf("config: %v", p)
+	}
+	if len(problems) > 0 {
+		log.Fatalf("config: invalid, see above")
+	}
+	if *validateCfg {
+		log.Printf("config: ok")
+		os.Exit(0)
+	}
+
+	// Fall back to another output format if WebP encoding is broken in
+	// this build, so stored files and their catalog format always agree.
+	log.Printf("output format: %s", optimize.Probe())
+
+	corner, err := optimize.ParseCorner(*wmCorner)
+	if err != nil {
+		log.Fatalf("invalid -watermark-corner: %v", err)
+	}
+	catCaps, err := maintenance.ParseCategoryCaps(*catMaxCount)
+	if err != nil {
+		log.Fatalf("invalid -category-max-count: %v", err)
+	}
+	downloadRates, err := ingest.ParseDownloadRates(*dlRates)
+	if err != nil {
+		log.Fatalf("invalid -download-rates: %v", err)
+	}
+	strategy, err := catalog.ParseRandomStrategy(*randomStrat)
+	if err != nil {
+		log.Fatalf("invalid -random-strategy: %v", err)
+	}
+	if err := optimize.CheckQuality(*webpQuality); err != nil {
+		log.Fatalf("invalid -webp-quality: %v", err)
+	}
+	if err := ingest.CheckHashAlgo(*hashAlgo); err != nil {
+		log.Fatalf("invalid -hash-algo: %v", err)
+	}
+	layout, err := maintenance.ParseLayout(*layoutName)
+	if err != nil {
+		log.Fatalf("invalid -layout: %v", err)
+	}
+	urlDedup, err := ingest.ParseURLDedup(*urlDedupStr)
+	if err != nil {
+		log.Fatalf("invalid -url-dedup: %v", err)
+	}
+	missingBehavior, err := server.ParseMissingFileBehavior(*missingFile)
+	if err != nil {
+		log.Fatalf("invalid -missing-file-behavior: %v", err)
+	}
+	var fallback []byte
+	if missingBehavior == server.MissingFallback {
+		if fallback, err = loadFallbackImage(*fallbackImg); err != nil {
+			log.Fatalf("invalid -fallback-image: %v", err)
+		}
+	}
+	catByteCaps, err := maintenance.ParseCategoryByteCaps(*catMaxBytes)
+	if err != nil {
+		log.Fatalf("invalid -category-max-bytes: %v", err)
+	}
+	evictPolicy := maintenance.EvictPolicy{MaxCount: *maxCount, CategoryMaxCount: catCaps, CategoryMaxBytes: catByteCaps}
+
+	// Optimizer benchmark mode touches neither the catalog nor the data dir.
+	if *benchDir != "" {
+		if err := optimizeBenchmark(*benchDir, optimize.DefaultMaxWidth, os.Stdout); err != nil {
+			log.Fatalf("optimize benchmark: %v", err)
+		}
+		os.Exit(0)
+	}
 
 	// Ensure data directory exists.
 	imgDir := filepath.Join(*dataDir, "images")
@@ -68,8 +372,22 @@ func main() {
 		log.Fatalf("create data dir: %v", err)
 	}
 
+	// Only one process may use a data dir: two servers would fight over the
+	// tsnet state, and a maintenance pass or one-shot ingest racing a server
+	// could delete files the other's rows point at.
+	dirLock, err := lockfile.Acquire(*dataDir)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer dirLock.Release()
+
 	// Open catalog (SQLite).
-	cat, err := catalog.Open(filepath.Join(*dataDir, "catalog.db"))
+	cat, err := catalog.Open(filepath.Join(*dataDir, "catalog.db"),
+		catalog.WithMaxOpenConns(*dbMaxOpen),
+		catalog.WithMaxIdleConns(*dbMaxIdle),
+		catalog.WithConnMaxLifetime(*dbLifetime),
+		catalog.WithRandomStrategy(strategy),
+	)
 	if err != nil {
 		log.Fatalf("open catalog: %v", err)
 	}
@@ -85,14 +403,201 @@ func main() {
 		cancel()
 	}()
 
+	// Consistency check mode.
+	if *runFsck {
+		report, err := maintenance.Fsck(cat, imgDir, *fsckFix)
+		if err != nil {
+			log.Fatalf("fsck: %v", err)
+		}
+		for _, p := range report.Problems {
+			if p.Hash == "" {
+				log.Printf("fsck: %s: %s", p.Kind, p.Filename)
+				continue
+			}
+			log.Printf("fsck: %s: %s (hash %s)", p.Kind, p.Filename, p.Hash)
+		}
+		log.Printf("fsck: checked %d images, %d problems, %d removed",
+			report.Checked, len(report.Problems), report.Removed)
+		os.Exit(0)
+	}
+
+	// Orphan and dangling row cleanup.
+	if pruneCmd {
+		report, err := maintenance.Reconcile(cat, imgDir, pruneDryRun)
+		if err != nil {
+			log.Fatalf("prune: %v", err)
+		}
+		for _, name := range report.Orphans {
+			log.Printf("prune: orphan file %s", name)
+		}
+		for _, img := range report.Dangling {
+			log.Printf("prune: missing file %s (hash %s)", img.Filename, img.Hash)
+		}
+		verb, n := "removed", report.Removed
+		if pruneDryRun {
+			verb, n = "would remove", len(report.Orphans)+len(report.Dangling)
+		}
+		log.Printf("prune: checked %d images, %d orphan files, %d rows without a file; %s %d",
+			report.Checked, len(report.Orphans), len(report.Dangling), verb, n)
+		os.Exit(0)
+	}
+
+	// Filename reconciliation mode.
+	if *repairFiles {
+		report, err := maintenance.RepairFilenames(cat, imgDir)
+		if err != nil {
+			log.Fatalf("repair-filenames: %v", err)
+		}
+		for hash, filename := range report.Repaired {
+			log.Printf("repair-filenames: %s -> %s", hash, filename)
+		}
+		for hash, reason := range report.Unrepairable {
+			log.Printf("repair-filenames: cannot repair %s: %s", hash, reason)
+		}
+		log.Printf("repair-filenames: checked %d images, %d repaired, %d unrepairable",
+			report.Checked, len(report.Repaired), len(report.Unrepairable))
+		os.Exit(0)
+	}
+
+	// Layout migration mode.
+	if *migrateLay {
+		report, err := maintenance.MigrateLayout(cat, imgDir, layout)
+		if err != nil {
+			log.Fatalf("migrate-layout: %v", err)
+		}
+		log.Printf("migrate-layout: checked %d images, %d moved to the %s layout, %d failed",
+			report.Checked, report.Moved, layout, report.Failed)
+		os.Exit(0)
+	}
+
+	// Thumbnail pregeneration mode.
+	if *pregenThumb {
+		report, err := maintenance.PregenThumbs(cat, imgDir, *maintN, maintenance.LogProgress("pregen-thumbs"))
+		if err != nil {
+			log.Fatalf("pregen-thumbs: %v", err)
+		}
+		log.Printf("pregen-thumbs: checked %d images, %d generated, %d current, %d failed",
+			report.Checked, report.Generated, report.Current, report.Failed)
+		os.Exit(0)
+	}
+
+	// Duplicate file compaction mode.
+	if *compact {
+		report, err := maintenance.Compact(cat, imgDir, *maintN, maintenance.LogProgress("compact"))
+		if err != nil {
+			log.Fatalf("compact: %v", err)
+		}
+		log.Printf("compact: checked %d files, %d linked, %d failed, %d bytes reclaimed",
+			report.Checked, report.Linked, report.Failed, report.Reclaimed)
+		os.Exit(0)
+	}
+
+	if *backfillOrg {
+		ing := ingest.New(cat, imgDir,
+			ingest.WithAllowedHosts(ingest.ParseHostList(*allowHosts)),
+			ingest.WithPrivateNetworks(*allowPriv),
+			ingest.WithDownloadRates(downloadRates),
+		)
+		report, err := ing.BackfillOrigSize(ctx, *maintN, maintenance.LogProgress("backfill-orig-size"))
+		if err != nil {
+			log.Fatalf("backfill-orig-size: %v", err)
+		}
+		log.Printf("backfill-orig-size: %d images missing a size, %d updated, %d failed",
+			report.Checked, report.Updated, report.Failed)
+		os.Exit(0)
+	}
+
+	if *rebuildIdx {
+		start := time.Now()
+		if err := cat.Reindex(); err != nil {
+			log.Fatalf("rebuild-index: %v", err)
+		}
+		log.Printf("rebuild-index: done in %v", time.Since(start).Round(time.Millisecond))
+		os.Exit(0)
+	}
+
+	if *recompStats {
+		if err := cat.RecomputeStats(); err != nil {
+			log.Fatalf("recompute-stats: %v", err)
+		}
+		stats, err := cat.Stats()
+		if err != nil {
+			log.Fatalf("recompute-stats: %v", err)
+		}
+		log.Printf("recompute-stats: %d sfw, %d nsfw, %d bytes",
+			stats.SFWCount, stats.NSFWCount, stats.TotalBytes)
+		os.Exit(0)
+	}
+
+	// Every mode from here on stores images.
+	if err := cat.PinHashAlgo(*hashAlgo); err != nil {
+		log.Fatalf("-hash-algo: %v", err)
+	}
+
+	// Manual seeding mode.
+	if *urlList != "" {
+		f, err := os.Open(*urlList)
+		if err != nil {
+			log.Fatalf("ingest-urls: %v", err)
+		}
+		ing := ingest.New(cat, imgDir,
+			ingest.WithQuality(*webpQuality),
+			ingest.WithHashAlgo(*hashAlgo),
+			ingest.WithLayout(layout),
+			ingest.WithNearDuplicateDistance(*nearDup),
+			ingest.WithURLDedup(urlDedup),
+			ingest.WithFirstByteTimeout(*ttfbTO),
+			ingest.WithMaxImageBytes(*maxImgBytes),
+			ingest.WithAllowedHosts(ingest.ParseHostList(*allowHosts)),
+			ingest.WithPrivateNetworks(*allowPriv),
+			ingest.WithDownloadRates(downloadRates),
+		)
+		report, err := ing.IngestURLs(ctx, f)
+		f.Close()
+		for _, r := range report.Results {
+			if r.Err != nil {
+				log.Printf("ingest-urls: line %d: %s: %v", r.Line, r.URL, r.Err)
+			} else {
+				log.Printf("ingest-urls: line %d: %s: %s (%s)", r.Line, r.URL, r.Status, r.Category)
+			}
+		}
+		if err != nil {
+			log.Fatalf("ingest-urls: %v", err)
+		}
+		log.Printf("ingest-urls: %d stored, %d duplicates, %d failed",
+			report.Stored, report.Duplicate, report.Failed)
+		os.Exit(0)
+	}
+
 	// One-shot ingest mode.
 	if *runIngest {
-		ing := ingest.New(cat, imgDir)
-		n, err := ing.Run(ctx)
+		ing := ingest.New(cat, imgDir,
+			ingest.WithWaifuImPages(*waifuImPgs),
+			ingest.WithQuality(*webpQuality),
+			ingest.WithHashAlgo(*hashAlgo),
+			ingest.WithLayout(layout),
+			ingest.WithNearDuplicateDistance(*nearDup),
+			ingest.WithURLDedup(urlDedup),
+			ingest.WithCycleTimeout(*ingestTO),
+			ingest.WithTargetCount(*targetCount),
+			ingest.WithFirstByteTimeout(*ttfbTO),
+			ingest.WithMaxImageBytes(*maxImgBytes),
+			ingest.WithAllowedHosts(ingest.ParseHostList(*allowHosts)),
+			ingest.WithPrivateNetworks(*allowPriv),
+			ingest.WithDownloadRates(downloadRates),
+		)
+		res, err := ing.Run(ctx)
 		if err != nil {
 			log.Fatalf("ingest: %v", err)
 		}
-		log.Printf("ingested %d new images", n)
+		logTimeout(res)
+		if !res.Skipped {
+			logCycle(res)
+		}
+		evict(cat, imgDir, evictPolicy)
+		prune(cat, imgDir, *maxAge, *maxBytes)
+		analyze(cat, res)
+		refreshStats(cat)
 		os.Exit(0)
 	}
 
@@ -102,15 +607,70 @@ func main() {
 		log.Fatalf("invalid cron interval: %v", err)
 	}
 
+	// Newly ingested images are streamed to /api/events subscribers.
+	bus := events.NewBus()
+
+	// Optionally keep the most requested images in memory.
+	var warm *server.WarmSet
+	if *warmCount > 0 {
+		warm = server.NewWarmSet(cat, imgDir, *warmCat, *warmCount, *warmMax)
+		if err := warm.Reload(); err != nil {
+			slog.Error("warm set", "err", err)
+		}
+		go warm.Run(ctx, *warmEvery)
+	}
+
+	// After every cycle: enforce caps, refresh planner statistics after a
+	// large batch and the cached catalog stats, then rotate new images into
+	// the warm set.
+	afterIngest := func(res *ingest.RunResult) {
+		if ctx.Err() != nil {
+			return // shutting down; leave maintenance to the next start
+		}
+		evict(cat, imgDir, evictPolicy)
+		analyze(cat, res)
+		refreshStats(cat)
+		if warm != nil {
+			if err := warm.Reload(); err != nil {
+				slog.Error("warm set", "err", err)
+			}
+		}
+	}
+
 	// Start background ingest goroutine.
-	ing := ingest.New(cat, imgDir)
+	ing := ingest.New(cat, imgDir,
+		ingest.WithEvents(bus),
+		ingest.WithWaifuImPages(*waifuImPgs),
+		ingest.WithQuality(*webpQuality),
+		ingest.WithHashAlgo(*hashAlgo),
+		ingest.WithLayout(layout),
+		ingest.WithNearDuplicateDistance(*nearDup),
+		ingest.WithURLDedup(urlDedup),
+		ingest.WithCycleTimeout(*ingestTO),
+		ingest.WithTargetCount(*targetCount),
+		ingest.WithFirstByteTimeout(*ttfbTO),
+		ingest.WithMaxImageBytes(*maxImgBytes),
+		ingest.WithAllowedHosts(ingest.ParseHostList(*allowHosts)),
+		ingest.WithPrivateNetworks(*allowPriv),
+		ingest.WithDownloadRates(downloadRates),
+	)
+	// ingestDone is closed once the ingest loop has returned, so shutdown
+	// can wait for a cancelled cycle to record its partial result before
+	// the catalog is closed.
+	ingestDone := make(chan struct{})
 	go func() {
+		defer close(ingestDone)
 		// Initial ingest on startup.
-		if n, err := ing.Run(ctx); err != nil {
-			log.Printf("initial ingest: %v", err)
+		res, err := ing.Run(ctx)
+		if err != nil {
+			slog.Error("initial ingest", "err", err)
 		} else {
-			log.Printf("initial ingest: %d new images", n)
+			logTimeout(res)
+			if !res.Skipped {
+				logCycle(res)
+			}
 		}
+		afterIngest(res)
 
 		ticker := time.NewTicker(cronInterval)
 		defer ticker.Stop()
@@ -119,20 +679,104 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				if n, err := ing.Run(ctx); err != nil {
-					log.Printf("ingest: %v", err)
-				} else if n > 0 {
-					log.Printf("ingested %d new images", n)
+				res, err := ing.Run(ctx)
+				if err != nil {
+					slog.Error("ingest", "err", err)
+				} else {
+					logTimeout(res)
+					if res.New > 0 {
+						logCycle(res)
+					}
 				}
+				afterIngest(res)
 			}
 		}
 	}()
 
-	// Build HTTP server.
-	handler := server.New(cat, imgDir)
+	// Apply -max-age and -max-bytes on their own schedule: age limits expire
+	// images between ingest cycles too.
+	if *maxAge > 0 || *maxBytes > 0 {
+		go func() {
+			ticker := time.NewTicker(pruneInterval)
+			defer ticker.Stop()
+			for {
+				prune(cat, imgDir, *maxAge, *maxBytes)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	// The tsnet server is only started by its first Listen below, but the
+	// HTTP servers need it to look up peers.
+	var ts *tsnet.Server
+	if *tailnetOnly {
+		ts = &tsnet.Server{
+			Hostname: "waifu-mirror",
+			Dir:      filepath.Join(*dataDir, "tsnet"),
+		}
+		defer ts.Close()
+	}
+
+	// Build HTTP servers. The watermark applies to publicly reachable
+	// listeners (funnel, or a plain listener without tsnet) and only to the
+	// tailnet when explicitly requested. The admin API is never exposed
+	// through funnel.
+	transforms := server.NewTransformPool(*transformN)
+	var transformCache *server.TransformCache
+	if *tcacheBytes > 0 {
+		transformCache = server.NewTransformCache(*tcacheBytes)
+	}
+	served := server.NewServedLog(cat)
+	go served.Run(ctx, 10*time.Second)
+	baseOpts := []server.Option{
+		server.WithTransformPool(transforms),
+		server.WithTransformCache(transformCache),
+		server.WithEvents(bus),
+		server.WithEvictPolicy(evictPolicy),
+		server.WithRequestLimits(*maxURLLen, *maxBody),
+		server.WithMaxConcurrentRequests(*maxInFlight),
+		server.WithWarmSet(warm),
+		server.WithServedLog(served),
+		server.WithSources(ing.Sources),
+		server.WithNearColorDistance(*nearColor),
+		server.WithMissingFileBehavior(missingBehavior, fallback),
+	}
+	if *logFormat == "json" {
+		// Text output stays as quiet as before -log-format existed.
+		baseOpts = append(baseOpts, server.WithAccessLog(slog.Default()))
+	}
+	if *nsfwTag != "" {
+		baseOpts = append(baseOpts, server.WithNSFWTag(*nsfwTag))
+	}
+	var wmOpts []server.Option
+	if *wmText != "" {
+		wmOpts = append(wmOpts, server.WithWatermark(*wmText, corner))
+	}
+	publicOpts := slices.Concat(baseOpts, wmOpts)
+	tailnetOpts := slices.Concat(baseOpts, []server.Option{server.WithAuthToken(*authToken)})
+	if ts != nil {
+		// Funnel requests come from the internet, not tailnet peers.
+		tailnetOpts = append(tailnetOpts, server.WithPeers(tailnetPeers(ts)))
+	}
+	if *wmTailnet || !*tailnetOnly {
+		tailnetOpts = append(tailnetOpts, wmOpts...)
+	}
 
 	srv := &http.Server{
-		Handler: handler,
+		Handler: server.New(cat, imgDir, tailnetOpts...),
+	}
+	// Shutdown waits for active requests; closing the bus ends event streams.
+	srv.RegisterOnShutdown(bus.Close)
+	var funnelSrv *http.Server
+	if *funnel {
+		funnelSrv = &http.Server{
+			Handler: server.New(cat, imgDir, publicOpts...),
+		}
+		funnelSrv.RegisterOnShutdown(bus.Close)
 	}
 
 	go func() {
@@ -140,36 +784,163 @@ func main() {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer shutdownCancel()
 		srv.Shutdown(shutdownCtx)
+		if funnelSrv != nil {
+			funnelSrv.Shutdown(shutdownCtx)
+		}
 	}()
 
 	var ln net.Listener
-	if *tailnetOnly {
+	if ts != nil {
 		// tsnet binds directly to the tailnet — no public exposure.
-		tsnetDir := filepath.Join(*dataDir, "tsnet")
-		ts := &tsnet.Server{
-			Hostname: "waifu-mirror",
-			Dir:      tsnetDir,
-		}
-		defer ts.Close()
-
 		var tsErr error
 		ln, tsErr = ts.Listen("tcp", *addr)
 		if tsErr != nil {
 			log.Fatalf("tsnet listen: %v", tsErr)
 		}
-		log.Printf("waifu-mirror %s listening on tailnet (hostname: waifu-mirror, addr: %s)", version, ln.Addr())
+		slog.Info("waifu-mirror listening on tailnet", "version", version, "hostname", "waifu-mirror", "addr", ln.Addr().String())
+
+		if funnelSrv != nil {
+			fln, err := ts.ListenFunnel("tcp", ":443")
+			if err != nil {
+				log.Fatalf("tsnet funnel: %v", err)
+			}
+			slog.Info("waifu-mirror serving publicly via funnel", "version", version, "addr", fln.Addr().String())
+			go func() {
+				if err := funnelSrv.Serve(fln); err != http.ErrServerClosed {
+					slog.Error("funnel server", "err", err)
+				}
+			}()
+		}
 	} else {
 		var listenErr error
 		ln, listenErr = net.Listen("tcp", *addr)
 		if listenErr != nil {
 			log.Fatalf("listen: %v", listenErr)
 		}
-		log.Printf("waifu-mirror %s listening on %s", version, *addr)
+		slog.Info("waifu-mirror listening", "version", version, "addr", *addr)
 	}
 
 	if err := srv.Serve(ln); err != http.ErrServerClosed {
 		log.Fatalf("server: %v", err)
 	}
+	select {
+	case <-ingestDone:
+	case <-time.After(10 * time.Second):
+		log.Printf("shutdown: ingest still running after 10s, exiting anyway")
+	}
+	if err := served.Flush(); err != nil {
+		slog.Error("mark served", "err", err)
+	}
+}
+
+// tailnetPeers identifies tailnet peers through ts. Tagged devices all
+// belong to the same pseudo-user, so they are told apart by node name.
+// Funnel clients are not tailnet peers and cannot be identified.
+func tailnetPeers(ts *tsnet.Server) server.PeerResolver {
+	return func(ctx context.Context, remoteAddr string) (server.Peer, error) {
+		lc, err := ts.LocalClient()
+		if err != nil {
+			return server.Peer{}, err
+		}
+		who, err := lc.WhoIs(ctx, remoteAddr)
+		if err != nil {
+			return server.Peer{}, err
+		}
+		var peer server.Peer
+		if who.UserProfile != nil {
+			peer.User = who.UserProfile.LoginName
+		}
+		if who.Node != nil && who.Node.IsTagged() {
+			peer.User, peer.Tags = who.Node.Name, who.Node.Tags
+		}
+		return peer, nil
+	}
+}
+
+// evict applies the eviction policy, logging how many images each category
+// lost. Failures are logged; the next cycle retries.
+func evict(cat *catalog.DB, imgDir string, policy maintenance.EvictPolicy) {
+	if !policy.Enabled() {
+		return
+	}
+	evicted, err := maintenance.Evict(cat, imgDir, policy)
+	if err != nil {
+		slog.Error("evict", "err", err)
+	}
+	for category, n := range evicted {
+		slog.Info("evict: removed images", "category", category, "count", n)
+	}
+}
+
+// pruneInterval is how often continuous mode applies -max-age and
+// -max-bytes.
+const pruneInterval = 10 * time.Minute
+
+// prune deletes images beyond the age and size limits and logs the count.
+func prune(cat *catalog.DB, imgDir string, maxAge time.Duration, maxBytes int64) {
+	n, err := maintenance.Prune(cat, imgDir, maxAge, maxBytes)
+	if err != nil {
+		slog.Error("prune", "err", err)
+	}
+	if n > 0 {
+		slog.Info("prune: removed images", "count", n)
+	}
+}
+
+// loadFallbackImage reads the image served in place of missing files.
+func loadFallbackImage(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("required by -missing-file-behavior fallback")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if optimize.Sniff(data) == "" {
+		return nil, fmt.Errorf("%s is not a supported image", path)
+	}
+	return data, nil
+}
+
+// analyzeAfter is the number of new images in one cycle after which the
+// catalog's planner statistics are refreshed.
+const analyzeAfter = 500
+
+// analyze runs ANALYZE after a large ingest cycle so the query planner keeps
+// choosing the category and hash indexes as the catalog grows. res may be
+// nil if the cycle failed.
+func analyze(cat *catalog.DB, res *ingest.RunResult) {
+	if res == nil || res.New < analyzeAfter {
+		return
+	}
+	if err := cat.Analyze(); err != nil {
+		slog.Error("analyze", "err", err)
+	}
+}
+
+// refreshStats rebuilds the cached catalog statistics after a cycle. The
+// cache follows every change on its own; this only brings the last ingest
+// time back in line after evictions. Failures are logged.
+func refreshStats(cat *catalog.DB) {
+	if err := cat.RecomputeStats(); err != nil {
+		slog.Error("stats", "err", err)
+	}
+}
+
+// logTimeout notes an ingest cycle cut short by -ingest-timeout or by
+// shutdown.
+func logTimeout(res *ingest.RunResult) {
+	switch {
+	case res.TimedOut:
+		slog.Warn("ingest: cycle timed out, remaining sources skipped", "duration", res.Duration.Round(time.Second))
+	case res.Canceled:
+		slog.Warn("ingest: cycle interrupted; new images kept", "duration", res.Duration.Round(time.Second), "count", res.New)
+	}
+}
+
+// logCycle reports a completed ingest cycle.
+func logCycle(res *ingest.RunResult) {
+	slog.Info("ingest: cycle done", "count", res.New, "duration", res.Duration.Round(time.Millisecond))
 }
 
 func defaultDataDir() string {
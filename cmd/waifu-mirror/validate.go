@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/ingest"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+	"github.com/Jesssullivan/waifu-mirror/internal/server"
+)
+
+// modeFlags are the boolean or string flags that each select a run-once
+// mode; main runs the first one set, so setting several is a mistake.
+var modeFlags = []string{
+	"ingest", "ingest-urls", "fsck", "repair-filenames", "migrate-layout", "pregen-thumbs", "compact",
+	"backfill-orig-size", "rebuild-index", "recompute-stats", "optimize-benchmark",
+}
+
+// nonNegativeFlags are numeric flags where 0 is the "off" or "unlimited"
+// value and anything below it is a typo.
+var nonNegativeFlags = []string{
+	"target-count", "max-count", "max-age", "max-bytes", "ingest-timeout", "ttfb-timeout",
+	"db-max-open", "db-max-idle", "db-conn-lifetime", "max-url-length", "max-body-bytes",
+	"max-concurrent-requests", "near-color-distance", "warm-count", "warm-max-bytes",
+	"transform-cache-bytes", "max-image-bytes",
+}
+
+// validateConfig checks the flags and command in fs for values that do not
+// parse and combinations that cannot work as meant, and returns every
+// problem found rather than just the first. It reads no files except
+// -fallback-image.
+func validateConfig(fs *flag.FlagSet) []error {
+	var problems []error
+	bad := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	str := func(name string) string {
+		if f := fs.Lookup(name); f != nil {
+			return f.Value.String()
+		}
+		return ""
+	}
+	on := func(name string) bool {
+		v := str(name)
+		return v != "" && v != "false" && v != "0"
+	}
+
+	// Values that must parse.
+	if _, _, err := net.SplitHostPort(str("addr")); err != nil {
+		bad("-addr: %v", err)
+	}
+	if _, err := optimize.ParseCorner(str("watermark-corner")); err != nil {
+		bad("-watermark-corner: %v", err)
+	}
+	if _, err := maintenance.ParseCategoryCaps(str("category-max-count")); err != nil {
+		bad("-category-max-count: %v", err)
+	}
+	if _, err := maintenance.ParseCategoryByteCaps(str("category-max-bytes")); err != nil {
+		bad("-category-max-bytes: %v", err)
+	}
+	if _, err := ingest.ParseDownloadRates(str("download-rates")); err != nil {
+		bad("-download-rates: %v", err)
+	}
+	if _, err := catalog.ParseRandomStrategy(str("random-strategy")); err != nil {
+		bad("-random-strategy: %v", err)
+	}
+	if f := fs.Lookup("webp-quality"); f != nil {
+		if err := optimize.CheckQuality(f.Value.(flag.Getter).Get().(int)); err != nil {
+			bad("-webp-quality: %v", err)
+		}
+	}
+	if err := ingest.CheckHashAlgo(str("hash-algo")); err != nil {
+		bad("-hash-algo: %v", err)
+	}
+	if _, err := maintenance.ParseLayout(str("layout")); err != nil {
+		bad("-layout: %v", err)
+	}
+	if err := checkLogFormat(str("log-format")); err != nil {
+		bad("-log-format: %v", err)
+	}
+	if _, err := ingest.ParseURLDedup(str("url-dedup")); err != nil {
+		bad("-url-dedup: %v", err)
+	}
+	if d, err := time.ParseDuration(str("cron")); err != nil {
+		bad("-cron: %v", err)
+	} else if d <= 0 {
+		bad("-cron: interval must be positive, got %v", d)
+	}
+	for _, h := range ingest.ParseHostList(str("allowed-hosts")) {
+		if strings.ContainsAny(h, "/:@ ") {
+			bad("-allowed-hosts: %q is not a host name (drop any scheme, port or path)", h)
+		}
+	}
+	missing, err := server.ParseMissingFileBehavior(str("missing-file-behavior"))
+	if err != nil {
+		bad("-missing-file-behavior: %v", err)
+	}
+	if missing == server.MissingFallback {
+		if _, err := loadFallbackImage(str("fallback-image")); err != nil {
+			bad("-fallback-image: %v", err)
+		}
+	} else if str("fallback-image") != "" {
+		bad("-fallback-image has no effect without -missing-file-behavior fallback")
+	}
+
+	// Numeric ranges.
+	for _, name := range nonNegativeFlags {
+		if n, ok := number(fs, name); ok && n < 0 {
+			bad("-%s must not be negative", name)
+		}
+	}
+	if n, ok := number(fs, "waifu-im-pages"); ok && n < 1 {
+		bad("-waifu-im-pages must be at least 1")
+	}
+	if n, ok := number(fs, "near-dup-distance"); ok && n < -1 {
+		bad("-near-dup-distance must be -1 or more")
+	}
+
+	// Combinations.
+	var modes []string
+	for _, name := range modeFlags {
+		if on(name) {
+			modes = append(modes, "-"+name)
+		}
+	}
+	switch cmd := fs.Arg(0); cmd {
+	case "":
+	case "prune":
+		modes = append(modes, "prune")
+	default:
+		bad("unknown command %q", cmd)
+	}
+	if len(modes) > 1 {
+		bad("%s are exclusive; run them one at a time", strings.Join(modes, ", "))
+	}
+	if on("fsck-fix") && !on("fsck") {
+		bad("-fsck-fix has no effect without -fsck")
+	}
+	if on("funnel") && !on("tailnet-only") {
+		bad("-funnel requires -tailnet-only")
+	}
+	if tag := str("nsfw-tag"); tag != "" {
+		if !strings.HasPrefix(tag, "tag:") || len(tag) == len("tag:") {
+			bad("-nsfw-tag: %q is not a Tailscale ACL tag (tag:name)", tag)
+		}
+		if !on("tailnet-only") {
+			bad("-nsfw-tag requires -tailnet-only")
+		}
+	}
+	if on("watermark-tailnet") && str("watermark") == "" {
+		bad("-watermark-tailnet has no effect without -watermark")
+	}
+	target, _ := number(fs, "target-count")
+	maxCount, _ := number(fs, "max-count")
+	if target > 0 && maxCount > 0 && target > maxCount {
+		bad("-target-count %v is above -max-count %v, so ingest never pauses", target, maxCount)
+	}
+	return problems
+}
+
+// number returns the value of the numeric flag name as a float64, or false
+// if fs has no such flag.
+func number(fs *flag.FlagSet, name string) (float64, bool) {
+	f := fs.Lookup(name)
+	if f == nil {
+		return 0, false
+	}
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return 0, false
+	}
+	switch v := g.Get().(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case time.Duration:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// checkURLList validates the -ingest-urls file, if any, for -validate-config.
+// It is not part of validateConfig because -ingest-urls itself skips bad
+// lines rather than refusing the whole file.
+func checkURLList(path, allowedHosts string) []error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return []error{fmt.Errorf("-ingest-urls: %w", err)}
+	}
+	defer f.Close()
+	lineProblems, err := ingest.CheckURLList(f, ingest.ParseHostList(allowedHosts))
+	var problems []error
+	for _, p := range lineProblems {
+		problems = append(problems, fmt.Errorf("-ingest-urls %s: %w", path, p))
+	}
+	if err != nil {
+		problems = append(problems, fmt.Errorf("-ingest-urls: %w", err))
+	}
+	return problems
+}
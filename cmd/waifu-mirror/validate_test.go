@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/ingest"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+	"github.com/Jesssullivan/waifu-mirror/internal/server"
+)
+
+// testFlags parses args against the flags validateConfig reads, with the
+// defaults main gives them.
+func testFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("waifu-mirror", flag.ContinueOnError)
+	fs.String("addr", ":8420", "")
+	for _, name := range []string{"ingest", "fsck", "fsck-fix", "repair-filenames", "migrate-layout", "pregen-thumbs",
+		"compact", "backfill-orig-size", "rebuild-index", "recompute-stats", "funnel", "watermark-tailnet"} {
+		fs.Bool(name, false, "")
+	}
+	fs.Bool("tailnet-only", true, "")
+	fs.String("nsfw-tag", "", "")
+	fs.String("log-format", "text", "")
+	fs.String("ingest-urls", "", "")
+	fs.String("optimize-benchmark", "", "")
+	fs.Int("webp-quality", optimize.DefaultQuality, "")
+	fs.String("hash-algo", ingest.HashSHA256, "")
+	fs.String("layout", "flat", "")
+	fs.Int("near-dup-distance", ingest.DefaultNearDuplicateDistance, "")
+	fs.String("url-dedup", string(ingest.URLDedupGlobal), "")
+	fs.Int("waifu-im-pages", 1, "")
+	fs.String("allowed-hosts", strings.Join(ingest.DefaultAllowedHosts, ","), "")
+	fs.String("download-rates", "", "")
+	fs.String("cron", "1h", "")
+	fs.String("category-max-count", "", "")
+	fs.String("category-max-bytes", "", "")
+	fs.String("random-strategy", "offset", "")
+	fs.String("watermark", "", "")
+	fs.String("watermark-corner", "bottom-right", "")
+	fs.String("missing-file-behavior", string(server.MissingNotFound), "")
+	fs.String("fallback-image", "", "")
+	fs.Float64("near-color-distance", server.DefaultNearColorDistance, "")
+	for _, name := range []string{"target-count", "max-count", "db-max-open", "db-max-idle",
+		"max-url-length", "max-concurrent-requests", "warm-count"} {
+		fs.Int(name, 0, "")
+	}
+	for _, name := range []string{"max-bytes", "max-body-bytes", "warm-max-bytes", "transform-cache-bytes",
+		"max-image-bytes"} {
+		fs.Int64(name, 0, "")
+	}
+	for _, name := range []string{"max-age", "ingest-timeout", "ttfb-timeout", "db-conn-lifetime"} {
+		fs.Duration(name, 0, "")
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("parse %v: %v", args, err)
+	}
+	return fs
+}
+
+func TestValidateConfig(t *testing.T) {
+	if problems := validateConfig(testFlags(t)); len(problems) != 0 {
+		t.Fatalf("defaults: %v", problems)
+	}
+
+	tests := []struct {
+		args []string
+		want []string // substrings, one per expected problem
+	}{
+		{[]string{"-ingest", "-fsck"}, []string{"-ingest, -fsck are exclusive"}},
+		{[]string{"-compact", "prune"}, []string{"-compact, prune are exclusive"}},
+		{[]string{"-fsck-fix"}, []string{"-fsck-fix has no effect"}},
+		{[]string{"-funnel", "-tailnet-only=false"}, []string{"-funnel requires -tailnet-only"}},
+		{[]string{"-watermark-tailnet"}, []string{"-watermark-tailnet has no effect"}},
+		{[]string{"-nsfw-tag", "nsfw", "-tailnet-only=false"}, []string{"not a Tailscale ACL tag", "-nsfw-tag requires -tailnet-only"}},
+		{[]string{"-target-count", "500", "-max-count", "100"}, []string{"never pauses"}},
+		{[]string{"-missing-file-behavior", "fallback"}, []string{"-fallback-image: required"}},
+		{[]string{"-fallback-image", "x.png"}, []string{"-fallback-image has no effect"}},
+		{[]string{"-cron", "0s", "-max-age", "-1h", "-waifu-im-pages", "0"},
+			[]string{"-cron: interval must be positive", "-max-age must not be negative", "-waifu-im-pages"}},
+		{[]string{"-allowed-hosts", "https://waifu.im,.nekos.best"}, []string{`"https://waifu.im" is not a host name`}},
+		{[]string{"-random-strategy", "best", "-hash-algo", "md5", "-watermark-corner", "middle", "-layout", "nested"},
+			[]string{"-watermark-corner", "-random-strategy", "-hash-algo", "-layout"}},
+		{[]string{"-addr", "8420"}, []string{"-addr"}},
+		{[]string{"-url-dedup", "none"}, []string{"-url-dedup"}},
+		{[]string{"-log-format", "xml"}, []string{"-log-format"}},
+		{[]string{"frobnicate"}, []string{`unknown command "frobnicate"`}},
+	}
+	for _, tt := range tests {
+		problems := validateConfig(testFlags(t, tt.args...))
+		if len(problems) != len(tt.want) {
+			t.Errorf("%v: problems %v, want %d", tt.args, problems, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if !strings.Contains(problems[i].Error(), want) {
+				t.Errorf("%v: problem %d = %q, want it to mention %q", tt.args, i, problems[i], want)
+			}
+		}
+	}
+}
+
+func TestCheckURLList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	list := strings.Join([]string{
+		"# seeds",
+		"https://i.waifu.pics/a.png",
+		"https://cdn.waifu.im/b.jpg nsfw",
+		"ftp://i.waifu.pics/c.png",
+		"https://example.com/d.png",
+		"https://i.waifu.pics/e.png Bad!",
+		"/relative.png",
+	}, "\n")
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems := checkURLList(path, strings.Join(ingest.DefaultAllowedHosts, ","))
+	want := []string{"line 4", "line 5: example.com", "line 6: invalid category", "line 7"}
+	if len(problems) != len(want) {
+		t.Fatalf("problems %v, want %d", problems, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(problems[i].Error(), w) {
+			t.Errorf("problem %d = %q, want it to mention %q", i, problems[i], w)
+		}
+	}
+	// Any host goes when the allowlist is empty.
+	if problems := checkURLList(path, ""); len(problems) != 3 {
+		t.Errorf("empty allowlist: problems %v, want 3", problems)
+	}
+	if problems := checkURLList(filepath.Join(t.TempDir(), "none.txt"), ""); len(problems) != 1 {
+		t.Errorf("missing file: problems %v, want 1", problems)
+	}
+}
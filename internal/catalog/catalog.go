@@ -4,55 +4,127 @@
 package catalog
 
 import (
+	"bufio"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"time"
 
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
 	_ "modernc.org/sqlite"
 )
 
 // Image represents a single cached image in the catalog.
 type Image struct {
-	ID        int64     `json:"id"`
-	Hash      string    `json:"hash"`
-	Source    string    `json:"source"`
-	SourceURL string    `json:"source_url"`
-	Category  string    `json:"category"`
-	Width     int       `json:"width"`
-	Height    int       `json:"height"`
-	Format    string    `json:"format"`
-	SizeBytes int64     `json:"size_bytes"`
-	Filename  string    `json:"filename"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int64     `json:"id"`
+	Hash          string    `json:"hash"`
+	Source        string    `json:"source"`
+	SourceURL     string    `json:"source_url"`
+	Category      string    `json:"category"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	OrigWidth     int       `json:"orig_width"`  // upstream width before resizing; 0 if unknown
+	OrigHeight    int       `json:"orig_height"` // upstream height before resizing; 0 if unknown
+	Format        string    `json:"format"`
+	SizeBytes     int64     `json:"size_bytes"`
+	Filename      string    `json:"filename"`
+	CreatedAt     time.Time `json:"created_at"`
+	DominantColor string    `json:"dominant_color,omitempty"` // "#rrggbb"; empty if not computed
+	Blurhash      string    `json:"blurhash,omitempty"`       // placeholder; empty if not computed
+	PHash         *uint64   `json:"phash,omitempty"`          // perceptual hash; nil if not computed
+	Tags          []string  `json:"tags,omitempty"`           // upstream tags; written by Insert, loaded only by ImageTags
 }
 
 // Stats holds catalog statistics for the health endpoint.
 type Stats struct {
-	SFWCount    int       `json:"sfw_count"`
-	NSFWCount   int       `json:"nsfw_count"`
-	TotalBytes  int64     `json:"total_bytes"`
-	LastIngest  time.Time `json:"last_ingest"`
+	SFWCount   int       `json:"sfw_count"`
+	NSFWCount  int       `json:"nsfw_count"`
+	TotalBytes int64     `json:"total_bytes"`
+	LastIngest time.Time `json:"last_ingest"`
 }
 
 // DB wraps a SQLite database for image catalog operations.
 type DB struct {
-	db *sql.DB
+	db       *sql.DB
+	strategy RandomStrategy
+}
+
+// RandomStrategy selects how Random picks a row.
+type RandomStrategy string
+
+const (
+	// RandomOffset counts matching rows and skips to a random offset. Exactly
+	// uniform, but the OFFSET scan grows linearly with the catalog.
+	RandomOffset RandomStrategy = "offset"
+	// RandomRowID picks a random ID between the minimum and maximum and takes
+	// the next matching row. Index-only and fast at any size, slightly biased
+	// toward rows that follow gaps left by deletions or other categories.
+	RandomRowID RandomStrategy = "rowid"
+	// RandomOrderBy sorts every matching row by RANDOM(). Uniform and simple,
+	// but the slowest on large catalogs.
+	RandomOrderBy RandomStrategy = "orderby"
+)
+
+// ParseRandomStrategy validates a strategy name.
+func ParseRandomStrategy(s string) (RandomStrategy, error) {
+	switch st := RandomStrategy(s); st {
+	case RandomOffset, RandomRowID, RandomOrderBy:
+		return st, nil
+	}
+	return "", fmt.Errorf("catalog: unknown random strategy %q", s)
+}
+
+// Option configures the catalog's connection pool.
+//
+// With WAL enabled SQLite allows one writer alongside any number of readers;
+// writers queue on the busy timeout. A small pool (e.g. 4 open, 4 idle, no
+// lifetime limit) keeps concurrent reads fast without piling up writers.
+// Note that a pool of one serializes everything: do not query the catalog
+// from inside an Each callback with MaxOpenConns(1).
+type Option func(*DB)
+
+// WithMaxOpenConns caps open connections (0 = unlimited).
+func WithMaxOpenConns(n int) Option {
+	return func(d *DB) { d.db.SetMaxOpenConns(n) }
+}
+
+// WithMaxIdleConns caps idle connections kept in the pool.
+func WithMaxIdleConns(n int) Option {
+	return func(d *DB) { d.db.SetMaxIdleConns(n) }
+}
+
+// WithConnMaxLifetime closes connections older than d (0 = forever).
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(db *DB) { db.db.SetConnMaxLifetime(d) }
+}
+
+// WithRandomStrategy selects the row-picking strategy used by Random and
+// friends. The default is RandomOffset.
+func WithRandomStrategy(s RandomStrategy) Option {
+	return func(d *DB) { d.strategy = s }
 }
 
 // Open creates or opens the catalog database at the given path.
-func Open(path string) (*DB, error) {
-	db, err := sql.Open("sqlite", path+"?_journal=WAL&_busy_timeout=5000")
+func Open(path string, opts ...Option) (*DB, error) {
+	// Pragmas are applied to every pooled connection by the driver.
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("catalog: open: %w", err)
 	}
+	d := &DB{db: db, strategy: RandomOffset}
+	for _, opt := range opts {
+		opt(d)
+	}
 
 	if err := migrate(db); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("catalog: migrate: %w", err)
 	}
 
-	return &DB{db: db}, nil
+	return d, nil
 }
 
 // Close closes the database connection.
@@ -60,39 +132,74 @@ func (d *DB) Close() error {
 	return d.db.Close()
 }
 
-func migrate(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS images (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			hash TEXT UNIQUE NOT NULL,
-			source TEXT NOT NULL,
-			source_url TEXT NOT NULL,
-			category TEXT NOT NULL DEFAULT 'sfw',
-			width INTEGER NOT NULL DEFAULT 0,
-			height INTEGER NOT NULL DEFAULT 0,
-			format TEXT NOT NULL DEFAULT 'webp',
-			size_bytes INTEGER NOT NULL DEFAULT 0,
-			filename TEXT NOT NULL,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		);
-		CREATE INDEX IF NOT EXISTS idx_images_category ON images(category);
-		CREATE INDEX IF NOT EXISTS idx_images_hash ON images(hash);
-	`)
-	return err
+// Reindex rebuilds every index and refreshes the query planner's statistics.
+// Run it after bulk imports if lookups have slowed down.
+func (d *DB) Reindex() error {
+	if _, err := d.db.Exec("REINDEX"); err != nil {
+		return fmt.Errorf("catalog: reindex: %w", err)
+	}
+	return d.Analyze()
+}
+
+// Analyze refreshes the query planner's statistics. It is much cheaper than
+// Reindex and worth running after a large batch of inserts.
+func (d *DB) Analyze() error {
+	if _, err := d.db.Exec("ANALYZE"); err != nil {
+		return fmt.Errorf("catalog: analyze: %w", err)
+	}
+	return nil
 }
 
 // Insert adds a new image to the catalog. Returns the row ID.
 func (d *DB) Insert(img *Image) (int64, error) {
-	result, err := d.db.Exec(
-		`INSERT OR IGNORE INTO images (hash, source, source_url, category, width, height, format, size_bytes, filename)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("catalog: insert: %w", err)
+	}
+	defer tx.Rollback()
+
+	// SQLite integers are signed; the hash is stored bit for bit.
+	var phash sql.NullInt64
+	if img.PHash != nil {
+		phash = sql.NullInt64{Int64: int64(*img.PHash), Valid: true}
+	}
+	result, err := tx.Exec(
+		`INSERT OR IGNORE INTO images (hash, source, source_url, category, width, height, orig_width, orig_height, format, size_bytes, filename, dominant_color, blurhash, phash)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		img.Hash, img.Source, img.SourceURL, img.Category,
-		img.Width, img.Height, img.Format, img.SizeBytes, img.Filename,
+		img.Width, img.Height, img.OrigWidth, img.OrigHeight, img.Format, img.SizeBytes, img.Filename, img.DominantColor, img.Blurhash, phash,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("catalog: insert: %w", err)
 	}
-	return result.LastInsertId()
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("catalog: insert: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		if err := insertTags(tx, id, img.Tags); err != nil {
+			return 0, fmt.Errorf("catalog: insert tags: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO categories (name) VALUES (?)`, img.Category); err != nil {
+		return 0, fmt.Errorf("catalog: insert category: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("catalog: insert: %w", err)
+	}
+	return id, nil
+}
+
+// CategoryExists reports whether category is known: one of the built-in
+// categories, or one that has ever had an image inserted, even if all of its
+// images have since been deleted.
+func (d *DB) CategoryExists(category string) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM categories WHERE name = ?`, category).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("catalog: category exists: %w", err)
+	}
+	return n > 0, nil
 }
 
 // HasHash checks if an image with the given content hash already exists.
@@ -102,33 +209,237 @@ func (d *DB) HasHash(hash string) (bool, error) {
 	return count > 0, err
 }
 
+// HasSimilar reports whether any image's perceptual hash is within
+// threshold differing bits of phash. Rows without a hash are ignored. The
+// comparison runs in Go over every hashed row.
+func (d *DB) HasSimilar(phash uint64, threshold int) (bool, error) {
+	rows, err := d.db.Query("SELECT phash FROM images WHERE phash IS NOT NULL")
+	if err != nil {
+		return false, fmt.Errorf("catalog: has similar: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h int64
+		if err := rows.Scan(&h); err != nil {
+			return false, fmt.Errorf("catalog: has similar: %w", err)
+		}
+		if optimize.HammingDistance(uint64(h), phash) <= threshold {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("catalog: has similar: %w", err)
+	}
+	return false, nil
+}
+
+// imageColumns lists the images columns in the order scanImage expects.
+const imageColumns = `id, hash, source, source_url, category, width, height, orig_width, orig_height, format, size_bytes, filename, created_at, dominant_color, blurhash, phash`
+
+// scanImage scans a row selected with imageColumns.
+func scanImage(row interface{ Scan(...any) error }) (*Image, error) {
+	img := &Image{}
+	var phash sql.NullInt64
+	err := row.Scan(&img.ID, &img.Hash, &img.Source, &img.SourceURL, &img.Category,
+		&img.Width, &img.Height, &img.OrigWidth, &img.OrigHeight, &img.Format, &img.SizeBytes, &img.Filename, &img.CreatedAt, &img.DominantColor, &img.Blurhash, &phash)
+	if err != nil {
+		return nil, err
+	}
+	if phash.Valid {
+		h := uint64(phash.Int64)
+		img.PHash = &h
+	}
+	return img, nil
+}
+
 // Random returns a random image from the given category.
 func (d *DB) Random(category string) (*Image, error) {
+	return d.randomIn(category, "")
+}
+
+// RandomExcept returns a random image from category other than the one with
+// hash.
+func (d *DB) RandomExcept(category, hash string) (*Image, error) {
+	return d.randomIn(category, " AND hash != ?", hash)
+}
+
+// RandomBalancedBySource returns a random image from the given category,
+// first picking a source uniformly among those with images in the category
+// and then an image uniformly within it, so a small source is not drowned
+// out by a large one.
+func (d *DB) RandomBalancedBySource(category string) (*Image, error) {
+	rows, err := d.db.Query("SELECT DISTINCT source FROM images WHERE category = ?", category)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: random sources: %w", err)
+	}
+	var sources []string
+	for rows.Next() {
+		var src string
+		if err := rows.Scan(&src); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("catalog: random sources: %w", err)
+		}
+		sources = append(sources, src)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: random sources: %w", err)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("catalog: no images in category %q", category)
+	}
+
+	source := sources[rand.Intn(len(sources))]
+	return d.randomIn(category, " AND source = ?", source)
+}
+
+// randomIn picks a random row in category, optionally narrowed by an extra
+// SQL condition (starting with " AND") and its arguments, using the
+// configured strategy.
+func (d *DB) randomIn(category, filter string, filterArgs ...any) (*Image, error) {
+	where := "category = ?" + filter
+	args := append([]any{category}, filterArgs...)
+
+	var img *Image
+	var err error
+	switch d.strategy {
+	case RandomOrderBy:
+		img, err = scanImage(d.db.QueryRow(
+			`SELECT `+imageColumns+` FROM images WHERE `+where+` ORDER BY RANDOM() LIMIT 1`, args...))
+	case RandomRowID:
+		img, err = d.randomByRowID(where, args)
+	default:
+		img, err = d.randomByOffset(where, args)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("catalog: no images in category %q", category)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("catalog: random: %w", err)
+	}
+	return img, nil
+}
+
+func (d *DB) randomByOffset(where string, args []any) (*Image, error) {
 	var count int
-	err := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE category = ?", category).Scan(&count)
+	err := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE "+where, args...).Scan(&count)
 	if err != nil {
 		return nil, err
 	}
 	if count == 0 {
-		return nil, fmt.Errorf("catalog: no images in category %q", category)
+		return nil, sql.ErrNoRows
 	}
 
 	offset := rand.Intn(count)
-	img := &Image{}
-	err = d.db.QueryRow(
-		`SELECT id, hash, source, source_url, category, width, height, format, size_bytes, filename, created_at
-		 FROM images WHERE category = ? LIMIT 1 OFFSET ?`,
-		category, offset,
-	).Scan(&img.ID, &img.Hash, &img.Source, &img.SourceURL, &img.Category,
-		&img.Width, &img.Height, &img.Format, &img.SizeBytes, &img.Filename, &img.CreatedAt)
+	return scanImage(d.db.QueryRow(
+		`SELECT `+imageColumns+` FROM images WHERE `+where+` LIMIT 1 OFFSET ?`,
+		append(args, offset)...,
+	))
+}
+
+func (d *DB) randomByRowID(where string, args []any) (*Image, error) {
+	// Separate ordered lookups let SQLite walk the category index from
+	// either end; a combined MIN/MAX would scan every matching row.
+	var lo, hi int64
+	err := d.db.QueryRow("SELECT id FROM images WHERE "+where+" ORDER BY id LIMIT 1", args...).Scan(&lo)
 	if err != nil {
-		return nil, fmt.Errorf("catalog: random: %w", err)
+		return nil, err
 	}
-	return img, nil
+	err = d.db.QueryRow("SELECT id FROM images WHERE "+where+" ORDER BY id DESC LIMIT 1", args...).Scan(&hi)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := lo + rand.Int63n(hi-lo+1)
+	return scanImage(d.db.QueryRow(
+		`SELECT `+imageColumns+` FROM images WHERE `+where+` AND id >= ? ORDER BY id LIMIT 1`,
+		append(args, pick)...,
+	))
+}
+
+// MostViewed returns up to n images in category, most viewed first, with
+// ties broken randomly.
+func (d *DB) MostViewed(category string, n int) ([]*Image, error) {
+	rows, err := d.db.Query(
+		`SELECT `+imageColumns+` FROM images WHERE category = ? ORDER BY views DESC, RANDOM() LIMIT ?`,
+		category, n)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: most viewed: %w", err)
+	}
+	defer rows.Close()
+
+	var imgs []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("catalog: most viewed: %w", err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
+}
+
+// List returns up to limit images in category, in ID order, skipping the
+// first offset. An empty category lists every image.
+func (d *DB) List(category string, limit, offset int) ([]*Image, error) {
+	where, args := categoryWhere(category)
+	rows, err := d.db.Query(
+		`SELECT `+imageColumns+` FROM images`+where+` ORDER BY id LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: list: %w", err)
+	}
+	defer rows.Close()
+
+	imgs := []*Image{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("catalog: list: %w", err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
+}
+
+// CountCategory returns the number of images in category, or in the whole
+// catalog if category is empty.
+func (d *DB) CountCategory(category string) (int, error) {
+	var count int
+	where, args := categoryWhere(category)
+	err := d.db.QueryRow("SELECT COUNT(*) FROM images"+where, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("catalog: count category: %w", err)
+	}
+	return count, nil
+}
+
+// categoryWhere returns the WHERE clause, with a leading space, and its
+// arguments for images in category, or an empty clause if category is
+// empty. Leaving the clause out, rather than writing one that also matches
+// an empty parameter, lets SQLite use idx_images_category.
+func categoryWhere(category string) (string, []any) {
+	if category == "" {
+		return "", nil
+	}
+	return " WHERE category = ?", []any{category}
 }
 
-// Stats returns catalog statistics.
+// Stats returns catalog statistics from the catalog_stats cache, or
+// computes them if the cache row is missing.
 func (d *DB) Stats() (*Stats, error) {
+	s, err := d.cachedStats()
+	if errors.Is(err, sql.ErrNoRows) {
+		return d.liveStats()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("catalog: stats: %w", err)
+	}
+	return s, nil
+}
+
+// liveStats computes Stats by scanning images.
+func (d *DB) liveStats() (*Stats, error) {
 	s := &Stats{}
 
 	d.db.QueryRow("SELECT COUNT(*) FROM images WHERE category = 'sfw'").Scan(&s.SFWCount)
@@ -145,3 +456,252 @@ func (d *DB) Count() (int, error) {
 	err := d.db.QueryRow("SELECT COUNT(*) FROM images").Scan(&count)
 	return count, err
 }
+
+// MaxID returns the highest image ID in the catalog, or 0 if it is empty.
+func (d *DB) MaxID() (int64, error) {
+	var id int64
+	err := d.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM images").Scan(&id)
+	return id, err
+}
+
+// ExportSince writes every image with an ID greater than id to w as
+// newline-delimited JSON, in ID order. Peers syncing incrementally record the
+// last ID they received and pass it on their next call.
+func (d *DB) ExportSince(id int64, w io.Writer) error {
+	rows, err := d.db.Query(
+		`SELECT `+imageColumns+` FROM images WHERE id > ? ORDER BY id`, id)
+	if err != nil {
+		return fmt.Errorf("catalog: export: %w", err)
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return fmt.Errorf("catalog: export: %w", err)
+		}
+		if err := enc.Encode(img); err != nil {
+			return fmt.Errorf("catalog: export: %w", err)
+		}
+	}
+	return rows.Err()
+}
+
+// StreamHashes writes the hash of every image in category to w, one per
+// line in hash order, or of every image if category is empty, so clients
+// can cheaply diff the catalog against a local cache. For the whole catalog
+// it reads only the hash index; for a category it reads the category index
+// and sorts the matching hashes.
+func (d *DB) StreamHashes(category string, w io.Writer) error {
+	where, args := categoryWhere(category)
+	rows, err := d.db.Query("SELECT hash FROM images"+where+" ORDER BY hash", args...)
+	if err != nil {
+		return fmt.Errorf("catalog: stream hashes: %w", err)
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return fmt.Errorf("catalog: stream hashes: %w", err)
+		}
+		bw.WriteString(hash)
+		if err := bw.WriteByte('\n'); err != nil {
+			return fmt.Errorf("catalog: stream hashes: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("catalog: stream hashes: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("catalog: stream hashes: %w", err)
+	}
+	return nil
+}
+
+// Each calls fn for every image in ID order, stopping at the first error.
+// fn must not write to the catalog; collect changes and apply them after
+// Each returns.
+func (d *DB) Each(fn func(*Image) error) error {
+	rows, err := d.db.Query(`SELECT ` + imageColumns + ` FROM images ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("catalog: each: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return fmt.Errorf("catalog: each: %w", err)
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetByHash returns the image with the given hash. A missing hash yields an
+// error wrapping sql.ErrNoRows.
+func (d *DB) GetByHash(hash string) (*Image, error) {
+	img, err := scanImage(d.db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE hash = ?`, hash))
+	if err != nil {
+		return nil, fmt.Errorf("catalog: get %s: %w", hash, err)
+	}
+	return img, nil
+}
+
+// UpdateCategory moves the image with the given hash to category. The caller
+// is responsible for checking that category is one it accepts. A missing hash
+// yields an error wrapping sql.ErrNoRows.
+func (d *DB) UpdateCategory(hash, category string) error {
+	res, err := d.db.Exec("UPDATE images SET category = ? WHERE hash = ?", category, hash)
+	if err != nil {
+		return fmt.Errorf("catalog: update category %s: %w", hash, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("catalog: update category %s: %w", hash, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// UpdateFile points the image row for hash at a different stored file.
+func (d *DB) UpdateFile(hash, filename, format string) error {
+	res, err := d.db.Exec("UPDATE images SET filename = ?, format = ? WHERE hash = ?", filename, format, hash)
+	if err != nil {
+		return fmt.Errorf("catalog: update file %s: %w", hash, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("catalog: update file %s: %w", hash, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// SetOrigSize records the pre-resize source dimensions of an image.
+func (d *DB) SetOrigSize(hash string, width, height int) error {
+	res, err := d.db.Exec("UPDATE images SET orig_width = ?, orig_height = ? WHERE hash = ?", width, height, hash)
+	if err != nil {
+		return fmt.Errorf("catalog: set orig size %s: %w", hash, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("catalog: set orig size %s: %w", hash, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// DeleteByHash removes the image row with the given hash. It does not touch
+// the file on disk. Deleting a missing hash is not an error.
+func (d *DB) DeleteByHash(hash string) error {
+	if _, err := d.db.Exec("DELETE FROM images WHERE hash = ?", hash); err != nil {
+		return fmt.Errorf("catalog: delete %s: %w", hash, err)
+	}
+	return nil
+}
+
+// AllFilenames returns every filename the catalog references, sorted and
+// each listed once.
+func (d *DB) AllFilenames() ([]string, error) {
+	rows, err := d.db.Query("SELECT DISTINCT filename FROM images ORDER BY filename")
+	if err != nil {
+		return nil, fmt.Errorf("catalog: all filenames: %w", err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("catalog: all filenames: %w", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: all filenames: %w", err)
+	}
+	return names, nil
+}
+
+// FileRefCount returns how many rows reference filename. New rows cannot
+// share a file, but databases from before that rule may hold some that do,
+// so delete paths unlink a file only once its count reaches zero.
+func (d *DB) FileRefCount(filename string) (int, error) {
+	var n int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE filename = ?", filename).Scan(&n); err != nil {
+		return 0, fmt.Errorf("catalog: file ref count %s: %w", filename, err)
+	}
+	return n, nil
+}
+
+// DeleteToCount evicts the oldest images until at most max remain, returning
+// the deleted rows so the caller can remove their files.
+func (d *DB) DeleteToCount(max int) ([]*Image, error) {
+	return d.deleteOldest("1 = 1", max)
+}
+
+// DeleteToCountByCategory evicts the oldest images in category until at most
+// max remain there, returning the deleted rows so the caller can remove their
+// files. Other categories are untouched.
+func (d *DB) DeleteToCountByCategory(category string, max int) ([]*Image, error) {
+	return d.deleteOldest("category = ?", max, category)
+}
+
+// DeleteToBytesByCategory evicts the oldest images in category until those
+// left there total at most max bytes, returning the deleted rows so the
+// caller can remove their files. Other categories are untouched.
+func (d *DB) DeleteToBytesByCategory(category string, max int64) ([]*Image, error) {
+	return d.deleteVictims(
+		`SELECT `+imageColumns+` FROM (
+			SELECT *, SUM(size_bytes) OVER (ORDER BY id DESC) AS newer_bytes
+			FROM images WHERE category = ?
+		) WHERE newer_bytes > ?`,
+		category, max)
+}
+
+// deleteOldest deletes every row matching where except the newest keep.
+func (d *DB) deleteOldest(where string, keep int, args ...any) ([]*Image, error) {
+	if keep < 0 {
+		keep = 0
+	}
+	return d.deleteVictims(
+		`SELECT `+imageColumns+` FROM images WHERE `+where+` ORDER BY id DESC LIMIT -1 OFFSET ?`,
+		append(args, keep)...)
+}
+
+// deleteVictims deletes the rows query selects, with imageColumns, and
+// returns them.
+func (d *DB) deleteVictims(query string, args ...any) ([]*Image, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("catalog: evict: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: evict: %w", err)
+	}
+	var victims []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("catalog: evict: %w", err)
+		}
+		victims = append(victims, img)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: evict: %w", err)
+	}
+
+	for _, img := range victims {
+		if _, err := tx.Exec("DELETE FROM images WHERE id = ?", img.ID); err != nil {
+			return nil, fmt.Errorf("catalog: evict: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("catalog: evict: %w", err)
+	}
+	return victims, nil
+}
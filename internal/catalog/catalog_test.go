@@ -1,8 +1,18 @@
 package catalog
 
 import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func testDB(t *testing.T) *DB {
@@ -15,6 +25,122 @@ func testDB(t *testing.T) *DB {
 	return db
 }
 
+// imageHashes returns the hashes of imgs, in order.
+func imageHashes(imgs []*Image) []string {
+	var hashes []string
+	for _, img := range imgs {
+		hashes = append(hashes, img.Hash)
+	}
+	return hashes
+}
+
+// legacyDB creates a database at the original, unversioned schema holding
+// two rows, and returns its path.
+func legacyDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open raw db: %v", err)
+	}
+	defer raw.Close()
+	_, err = raw.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT UNIQUE NOT NULL,
+			source TEXT NOT NULL,
+			source_url TEXT NOT NULL,
+			category TEXT NOT NULL DEFAULT 'sfw',
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			format TEXT NOT NULL DEFAULT 'webp',
+			size_bytes INTEGER NOT NULL DEFAULT 0,
+			filename TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_images_category ON images(category);
+		CREATE INDEX idx_images_hash ON images(hash);
+		INSERT INTO images (hash, source, source_url, category, width, height, filename)
+		VALUES ('old1', 'waifu.im', 'u1', 'sfw', 100, 200, 'old1.webp'),
+		       ('old2', 'waifu.pics', 'u2', 'legacy', 300, 400, 'old2.webp');
+	`)
+	if err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+	return path
+}
+
+func TestMigrateLegacySchema(t *testing.T) {
+	path := legacyDB(t)
+
+	for i := 0; i < 2; i++ { // a second open must be a no-op
+		db, err := Open(path)
+		if err != nil {
+			t.Fatalf("open #%d: %v", i+1, err)
+		}
+		v, err := db.SchemaVersion()
+		if err != nil {
+			t.Fatalf("SchemaVersion: %v", err)
+		}
+		if want := migrations[len(migrations)-1].version; v != want {
+			t.Errorf("schema version = %d, want %d", v, want)
+		}
+		if n, _ := db.Count(); n != 2 {
+			t.Errorf("count = %d, want 2 rows preserved", n)
+		}
+		if ok, _ := db.CategoryExists("legacy"); !ok {
+			t.Error("category of existing rows should be known after migration")
+		}
+		db.Close()
+	}
+}
+
+func TestMigrateAddsColumnsWithDefaults(t *testing.T) {
+	db, err := Open(legacyDB(t))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	var (
+		tags, dominant, blurhash, optimizedHash string
+		phash                                   sql.NullInt64
+		views, pinned                           int
+		aspect                                  float64
+	)
+	err = db.db.QueryRow(`SELECT tags, phash, dominant_color, blurhash, views, pinned, optimized_hash, aspect_ratio
+		FROM images WHERE hash = 'old1'`).Scan(&tags, &phash, &dominant, &blurhash, &views, &pinned, &optimizedHash, &aspect)
+	if err != nil {
+		t.Fatalf("select new columns: %v", err)
+	}
+	if tags != "" || phash.Valid || dominant != "" || blurhash != "" || views != 0 || pinned != 0 || optimizedHash != "" {
+		t.Errorf("unexpected defaults: tags=%q phash=%v dominant=%q blurhash=%q views=%d pinned=%d optimized_hash=%q",
+			tags, phash, dominant, blurhash, views, pinned, optimizedHash)
+	}
+	if aspect != 0.5 {
+		t.Errorf("aspect_ratio = %v, want 0.5 for a 100x200 row", aspect)
+	}
+
+	// Rows inserted after migrating get the same defaults.
+	if _, err := db.Insert(&Image{Hash: "new1", Source: "test", Category: "sfw", Width: 300, Height: 150, Filename: "new1.webp"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := db.db.QueryRow(`SELECT aspect_ratio FROM images WHERE hash = 'new1'`).Scan(&aspect); err != nil {
+		t.Fatalf("select aspect_ratio: %v", err)
+	}
+	if aspect != 2 {
+		t.Errorf("aspect_ratio = %v, want 2 for a 300x150 row", aspect)
+	}
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("migration %q has version %d at position %d", m.name, m.version, i)
+		}
+	}
+}
+
 func TestInsertAndHasHash(t *testing.T) {
 	db := testDB(t)
 
@@ -126,6 +252,694 @@ func TestRandom(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error for empty nsfw category")
 	}
+
+	for range 20 {
+		img, err := db.RandomExcept("sfw", "ahash")
+		if err != nil || img.Hash == "ahash" {
+			t.Fatalf("RandomExcept(ahash) = %v, %v", img, err)
+		}
+	}
+}
+
+func TestDaily(t *testing.T) {
+	db := testDB(t)
+	day := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	if _, err := db.Daily("sfw", day); err == nil {
+		t.Fatal("expected error on empty catalog")
+	}
+
+	for i := range 20 {
+		h := fmt.Sprintf("daily%02d", i)
+		if _, err := db.Insert(&Image{Hash: h, Source: "test", Category: "sfw", Filename: h + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	pick, err := db.Daily("sfw", day)
+	if err != nil {
+		t.Fatalf("Daily: %v", err)
+	}
+	// Any time on the same UTC day, in any zone, picks the same image.
+	for _, at := range []time.Time{
+		day.Add(14 * time.Hour),
+		time.Date(2024, 4, 30, 22, 0, 0, 0, time.FixedZone("UTC-3", -3*3600)),
+	} {
+		again, err := db.Daily("sfw", at)
+		if err != nil {
+			t.Fatalf("Daily: %v", err)
+		}
+		if again.Hash != pick.Hash {
+			t.Errorf("Daily(%v) = %s, want %s", at, again.Hash, pick.Hash)
+		}
+	}
+	// Over a few weeks the pick rotates.
+	seen := map[string]bool{}
+	for i := range 21 {
+		img, err := db.Daily("sfw", day.AddDate(0, 0, i))
+		if err != nil {
+			t.Fatalf("Daily: %v", err)
+		}
+		seen[img.Hash] = true
+	}
+	if len(seen) < 5 {
+		t.Errorf("21 days picked only %d distinct images", len(seen))
+	}
+
+	// The pick holds while the category grows during the day, and moves
+	// only if the picked image is deleted.
+	last := day.AddDate(0, 0, 20)
+	pick, _ = db.Daily("sfw", last)
+	for i := range 7 {
+		h := fmt.Sprintf("later%02d", i)
+		if _, err := db.Insert(&Image{Hash: h, Source: "test", Category: "sfw", Filename: h + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		if again, err := db.Daily("sfw", last); err != nil || again.Hash != pick.Hash {
+			t.Fatalf("after %d more images, Daily = %v, %v; want %s", i+1, again, err, pick.Hash)
+		}
+	}
+	if err := db.DeleteByHash(pick.Hash); err != nil {
+		t.Fatalf("DeleteByHash: %v", err)
+	}
+	if again, err := db.Daily("sfw", last); err != nil || again.Hash == pick.Hash {
+		t.Fatalf("after deleting the pick, Daily = %v, %v", again, err)
+	}
+	if _, err := db.Daily("nsfw", day); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("empty category: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRandomFresh(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.RandomFresh("sfw"); err == nil {
+		t.Fatal("expected error on empty catalog")
+	}
+	for i := range 10 {
+		h := fmt.Sprintf("fresh%02d", i)
+		if _, err := db.Insert(&Image{Hash: h, Source: "test", Category: "sfw", Filename: h + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	// Each pick is marked served, so it is out of the pool for the next
+	// several calls.
+	var picks []string
+	for range 20 {
+		img, err := db.RandomFresh("sfw")
+		if err != nil {
+			t.Fatalf("RandomFresh: %v", err)
+		}
+		if i := slices.Index(picks, img.Hash); i >= 0 && len(picks)-i <= 5 {
+			t.Fatalf("RandomFresh repeated %s after %d calls", img.Hash, len(picks)-i)
+		}
+		picks = append(picks, img.Hash)
+		if err := db.MarkServed(img.Hash); err != nil {
+			t.Fatalf("MarkServed: %v", err)
+		}
+	}
+	if err := db.MarkServed("unknown"); err != nil {
+		t.Errorf("MarkServed(unknown) = %v, want nil", err)
+	}
+}
+
+func TestRandomForUser(t *testing.T) {
+	db := testDB(t)
+	var hashes []string
+	for i := range 4 {
+		h := fmt.Sprintf("user%02d", i)
+		hashes = append(hashes, h)
+		if _, err := db.Insert(&Image{Hash: h, Source: "test", Category: "sfw", Filename: h + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	// Each user's two latest views, half the category, are left out.
+	views := map[string][]string{"alice": hashes[:2], "bob": hashes[2:]}
+	for user, seen := range views {
+		for _, h := range seen {
+			if err := db.RecordUserView(user, h); err != nil {
+				t.Fatalf("RecordUserView: %v", err)
+			}
+		}
+	}
+	want := map[string][]string{
+		"alice": {hashes[2], hashes[3]},
+		"bob":   {hashes[0], hashes[1]},
+		"carol": hashes,
+	}
+	for user, allowed := range want {
+		for range 20 {
+			img, err := db.RandomForUser("sfw", user)
+			if err != nil {
+				t.Fatalf("RandomForUser(%s): %v", user, err)
+			}
+			if !slices.Contains(allowed, img.Hash) {
+				t.Fatalf("RandomForUser(%s) = %s, want one of %v", user, img.Hash, allowed)
+			}
+		}
+	}
+
+	// Deleting an image takes its views along.
+	if err := db.DeleteByHash(hashes[0]); err != nil {
+		t.Fatalf("DeleteByHash: %v", err)
+	}
+	var n int
+	db.db.QueryRow("SELECT COUNT(*) FROM user_views WHERE hash = ?", hashes[0]).Scan(&n)
+	if n != 0 {
+		t.Errorf("%d views of a deleted image remain", n)
+	}
+}
+
+func TestRandomStrategies(t *testing.T) {
+	for _, st := range []RandomStrategy{RandomOffset, RandomRowID, RandomOrderBy} {
+		t.Run(string(st), func(t *testing.T) {
+			db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithRandomStrategy(st))
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer db.Close()
+
+			if _, err := db.Random("sfw"); err == nil {
+				t.Fatal("expected error on empty catalog")
+			}
+
+			// Interleave categories so rowid has gaps to skip over.
+			for i := 0; i < 10; i++ {
+				cat := "sfw"
+				if i%2 == 1 {
+					cat = "nsfw"
+				}
+				img := &Image{Hash: fmt.Sprintf("h%d", i), Source: "test", Category: cat, Filename: fmt.Sprintf("h%d.webp", i)}
+				if _, err := db.Insert(img); err != nil {
+					t.Fatalf("Insert: %v", err)
+				}
+			}
+
+			seen := make(map[string]bool)
+			for i := 0; i < 200; i++ {
+				img, err := db.Random("nsfw")
+				if err != nil {
+					t.Fatalf("Random: %v", err)
+				}
+				if img.Category != "nsfw" {
+					t.Fatalf("Random returned category %q", img.Category)
+				}
+				seen[img.Hash] = true
+			}
+			if len(seen) != 5 {
+				t.Errorf("saw %d distinct images in 200 picks, want 5", len(seen))
+			}
+		})
+	}
+
+	if _, err := ParseRandomStrategy("bogus"); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
+
+func BenchmarkRandom(b *testing.B) {
+	for _, rows := range []int{1_000, 100_000} {
+		path := filepath.Join(b.TempDir(), "bench.db")
+		seed, err := Open(path)
+		if err != nil {
+			b.Fatalf("open: %v", err)
+		}
+		tx, err := seed.db.Begin()
+		if err != nil {
+			b.Fatalf("begin: %v", err)
+		}
+		for i := 0; i < rows; i++ {
+			_, err := tx.Exec(`INSERT INTO images (hash, source, source_url, category, filename)
+				VALUES (?, 'bench', '', 'sfw', ?)`, fmt.Sprintf("%016x", i), fmt.Sprintf("%016x.webp", i))
+			if err != nil {
+				b.Fatalf("seed: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatalf("commit: %v", err)
+		}
+		seed.Close()
+
+		for _, st := range []RandomStrategy{RandomOffset, RandomRowID, RandomOrderBy} {
+			b.Run(fmt.Sprintf("%s/%d", st, rows), func(b *testing.B) {
+				db, err := Open(path, WithRandomStrategy(st))
+				if err != nil {
+					b.Fatalf("open: %v", err)
+				}
+				defer db.Close()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := db.Random("sfw"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCategoryExists(t *testing.T) {
+	db := testDB(t)
+
+	for _, tc := range []struct {
+		category string
+		want     bool
+	}{{"sfw", true}, {"nsfw", true}, {"foo", false}} {
+		got, err := db.CategoryExists(tc.category)
+		if err != nil {
+			t.Fatalf("CategoryExists(%q): %v", tc.category, err)
+		}
+		if got != tc.want {
+			t.Errorf("CategoryExists(%q) = %v, want %v", tc.category, got, tc.want)
+		}
+	}
+
+	if _, err := db.Insert(&Image{Hash: "f1", Source: "test", Category: "foo", Filename: "f1.webp"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := db.DeleteByHash("f1"); err != nil {
+		t.Fatalf("DeleteByHash: %v", err)
+	}
+	if ok, _ := db.CategoryExists("foo"); !ok {
+		t.Error("category should stay known after its images are deleted")
+	}
+}
+
+func TestGetByHashAndUpdateCategory(t *testing.T) {
+	db := testDB(t)
+
+	if _, err := db.GetByHash("nope"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetByHash(missing) error = %v, want sql.ErrNoRows", err)
+	}
+	if err := db.UpdateCategory("nope", "nsfw"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("UpdateCategory(missing) error = %v, want sql.ErrNoRows", err)
+	}
+
+	if _, err := db.Insert(&Image{Hash: "h1", Source: "test", Category: "sfw", Width: 3, Filename: "h1.webp"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := db.UpdateCategory("h1", "nsfw"); err != nil {
+		t.Fatalf("UpdateCategory: %v", err)
+	}
+	img, err := db.GetByHash("h1")
+	if err != nil {
+		t.Fatalf("GetByHash: %v", err)
+	}
+	if img.Category != "nsfw" || img.Width != 3 || img.ID == 0 {
+		t.Errorf("GetByHash = %+v", img)
+	}
+}
+
+func TestOrigSize(t *testing.T) {
+	db := testDB(t)
+
+	if _, err := db.Insert(&Image{Hash: "h1", Source: "test", Category: "sfw", Width: 480, Height: 320,
+		OrigWidth: 1920, OrigHeight: 1280, Filename: "h1.webp"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := db.Insert(&Image{Hash: "h2", Source: "test", Category: "sfw", Filename: "h2.webp"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := db.SetOrigSize("h2", 800, 600); err != nil {
+		t.Fatalf("SetOrigSize: %v", err)
+	}
+	if err := db.SetOrigSize("nope", 1, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SetOrigSize(missing) error = %v, want sql.ErrNoRows", err)
+	}
+
+	for hash, want := range map[string][2]int{"h1": {1920, 1280}, "h2": {800, 600}} {
+		img, err := db.GetByHash(hash)
+		if err != nil {
+			t.Fatalf("GetByHash: %v", err)
+		}
+		if img.OrigWidth != want[0] || img.OrigHeight != want[1] {
+			t.Errorf("%s: orig size %dx%d, want %dx%d", hash, img.OrigWidth, img.OrigHeight, want[0], want[1])
+		}
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	db := testDB(t)
+	for i, src := range []string{"a", "a", "b", "a"} {
+		hash := fmt.Sprintf("h%d", i)
+		if _, err := db.Insert(&Image{Hash: hash, Source: src, Category: "sfw", Filename: hash + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	// h0 and h1 are old; h1 has been viewed.
+	db.db.Exec(`UPDATE images SET created_at = '2020-01-01 00:00:00' WHERE hash IN ('h0', 'h1')`)
+	db.db.Exec(`UPDATE images SET views = 5 WHERE hash = 'h1'`)
+
+	if _, err := db.DeleteWhere(DeleteFilter{}, false); !errors.Is(err, ErrEmptyFilter) {
+		t.Fatalf("empty filter error = %v, want ErrEmptyFilter", err)
+	}
+	zero := 0
+	if _, err := db.DeleteWhere(DeleteFilter{MaxViews: &zero}, false); !errors.Is(err, ErrEmptyFilter) {
+		t.Fatalf("max views only error = %v, want ErrEmptyFilter", err)
+	}
+	if n, _ := db.Count(); n != 4 {
+		t.Fatalf("max views only deleted rows: %d left", n)
+	}
+
+	f := DeleteFilter{Source: "a", MaxViews: &zero, OlderThan: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	got, err := db.DeleteWhere(f, true)
+	if err != nil || len(got) != 1 || got[0].Hash != "h0" {
+		t.Fatalf("dry run = %v, %v; want [h0]", got, err)
+	}
+	if n, _ := db.Count(); n != 4 {
+		t.Fatalf("dry run deleted rows: %d left", n)
+	}
+
+	got, err = db.DeleteWhere(DeleteFilter{Source: "a"}, false)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("DeleteWhere(source=a) = %v, %v; want 3 rows", got, err)
+	}
+	if n, _ := db.Count(); n != 1 {
+		t.Errorf("%d rows left, want 1", n)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := testDB(t)
+	for i := range 5 {
+		hash := fmt.Sprintf("h%d", i)
+		if _, err := db.Insert(&Image{Hash: hash, Source: "a", Category: "sfw", SizeBytes: 100, Filename: hash + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	db.db.Exec(`UPDATE images SET created_at = '2020-01-01 00:00:00' WHERE hash = 'h0'`)
+
+	if got, err := db.Prune(0, 0); err != nil || len(got) != 0 {
+		t.Fatalf("Prune(0, 0) = %v, %v; want nothing", got, err)
+	}
+
+	// h0 is too old; then h1 and h2 go to get 400 bytes under 250.
+	got, err := db.Prune(24*time.Hour, 250)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	want := []string{"h0", "h1", "h2"}
+	if !slices.Equal(imageHashes(got), want) {
+		t.Fatalf("Prune = %v, want %v", got, want)
+	}
+	if n, _ := db.Count(); n != 2 {
+		t.Errorf("%d rows left, want 2", n)
+	}
+}
+
+func TestPrune_SameDay(t *testing.T) {
+	db := testDB(t)
+	for _, hash := range []string{"old", "new"} {
+		if _, err := db.Insert(&Image{Hash: hash, Source: "a", Category: "sfw", Filename: hash + ".webp"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	// Minutes old, so almost always the same UTC date as the cutoff.
+	ten := time.Now().Add(-10 * time.Minute).UTC().Format(time.DateTime)
+	db.db.Exec(`UPDATE images SET created_at = ? WHERE hash = 'old'`, ten)
+
+	got, err := db.Prune(5*time.Minute, 0)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if want := []string{"old"}; !slices.Equal(imageHashes(got), want) {
+		t.Fatalf("Prune = %v, want %v", got, want)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	db := testDB(t)
+	for i := 0; i < 50; i++ {
+		db.Insert(&Image{
+			Hash: fmt.Sprintf("h%d", i), Source: "test", SourceURL: "u",
+			Category: []string{"sfw", "nsfw"}[i%2], Filename: fmt.Sprintf("h%d.webp", i),
+		})
+	}
+
+	if err := db.Reindex(); err != nil {
+		t.Fatalf("Reindex: %v", err)
+	}
+	var n int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM sqlite_stat1").Scan(&n); err != nil || n == 0 {
+		t.Errorf("sqlite_stat1 rows = %d, %v; want ANALYZE statistics", n, err)
+	}
+	if ok, err := db.HasHash("h7"); err != nil || !ok {
+		t.Errorf("HasHash after Reindex = %v, %v", ok, err)
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	db := testDB(t)
+	if dist, err := db.Distribution(); err != nil || dist.Count != 0 || dist.Size.P50 != 0 {
+		t.Fatalf("empty Distribution = %+v, %v", dist, err)
+	}
+
+	// Sizes 1..100 KB; every tenth image comes from a second source as PNG.
+	for i := 1; i <= 100; i++ {
+		img := &Image{
+			Hash: fmt.Sprintf("h%d", i), Source: "waifu.im", SourceURL: "u", Category: "sfw",
+			Width: i * 10, Height: 500, Format: "webp", SizeBytes: int64(i) * 1000,
+			Filename: fmt.Sprintf("h%d.webp", i),
+		}
+		if i%10 == 0 {
+			img.Source, img.Format = "waifu.pics", "png"
+		}
+		if _, err := db.Insert(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dist, err := db.Distribution()
+	if err != nil {
+		t.Fatalf("Distribution: %v", err)
+	}
+	if dist.Count != 100 {
+		t.Errorf("count = %d, want 100", dist.Count)
+	}
+	if want := (Percentiles{P50: 50000, P90: 90000, P99: 99000, Max: 100000}); dist.Size != want {
+		t.Errorf("size = %+v, want %+v", dist.Size, want)
+	}
+	if dist.Width.P90 != 900 || dist.Height.P50 != 500 {
+		t.Errorf("width = %+v, height = %+v", dist.Width, dist.Height)
+	}
+	if dist.BySource["waifu.im"] != 90 || dist.BySource["waifu.pics"] != 10 {
+		t.Errorf("by source = %v", dist.BySource)
+	}
+	if dist.ByFormat["webp"] != 90 || dist.ByFormat["png"] != 10 {
+		t.Errorf("by format = %v", dist.ByFormat)
+	}
+}
+
+func TestHasSimilar(t *testing.T) {
+	db := testDB(t)
+	h := uint64(0xf0f0_0000_0000_00ff) // high bit set: stored as a negative integer
+	db.Insert(&Image{Hash: "a", Source: "test", SourceURL: "u", Category: "sfw", Filename: "a.webp", PHash: &h})
+	db.Insert(&Image{Hash: "b", Source: "test", SourceURL: "u", Category: "sfw", Filename: "b.webp"})
+
+	img, err := db.GetByHash("a")
+	if err != nil || img.PHash == nil || *img.PHash != h {
+		t.Fatalf("GetByHash phash = %v, %v; want %#x", img.PHash, err, h)
+	}
+	if img, _ := db.GetByHash("b"); img.PHash != nil {
+		t.Errorf("unhashed image has phash %#x", *img.PHash)
+	}
+
+	for _, tc := range []struct {
+		phash     uint64
+		threshold int
+		want      bool
+	}{
+		{h, 0, true},
+		{h ^ 0b111, 3, true},
+		{h ^ 0b111, 2, false},
+		{^h, 5, false},
+	} {
+		if got, err := db.HasSimilar(tc.phash, tc.threshold); err != nil || got != tc.want {
+			t.Errorf("HasSimilar(%#x, %d) = %v, %v; want %v", tc.phash, tc.threshold, got, err, tc.want)
+		}
+	}
+}
+
+func TestRandomByTag(t *testing.T) {
+	db := testDB(t)
+	for hash, tags := range map[string][]string{
+		"maid":         {"maid"},
+		"maid-uniform": {"maid", "uniform"},
+		"uniform":      {"uniform"},
+		"untagged":     nil,
+	} {
+		db.Insert(&Image{Hash: hash, Source: "test", SourceURL: "u", Category: "sfw", Filename: hash + ".webp", Tags: tags})
+	}
+	// Re-inserting a known hash must not attach its tags to another row.
+	db.Insert(&Image{Hash: "untagged", Source: "test", SourceURL: "u", Category: "sfw", Filename: "untagged.webp", Tags: []string{"selfie"}})
+	for hash, want := range map[string]string{"maid-uniform": "maid,uniform", "untagged": ""} {
+		img, _ := db.GetByHash(hash)
+		if tags, err := db.ImageTags(img.ID); err != nil || strings.Join(tags, ",") != want {
+			t.Errorf("ImageTags(%s) = %v, %v, want %q", hash, tags, err, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		tags []string
+		want []string
+	}{
+		{[]string{"maid"}, []string{"maid", "maid-uniform"}},
+		{[]string{"maid", "uniform"}, []string{"maid-uniform"}},
+		{[]string{"uniform", "maid", "maid"}, []string{"maid-uniform"}},
+	} {
+		seen := map[string]bool{}
+		for i := 0; i < 30; i++ {
+			img, err := db.RandomByTag("sfw", tc.tags...)
+			if err != nil {
+				t.Fatalf("RandomByTag(%v): %v", tc.tags, err)
+			}
+			seen[img.Hash] = true
+		}
+		if len(seen) != len(tc.want) {
+			t.Errorf("RandomByTag(%v) picked %v, want %v", tc.tags, seen, tc.want)
+		}
+		for _, h := range tc.want {
+			if !seen[h] {
+				t.Errorf("RandomByTag(%v) never picked %s", tc.tags, h)
+			}
+		}
+	}
+
+	if _, err := db.RandomByTag("nsfw", "maid"); err == nil {
+		t.Error("RandomByTag in an empty category succeeded")
+	}
+	for tag, want := range map[string]bool{"maid": true, "selfie": false, "": false} {
+		if got, err := db.TagExists(tag); err != nil || got != want {
+			t.Errorf("TagExists(%q) = %v, %v; want %v", tag, got, err, want)
+		}
+	}
+
+	// Deleting an image drops its tags.
+	if err := db.DeleteByHash("uniform"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteByHash("maid-uniform"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := db.TagExists("uniform"); ok {
+		t.Error("tag of deleted images still exists")
+	}
+}
+
+func TestFilenameUnique(t *testing.T) {
+	db := testDB(t)
+
+	insert := func(hash, filename string) error {
+		_, err := db.Insert(&Image{Hash: hash, Source: "test", Category: "sfw", Filename: filename})
+		return err
+	}
+	if err := insert("h1", "same.webp"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := insert("h1", "same.webp"); err != nil {
+		t.Errorf("re-inserting the same hash should stay a no-op, got %v", err)
+	}
+	if err := insert("h2", "same.webp"); err == nil {
+		t.Error("expected error inserting a second hash with the same filename")
+	}
+	if err := insert("h2", "h2.webp"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := db.UpdateFile("h2", "same.webp", "webp"); err == nil {
+		t.Error("expected error pointing a row at another row's filename")
+	}
+	if err := db.UpdateFile("h2", "h2.png", "png"); err != nil {
+		t.Errorf("UpdateFile to a free filename: %v", err)
+	}
+	if names, err := db.AllFilenames(); err != nil || !slices.Equal(names, []string{"h2.png", "same.webp"}) {
+		t.Errorf("AllFilenames = %v, %v; want [h2.png same.webp]", names, err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	db := testDB(t)
+	if page, err := db.GetCursor("waifu.im:sfw"); err != nil || page != 0 {
+		t.Fatalf("unset cursor = %d, %v; want 0", page, err)
+	}
+	for _, page := range []int{3, 4, 0} {
+		if err := db.SetCursor("waifu.im:sfw", page); err != nil {
+			t.Fatalf("SetCursor(%d): %v", page, err)
+		}
+		if got, err := db.GetCursor("waifu.im:sfw"); err != nil || got != page {
+			t.Errorf("GetCursor = %d, %v; want %d", got, err, page)
+		}
+	}
+	if got, _ := db.GetCursor("waifu.im:nsfw"); got != 0 {
+		t.Errorf("other source's cursor = %d, want 0", got)
+	}
+}
+
+func TestPinHashAlgo(t *testing.T) {
+	db := testDB(t)
+	if err := db.PinHashAlgo("blake3"); err != nil {
+		t.Fatalf("pin on empty catalog: %v", err)
+	}
+	if err := db.PinHashAlgo("blake3"); err != nil {
+		t.Errorf("same algorithm again: %v", err)
+	}
+	if err := db.PinHashAlgo("sha256"); err == nil {
+		t.Error("switching algorithms succeeded")
+	}
+
+	// A catalog filled before the setting existed was hashed with sha256.
+	legacy, err := Open(legacyDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	if err := legacy.PinHashAlgo("xxhash"); err == nil {
+		t.Error("legacy catalog accepted xxhash")
+	}
+	if err := legacy.PinHashAlgo("sha256"); err != nil {
+		t.Errorf("legacy catalog with sha256: %v", err)
+	}
+}
+
+func TestRuns(t *testing.T) {
+	db := testDB(t)
+
+	runs, err := db.Runs(10)
+	if err != nil || len(runs) != 0 {
+		t.Fatalf("Runs on empty table = %v, %v", runs, err)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		_, err := db.InsertRun(&Run{
+			Started:  start.Add(time.Duration(i) * time.Hour),
+			Duration: time.Duration(i+1) * time.Second,
+			New:      i,
+			Errors:   1,
+			Canceled: i == 2,
+			Sources:  json.RawMessage(`[{"source":"waifu.im"}]`),
+		})
+		if err != nil {
+			t.Fatalf("InsertRun: %v", err)
+		}
+	}
+
+	runs, err = db.Runs(2)
+	if err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("got %d runs, want 2", len(runs))
+	}
+	if runs[0].New != 2 || runs[1].New != 1 {
+		t.Errorf("runs not newest first: %+v, %+v", runs[0], runs[1])
+	}
+	if !runs[0].Started.Equal(start.Add(2*time.Hour)) || runs[0].Duration != 3*time.Second {
+		t.Errorf("round trip: started %v duration %v", runs[0].Started, runs[0].Duration)
+	}
+	if !runs[0].Canceled || runs[1].Canceled {
+		t.Errorf("canceled = %v, %v; want true, false", runs[0].Canceled, runs[1].Canceled)
+	}
+	if string(runs[0].Sources) != `[{"source":"waifu.im"}]` {
+		t.Errorf("sources = %s", runs[0].Sources)
+	}
 }
 
 func TestStats(t *testing.T) {
@@ -135,13 +949,13 @@ func TestStats(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		db.Insert(&Image{
 			Hash: string(rune('a'+i)) + "sfw", Source: "test", SourceURL: "u",
-			Category: "sfw", Filename: "f.webp", SizeBytes: 1000,
+			Category: "sfw", Filename: string(rune('a'+i)) + "sfw.webp", SizeBytes: 1000,
 		})
 	}
 	for i := 0; i < 2; i++ {
 		db.Insert(&Image{
 			Hash: string(rune('a'+i)) + "nsfw", Source: "test", SourceURL: "u",
-			Category: "nsfw", Filename: "f.webp", SizeBytes: 2000,
+			Category: "nsfw", Filename: string(rune('a'+i)) + "nsfw.webp", SizeBytes: 2000,
 		})
 	}
 
@@ -160,6 +974,48 @@ func TestStats(t *testing.T) {
 	}
 }
 
+func TestStats_CacheMatchesLive(t *testing.T) {
+	db := testDB(t)
+	check := func(step string) {
+		t.Helper()
+		cached, err := db.cachedStats()
+		if err != nil {
+			t.Fatalf("%s: cached stats: %v", step, err)
+		}
+		live, err := db.liveStats()
+		if err != nil {
+			t.Fatalf("%s: live stats: %v", step, err)
+		}
+		if cached.SFWCount != live.SFWCount || cached.NSFWCount != live.NSFWCount || cached.TotalBytes != live.TotalBytes {
+			t.Errorf("%s: cached %+v, live %+v", step, cached, live)
+		}
+	}
+
+	for i, c := range []string{"sfw", "sfw", "nsfw", "legacy"} {
+		h := fmt.Sprintf("h%d", i)
+		db.Insert(&Image{Hash: h, Source: "test", SourceURL: "u", Category: c, Filename: h + ".webp", SizeBytes: int64(100 * (i + 1))})
+	}
+	db.Insert(&Image{Hash: "h0", Source: "test", SourceURL: "u", Category: "sfw", Filename: "h0.webp", SizeBytes: 999}) // ignored duplicate
+	check("insert")
+	db.UpdateCategory("h0", "nsfw")
+	check("update")
+	db.DeleteByHash("h2")
+	db.DeleteToCount(2)
+	check("delete")
+
+	// Without the cache row, Stats falls back to scanning; RecomputeStats
+	// restores it.
+	db.db.Exec(`DELETE FROM catalog_stats`)
+	live, _ := db.liveStats()
+	if s, err := db.Stats(); err != nil || s.SFWCount != live.SFWCount || s.TotalBytes != live.TotalBytes {
+		t.Errorf("fallback Stats = %+v, %v; want %+v", s, err, live)
+	}
+	if err := db.RecomputeStats(); err != nil {
+		t.Fatalf("RecomputeStats: %v", err)
+	}
+	check("recompute")
+}
+
 func TestCount(t *testing.T) {
 	db := testDB(t)
 
@@ -183,3 +1039,275 @@ func TestCount(t *testing.T) {
 		t.Fatalf("expected 1, got %d", count)
 	}
 }
+
+func TestRandomBalancedBySource(t *testing.T) {
+	db := testDB(t)
+
+	// One large source and one single-image source.
+	for i := 0; i < 50; i++ {
+		db.Insert(&Image{
+			Hash: fmt.Sprintf("big%02d", i), Source: "big", SourceURL: "u",
+			Category: "sfw", Filename: fmt.Sprintf("big%02d.webp", i),
+		})
+	}
+	db.Insert(&Image{
+		Hash: "small", Source: "small", SourceURL: "u", Category: "sfw", Filename: "small.webp",
+	})
+
+	var small int
+	const draws = 400
+	for i := 0; i < draws; i++ {
+		img, err := db.RandomBalancedBySource("sfw")
+		if err != nil {
+			t.Fatalf("RandomBalancedBySource: %v", err)
+		}
+		if img.Source == "small" {
+			small++
+		}
+	}
+	// Balanced draws should hit the small source about half the time; a flat
+	// uniform draw would hit it ~2% of the time.
+	if small < draws/4 {
+		t.Fatalf("small source drawn %d/%d times, want roughly half", small, draws)
+	}
+
+	if _, err := db.RandomBalancedBySource("nsfw"); err == nil {
+		t.Fatal("expected error for empty nsfw category")
+	}
+}
+
+func TestExportSince(t *testing.T) {
+	db := testDB(t)
+
+	for i := 0; i < 5; i++ {
+		db.Insert(&Image{
+			Hash: fmt.Sprintf("h%d", i), Source: "test", SourceURL: "u",
+			Category: "sfw", Filename: fmt.Sprintf("h%d.webp", i),
+		})
+	}
+
+	max, err := db.MaxID()
+	if err != nil {
+		t.Fatalf("MaxID: %v", err)
+	}
+	if max != 5 {
+		t.Fatalf("MaxID = %d, want 5", max)
+	}
+
+	var buf bytes.Buffer
+	if err := db.ExportSince(3, &buf); err != nil {
+		t.Fatalf("ExportSince: %v", err)
+	}
+
+	var ids []int64
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var img Image
+		if err := json.Unmarshal(sc.Bytes(), &img); err != nil {
+			t.Fatalf("decode line %q: %v", sc.Text(), err)
+		}
+		ids = append(ids, img.ID)
+	}
+	if len(ids) != 2 || ids[0] != 4 || ids[1] != 5 {
+		t.Fatalf("exported ids = %v, want [4 5]", ids)
+	}
+
+	buf.Reset()
+	if err := db.ExportSince(max, &buf); err != nil {
+		t.Fatalf("ExportSince(max): %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected empty export past max id, got %q", buf.String())
+	}
+}
+
+func TestSourceURLs(t *testing.T) {
+	db := testDB(t)
+	db.Insert(&Image{Hash: "h1", Source: "waifu.im", SourceURL: "https://cdn/a.png", Category: "sfw", Filename: "h1.webp"})
+	if err := db.RecordSourceURL("https://cdn/a.png", "waifu.pics", "h1"); err != nil {
+		t.Fatalf("RecordSourceURL: %v", err)
+	}
+	db.RecordSourceURL("https://cdn/a.png", "waifu.pics", "h1") // repeats are ignored
+
+	for _, tt := range []struct{ url, source, want string }{
+		{"https://cdn/a.png", "", "waifu.im"},
+		{"https://cdn/a.png", "waifu.pics", "waifu.pics"},
+		{"https://cdn/a.png", "nekos.best", ""},
+		{"https://cdn/b.png", "", ""},
+	} {
+		got, err := db.SourceURLSource(tt.url, tt.source)
+		if err != nil || got != tt.want {
+			t.Errorf("SourceURLSource(%q, %q) = %q, %v, want %q", tt.url, tt.source, got, err, tt.want)
+		}
+	}
+
+	// Deleting the image forgets every delivery of it, so it can come back.
+	if err := db.DeleteByHash("h1"); err != nil {
+		t.Fatalf("DeleteByHash: %v", err)
+	}
+	if got, _ := db.SourceURLSource("https://cdn/a.png", ""); got != "" {
+		t.Errorf("after delete: first source = %q, want none", got)
+	}
+}
+
+func TestVariants(t *testing.T) {
+	db := testDB(t)
+	db.Insert(&Image{Hash: "h1", Source: "test", SourceURL: "u", Category: "sfw", Width: 400, Height: 200, Filename: "h1.webp"})
+
+	for _, v := range []Variant{
+		{Width: 200, Height: 100, SizeBytes: 900, Format: "webp"},
+		{Width: 100, Height: 50, SizeBytes: 300, Format: "webp"},
+		{Width: 200, Height: 100, SizeBytes: 800, Format: "webp"},  // replaces the first
+		{Width: 400, Height: 200, SizeBytes: 2000, Format: "webp"}, // the base size
+	} {
+		if err := db.PutVariant("h1", v); err != nil {
+			t.Fatalf("PutVariant: %v", err)
+		}
+	}
+	got, err := db.Variants("h1")
+	want := []Variant{{100, 50, 300, "webp"}, {200, 100, 800, "webp"}}
+	if err != nil || !slices.Equal(got, want) {
+		t.Fatalf("Variants = %v, %v, want %v", got, err, want)
+	}
+
+	if _, err := db.Variants("nope"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Variants(unknown) error = %v, want sql.ErrNoRows", err)
+	}
+	db.DeleteByHash("h1")
+	db.Insert(&Image{Hash: "h1", Source: "test", SourceURL: "u", Category: "sfw", Width: 400, Height: 200, Filename: "h1.webp"})
+	if got, err := db.Variants("h1"); err != nil || len(got) != 0 {
+		t.Errorf("after delete and re-insert: Variants = %v, %v, want none", got, err)
+	}
+}
+
+func TestStreamHashes(t *testing.T) {
+	db := testDB(t)
+	for i, hash := range []string{"c", "a", "d", "b"} {
+		category := "sfw"
+		if i == 2 {
+			category = "nsfw"
+		}
+		db.Insert(&Image{Hash: hash, Source: "test", SourceURL: "u", Category: category, Filename: hash + ".webp"})
+	}
+
+	for category, want := range map[string]string{
+		"sfw":   "a\nb\nc\n",
+		"":      "a\nb\nc\nd\n",
+		"other": "",
+	} {
+		var buf bytes.Buffer
+		if err := db.StreamHashes(category, &buf); err != nil {
+			t.Fatalf("StreamHashes(%q): %v", category, err)
+		}
+		if buf.String() != want {
+			t.Errorf("StreamHashes(%q) = %q, want %q", category, buf.String(), want)
+		}
+	}
+}
+
+func TestDeleteToCountByCategory(t *testing.T) {
+	db := testDB(t)
+
+	for i := 0; i < 5; i++ {
+		db.Insert(&Image{
+			Hash: fmt.Sprintf("sfw%d", i), Source: "test", SourceURL: "u",
+			Category: "sfw", Filename: fmt.Sprintf("sfw%d.webp", i),
+		})
+		db.Insert(&Image{
+			Hash: fmt.Sprintf("nsfw%d", i), Source: "test", SourceURL: "u",
+			Category: "nsfw", Filename: fmt.Sprintf("nsfw%d.webp", i),
+		})
+	}
+
+	evicted, err := db.DeleteToCountByCategory("nsfw", 2)
+	if err != nil {
+		t.Fatalf("DeleteToCountByCategory: %v", err)
+	}
+	if len(evicted) != 3 {
+		t.Fatalf("evicted %d, want 3", len(evicted))
+	}
+	for _, img := range evicted {
+		if img.Category != "nsfw" {
+			t.Fatalf("evicted %s from category %s", img.Hash, img.Category)
+		}
+		if img.Hash == "nsfw3" || img.Hash == "nsfw4" {
+			t.Fatalf("evicted newest image %s", img.Hash)
+		}
+	}
+
+	stats, _ := db.Stats()
+	if stats.SFWCount != 5 || stats.NSFWCount != 2 {
+		t.Fatalf("counts after eviction = %d sfw, %d nsfw; want 5, 2", stats.SFWCount, stats.NSFWCount)
+	}
+
+	// Under the cap: nothing to do.
+	evicted, err = db.DeleteToCountByCategory("nsfw", 10)
+	if err != nil || len(evicted) != 0 {
+		t.Fatalf("DeleteToCountByCategory under cap = %d, %v; want 0, nil", len(evicted), err)
+	}
+
+	evicted, err = db.DeleteToCount(4)
+	if err != nil {
+		t.Fatalf("DeleteToCount: %v", err)
+	}
+	if len(evicted) != 3 {
+		t.Fatalf("global evicted %d, want 3", len(evicted))
+	}
+	if n, _ := db.Count(); n != 4 {
+		t.Fatalf("count after global eviction = %d, want 4", n)
+	}
+}
+
+func TestSmallPoolConcurrentReads(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "pool.db"),
+		WithMaxOpenConns(2), WithMaxIdleConns(2), WithConnMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal_mode = %q, %v; want wal", mode, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		db.Insert(&Image{
+			Hash: fmt.Sprintf("h%d", i), Source: "test", SourceURL: "u",
+			Category: "sfw", Filename: fmt.Sprintf("h%d.webp", i),
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := db.Random("sfw"); err != nil {
+					t.Errorf("Random: %v", err)
+				}
+				if _, err := db.Stats(); err != nil {
+					t.Errorf("Stats: %v", err)
+				}
+				if i%5 == 0 {
+					if _, err := db.Insert(&Image{
+						Hash: fmt.Sprintf("w%d", i), Source: "test", SourceURL: "u",
+						Category: "sfw", Filename: fmt.Sprintf("w%d.webp", i),
+					}); err != nil {
+						t.Errorf("Insert: %v", err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent catalog access deadlocked with a small pool")
+	}
+}
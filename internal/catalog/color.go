@@ -0,0 +1,63 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math/rand"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// ErrNoneNear is returned by RandomNearColor when no image's dominant color
+// is close enough to the target.
+var ErrNoneNear = errors.New("catalog: no image near that color")
+
+// RandomNearColor returns a random image in category whose dominant color
+// lies within maxDist of target, measured as Euclidean distance in RGB
+// (0 to about 441). Images without a computed color never match.
+//
+// Distances are computed in Go over every colored row of the category, which
+// is cheap next to the image bytes it leads to but grows with the catalog.
+func (d *DB) RandomNearColor(category string, target color.RGBA, maxDist float64) (*Image, error) {
+	rows, err := d.db.Query(
+		`SELECT id, dominant_color FROM images WHERE category = ? AND dominant_color != ''`, category)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: near color: %w", err)
+	}
+	var near []int64
+	for rows.Next() {
+		var id int64
+		var hex string
+		if err := rows.Scan(&id, &hex); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("catalog: near color: %w", err)
+		}
+		c, err := optimize.ParseHexColor(hex)
+		if err == nil && colorDist2(c, target) <= maxDist*maxDist {
+			near = append(near, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: near color: %w", err)
+	}
+	if len(near) == 0 {
+		return nil, ErrNoneNear
+	}
+
+	id := near[rand.Intn(len(near))]
+	img, err := scanImage(d.db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id = ?`, id))
+	if err != nil {
+		return nil, fmt.Errorf("catalog: near color: %w", err)
+	}
+	return img, nil
+}
+
+// colorDist2 is the squared Euclidean RGB distance between a and b.
+func colorDist2(a, b color.RGBA) float64 {
+	dr := float64(a.R) - float64(b.R)
+	dg := float64(a.G) - float64(b.G)
+	db := float64(a.B) - float64(b.B)
+	return dr*dr + dg*dg + db*db
+}
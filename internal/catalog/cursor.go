@@ -0,0 +1,35 @@
+package catalog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// GetCursor returns the last page ingest fetched from source, or 0 if it has
+// none, meaning the next fetch starts at page 1. source is any key the
+// ingester chooses, such as "waifu.im:sfw".
+func (d *DB) GetCursor(source string) (int, error) {
+	var page int
+	err := d.db.QueryRow(`SELECT page FROM ingest_state WHERE source = ?`, source).Scan(&page)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("catalog: get cursor %s: %w", source, err)
+	}
+	return page, nil
+}
+
+// SetCursor records page as the last page fetched from source. Setting 0
+// starts the next fetch over at page 1.
+func (d *DB) SetCursor(source string, page int) error {
+	_, err := d.db.Exec(
+		`INSERT INTO ingest_state (source, page, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (source) DO UPDATE SET page = excluded.page, updated_at = excluded.updated_at`,
+		source, page)
+	if err != nil {
+		return fmt.Errorf("catalog: set cursor %s: %w", source, err)
+	}
+	return nil
+}
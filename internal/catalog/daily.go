@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// Daily returns the image of the day for category: the same image for every
+// caller until midnight UTC of day. The first call of a UTC day picks it,
+// seeded by the date, and records the pick, so images added to or removed
+// from the category during the day do not move it; only deleting the
+// picked image does. Days before day are forgotten. An empty category is
+// an error wrapping sql.ErrNoRows.
+func (d *DB) Daily(category string, day time.Time) (*Image, error) {
+	date := day.UTC().Format(time.DateOnly)
+	img, err := scanImage(d.db.QueryRow(
+		`SELECT `+imageColumns+` FROM images
+		WHERE hash = (SELECT hash FROM daily_picks WHERE day = ? AND category = ?) AND category = ?`,
+		date, category, category))
+	if err == nil {
+		return img, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+
+	img, err = d.dailyPick(category, date)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM daily_picks WHERE day < ?`, date); err != nil {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO daily_picks (day, category, hash) VALUES (?, ?, ?)
+		ON CONFLICT (day, category) DO UPDATE SET hash = excluded.hash`,
+		date, category, img.Hash); err != nil {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+	return img, nil
+}
+
+// dailyPick picks the image of date, a YYYY-MM-DD UTC date, for category:
+// an offset seeded by date and category into the category in ID order.
+func (d *DB) dailyPick(category, date string) (*Image, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE category = ?", category).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("catalog: no images in category %q: %w", category, sql.ErrNoRows)
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s", date, category)
+	offset := h.Sum64() % uint64(count)
+	img, err := scanImage(d.db.QueryRow(
+		`SELECT `+imageColumns+` FROM images WHERE category = ? ORDER BY id LIMIT 1 OFFSET ?`,
+		category, int64(offset)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("catalog: no images in category %q: %w", category, sql.ErrNoRows)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("catalog: daily: %w", err)
+	}
+	return img, nil
+}
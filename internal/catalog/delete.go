@@ -0,0 +1,146 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeleteFilter selects images for DeleteWhere. Unset fields do not filter;
+// set fields must all match. MaxViews only narrows one of the other fields:
+// most images are rarely viewed, so on its own it would match nearly all.
+type DeleteFilter struct {
+	Source    string
+	Category  string
+	MaxViews  *int      // views <= *MaxViews
+	OlderThan time.Time // created before this instant
+}
+
+// ErrEmptyFilter is returned by DeleteWhere for a filter with none of
+// Source, Category or OlderThan set, which would otherwise delete every
+// image, or nearly.
+var ErrEmptyFilter = errors.New("catalog: delete filter matches everything")
+
+// where builds the SQL condition for f.
+func (f DeleteFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Source != "" {
+		conds = append(conds, "source = ?")
+		args = append(args, f.Source)
+	}
+	if f.Category != "" {
+		conds = append(conds, "category = ?")
+		args = append(args, f.Category)
+	}
+	if f.MaxViews != nil {
+		conds = append(conds, "views <= ?")
+		args = append(args, *f.MaxViews)
+	}
+	if !f.OlderThan.IsZero() {
+		// created_at holds SQLite CURRENT_TIMESTAMP text, which compares
+		// correctly against the same layout.
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.OlderThan.UTC().Format(time.DateTime))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// DeleteWhere deletes every image matching f and returns the deleted rows
+// so the caller can remove their files. With dryRun it only returns the
+// rows that would be deleted.
+func (d *DB) DeleteWhere(f DeleteFilter, dryRun bool) ([]*Image, error) {
+	if f.Source == "" && f.Category == "" && f.OlderThan.IsZero() {
+		return nil, ErrEmptyFilter
+	}
+	where, args := f.where()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("catalog: delete where: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+imageColumns+` FROM images WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: delete where: %w", err)
+	}
+	var matched []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("catalog: delete where: %w", err)
+		}
+		matched = append(matched, img)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: delete where: %w", err)
+	}
+	if dryRun {
+		return matched, nil
+	}
+
+	for _, img := range matched {
+		if _, err := tx.Exec("DELETE FROM images WHERE id = ?", img.ID); err != nil {
+			return nil, fmt.Errorf("catalog: delete where: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("catalog: delete where: %w", err)
+	}
+	return matched, nil
+}
+
+// Prune deletes images created more than maxAge ago and then, while the
+// rest total more than maxBytes, the oldest of those. Zero disables either
+// limit. It returns the deleted rows. The rows are gone
+// before the caller unlinks anything, so a crash in between leaves orphan
+// files, which fsck finds, rather than rows pointing at missing files.
+func (d *DB) Prune(maxAge time.Duration, maxBytes int64) ([]*Image, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("catalog: prune: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT ` + imageColumns + ` FROM images ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: prune: %w", err)
+	}
+	var all []*Image
+	var total int64
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("catalog: prune: %w", err)
+		}
+		all = append(all, img)
+		total += img.SizeBytes
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: prune: %w", err)
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var removed []*Image
+	for _, img := range all { // oldest first
+		expired := maxAge > 0 && img.CreatedAt.Before(cutoff)
+		if !expired && (maxBytes <= 0 || total <= maxBytes) {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM images WHERE id = ?", img.ID); err != nil {
+			return nil, fmt.Errorf("catalog: prune: %w", err)
+		}
+		removed = append(removed, img)
+		total -= img.SizeBytes
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("catalog: prune: %w", err)
+	}
+	return removed, nil
+}
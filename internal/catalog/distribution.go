@@ -0,0 +1,98 @@
+package catalog
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Percentiles holds nearest-rank percentiles of one numeric column.
+type Percentiles struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+// Distribution describes the shape of the catalog: how large its images are
+// and where they came from.
+type Distribution struct {
+	Count    int            `json:"count"`
+	Size     Percentiles    `json:"size_bytes"`
+	Width    Percentiles    `json:"width"`
+	Height   Percentiles    `json:"height"`
+	BySource map[string]int `json:"by_source"`
+	ByFormat map[string]int `json:"by_format"`
+}
+
+// Distribution computes size and dimension percentiles and per-source and
+// per-format counts. Each percentile is a separate sorted query, so it is
+// far heavier than Stats; callers serving it over HTTP should cache it.
+func (d *DB) Distribution() (*Distribution, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("catalog: distribution: %w", err)
+	}
+	defer tx.Rollback() // read-only; gives every query the same snapshot
+
+	dist := &Distribution{BySource: map[string]int{}, ByFormat: map[string]int{}}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM images").Scan(&dist.Count); err != nil {
+		return nil, fmt.Errorf("catalog: distribution: %w", err)
+	}
+	for _, c := range []struct {
+		column string
+		dst    *Percentiles
+	}{{"size_bytes", &dist.Size}, {"width", &dist.Width}, {"height", &dist.Height}} {
+		if err := percentiles(tx, c.column, dist.Count, c.dst); err != nil {
+			return nil, fmt.Errorf("catalog: distribution: %s: %w", c.column, err)
+		}
+	}
+	for _, g := range []struct {
+		column string
+		dst    map[string]int
+	}{{"source", dist.BySource}, {"format", dist.ByFormat}} {
+		if err := countBy(tx, g.column, g.dst); err != nil {
+			return nil, fmt.Errorf("catalog: distribution: %s: %w", g.column, err)
+		}
+	}
+	return dist, nil
+}
+
+// percentiles fills p from column, which has n rows, using the nearest-rank
+// method. column must be a trusted identifier.
+func percentiles(tx *sql.Tx, column string, n int, p *Percentiles) error {
+	if n == 0 {
+		return nil
+	}
+	for _, q := range []struct {
+		pct int
+		dst *int64
+	}{{50, &p.P50}, {90, &p.P90}, {99, &p.P99}, {100, &p.Max}} {
+		rank := (q.pct*n + 99) / 100 // ceil(pct/100 * n), 1-based
+		err := tx.QueryRow(
+			`SELECT `+column+` FROM images ORDER BY `+column+` LIMIT 1 OFFSET ?`, rank-1,
+		).Scan(q.dst)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countBy fills counts with the number of rows per value of column, which
+// must be a trusted identifier.
+func countBy(tx *sql.Tx, column string, counts map[string]int) error {
+	rows, err := tx.Query(`SELECT ` + column + `, COUNT(*) FROM images GROUP BY ` + column)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return err
+		}
+		counts[key] = n
+	}
+	return rows.Err()
+}
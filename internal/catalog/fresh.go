@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// servedTimeFormat is how last_served_at and user_views.seen_at are
+// stored: fixed width, so text order is time order even within a second.
+const servedTimeFormat = "2006-01-02 15:04:05.000000"
+
+// Served is what MarkServedAt records for one image.
+type Served struct {
+	At    time.Time // when it was last served
+	Views int       // added to its view count
+}
+
+// MarkServed records that the image hash was served just now, without
+// counting a view. An unknown hash is not an error.
+func (d *DB) MarkServed(hash string) error {
+	return d.MarkServedAt(map[string]Served{hash: {At: time.Now()}})
+}
+
+// MarkServedAt records, in one transaction, when each image in served (by
+// hash) was last served and how many more views it has. Unknown hashes are
+// skipped.
+func (d *DB) MarkServedAt(served map[string]Served) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("catalog: mark served: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE images SET last_served_at = ?, views = views + ? WHERE hash = ?")
+	if err != nil {
+		return fmt.Errorf("catalog: mark served: %w", err)
+	}
+	defer stmt.Close()
+	for hash, s := range served {
+		if _, err := stmt.Exec(s.At.UTC().Format(servedTimeFormat), s.Views, hash); err != nil {
+			return fmt.Errorf("catalog: mark served: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("catalog: mark served: %w", err)
+	}
+	return nil
+}
+
+// RandomFresh returns a random image from category among the half served
+// least recently, never-served images first, so repeated calls that each
+// MarkServed their pick do not return an image again until much of the
+// category has had a turn.
+func (d *DB) RandomFresh(category string) (*Image, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE category = ?", category).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: random fresh: %w", err)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("catalog: no images in category %q", category)
+	}
+
+	offset := rand.Intn(max(count/2, 1))
+	img, err := scanImage(d.db.QueryRow(
+		`SELECT `+imageColumns+` FROM images WHERE category = ?
+		 ORDER BY last_served_at, id LIMIT 1 OFFSET ?`,
+		category, offset))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("catalog: no images in category %q", category)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("catalog: random fresh: %w", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,309 @@
+package catalog
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is one versioned schema change.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations are applied in order, each at most once, and recorded in
+// schema_migrations. Append new entries with the next version number; never
+// edit or reorder one that has shipped.
+//
+// The first two use IF NOT EXISTS so databases created before versioning
+// existed adopt them without changes.
+var migrations = []migration{
+	{1, "images", execMigration(`
+		CREATE TABLE IF NOT EXISTS images (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT UNIQUE NOT NULL,
+			source TEXT NOT NULL,
+			source_url TEXT NOT NULL,
+			category TEXT NOT NULL DEFAULT 'sfw',
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			format TEXT NOT NULL DEFAULT 'webp',
+			size_bytes INTEGER NOT NULL DEFAULT 0,
+			filename TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_images_category ON images(category);
+		CREATE INDEX IF NOT EXISTS idx_images_hash ON images(hash);
+	`)},
+	{2, "categories", execMigration(`
+		CREATE TABLE IF NOT EXISTS categories (
+			name TEXT PRIMARY KEY,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT OR IGNORE INTO categories (name) VALUES ('sfw'), ('nsfw');
+		INSERT OR IGNORE INTO categories (name) SELECT DISTINCT category FROM images;
+	`)},
+	{3, "images.tags", addColumn("images", "tags TEXT NOT NULL DEFAULT ''")},
+	{4, "images.phash", addColumn("images", "phash INTEGER")}, // NULL until computed
+	{5, "images.dominant_color", addColumn("images", "dominant_color TEXT NOT NULL DEFAULT ''")},
+	{6, "images.blurhash", addColumn("images", "blurhash TEXT NOT NULL DEFAULT ''")},
+	{7, "images.views", addColumn("images", "views INTEGER NOT NULL DEFAULT 0")},
+	{8, "images.pinned", addColumn("images", "pinned INTEGER NOT NULL DEFAULT 0")},
+	{9, "images.optimized_hash", addColumn("images", "optimized_hash TEXT NOT NULL DEFAULT ''")},
+	// Derived from the stored dimensions so it can never drift from them.
+	{10, "images.aspect_ratio", addColumn("images",
+		"aspect_ratio REAL GENERATED ALWAYS AS (CASE WHEN height > 0 THEN CAST(width AS REAL) / height ELSE 0 END) VIRTUAL")},
+	// Filenames must be unique across hashes. Triggers rather than a UNIQUE
+	// index, so a database that already holds a collision still opens and
+	// -fsck can report it. Re-inserting the same hash stays a silent no-op.
+	{11, "images.filename unique", execMigration(`
+		CREATE INDEX IF NOT EXISTS idx_images_filename ON images(filename);
+		CREATE TRIGGER images_filename_unique_insert BEFORE INSERT ON images
+		WHEN EXISTS (SELECT 1 FROM images WHERE filename = NEW.filename AND hash != NEW.hash)
+		BEGIN
+			SELECT RAISE(ABORT, 'filename already used by another image');
+		END;
+		CREATE TRIGGER images_filename_unique_update BEFORE UPDATE OF filename ON images
+		WHEN EXISTS (SELECT 1 FROM images WHERE filename = NEW.filename AND id != NEW.id)
+		BEGIN
+			SELECT RAISE(ABORT, 'filename already used by another image');
+		END;
+	`)},
+	{12, "ingest_runs", execMigration(`
+		CREATE TABLE ingest_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_at DATETIME NOT NULL,
+			duration_ns INTEGER NOT NULL DEFAULT 0,
+			new INTEGER NOT NULL DEFAULT 0,
+			errors INTEGER NOT NULL DEFAULT 0,
+			timed_out INTEGER NOT NULL DEFAULT 0,
+			sources TEXT NOT NULL DEFAULT '[]'
+		);
+	`)},
+	{13, "ingest_runs.canceled", addColumn("ingest_runs", "canceled INTEGER NOT NULL DEFAULT 0")},
+	// Source dimensions before any resize or crop; 0 until known.
+	{14, "images.orig_size", execMigration(`
+		ALTER TABLE images ADD COLUMN orig_width INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE images ADD COLUMN orig_height INTEGER NOT NULL DEFAULT 0;
+	`)},
+	// Upstream tags, one row per image and tag. The trigger stands in for
+	// ON DELETE CASCADE, which needs foreign_keys enabled on every connection.
+	{15, "tags", execMigration(`
+		CREATE TABLE tags (
+			image_id INTEGER NOT NULL REFERENCES images(id),
+			tag TEXT NOT NULL,
+			PRIMARY KEY (image_id, tag)
+		) WITHOUT ROWID;
+		CREATE INDEX idx_tags_tag ON tags(tag, image_id);
+		CREATE TRIGGER images_delete_tags AFTER DELETE ON images
+		BEGIN
+			DELETE FROM tags WHERE image_id = OLD.id;
+		END;
+	`)},
+	{16, "ingest_state", execMigration(`
+		CREATE TABLE ingest_state (
+			source TEXT PRIMARY KEY,
+			page INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+	// Deployment-wide choices that must not change once images exist.
+	{17, "settings", execMigration(`
+		CREATE TABLE settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);
+	`)},
+	// One-row cache of Stats, kept current by triggers so the health
+	// endpoint need not scan images. Deletes leave last_ingest alone;
+	// RecomputeStats corrects it.
+	{18, "catalog_stats", execMigration(`
+		CREATE TABLE catalog_stats (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			sfw_count INTEGER NOT NULL,
+			nsfw_count INTEGER NOT NULL,
+			total_bytes INTEGER NOT NULL,
+			last_ingest DATETIME NOT NULL,
+			computed_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO catalog_stats (id, sfw_count, nsfw_count, total_bytes, last_ingest)
+		SELECT 1, COALESCE(SUM(category = 'sfw'), 0), COALESCE(SUM(category = 'nsfw'), 0),
+		       COALESCE(SUM(size_bytes), 0), COALESCE(MAX(created_at), '1970-01-01')
+		FROM images;
+		CREATE TRIGGER catalog_stats_insert AFTER INSERT ON images
+		BEGIN
+			UPDATE catalog_stats SET
+				sfw_count = sfw_count + (NEW.category = 'sfw'),
+				nsfw_count = nsfw_count + (NEW.category = 'nsfw'),
+				total_bytes = total_bytes + NEW.size_bytes,
+				last_ingest = MAX(last_ingest, NEW.created_at);
+		END;
+		CREATE TRIGGER catalog_stats_delete AFTER DELETE ON images
+		BEGIN
+			UPDATE catalog_stats SET
+				sfw_count = sfw_count - (OLD.category = 'sfw'),
+				nsfw_count = nsfw_count - (OLD.category = 'nsfw'),
+				total_bytes = total_bytes - OLD.size_bytes;
+		END;
+		CREATE TRIGGER catalog_stats_update AFTER UPDATE OF category, size_bytes ON images
+		BEGIN
+			UPDATE catalog_stats SET
+				sfw_count = sfw_count - (OLD.category = 'sfw') + (NEW.category = 'sfw'),
+				nsfw_count = nsfw_count - (OLD.category = 'nsfw') + (NEW.category = 'nsfw'),
+				total_bytes = total_bytes - OLD.size_bytes + NEW.size_bytes;
+		END;
+	`)},
+	// Which sources delivered which image URLs, so ingest can skip a URL
+	// before downloading it. Stored images are recorded by trigger; ingest
+	// adds URLs whose download was a duplicate. Records go with their image.
+	{19, "source_urls", execMigration(`
+		CREATE TABLE source_urls (
+			url TEXT NOT NULL,
+			source TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			first_seen DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (url, source)
+		);
+		CREATE INDEX idx_source_urls_hash ON source_urls(hash);
+		INSERT OR IGNORE INTO source_urls (url, source, hash, first_seen)
+		SELECT source_url, source, hash, created_at FROM images ORDER BY id;
+		CREATE TRIGGER images_insert_source_urls AFTER INSERT ON images
+		BEGIN
+			INSERT OR IGNORE INTO source_urls (url, source, hash, first_seen)
+			VALUES (NEW.source_url, NEW.source, NEW.hash, NEW.created_at);
+		END;
+		CREATE TRIGGER images_delete_source_urls AFTER DELETE ON images
+		BEGIN
+			DELETE FROM source_urls WHERE hash = OLD.hash;
+		END;
+	`)},
+	// Downscaled copies kept on disk, one row per image and width; the
+	// server records them as it caches resizes.
+	{20, "variants", execMigration(`
+		CREATE TABLE variants (
+			image_id INTEGER NOT NULL REFERENCES images(id),
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			format TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (image_id, width)
+		) WITHOUT ROWID;
+		CREATE TRIGGER images_delete_variants AFTER DELETE ON images
+		BEGIN
+			DELETE FROM variants WHERE image_id = OLD.id;
+		END;
+	`)},
+	// When /api/random or /api/image last served each image, NULL if never,
+	// for RandomFresh.
+	{21, "images.last_served_at", execMigration(`
+		ALTER TABLE images ADD COLUMN last_served_at DATETIME;
+		CREATE INDEX idx_images_category_served ON images(category, last_served_at);
+	`)},
+	// Which images each tailnet user has seen, for RandomForUser. Rows go
+	// with their image.
+	{22, "user_views", execMigration(`
+		CREATE TABLE user_views (
+			user TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			seen_at DATETIME NOT NULL,
+			PRIMARY KEY (user, hash)
+		) WITHOUT ROWID;
+		CREATE INDEX idx_user_views_seen ON user_views(user, seen_at);
+		CREATE TRIGGER images_delete_user_views AFTER DELETE ON images
+		BEGIN
+			DELETE FROM user_views WHERE hash = OLD.hash;
+		END;
+	`)},
+	// The image of the day per UTC date and category, kept so the pick
+	// holds while the category changes during the day.
+	{23, "daily_picks", execMigration(`
+		CREATE TABLE daily_picks (
+			day TEXT NOT NULL,
+			category TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			PRIMARY KEY (day, category)
+		) WITHOUT ROWID;
+	`)},
+	// Lets images_delete_user_views find an image's views without scanning
+	// every user's history.
+	{24, "idx_user_views_hash", execMigration(`
+		CREATE INDEX idx_user_views_hash ON user_views(hash);
+	`)},
+}
+
+// execMigration returns a migration step that runs a fixed SQL script.
+func execMigration(script string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(script)
+		return err
+	}
+}
+
+// addColumn returns a migration step adding one column to table. SQLite
+// fills existing rows with the column default, so this is safe on a
+// populated database.
+func addColumn(table, columnDef string) func(tx *sql.Tx) error {
+	return execMigration("ALTER TABLE " + table + " ADD COLUMN " + columnDef)
+}
+
+// migrate applies every migration not yet recorded in schema_migrations,
+// each in its own transaction together with its version record.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+	return v, err
+}
+
+// SchemaVersion returns the highest applied migration version.
+func (d *DB) SchemaVersion() (int, error) {
+	v, err := schemaVersion(d.db)
+	if err != nil {
+		return 0, fmt.Errorf("catalog: schema version: %w", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,61 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Run is the audit record of one ingest cycle.
+type Run struct {
+	ID       int64           `json:"id"`
+	Started  time.Time       `json:"started"`
+	Duration time.Duration   `json:"duration_ns"`
+	New      int             `json:"new"`
+	Errors   int             `json:"errors"`
+	TimedOut bool            `json:"timed_out"`
+	Canceled bool            `json:"canceled"` // stopped early by shutdown
+	Sources  json.RawMessage `json:"sources"`  // per-source detail, as recorded by ingest
+}
+
+// InsertRun records an ingest cycle and returns its ID.
+func (d *DB) InsertRun(run *Run) (int64, error) {
+	sources := run.Sources
+	if len(sources) == 0 {
+		sources = json.RawMessage("[]")
+	}
+	res, err := d.db.Exec(
+		`INSERT INTO ingest_runs (started_at, duration_ns, new, errors, timed_out, canceled, sources)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		run.Started.UTC(), int64(run.Duration), run.New, run.Errors, run.TimedOut, run.Canceled, string(sources),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("catalog: insert run: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// Runs returns the most recent ingest runs, newest first.
+func (d *DB) Runs(limit int) ([]*Run, error) {
+	rows, err := d.db.Query(
+		`SELECT id, started_at, duration_ns, new, errors, timed_out, canceled, sources
+		 FROM ingest_runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []*Run{}
+	for rows.Next() {
+		var r Run
+		var duration int64
+		var sources string
+		if err := rows.Scan(&r.ID, &r.Started, &duration, &r.New, &r.Errors, &r.TimedOut, &r.Canceled, &sources); err != nil {
+			return nil, fmt.Errorf("catalog: runs: %w", err)
+		}
+		r.Duration = time.Duration(duration)
+		r.Sources = json.RawMessage(sources)
+		runs = append(runs, &r)
+	}
+	return runs, rows.Err()
+}
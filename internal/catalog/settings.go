@@ -0,0 +1,46 @@
+package catalog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// legacyHashAlgo is the content hash of catalogs filled before the
+// algorithm was recorded.
+const legacyHashAlgo = "sha256"
+
+// PinHashAlgo records algo as the content hash algorithm of the catalog's
+// images, or checks it against the one already recorded. A catalog that
+// holds images but no record was filled with sha256. Hashes from different
+// algorithms never match, so mixing them would store every image again
+// instead of deduplicating; an error is returned rather than allowing that.
+func (d *DB) PinHashAlgo(algo string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("catalog: pin hash algo: %w", err)
+	}
+	defer tx.Rollback()
+
+	var pinned string
+	err = tx.QueryRow(`SELECT value FROM settings WHERE key = 'hash_algo'`).Scan(&pinned)
+	if errors.Is(err, sql.ErrNoRows) {
+		pinned = algo
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM (SELECT 1 FROM images LIMIT 1)`).Scan(&n); err != nil {
+			return fmt.Errorf("catalog: pin hash algo: %w", err)
+		}
+		if n > 0 {
+			pinned = legacyHashAlgo
+		}
+		if _, err := tx.Exec(`INSERT INTO settings (key, value) VALUES ('hash_algo', ?)`, pinned); err != nil {
+			return fmt.Errorf("catalog: pin hash algo: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("catalog: pin hash algo: %w", err)
+	}
+	if pinned != algo {
+		return fmt.Errorf("catalog: images are hashed with %s, not %s; mixing algorithms would defeat deduplication", pinned, algo)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,38 @@
+package catalog
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SourceURLSource returns the source that first delivered url, or "" if
+// none has. With a non-empty source only that source's deliveries count, so
+// the result is either source or "". Every stored image counts as delivered
+// by its source; RecordSourceURL adds deliveries that turned out to be
+// duplicates.
+func (d *DB) SourceURLSource(url, source string) (string, error) {
+	var first string
+	err := d.db.QueryRow(
+		`SELECT source FROM source_urls WHERE url = ? AND (? = '' OR source = ?)
+		 ORDER BY rowid LIMIT 1`, url, source, source).Scan(&first)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("catalog: source url: %w", err)
+	}
+	return first, nil
+}
+
+// RecordSourceURL notes that source delivered url with the contents of the
+// stored image hash, so ingest can skip the download next time. Repeats
+// keep the first record. The record goes when the image is deleted.
+func (d *DB) RecordSourceURL(url, source, hash string) error {
+	_, err := d.db.Exec(
+		`INSERT OR IGNORE INTO source_urls (url, source, hash) VALUES (?, ?, ?)`, url, source, hash)
+	if err != nil {
+		return fmt.Errorf("catalog: record source url: %w", err)
+	}
+	return nil
+}
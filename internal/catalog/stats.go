@@ -0,0 +1,34 @@
+package catalog
+
+import (
+	"fmt"
+)
+
+// cachedStats reads the catalog_stats row, returning sql.ErrNoRows if it
+// is missing.
+func (d *DB) cachedStats() (*Stats, error) {
+	s := &Stats{}
+	err := d.db.QueryRow(
+		`SELECT sfw_count, nsfw_count, total_bytes, last_ingest FROM catalog_stats WHERE id = 1`,
+	).Scan(&s.SFWCount, &s.NSFWCount, &s.TotalBytes, &s.LastIngest)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RecomputeStats rebuilds the catalog_stats cache from the images table.
+// Triggers keep the cache current on every insert, update and delete, so
+// this is only needed to refresh the last ingest time after deletions or
+// to repair a cache edited by hand.
+func (d *DB) RecomputeStats() error {
+	_, err := d.db.Exec(`
+		INSERT OR REPLACE INTO catalog_stats (id, sfw_count, nsfw_count, total_bytes, last_ingest, computed_at)
+		SELECT 1, COALESCE(SUM(category = 'sfw'), 0), COALESCE(SUM(category = 'nsfw'), 0),
+		       COALESCE(SUM(size_bytes), 0), COALESCE(MAX(created_at), '1970-01-01'), CURRENT_TIMESTAMP
+		FROM images`)
+	if err != nil {
+		return fmt.Errorf("catalog: recompute stats: %w", err)
+	}
+	return nil
+}
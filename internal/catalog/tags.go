@@ -0,0 +1,66 @@
+package catalog
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// insertTags records tags for the image with the given id.
+func insertTags(tx *sql.Tx, id int64, tags []string) error {
+	for _, tag := range tags {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO tags (image_id, tag) VALUES (?, ?)`, id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImageTags returns the tags of the image with the given id, sorted.
+func (d *DB) ImageTags(id int64) ([]string, error) {
+	rows, err := d.db.Query(`SELECT tag FROM tags WHERE image_id = ? ORDER BY tag`, id)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: image tags: %w", err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("catalog: image tags: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: image tags: %w", err)
+	}
+	return tags, nil
+}
+
+// TagExists reports whether any image in the catalog carries tag.
+func (d *DB) TagExists(tag string) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM (SELECT 1 FROM tags WHERE tag = ? LIMIT 1)`, tag).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("catalog: tag exists: %w", err)
+	}
+	return n > 0, nil
+}
+
+// RandomByTag returns a random image from the given category that carries
+// every one of tags, using the configured strategy.
+func (d *DB) RandomByTag(category string, tags ...string) (*Image, error) {
+	tags = slices.Compact(slices.Sorted(slices.Values(tags)))
+	if len(tags) == 0 {
+		return d.Random(category)
+	}
+	args := make([]any, 0, len(tags)+1)
+	for _, t := range tags {
+		args = append(args, t)
+	}
+	args = append(args, len(tags))
+	return d.randomIn(category,
+		` AND id IN (SELECT image_id FROM tags WHERE tag IN (?`+strings.Repeat(", ?", len(tags)-1)+`)
+		  GROUP BY image_id HAVING COUNT(*) = ?)`, args...)
+}
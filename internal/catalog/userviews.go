@@ -0,0 +1,36 @@
+package catalog
+
+import (
+	"fmt"
+	"time"
+)
+
+// RecordUserView notes that user has just seen the image hash. Seeing it
+// again moves it to the front of the user's history.
+func (d *DB) RecordUserView(user, hash string) error {
+	_, err := d.db.Exec(
+		`INSERT INTO user_views (user, hash, seen_at) VALUES (?, ?, ?)
+		 ON CONFLICT (user, hash) DO UPDATE SET seen_at = excluded.seen_at`,
+		user, hash, time.Now().UTC().Format(servedTimeFormat))
+	if err != nil {
+		return fmt.Errorf("catalog: record user view: %w", err)
+	}
+	return nil
+}
+
+// RandomForUser returns a random image from category that user has not
+// seen recently: the images behind the user's latest views, up to half the
+// category, are left out. Other users' views do not count, and a user with
+// no history gets a plain Random pick.
+func (d *DB) RandomForUser(category, user string) (*Image, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM images WHERE category = ?", category).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: random for user: %w", err)
+	}
+	return d.randomIn(category,
+		` AND hash NOT IN (
+			SELECT v.hash FROM user_views v JOIN images i ON i.hash = v.hash
+			WHERE v.user = ? AND i.category = ? ORDER BY v.seen_at DESC LIMIT ?)`,
+		user, category, count/2)
+}
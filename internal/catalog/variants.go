@@ -0,0 +1,56 @@
+package catalog
+
+import "fmt"
+
+// Variant is a stored downscale of an image, served at
+// /api/image/{hash}?w={Width}.
+type Variant struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	SizeBytes int64  `json:"size_bytes"`
+	Format    string `json:"format"`
+}
+
+// PutVariant records v as a variant of the image hash, replacing any
+// earlier one of the same width. Variants at least as wide as the image are
+// the base size again and are not recorded, nor is anything for an unknown
+// hash.
+func (d *DB) PutVariant(hash string, v Variant) error {
+	_, err := d.db.Exec(
+		`INSERT OR REPLACE INTO variants (image_id, width, height, size_bytes, format)
+		 SELECT id, ?, ?, ?, ? FROM images WHERE hash = ? AND width > ?`,
+		v.Width, v.Height, v.SizeBytes, v.Format, hash, v.Width)
+	if err != nil {
+		return fmt.Errorf("catalog: put variant: %w", err)
+	}
+	return nil
+}
+
+// Variants returns the variants of the image hash, narrowest first, and an
+// empty slice if it has none. An unknown hash yields an error wrapping
+// sql.ErrNoRows.
+func (d *DB) Variants(hash string) ([]Variant, error) {
+	var id int64
+	if err := d.db.QueryRow(`SELECT id FROM images WHERE hash = ?`, hash).Scan(&id); err != nil {
+		return nil, fmt.Errorf("catalog: variants: %w", err)
+	}
+	rows, err := d.db.Query(
+		`SELECT width, height, size_bytes, format FROM variants WHERE image_id = ? ORDER BY width`, id)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: variants: %w", err)
+	}
+	defer rows.Close()
+
+	variants := []Variant{}
+	for rows.Next() {
+		var v Variant
+		if err := rows.Scan(&v.Width, &v.Height, &v.SizeBytes, &v.Format); err != nil {
+			return nil, fmt.Errorf("catalog: variants: %w", err)
+		}
+		variants = append(variants, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("catalog: variants: %w", err)
+	}
+	return variants, nil
+}
@@ -0,0 +1,103 @@
+// Package config reads settings from a JSON file whose keys are the
+// command-line flag names, so a service does not need a dozen flags on its
+// command line.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Load reads the config file at path. See Parse.
+func Load(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+	return Parse(f, path)
+}
+
+// Parse reads a config file, named name in errors, into flag values. The
+// file holds one JSON object, e.g. {"addr": ":8420", "tailnet-only": false,
+// "cron": "30m"}; strings are taken as written and booleans and numbers as
+// the flag package would parse them. Nested objects and arrays are an error.
+func Parse(r io.Reader, name string) (map[string]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %w", name, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		var offset int64 = -1
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			offset = syntaxErr.Offset
+		case errors.As(err, &typeErr):
+			offset = typeErr.Offset
+		}
+		if offset >= 0 {
+			line := 1 + bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n"))
+			return nil, fmt.Errorf("config: %s:%d: %w", name, line, err)
+		}
+		return nil, fmt.Errorf("config: %s: %w", name, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("config: %s: trailing data after the top-level object", name)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		case json.Number:
+			values[key] = v.String()
+		default:
+			return nil, fmt.Errorf("config: %s: %q must be a string, number or boolean", name, key)
+		}
+	}
+	return values, nil
+}
+
+// Apply sets values on fs for every flag not given on the command line, so
+// flags override the file and the file overrides defaults. It must run
+// after fs.Parse. Keys that name no flag, and values the flag rejects, are
+// errors naming the key.
+func Apply(fs *flag.FlagSet, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("config: unknown setting %q", key)
+		}
+	}
+
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	for _, key := range keys {
+		if onCommandLine[key] {
+			continue
+		}
+		if err := fs.Set(key, values[key]); err != nil {
+			return fmt.Errorf("config: %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := fs.String("addr", ":8420", "")
+	data := fs.String("data", "/default", "")
+	cron := fs.Duration("cron", time.Hour, "")
+	tailnetOnly := fs.Bool("tailnet-only", true, "")
+	quality := fs.Int("webp-quality", 80, "")
+	if err := fs.Parse([]string{"-addr", ":9000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := Parse(strings.NewReader(`{
+		"addr": ":1234",
+		"cron": "30m",
+		"tailnet-only": false,
+		"webp-quality": 90
+	}`), "test.json")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := Apply(fs, values); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if *addr != ":9000" {
+		t.Errorf("addr = %q, want the command line's :9000", *addr)
+	}
+	if *cron != 30*time.Minute || *tailnetOnly || *quality != 90 {
+		t.Errorf("cron, tailnet-only, webp-quality = %v, %v, %d, want the file's 30m, false, 90", *cron, *tailnetOnly, *quality)
+	}
+	if *data != "/default" {
+		t.Errorf("data = %q, want the default", *data)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waifu-mirror.json")
+	if err := os.WriteFile(path, []byte(`{"data": "/srv/waifu"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	values, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if values["data"] != "/srv/waifu" {
+		t.Errorf("data = %q, want /srv/waifu", values["data"])
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"{\n  \"addr\": \":8420\",\n  \"cron\" \"1h\"\n}", "test.json:3:"},
+		{"{\"addr\": \":8420\"", "test.json"},
+		{"[\"addr\"]", "test.json:1:"},
+		{`{"allowed-hosts": ["waifu.im"]}`, `"allowed-hosts" must be a string, number or boolean`},
+		{`{"addr": ":8420"} {}`, "trailing data"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.file), "test.json")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) = %v, want an error mentioning %q", tt.file, err, tt.want)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("cron", time.Hour, "")
+	fs.Parse(nil)
+	for _, tt := range []struct {
+		values map[string]string
+		want   string
+	}{
+		{map[string]string{"crn": "1h"}, `unknown setting "crn"`},
+		{map[string]string{"cron": "1 h"}, "config: cron:"},
+	} {
+		if err := Apply(fs, tt.values); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Apply(%v) = %v, want an error mentioning %q", tt.values, err, tt.want)
+		}
+	}
+}
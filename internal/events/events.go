@@ -0,0 +1,119 @@
+// Package events is a small in-process publish/subscribe bus used to stream
+// ingest activity to long-lived HTTP clients. Publishing never blocks: a
+// subscriber that falls behind its buffer misses events instead of stalling
+// ingest.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Topics published on the bus.
+const (
+	// TopicImages carries one "image" event per newly stored image.
+	TopicImages = "images"
+
+	// TopicIngest carries ingest lifecycle events: "cycle_start",
+	// "source_progress", "image_result" and "cycle_complete".
+	TopicIngest = "ingest"
+)
+
+// Event is a single message on the bus.
+type Event struct {
+	Topic string    `json:"-"`
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+// Bus fans events out to subscribers. The zero value is not usable; call
+// NewBus.
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewBus creates an empty bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives events for one topic on C until it is closed, either
+// by Close or by the bus shutting down.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	topic   string
+	bus     *Bus
+	dropped atomic.Int64
+}
+
+// Subscribe registers a subscriber for topic with room for buffer pending
+// events. Subscribing to a closed bus returns an already-closed subscription.
+func (b *Bus) Subscribe(topic string, buffer int) *Subscription {
+	ch := make(chan Event, buffer)
+	s := &Subscription{C: ch, ch: ch, topic: topic, bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Close unregisters the subscription and closes C. It is safe to call more
+// than once and after the bus has closed.
+func (s *Subscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+// Dropped returns how many events were discarded because C was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Publish sends an event to every subscriber of topic without blocking.
+func (b *Bus) Publish(topic, typ string, data any) {
+	ev := Event{Topic: topic, Type: typ, Time: time.Now().UTC(), Data: data}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.topic != topic {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Close closes every subscription and rejects new ones, ending any streams
+// that are reading from the bus. It is used on server shutdown.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
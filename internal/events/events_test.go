@@ -0,0 +1,66 @@
+package events
+
+import "testing"
+
+func TestPublishSubscribe(t *testing.T) {
+	bus := NewBus()
+	images := bus.Subscribe(TopicImages, 4)
+	other := bus.Subscribe("other", 4)
+
+	bus.Publish(TopicImages, "image", "abc")
+
+	select {
+	case ev := <-images.C:
+		if ev.Type != "image" || ev.Data != "abc" {
+			t.Fatalf("got event %+v", ev)
+		}
+	default:
+		t.Fatal("expected an event on the images subscription")
+	}
+
+	select {
+	case ev := <-other.C:
+		t.Fatalf("unexpected event on other topic: %+v", ev)
+	default:
+	}
+}
+
+func TestSlowSubscriberDrops(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(TopicImages, 2)
+
+	// Publishing past the buffer must not block.
+	for i := 0; i < 5; i++ {
+		bus.Publish(TopicImages, "image", i)
+	}
+	if got := sub.Dropped(); got != 3 {
+		t.Fatalf("Dropped = %d, want 3", got)
+	}
+	if ev := <-sub.C; ev.Data != 0 {
+		t.Fatalf("first buffered event = %v, want 0", ev.Data)
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus := NewBus()
+	sub := bus.Subscribe(TopicImages, 1)
+
+	sub.Close()
+	sub.Close() // idempotent
+	if _, ok := <-sub.C; ok {
+		t.Fatal("expected closed channel after Close")
+	}
+
+	live := bus.Subscribe(TopicImages, 1)
+	bus.Close()
+	if _, ok := <-live.C; ok {
+		t.Fatal("expected bus Close to close subscriptions")
+	}
+	live.Close() // safe after bus close
+
+	late := bus.Subscribe(TopicImages, 1)
+	if _, ok := <-late.C; ok {
+		t.Fatal("expected subscription on closed bus to be closed")
+	}
+	bus.Publish(TopicImages, "image", nil) // must not panic
+}
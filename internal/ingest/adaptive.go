@@ -0,0 +1,124 @@
+package ingest
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Adaptive rate limiting tuning.
+const (
+	throttleWindow   = 20   // recent responses considered per source
+	throttleMinFill  = 5    // responses in the window before its ratio counts
+	throttleHighMark = 0.2  // 429 ratio above which the rate is halved
+	minRateFraction  = 0.05 // floor, as a fraction of the base rate
+	recoverFraction  = 0.1  // base rate restored per successful response
+)
+
+// adaptiveLimiter is a rate.Limiter that backs off when its upstream keeps
+// answering 429: once the window holds throttleMinFill responses and the
+// share of throttled ones reaches throttleHighMark, each further 429 halves
+// the rate, and every success restores a tenth of the base rate until it is
+// reached again. The minimum fill keeps a lone early 429 from counting as a
+// ratio of 1.0.
+type adaptiveLimiter struct {
+	*rate.Limiter
+	name string
+	base rate.Limit
+
+	mu        sync.Mutex
+	window    [throttleWindow]bool // true = throttled
+	next      int
+	filled    int
+	requests  int64
+	throttled int64
+	retries   int64
+}
+
+func newAdaptiveLimiter(name string, r rate.Limit, burst int) *adaptiveLimiter {
+	return &adaptiveLimiter{Limiter: rate.NewLimiter(r, burst), name: name, base: r}
+}
+
+// observe records one upstream response and adjusts the rate.
+func (l *adaptiveLimiter) observe(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.requests++
+	if throttled {
+		l.throttled++
+	}
+	l.window[l.next] = throttled
+	l.next = (l.next + 1) % throttleWindow
+	l.filled = min(l.filled+1, throttleWindow)
+
+	cur := l.Limit()
+	switch {
+	case throttled && l.filled >= throttleMinFill && l.ratioLocked() >= throttleHighMark:
+		l.SetLimit(max(cur/2, l.base*minRateFraction))
+	case !throttled && cur < l.base:
+		l.SetLimit(min(cur+l.base*recoverFraction, l.base))
+	}
+}
+
+// retried counts one retry spent against this source.
+func (l *adaptiveLimiter) retried() {
+	l.mu.Lock()
+	l.retries++
+	l.mu.Unlock()
+}
+
+func (l *adaptiveLimiter) ratioLocked() float64 {
+	if l.filled == 0 {
+		return 0
+	}
+	var n int
+	for _, t := range l.window[:l.filled] {
+		if t {
+			n++
+		}
+	}
+	return float64(n) / float64(l.filled)
+}
+
+// SourceStatus reports the current request budget for one upstream.
+type SourceStatus struct {
+	Name          string  `json:"name"`
+	Rate          float64 `json:"rate"`      // effective requests per second
+	BaseRate      float64 `json:"base_rate"` // configured requests per second
+	Requests      int64   `json:"requests"`
+	Throttled     int64   `json:"throttled"`
+	Retries       int64   `json:"retries"`
+	ThrottleRatio float64 `json:"throttle_ratio"` // share of 429s in the recent window
+}
+
+func (l *adaptiveLimiter) status() SourceStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return SourceStatus{
+		Name:          l.name,
+		Rate:          float64(l.Limit()),
+		BaseRate:      float64(l.base),
+		Requests:      l.requests,
+		Throttled:     l.throttled,
+		Retries:       l.retries,
+		ThrottleRatio: l.ratioLocked(),
+	}
+}
+
+// Sources reports the effective rate and retry budget of each upstream,
+// including per-source download limits ("download:<source>") in name order.
+func (ing *Ingester) Sources() []SourceStatus {
+	st := []SourceStatus{
+		ing.waifuImLimiter.status(),
+		ing.waifuPicsLimiter.status(),
+		ing.nekosBestLimiter.status(),
+		ing.downloadLimiter.status(),
+	}
+	for _, source := range slices.Sorted(maps.Keys(ing.sourceDownloads)) {
+		st = append(st, ing.sourceDownloads[source].status())
+	}
+	return st
+}
@@ -0,0 +1,109 @@
+package ingest
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// origProbeBytes is how much of an upstream image is fetched to read its
+// dimensions; every supported format declares them well within this.
+const origProbeBytes = 64 << 10
+
+// BackfillReport summarizes a BackfillOrigSize pass.
+type BackfillReport struct {
+	Checked int // rows without an original size
+	Updated int
+	Failed  int
+}
+
+// BackfillOrigSize fills in the original dimensions of images stored before
+// they were recorded. The stored file may have been resized, so it re-probes
+// each row's source URL instead, reading only the start of the image. Such
+// requests obey the same rate limit and host checks as downloads. Up to
+// workers probes run at once, reporting to progress if non-nil. Failures
+// for single images are logged and counted; the pass stops only if ctx is
+// cancelled or the catalog fails.
+func (ing *Ingester) BackfillOrigSize(ctx context.Context, workers int, progress maintenance.Progress) (*BackfillReport, error) {
+	var todo []*catalog.Image
+	err := ing.cat.Each(func(img *catalog.Image) error {
+		if img.OrigWidth == 0 || img.OrigHeight == 0 {
+			todo = append(todo, img)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("backfill: %w", err)
+	}
+
+	report := &BackfillReport{Checked: len(todo)}
+	var mu sync.Mutex
+	var catErr error
+	maintenance.ForEach(todo, workers, progress, func(img *catalog.Image) {
+		mu.Lock()
+		stop := catErr != nil
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			return
+		}
+
+		w, h, probeErr := ing.probeSize(ctx, img.SourceURL, ing.downloadLimiterFor(img.Source))
+		var err error
+		if probeErr == nil {
+			err = ing.cat.SetOrigSize(img.Hash, w, h)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			catErr = cmp.Or(catErr, fmt.Errorf("backfill: %w", err))
+		case probeErr == nil:
+			report.Updated++
+		case ctx.Err() == nil:
+			slog.Warn("backfill: probe", "hash", img.Hash, "err", probeErr)
+			report.Failed++
+		}
+	})
+	if catErr != nil {
+		return report, catErr
+	}
+	return report, ctx.Err()
+}
+
+// probeSize reads the dimensions of the image at srcURL from its first
+// origProbeBytes, through fetchImage like any download.
+func (ing *Ingester) probeSize(ctx context.Context, srcURL string, lim *adaptiveLimiter) (w, h int, err error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=0-%d", origProbeBytes-1)}}
+	resp, _, err := ing.fetchImage(ctx, srcURL, lim, header)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, fmt.Errorf("probe %d", resp.StatusCode)
+	}
+
+	head, err := io.ReadAll(io.LimitReader(resp.Body, origProbeBytes))
+	if err != nil {
+		return 0, 0, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return 0, 0, fmt.Errorf("probe: %w", err)
+	}
+	if optimize.Orientation(head) >= 5 {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
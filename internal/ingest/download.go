@@ -0,0 +1,73 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+)
+
+// fetchImage sends one GET for the image at srcURL. Every image request,
+// by ingest or a maintenance pass such as BackfillOrigSize, goes through
+// it, so all of them get the same politeness: the URL must pass the
+// allowlist, the request waits for the download rate limit lim and reports
+// its outcome to it, the download client refuses private addresses and the
+// first-byte timeout applies. header is added to the request. The caller
+// must close the response body. retry reports whether a failure is worth
+// retrying.
+func (ing *Ingester) fetchImage(ctx context.Context, srcURL string, lim *adaptiveLimiter, header http.Header) (resp *http.Response, retry bool, err error) {
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("download: %w", err)
+	}
+	if err := ing.checkImageURL(u); err != nil {
+		return nil, false, err
+	}
+	if err := lim.Wait(ctx); err != nil {
+		return nil, false, err
+	}
+
+	gctx, guard, stop := guardFirstByte(ctx, ing.firstByteTimeout)
+	req, err := http.NewRequestWithContext(gctx, http.MethodGet, srcURL, nil)
+	if err != nil {
+		stop()
+		return nil, false, err
+	}
+	maps.Copy(req.Header, header)
+	resp, err = ing.dl.Do(req)
+	if err != nil {
+		stop()
+		if errors.Is(err, errHostNotAllowed) || errors.Is(err, errPrivateAddress) {
+			return nil, false, err
+		}
+		return nil, true, guard.err(err)
+	}
+	lim.observe(resp.StatusCode == http.StatusTooManyRequests)
+	resp.Body = &guardedBody{r: guard.body(resp.Body), body: resp.Body, guard: guard, stop: stop}
+	return resp, false, nil
+}
+
+// guardedBody is a response body read through its first-byte guard, which
+// it releases on Close.
+type guardedBody struct {
+	r     io.Reader
+	body  io.Closer
+	guard *firstByteGuard
+	stop  func()
+}
+
+func (b *guardedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != io.EOF {
+		err = b.guard.err(err)
+	}
+	return n, err
+}
+
+func (b *guardedBody) Close() error {
+	defer b.stop()
+	return b.body.Close()
+}
@@ -0,0 +1,67 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// firstByteGuard cancels a request whose response body has not produced any
+// data within a deadline of the request starting. It catches stalled
+// connections long before the client's overall timeout does.
+type firstByteGuard struct {
+	timer   *time.Timer // nil when the guard is disabled
+	expired atomic.Bool
+}
+
+// guardFirstByte derives a request context from ctx that is cancelled if no
+// body data arrives within d. Zero d disables the guard. The returned stop
+// function must be called once the request is finished.
+func guardFirstByte(ctx context.Context, d time.Duration) (context.Context, *firstByteGuard, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &firstByteGuard{}
+	if d > 0 {
+		g.timer = time.AfterFunc(d, func() {
+			g.expired.Store(true)
+			cancel()
+		})
+	}
+	stop := func() {
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		cancel()
+	}
+	return ctx, g, stop
+}
+
+// body wraps r so the guard is disarmed by the first byte read.
+func (g *firstByteGuard) body(r io.Reader) io.Reader {
+	if g.timer == nil {
+		return r
+	}
+	return &firstByteReader{r: r, timer: g.timer}
+}
+
+// err annotates err if it was caused by the guard firing.
+func (g *firstByteGuard) err(err error) error {
+	if err != nil && g.expired.Load() {
+		return fmt.Errorf("no data within first-byte timeout: %w", err)
+	}
+	return err
+}
+
+type firstByteReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 {
+		f.timer.Stop()
+	}
+	return n, err
+}
@@ -0,0 +1,53 @@
+package ingest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+// Content hash algorithms for WithHashAlgo. The hash names the stored file
+// and is what deduplication compares, so one catalog must stick to one
+// algorithm; see catalog.DB.PinHashAlgo.
+const (
+	HashSHA256 = "sha256" // 128-bit prefix; the default
+	HashBLAKE3 = "blake3" // 128-bit prefix; faster than sha256 on most CPUs
+	HashXXHash = "xxhash" // 64 bits, not cryptographic; fastest
+)
+
+// HashAlgos lists the accepted content hash algorithms.
+var HashAlgos = []string{HashSHA256, HashBLAKE3, HashXXHash}
+
+// CheckHashAlgo reports whether algo is one of HashAlgos.
+func CheckHashAlgo(algo string) error {
+	switch algo {
+	case HashSHA256, HashBLAKE3, HashXXHash:
+		return nil
+	}
+	return fmt.Errorf("ingest: unknown hash algorithm %q (want sha256, blake3 or xxhash)", algo)
+}
+
+// WithHashAlgo names stored images by algo, one of HashAlgos, instead of
+// HashSHA256. Callers should validate algo with CheckHashAlgo; an unknown
+// one falls back to sha256.
+func WithHashAlgo(algo string) Option {
+	return func(ing *Ingester) { ing.hashAlgo = algo }
+}
+
+// contentHash returns the hex content hash of data under algo.
+func contentHash(algo string, data []byte) string {
+	switch algo {
+	case HashBLAKE3:
+		h := blake3.Sum256(data)
+		return hex.EncodeToString(h[:16])
+	case HashXXHash:
+		return hex.EncodeToString(binary.BigEndian.AppendUint64(nil, xxhash.Sum64(data)))
+	default:
+		h := sha256.Sum256(data)
+		return hex.EncodeToString(h[:16])
+	}
+}
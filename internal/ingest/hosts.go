@@ -0,0 +1,115 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultAllowedHosts are the hosts the upstream APIs serve images from.
+var DefaultAllowedHosts = []string{".waifu.im", ".waifu.pics", ".nekos.best"}
+
+// hostAllowed reports whether host matches an entry of allowed. An entry
+// starting with "." matches that domain and any subdomain of it; any other
+// entry must match exactly. An empty list allows every host.
+func hostAllowed(host string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, ".") {
+			if strings.HasSuffix(host, a) || host == a[1:] {
+				return true
+			}
+		} else if host == a {
+			return true
+		}
+	}
+	return false
+}
+
+// errHostNotAllowed is returned for image URLs outside the allowlist.
+var errHostNotAllowed = errors.New("host not allowed")
+
+// checkImageURL rejects image URLs that are not http(s) or whose host is
+// not on the allowlist.
+func (ing *Ingester) checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("download %s: unsupported scheme %q", u.Redacted(), u.Scheme)
+	}
+	if !hostAllowed(u.Hostname(), ing.allowedHosts) {
+		slog.Warn("ingest: rejected download: host not in allowlist", "host", u.Hostname())
+		return fmt.Errorf("download %s: %w", u.Redacted(), errHostNotAllowed)
+	}
+	return nil
+}
+
+// checkRedirect is the download client's redirect policy: each hop is
+// re-checked against the allowlist so an allowed host cannot bounce the
+// request elsewhere.
+func (ing *Ingester) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return ing.checkImageURL(req.URL)
+}
+
+// ParseHostList splits a comma-separated allowlist such as
+// ".waifu.im,cdn.example.com", ignoring blanks.
+func ParseHostList(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// errPrivateAddress is returned when a download would connect to a
+// loopback, private or link-local address.
+var errPrivateAddress = errors.New("connection to private address blocked")
+
+// cgnat is the shared address space (RFC 6598), also used by tailnets.
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether ip is safe for the ingester to connect to.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
+
+// guardDial rejects connections to non-public addresses. It runs after name
+// resolution, so a hostname that resolves to an internal address is caught
+// too.
+func guardDial(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errPrivateAddress, address)
+	}
+	if !publicAddr(ap.Addr()) {
+		slog.Warn("ingest: blocked download connection", "addr", address)
+		return fmt.Errorf("%w: %s", errPrivateAddress, address)
+	}
+	return nil
+}
+
+// downloadTransport returns the transport for image downloads: the default
+// transport, refusing non-public addresses unless allowPrivate is set.
+func downloadTransport(allowPrivate bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if !allowPrivate {
+		d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: guardDial}
+		t.DialContext = d.DialContext
+	}
+	return t
+}
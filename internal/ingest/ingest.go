@@ -5,20 +5,26 @@ package ingest
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"bytes"
+	"image"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/events"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
 	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
 	"golang.org/x/time/rate"
 )
@@ -28,108 +34,499 @@ const (
 	waifuImSearchURL = "https://api.waifu.im/images"
 	waifuPicsManyURL = "https://api.waifu.pics/many/sfw/waifu"
 	waifuPicsNSFWURL = "https://api.waifu.pics/many/nsfw/waifu"
+	nekosBestAPIURL  = "https://nekos.best/api/v2/waifu?amount=20"
 )
 
+// waifuImPageSize is the number of items requested per waifu.im page.
+const waifuImPageSize = 30
+
 // Ingester fetches and processes images from upstream APIs.
 type Ingester struct {
 	cat    *catalog.DB
 	imgDir string
-	hc     *http.Client
+	hc     *http.Client // upstream API requests
+	dl     *http.Client // image downloads
+
+	allowedHosts []string // image hosts downloads may reach; empty = any
+	allowPrivate bool     // let downloads reach private/loopback addresses
+
+	waifuImURL   string // search endpoint; overridden in tests
+	waifuImPages int    // pages fetched per category per cycle
+
+	// Pages in a row without new images, per cursor key. Kept in memory: a
+	// restart only delays the next wrap to page 1.
+	staleMu    sync.Mutex
+	stalePages map[string]int
+
+	waifuPicsSFWURL, waifuPicsNSFWURL string // overridden in tests
+
+	nekosBestURL string // overridden in tests
+
+	quality  int    // lossy quality for stored images, 1-100
+	hashAlgo string // content hash naming stored images; one of HashAlgos
+
+	layout maintenance.Layout // where stored images go under imgDir
+
+	nearDupDistance int // max perceptual hash distance of a near duplicate; <0 = off
+
+	urlDedup URLDedup // which earlier deliveries of a URL skip its download
+
+	targetCount int         // skip cycles while the catalog holds this many; 0 = off
+	full        atomic.Bool // last cycle found the catalog at targetCount
+
+	cycleTimeout     time.Duration // 0 = unbounded
+	firstByteTimeout time.Duration // per download attempt; 0 = off
+	maxImageBytes    int64         // larger downloads are skipped; 0 = unlimited
+
+	// Per-source rate limiters; each slows down while its upstream throttles.
+	waifuImLimiter   *adaptiveLimiter // 5 req/sec (API documented limit)
+	waifuPicsLimiter *adaptiveLimiter // 1 req/sec (undocumented, conservative)
+	nekosBestLimiter *adaptiveLimiter // 1 req/sec (conservative; 20 images per call)
+	downloadLimiter  *adaptiveLimiter // 10 req/sec for image downloads
 
-	// Per-source rate limiters.
-	waifuImLimiter   *rate.Limiter // 5 req/sec (API documented limit)
-	waifuPicsLimiter *rate.Limiter // 1 req/sec (undocumented, conservative)
-	downloadLimiter  *rate.Limiter // 10 req/sec for image downloads
+	// Download limiters of sources given their own rate; the rest share
+	// downloadLimiter.
+	sourceDownloads map[string]*adaptiveLimiter
+
+	events *events.Bus // optional; receives new images and cycle progress
+
+	rngMu sync.Mutex
+	rng   *rand.Rand // backoff jitter; seeded from the clock unless WithRand
 }
 
 const maxRetries = 3
 
+// maxRetryAfter caps how long a Retry-After header can delay a retry, so a
+// hostile or broken upstream cannot stall a whole cycle.
+const maxRetryAfter = 60 * time.Second
+
+// Option configures optional Ingester behavior.
+type Option func(*Ingester)
+
+// WithEvents publishes each newly stored image to bus on events.TopicImages
+// and cycle progress on events.TopicIngest.
+func WithEvents(bus *events.Bus) Option {
+	return func(ing *Ingester) { ing.events = bus }
+}
+
+// WithWaifuImPages fetches up to n pages of waifu.im results per category
+// each cycle instead of one. Values below 1 are treated as 1. Either way
+// each cycle continues from the page after the last one fetched.
+func WithWaifuImPages(n int) Option {
+	return func(ing *Ingester) { ing.waifuImPages = max(n, 1) }
+}
+
+// WithQuality encodes stored images at lossy quality q (1-100) instead of
+// optimize.DefaultQuality. Callers should validate q with
+// optimize.CheckQuality; out-of-range values make every image fall back to
+// its original bytes.
+func WithQuality(q int) Option {
+	return func(ing *Ingester) { ing.quality = q }
+}
+
+// WithLayout stores new images in layout instead of flat in the image
+// directory. It applies only to images stored from now on;
+// maintenance.MigrateLayout moves existing ones.
+func WithLayout(layout maintenance.Layout) Option {
+	return func(ing *Ingester) { ing.layout = layout }
+}
+
+// DefaultNearDuplicateDistance is the perceptual hash distance, in bits,
+// within which a new image counts as a copy of a stored one.
+const DefaultNearDuplicateDistance = 5
+
+// WithNearDuplicateDistance skips new images whose perceptual hash is within
+// n bits of a stored image's, catching copies that were re-encoded or
+// resized upstream. A negative n disables the check, leaving only the exact
+// content hash.
+func WithNearDuplicateDistance(n int) Option {
+	return func(ing *Ingester) { ing.nearDupDistance = n }
+}
+
+// WithTargetCount skips ingest cycles while the catalog holds at least n
+// images, saving upstream requests once the mirror is full enough. Cycles
+// resume once eviction brings the count back below n. Zero disables it.
+func WithTargetCount(n int) Option {
+	return func(ing *Ingester) { ing.targetCount = n }
+}
+
+// WithDownloadRates gives image downloads of each named source (e.g.
+// "waifu.pics" or "manual") their own limit of rates[source] requests per
+// second, so a slow CDN cannot starve another's downloads. Sources not
+// listed share the default 10 req/sec download limit.
+func WithDownloadRates(rates map[string]float64) Option {
+	return func(ing *Ingester) {
+		ing.sourceDownloads = make(map[string]*adaptiveLimiter, len(rates))
+		for source, r := range rates {
+			ing.sourceDownloads[source] = newAdaptiveLimiter("download:"+source, rate.Limit(r), 3)
+		}
+	}
+}
+
+// ParseDownloadRates parses a comma-separated list of source=rate pairs,
+// e.g. "waifu.im=10,waifu.pics=2.5", for WithDownloadRates.
+func ParseDownloadRates(s string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	if strings.TrimSpace(s) == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		source, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || source == "" {
+			return nil, fmt.Errorf("invalid download rate %q (want source=rate)", pair)
+		}
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid rate in download rate %q", pair)
+		}
+		rates[source] = r
+	}
+	return rates, nil
+}
+
+// downloadLimiterFor returns the limiter for image downloads of source.
+func (ing *Ingester) downloadLimiterFor(source string) *adaptiveLimiter {
+	if l, ok := ing.sourceDownloads[source]; ok {
+		return l
+	}
+	return ing.downloadLimiter
+}
+
+// WithCycleTimeout bounds each Run. When it expires, in-flight requests are
+// cancelled, remaining sources are skipped and Run returns the partial
+// result with TimedOut set. Zero means no limit.
+func WithCycleTimeout(d time.Duration) Option {
+	return func(ing *Ingester) { ing.cycleTimeout = d }
+}
+
+// DefaultMaxImageBytes is the largest image download ingest accepts.
+const DefaultMaxImageBytes = 10 << 20
+
+// WithMaxImageBytes skips images larger than n bytes instead of
+// DefaultMaxImageBytes. Zero removes the limit.
+func WithMaxImageBytes(n int64) Option {
+	return func(ing *Ingester) { ing.maxImageBytes = n }
+}
+
+// errImageTooLarge is returned for downloads over the image size limit.
+var errImageTooLarge = errors.New("image too large")
+
+// WithFirstByteTimeout aborts and retries an image download when no body
+// data has arrived within d of sending the request, even though the overall
+// client timeout has not expired yet. Zero disables the check.
+func WithFirstByteTimeout(d time.Duration) Option {
+	return func(ing *Ingester) { ing.firstByteTimeout = d }
+}
+
+// WithAllowedHosts restricts image downloads to hosts matching one of the
+// given entries: ".example.com" matches example.com and its subdomains, any
+// other entry only that exact host. An empty list allows every host. The
+// default is DefaultAllowedHosts.
+func WithAllowedHosts(hosts []string) Option {
+	return func(ing *Ingester) { ing.allowedHosts = hosts }
+}
+
+// WithPrivateNetworks lets image downloads connect to loopback, private,
+// link-local and CGNAT addresses, which are refused by default so a hostile
+// upstream cannot point the ingester at internal services.
+func WithPrivateNetworks(allow bool) Option {
+	return func(ing *Ingester) { ing.allowPrivate = allow }
+}
+
+// WithRand draws retry backoff jitter from r instead of a clock-seeded
+// source, so tests can make backoff durations reproducible.
+func WithRand(r *rand.Rand) Option {
+	return func(ing *Ingester) { ing.rng = r }
+}
+
 // New creates an Ingester that stores images in imgDir.
-func New(cat *catalog.DB, imgDir string) *Ingester {
-	return &Ingester{
+func New(cat *catalog.DB, imgDir string, opts ...Option) *Ingester {
+	ing := &Ingester{
 		cat:    cat,
 		imgDir: imgDir,
 		hc: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		waifuImLimiter:   rate.NewLimiter(rate.Limit(5), 1),
-		waifuPicsLimiter: rate.NewLimiter(rate.Limit(1), 1),
-		downloadLimiter:  rate.NewLimiter(rate.Limit(10), 3),
+		allowedHosts:     DefaultAllowedHosts,
+		waifuImURL:       waifuImSearchURL,
+		waifuImPages:     1,
+		stalePages:       map[string]int{},
+		quality:          optimize.DefaultQuality,
+		hashAlgo:         HashSHA256,
+		nearDupDistance:  DefaultNearDuplicateDistance,
+		urlDedup:         URLDedupGlobal,
+		maxImageBytes:    DefaultMaxImageBytes,
+		waifuPicsSFWURL:  waifuPicsManyURL,
+		waifuPicsNSFWURL: waifuPicsNSFWURL,
+		nekosBestURL:     nekosBestAPIURL,
+		waifuImLimiter:   newAdaptiveLimiter("waifu.im", rate.Limit(5), 1),
+		waifuPicsLimiter: newAdaptiveLimiter("waifu.pics", rate.Limit(1), 1),
+		nekosBestLimiter: newAdaptiveLimiter("nekos.best", rate.Limit(1), 1),
+		downloadLimiter:  newAdaptiveLimiter("download", rate.Limit(10), 3),
+		rng:              rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
+	for _, opt := range opts {
+		opt(ing)
+	}
+	ing.dl = &http.Client{
+		Timeout:       30 * time.Second,
+		Transport:     downloadTransport(ing.allowPrivate),
+		CheckRedirect: ing.checkRedirect,
+	}
+	return ing
 }
 
-// Run performs one ingest cycle: fetches from all upstream sources,
-// deduplicates, optimizes, and stores. Returns the count of new images.
-func (ing *Ingester) Run(ctx context.Context) (int, error) {
-	var total int
+// SourceResult is the outcome of one upstream fetch within a cycle.
+type SourceResult struct {
+	Source   string `json:"source"`
+	Category string `json:"category"`
+	New      int    `json:"new"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RunResult summarizes one ingest cycle.
+type RunResult struct {
+	Started  time.Time      `json:"started"`
+	Duration time.Duration  `json:"duration_ns"`
+	New      int            `json:"new"`
+	Sources  []SourceResult `json:"sources"`
+	TimedOut bool           `json:"timed_out,omitempty"`
+	Canceled bool           `json:"canceled,omitempty"` // ctx passed to Run was cancelled
+	Skipped  bool           `json:"skipped,omitempty"`  // catalog at its target count
+}
 
-	// Fetch SFW from waifu.im
-	n, err := ing.ingestWaifuIm(ctx, "sfw")
+// ImageResult is published on events.TopicIngest for every image considered
+// during a cycle.
+type ImageResult struct {
+	Source   string `json:"source"`
+	Category string `json:"category"`
+	URL      string `json:"url"`
+	Stored   bool   `json:"stored"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Run performs one ingest cycle: fetches from all upstream sources,
+// deduplicates, optimizes, and stores. A failing source is logged and
+// recorded in the result without stopping the others.
+//
+// When ctx is cancelled, as on shutdown, no new downloads start but those
+// already completed are still stored, and the partial result is recorded
+// with Canceled set.
+//
+// A cycle that finds the catalog at its WithTargetCount does nothing and
+// returns a result with Skipped set, which is not recorded.
+func (ing *Ingester) Run(ctx context.Context) (*RunResult, error) {
+	res := &RunResult{Started: time.Now().UTC()}
+	full, err := ing.atTarget()
 	if err != nil {
-		log.Printf("ingest: waifu.im sfw: %v", err)
+		return nil, err
 	}
-	total += n
+	if full {
+		res.Skipped = true
+		return res, nil
+	}
+	ing.publish("cycle_start", res)
 
-	// Fetch NSFW from waifu.im
-	n, err = ing.ingestWaifuIm(ctx, "nsfw")
-	if err != nil {
-		log.Printf("ingest: waifu.im nsfw: %v", err)
+	parent := ctx
+	if ing.cycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ing.cycleTimeout)
+		defer cancel()
 	}
-	total += n
 
-	// Fetch SFW from waifu.pics
-	n, err = ing.ingestWaifuPics(ctx, waifuPicsManyURL, "sfw")
-	if err != nil {
-		log.Printf("ingest: waifu.pics sfw: %v", err)
+	steps := []struct {
+		source, category string
+		fetch            func() (int, error)
+	}{
+		{"waifu.im", "sfw", func() (int, error) { return ing.ingestWaifuIm(ctx, "sfw") }},
+		{"waifu.im", "nsfw", func() (int, error) { return ing.ingestWaifuIm(ctx, "nsfw") }},
+		{"waifu.pics", "sfw", func() (int, error) { return ing.ingestWaifuPics(ctx, ing.waifuPicsSFWURL, "sfw") }},
+		{"waifu.pics", "nsfw", func() (int, error) { return ing.ingestWaifuPics(ctx, ing.waifuPicsNSFWURL, "nsfw") }},
+		{"nekos.best", "sfw", func() (int, error) { return ing.ingestNekosBest(ctx) }},
 	}
-	total += n
+	for _, step := range steps {
+		n, err := step.fetch()
+		sr := SourceResult{Source: step.source, Category: step.category, New: n}
+		if err != nil {
+			slog.Warn("ingest: source failed", "source", step.source, "category", step.category, "count", n, "err", err)
+			sr.Error = err.Error()
+		}
+		res.New += n
+		res.Sources = append(res.Sources, sr)
+		ing.publish("source_progress", sr)
+
+		if ctx.Err() != nil {
+			// Only our own deadline counts as a timeout, not shutdown.
+			res.TimedOut = parent.Err() == nil
+			res.Canceled = !res.TimedOut
+			break
+		}
+	}
+
+	res.Duration = time.Since(res.Started)
+	ing.recordRun(res)
+	ing.publish("cycle_complete", res)
+	return res, nil
+}
 
-	// Fetch NSFW from waifu.pics
-	n, err = ing.ingestWaifuPics(ctx, waifuPicsNSFWURL, "nsfw")
+// atTarget reports whether the catalog holds at least the target count,
+// logging when that changes between cycles.
+func (ing *Ingester) atTarget() (bool, error) {
+	if ing.targetCount <= 0 {
+		return false, nil
+	}
+	n, err := ing.cat.Count()
 	if err != nil {
-		log.Printf("ingest: waifu.pics nsfw: %v", err)
+		return false, fmt.Errorf("ingest: count: %w", err)
+	}
+	full := n >= ing.targetCount
+	if ing.full.Swap(full) != full {
+		if full {
+			slog.Info("ingest: catalog at target; pausing ingest", "count", n, "target", ing.targetCount)
+		} else {
+			slog.Info("ingest: catalog below target; resuming ingest", "count", n, "target", ing.targetCount)
+		}
+	}
+	return full, nil
+}
+
+// recordRun writes the cycle to the catalog's audit table. Failing to do so
+// is logged but does not fail the cycle.
+func (ing *Ingester) recordRun(res *RunResult) {
+	run := &catalog.Run{
+		Started:  res.Started,
+		Duration: res.Duration,
+		New:      res.New,
+		TimedOut: res.TimedOut,
+		Canceled: res.Canceled,
+	}
+	for _, sr := range res.Sources {
+		if sr.Error != "" {
+			run.Errors++
+		}
+	}
+	run.Sources, _ = json.Marshal(res.Sources)
+	if _, err := ing.cat.InsertRun(run); err != nil {
+		slog.Error("ingest: record run", "err", err)
+	}
+}
+
+// publish sends an ingest lifecycle event if an event bus is configured.
+func (ing *Ingester) publish(typ string, data any) {
+	if ing.events != nil {
+		ing.events.Publish(events.TopicIngest, typ, data)
 	}
-	total += n
+}
 
-	return total, nil
+// imageDone logs a failure and publishes the per-image result of
+// processImage.
+func (ing *Ingester) imageDone(source, category, url string, n int, err error) {
+	r := ImageResult{Source: source, Category: category, URL: url, Stored: n > 0}
+	if err != nil {
+		r.Error = err.Error()
+		slog.Warn("ingest: process image", "source", source, "category", category, "url", url, "err", err)
+	}
+	ing.publish("image_result", r)
 }
 
 // waifuImResponse matches the waifu.im /images API response.
 type waifuImResponse struct {
-	Items []struct {
-		URL    string `json:"url"`
-		Width  int    `json:"width"`
-		Height int    `json:"height"`
-	} `json:"items"`
+	Items []waifuImItem `json:"items"`
+}
+
+// waifuImItem is one image of a waifu.im response.
+type waifuImItem struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Tags   []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+// tagNames returns the item's tag names, lowercased, without blanks.
+func (it *waifuImItem) tagNames() []string {
+	var names []string
+	for _, t := range it.Tags {
+		if name := strings.ToLower(strings.TrimSpace(t.Name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
+// ingestWaifuIm fetches up to waifuImPages pages of category, continuing
+// from the catalog cursor "waifu.im:<category>" (see ingestPages).
 func (ing *Ingester) ingestWaifuIm(ctx context.Context, category string) (int, error) {
 	isNSFW := "false"
 	if category == "nsfw" {
 		isNSFW = "true"
 	}
+	return ing.ingestPages("waifu.im:"+category, ing.waifuImPages, func(page int) (int, bool, error) {
+		// Rate limit API calls.
+		if err := ing.waifuImLimiter.Wait(ctx); err != nil {
+			return 0, false, err
+		}
 
+		url := fmt.Sprintf("%s?included_tags=waifu&is_nsfw=%s&page_size=%d&page=%d",
+			ing.waifuImURL, isNSFW, waifuImPageSize, page)
+		body, err := ing.fetchWithRetry(ctx, http.MethodGet, url, nil, "waifu.im", ing.waifuImLimiter)
+		if err != nil {
+			return 0, false, err
+		}
+
+		var result waifuImResponse
+		if err := json.Unmarshal(body, &result); err != nil {
+			return 0, false, err
+		}
+
+		var count int
+		for _, img := range result.Items {
+			if ctx.Err() != nil {
+				return count, false, ctx.Err()
+			}
+			n, err := ing.processImage(ctx, img.URL, "waifu.im", category, img.Width, img.Height, img.tagNames())
+			ing.imageDone("waifu.im", category, img.URL, n, err)
+			if err != nil {
+				continue
+			}
+			count += n
+		}
+		// A short page means there are no more results.
+		return count, len(result.Items) == waifuImPageSize, nil
+	})
+}
+
+// waifuPicsResponse matches the waifu.pics /many endpoint.
+type waifuPicsResponse struct {
+	Files []string `json:"files"`
+}
+
+func (ing *Ingester) ingestWaifuPics(ctx context.Context, apiURL, category string) (int, error) {
 	// Rate limit API calls.
-	if err := ing.waifuImLimiter.Wait(ctx); err != nil {
+	if err := ing.waifuPicsLimiter.Wait(ctx); err != nil {
 		return 0, err
 	}
 
-	url := fmt.Sprintf("%s?included_tags=waifu&is_nsfw=%s&page_size=30", waifuImSearchURL, isNSFW)
-	body, err := ing.fetchWithRetry(ctx, http.MethodGet, url, nil, "waifu.im", ing.waifuImLimiter)
+	reqBody := []byte(`{"exclude":[]}`)
+	body, err := ing.fetchWithRetry(ctx, http.MethodPost, apiURL, reqBody, "waifu.pics", ing.waifuPicsLimiter)
 	if err != nil {
 		return 0, err
 	}
 
-	var result waifuImResponse
+	var result waifuPicsResponse
 	if err := json.Unmarshal(body, &result); err != nil {
 		return 0, err
 	}
 
 	var count int
-	for _, img := range result.Items {
-		n, err := ing.processImage(ctx, img.URL, "waifu.im", category, img.Width, img.Height)
+	for _, url := range result.Files {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		n, err := ing.processImage(ctx, url, "waifu.pics", category, 0, 0, nil)
+		ing.imageDone("waifu.pics", category, url, n, err)
 		if err != nil {
-			log.Printf("ingest: process %s: %v", img.URL, err)
 			continue
 		}
 		count += n
@@ -137,33 +534,39 @@ func (ing *Ingester) ingestWaifuIm(ctx context.Context, category string) (int, e
 	return count, nil
 }
 
-// waifuPicsResponse matches the waifu.pics /many endpoint.
-type waifuPicsResponse struct {
-	Files []string `json:"files"`
+// nekosBestResponse matches the nekos.best /api/v2/<category> endpoint.
+type nekosBestResponse struct {
+	Results []struct {
+		URL string `json:"url"`
+	} `json:"results"`
 }
 
-func (ing *Ingester) ingestWaifuPics(ctx context.Context, apiURL, category string) (int, error) {
+// ingestNekosBest stores a batch of nekos.best waifu images. The API serves
+// only sfw images.
+func (ing *Ingester) ingestNekosBest(ctx context.Context) (int, error) {
 	// Rate limit API calls.
-	if err := ing.waifuPicsLimiter.Wait(ctx); err != nil {
+	if err := ing.nekosBestLimiter.Wait(ctx); err != nil {
 		return 0, err
 	}
 
-	reqBody := []byte(`{"exclude":[]}`)
-	body, err := ing.fetchWithRetry(ctx, http.MethodPost, apiURL, reqBody, "waifu.pics", ing.waifuPicsLimiter)
+	body, err := ing.fetchWithRetry(ctx, http.MethodGet, ing.nekosBestURL, nil, "nekos.best", ing.nekosBestLimiter)
 	if err != nil {
 		return 0, err
 	}
 
-	var result waifuPicsResponse
+	var result nekosBestResponse
 	if err := json.Unmarshal(body, &result); err != nil {
 		return 0, err
 	}
 
 	var count int
-	for _, url := range result.Files {
-		n, err := ing.processImage(ctx, url, "waifu.pics", category, 0, 0)
+	for _, r := range result.Results {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		n, err := ing.processImage(ctx, r.URL, "nekos.best", "sfw", 0, 0, nil)
+		ing.imageDone("nekos.best", "sfw", r.URL, n, err)
 		if err != nil {
-			log.Printf("ingest: process %s: %v", url, err)
 			continue
 		}
 		count += n
@@ -171,119 +574,250 @@ func (ing *Ingester) ingestWaifuPics(ctx context.Context, apiURL, category strin
 	return count, nil
 }
 
-// processImage downloads, deduplicates, optimizes, and stores a single image.
-// Returns 1 if the image was new and stored, 0 if duplicate.
-func (ing *Ingester) processImage(ctx context.Context, srcURL, source, category string, origW, origH int) (int, error) {
-	// Rate limit downloads.
-	if err := ing.downloadLimiter.Wait(ctx); err != nil {
+// processImage downloads, deduplicates, optimizes, and stores a single image
+// along with its upstream tags. Returns 1 if the image was new and stored, 0
+// if duplicate.
+func (ing *Ingester) processImage(ctx context.Context, srcURL, source, category string, origW, origH int, tags []string) (int, error) {
+	// Skip URLs already delivered, before spending a download on them.
+	seen, err := ing.seenURL(srcURL, source)
+	if err != nil {
 		return 0, err
 	}
+	if seen {
+		return 0, nil
+	}
 
-	// Download with retry.
-	data, err := ing.downloadImage(ctx, srcURL)
+	// Download with retry, rate limited per source.
+	data, err := ing.downloadImage(ctx, srcURL, ing.downloadLimiterFor(source))
 	if err != nil {
 		return 0, err
 	}
+	// From here on ctx is not consulted, so a cancellation arriving now
+	// does not throw away a completed download.
+
+	// Upstreams sometimes answer 200 with an HTML or JSON error page.
+	if err := checkImageBytes(data); err != nil {
+		return 0, err
+	}
 
 	// Content hash for dedup.
-	hash := contentHash(data)
+	hash := contentHash(ing.hashAlgo, data)
 
 	exists, err := ing.cat.HasHash(hash)
 	if err != nil {
 		return 0, err
 	}
 	if exists {
-		return 0, nil // Already have this image.
+		// Already have this image; remember the URL so the next delivery
+		// is skipped without downloading it.
+		if err := ing.cat.RecordSourceURL(srcURL, source, hash); err != nil {
+			return 0, err
+		}
+		return 0, nil
 	}
 
-	// Optimize for terminal rendering.
-	optimized, w, h, err := optimize.ForTerminal(data, 480)
-	if err != nil {
-		// If optimization fails, use original data.
-		optimized = data
-		w, h = origW, origH
+	// Blurhash placeholder, from the full-size image so it matches what
+	// upstream serves whatever we store.
+	var blurhash string
+	if orig, _, err := optimize.Decode(data); err == nil {
+		blurhash, _ = optimize.Blurhash(orig)
+	}
+
+	// Optimize for terminal rendering, but keep the original whenever
+	// re-encoding would not make it smaller (tiny avatars, line art).
+	stored, format := data, optimize.Sniff(data)
+	w, h := origW, origH
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		w, h = cfg.Width, cfg.Height
+	}
+	// A JPEG stored sideways with an EXIF orientation is always
+	// re-encoded upright, as not every client honors the tag.
+	orientation := optimize.Orientation(data)
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	srcW, srcH := w, h // kept as the original size whatever is stored
+	settings := optimize.DefaultSettings
+	settings.Quality = ing.quality
+	optimized, ow, oh, err := optimize.ForTerminalWith(data, optimize.DefaultMaxWidth, settings)
+	if err == nil && (len(optimized) < len(data) || format == "" || orientation != 1) {
+		stored, format, w, h = optimized, optimize.OutputFormat(), ow, oh
+	}
+	if format == "" {
+		return 0, fmt.Errorf("unrecognized image format")
+	}
+
+	// Perceptual hash to catch near duplicates the content hash misses, and
+	// the dominant color of what is served, for /api/random?near_color=.
+	var phash *uint64
+	var dominant string
+	if img, _, err := optimize.Decode(stored); err == nil {
+		h := optimize.DHash(img)
+		phash = &h
+		dominant = optimize.HexColor(optimize.DominantColor(img))
+	}
+	if phash != nil && ing.nearDupDistance >= 0 {
+		similar, err := ing.cat.HasSimilar(*phash, ing.nearDupDistance)
+		if err != nil {
+			return 0, err
+		}
+		if similar {
+			return 0, nil // Near duplicate of an image we have.
+		}
 	}
 
 	// Write to disk.
-	filename := hash + ".webp"
+	filename := ing.layout.Filename(hash, extFor(format))
 	path := filepath.Join(ing.imgDir, filename)
-	if err := os.WriteFile(path, optimized, 0o644); err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, fmt.Errorf("write image: %w", err)
+	}
+	if err := os.WriteFile(path, stored, 0o644); err != nil {
 		return 0, fmt.Errorf("write image: %w", err)
 	}
 
 	// Insert into catalog.
 	img := &catalog.Image{
-		Hash:      hash,
-		Source:    source,
-		SourceURL: srcURL,
-		Category:  category,
-		Width:     w,
-		Height:    h,
-		Format:    "webp",
-		SizeBytes: int64(len(optimized)),
-		Filename:  filename,
-	}
-	if _, err := ing.cat.Insert(img); err != nil {
+		Hash:          hash,
+		Source:        source,
+		SourceURL:     srcURL,
+		Category:      category,
+		Width:         w,
+		Height:        h,
+		OrigWidth:     srcW,
+		OrigHeight:    srcH,
+		Format:        format,
+		SizeBytes:     int64(len(stored)),
+		Filename:      filename,
+		DominantColor: dominant,
+		Blurhash:      blurhash,
+		PHash:         phash,
+		Tags:          tags,
+	}
+	id, err := ing.cat.Insert(img)
+	if err != nil {
 		os.Remove(path) // Clean up on catalog failure.
 		return 0, err
 	}
 
+	if ing.events != nil {
+		img.ID = id
+		img.CreatedAt = time.Now().UTC()
+		ing.events.Publish(events.TopicImages, "image", img)
+	}
+
 	return 1, nil
 }
 
-// downloadImage fetches an image with retry and backoff.
-func (ing *Ingester) downloadImage(ctx context.Context, srcURL string) ([]byte, error) {
+// errNotImage is returned for downloads that are not image data.
+var errNotImage = errors.New("not an image")
+
+// checkImageBytes rejects data whose leading bytes identify it as something
+// other than an image, such as an error page. Data no sniffer recognizes
+// (HEIC, say) passes, and is left for decoding to judge.
+func checkImageBytes(data []byte) error {
+	if optimize.Sniff(data) != "" {
+		return nil
+	}
+	ct := http.DetectContentType(data)
+	if strings.HasPrefix(ct, "image/") || ct == "application/octet-stream" {
+		return nil
+	}
+	return fmt.Errorf("%w: got %s", errNotImage, ct)
+}
+
+// extFor returns the file extension used for a stored image format.
+func extFor(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// downloadImage fetches an image with retry and backoff, each attempt
+// waiting for the rate limit lim.
+func (ing *Ingester) downloadImage(ctx context.Context, srcURL string, lim *adaptiveLimiter) ([]byte, error) {
 	var lastErr error
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			backoff := backoffDuration(attempt)
+			backoff := ing.backoffDuration(attempt)
+			var te *throttledError
+			if errors.As(lastErr, &te) {
+				backoff = max(backoff, te.after)
+			}
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
 			case <-time.After(backoff):
 			}
+			lim.retried()
 		}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srcURL, nil)
-		if err != nil {
+		data, retry, err := ing.downloadAttempt(ctx, srcURL, lim)
+		if err == nil {
+			return data, nil
+		}
+		if !retry {
 			return nil, err
 		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
+}
 
-		resp, err := ing.hc.Do(req)
-		if err != nil {
-			lastErr = err
-			continue
-		}
+// downloadAttempt makes one download request. retry reports whether a
+// failure is worth retrying.
+func (ing *Ingester) downloadAttempt(ctx context.Context, srcURL string, lim *adaptiveLimiter) (data []byte, retry bool, err error) {
+	resp, retry, err := ing.fetchImage(ctx, srcURL, lim, nil)
+	if err != nil {
+		return nil, retry, err
+	}
+	defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
-			resp.Body.Close()
-			lastErr = fmt.Errorf("download %d", resp.StatusCode)
-			continue
-		}
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return nil, fmt.Errorf("download %d", resp.StatusCode)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, true, &throttledError{
+			msg:   fmt.Sprintf("download %d", resp.StatusCode),
+			after: retryAfter(resp.Header, time.Now()),
 		}
+	}
+	if resp.StatusCode >= 500 {
+		return nil, true, fmt.Errorf("download %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("download %d", resp.StatusCode)
+	}
 
-		data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
-		resp.Body.Close()
-		if err != nil {
-			lastErr = err
-			continue
-		}
-		return data, nil
+	// Refuse an announced oversize body before reading any of it, and read
+	// one byte past the limit to catch the rest, rather than storing a
+	// truncated image.
+	limit := ing.maxImageBytes
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, false, fmt.Errorf("%w: %d bytes, limit %d", errImageTooLarge, resp.ContentLength, limit)
 	}
-	return nil, fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
+	var body io.Reader = resp.Body
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	data, err = io.ReadAll(body)
+	if err != nil {
+		return nil, true, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, false, fmt.Errorf("%w: over %d bytes", errImageTooLarge, limit)
+	}
+	return data, false, nil
 }
 
 // fetchWithRetry performs an HTTP request with exponential backoff retry
 // for transient errors (429, 5xx) and rate limiting.
-func (ing *Ingester) fetchWithRetry(ctx context.Context, method, url string, reqBody []byte, source string, limiter *rate.Limiter) ([]byte, error) {
+func (ing *Ingester) fetchWithRetry(ctx context.Context, method, url string, reqBody []byte, source string, limiter *adaptiveLimiter) ([]byte, error) {
 	var lastErr error
+	var hint time.Duration // Retry-After of the last 429
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			backoff := backoffDuration(attempt)
-			log.Printf("ingest: %s retry %d after %v", source, attempt, backoff)
+			backoff := max(ing.backoffDuration(attempt), hint)
+			slog.Info("ingest: retry", "source", source, "attempt", attempt, "backoff", backoff)
+			limiter.retried()
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
@@ -316,7 +850,12 @@ func (ing *Ingester) fetchWithRetry(ctx context.Context, method, url string, req
 
 		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
 		resp.Body.Close()
+		limiter.observe(resp.StatusCode == http.StatusTooManyRequests)
 
+		hint = 0
+		if resp.StatusCode == http.StatusTooManyRequests {
+			hint = retryAfter(resp.Header, time.Now())
+		}
 		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
 			lastErr = fmt.Errorf("%s returned %d", source, resp.StatusCode)
 			continue
@@ -335,13 +874,36 @@ func (ing *Ingester) fetchWithRetry(ctx context.Context, method, url string, req
 }
 
 // backoffDuration returns exponential backoff with jitter.
-func backoffDuration(attempt int) time.Duration {
+func (ing *Ingester) backoffDuration(attempt int) time.Duration {
 	base := time.Duration(1<<uint(attempt)) * time.Second // 1s, 2s, 4s
-	jitter := time.Duration(rand.Int63n(int64(base / 2)))
+	ing.rngMu.Lock()
+	jitter := time.Duration(ing.rng.Int63n(int64(base / 2)))
+	ing.rngMu.Unlock()
 	return base + jitter
 }
 
-func contentHash(data []byte) string {
-	h := sha256.Sum256(data)
-	return hex.EncodeToString(h[:16])
+// throttledError is a 429 response, carrying the Retry-After delay the
+// server asked for (0 if none).
+type throttledError struct {
+	msg   string
+	after time.Duration
+}
+
+func (e *throttledError) Error() string { return e.msg }
+
+// retryAfter parses a Retry-After header in either its delay-seconds or
+// HTTP-date form, relative to now, capped at maxRetryAfter. Missing,
+// malformed or past values yield 0.
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	return min(max(d, 0), maxRetryAfter)
 }
@@ -0,0 +1,1215 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+	"golang.org/x/time/rate"
+)
+
+func testSetup(t *testing.T) (*catalog.DB, string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := catalog.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("open catalog: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	imgDir := filepath.Join(dir, "images")
+	os.MkdirAll(imgDir, 0o755)
+	return db, imgDir
+}
+
+// newTestIngester returns an Ingester that may download from the local
+// httptest servers.
+func newTestIngester(db *catalog.DB, imgDir string, opts ...Option) *Ingester {
+	return New(db, imgDir, append([]Option{WithAllowedHosts(nil), WithPrivateNetworks(true)}, opts...)...)
+}
+
+// serveBytes starts an upstream that answers every request with data.
+func serveBytes(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// smoothImage returns a size x size grayscale image of random smooth waves.
+// Images from different seeds are neither exact nor near duplicates of each
+// other.
+func smoothImage(seed int64, size int) image.Image {
+	rng := rand.New(rand.NewSource(seed))
+	a, b := 1+rng.Float64()*3, 1+rng.Float64()*3
+	p, q := rng.Float64()*6, rng.Float64()*6
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			fx, fy := float64(x)/float64(size), float64(y)/float64(size)
+			img.Pix[y*size+x] = uint8(128 + 60*math.Sin(a*fx*6+p) + 60*math.Cos(b*fy*6+q+fx*3))
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessImage_KeepsSmallerOriginal(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := newTestIngester(db, imgDir)
+
+	// A two-colour dither compresses far better as PNG than as lossy WebP.
+	pal := image.NewPaletted(image.Rect(0, 0, 32, 32), color.Palette{color.Black, color.White})
+	for i := range pal.Pix {
+		pal.Pix[i] = uint8((i*7 + i/3) % 5 % 2)
+	}
+	data := encodePNG(t, pal)
+	srv := serveBytes(t, data)
+
+	n, err := ing.processImage(context.Background(), srv.URL+"/tiny.png", "test", "sfw", 0, 0, nil)
+	if err != nil || n != 1 {
+		t.Fatalf("processImage = %d, %v", n, err)
+	}
+
+	img, err := db.Random("sfw")
+	if err != nil {
+		t.Fatalf("Random: %v", err)
+	}
+	if img.Format != "png" || filepath.Ext(img.Filename) != ".png" {
+		t.Errorf("stored as %s (%s), want png", img.Format, img.Filename)
+	}
+	if img.Width != 32 || img.Height != 32 || img.SizeBytes != int64(len(data)) {
+		t.Errorf("got %dx%d %d bytes, want 32x32 %d bytes", img.Width, img.Height, img.SizeBytes, len(data))
+	}
+	stored, err := os.ReadFile(filepath.Join(imgDir, img.Filename))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Errorf("stored file differs from original (err %v)", err)
+	}
+}
+
+func TestProcessImage_ShardedLayout(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := newTestIngester(db, imgDir, WithLayout(maintenance.LayoutSharded))
+	srv := serveBytes(t, encodePNG(t, smoothImage(1, 64)))
+
+	if n, err := ing.processImage(context.Background(), srv.URL+"/a.png", "test", "sfw", 0, 0, nil); err != nil || n != 1 {
+		t.Fatalf("processImage = %d, %v", n, err)
+	}
+	img, err := db.Random("sfw")
+	if err != nil {
+		t.Fatalf("Random: %v", err)
+	}
+	if want := img.Hash[:2] + "/" + img.Hash + filepath.Ext(img.Filename); img.Filename != want {
+		t.Fatalf("filename = %q, want %q", img.Filename, want)
+	}
+	stored, err := os.ReadFile(filepath.Join(imgDir, img.Hash[:2], filepath.Base(img.Filename)))
+	if err != nil || int64(len(stored)) != img.SizeBytes {
+		t.Fatalf("stored file: %d bytes, %v; want %d", len(stored), err, img.SizeBytes)
+	}
+
+	// The maintenance passes read it back where it was written.
+	report, err := maintenance.Fsck(db, imgDir, false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("fsck problems = %+v", report.Problems)
+	}
+}
+
+func TestProcessImage_OptimizesLargeImage(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := newTestIngester(db, imgDir)
+
+	rgba := image.NewRGBA(image.Rect(0, 0, 960, 640))
+	for y := 0; y < 640; y++ {
+		for x := 0; x < 960; x++ {
+			rgba.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	srv := serveBytes(t, encodePNG(t, rgba))
+
+	if _, err := ing.processImage(context.Background(), srv.URL+"/big.png", "test", "sfw", 0, 0, nil); err != nil {
+		t.Fatalf("processImage: %v", err)
+	}
+	img, err := db.Random("sfw")
+	if err != nil {
+		t.Fatalf("Random: %v", err)
+	}
+	if img.Format != "webp" || filepath.Ext(img.Filename) != ".webp" {
+		t.Errorf("stored as %s (%s), want webp", img.Format, img.Filename)
+	}
+	if img.Width != 480 || img.Height != 320 {
+		t.Errorf("got %dx%d, want 480x320", img.Width, img.Height)
+	}
+	if img.OrigWidth != 960 || img.OrigHeight != 640 {
+		t.Errorf("original size %dx%d, want 960x640", img.OrigWidth, img.OrigHeight)
+	}
+}
+
+func TestProcessImage_RejectsUnrecognizedData(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := newTestIngester(db, imgDir)
+	srv := serveBytes(t, []byte("<html>not an image</html>"))
+
+	if _, err := ing.processImage(context.Background(), srv.URL+"/x", "test", "sfw", 0, 0, nil); err == nil {
+		t.Fatal("expected error for non-image data")
+	}
+	if n, _ := db.Count(); n != 0 {
+		t.Errorf("catalog has %d rows, want 0", n)
+	}
+}
+
+func TestIngestWaifuIm_Pagination(t *testing.T) {
+	db, imgDir := testSetup(t)
+	img := encodePNG(t, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+
+	var pages []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/img.png" {
+			w.Write(img)
+			return
+		}
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		n := waifuImPageSize
+		if page == "2" {
+			n = 5 // short page: end of results
+		}
+		var resp waifuImResponse
+		resp.Items = make([]waifuImItem, n)
+		for i := range resp.Items {
+			resp.Items[i].URL = srv.URL + "/img.png"
+			json.Unmarshal([]byte(`[{"name":" Maid "},{"name":"uniform"},{"name":""}]`), &resp.Items[i].Tags)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := newTestIngester(db, imgDir, WithWaifuImPages(5))
+	ing.waifuImURL = srv.URL + "/images"
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+
+	n, err := ing.ingestWaifuIm(context.Background(), "sfw")
+	if err != nil {
+		t.Fatalf("ingestWaifuIm: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("stored %d images, want 1 (all items share one image)", n)
+	}
+	if strings.Join(pages, ",") != "1,2" {
+		t.Errorf("fetched pages %v, want [1 2]", pages)
+	}
+	if c, _ := db.GetCursor("waifu.im:sfw"); c != 0 {
+		t.Errorf("cursor after the last page = %d, want 0", c)
+	}
+	for _, tag := range []string{"maid", "uniform"} {
+		if ok, err := db.TagExists(tag); err != nil || !ok {
+			t.Errorf("TagExists(%q) = %v, %v; want the upstream tag stored", tag, ok, err)
+		}
+	}
+}
+
+func TestIngestWaifuIm_Cursor(t *testing.T) {
+	db, imgDir := testSetup(t)
+	img := encodePNG(t, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+
+	var pages []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/img.png" {
+			w.Write(img)
+			return
+		}
+		pages = append(pages, r.URL.Query().Get("page"))
+		var resp waifuImResponse
+		resp.Items = make([]waifuImItem, waifuImPageSize) // every page is full
+		for i := range resp.Items {
+			resp.Items[i].URL = srv.URL + "/img.png"
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := newTestIngester(db, imgDir)
+	ing.waifuImURL = srv.URL + "/images"
+	ing.waifuImLimiter = newAdaptiveLimiter("waifu.im", rate.Inf, 1)
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+
+	// Page 1 stores the image; pages 2-4 only repeat it, so after
+	// staleWrapAfter of them the cursor starts over.
+	wantCursor := []int{1, 2, 3, 0, 1}
+	for i, want := range wantCursor {
+		if _, err := ing.ingestWaifuIm(context.Background(), "sfw"); err != nil {
+			t.Fatalf("cycle %d: %v", i+1, err)
+		}
+		if got, err := db.GetCursor("waifu.im:sfw"); err != nil || got != want {
+			t.Errorf("cycle %d: cursor = %d, %v; want %d", i+1, got, err, want)
+		}
+	}
+	if got := strings.Join(pages, ","); got != "1,2,3,4,1" {
+		t.Errorf("fetched pages %s, want 1,2,3,4,1", got)
+	}
+	if got, _ := db.GetCursor("waifu.im:nsfw"); got != 0 {
+		t.Errorf("nsfw cursor = %d, want 0; categories page separately", got)
+	}
+}
+
+func TestIngestPages(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := newTestIngester(db, imgDir)
+
+	// A stub upstream of 5 pages, each with one new image, failing page 4
+	// once.
+	var fetched []int
+	failed := false
+	stub := func(page int) (int, bool, error) {
+		fetched = append(fetched, page)
+		if page == 4 && !failed {
+			failed = true
+			return 0, false, errors.New("upstream down")
+		}
+		return 1, page < 5, nil
+	}
+
+	cycles := []struct {
+		new, cursor int
+		err         bool
+	}{
+		{new: 2, cursor: 2},            // pages 1-2
+		{new: 1, cursor: 3, err: true}, // page 3, then 4 fails
+		{new: 2, cursor: 0},            // pages 4-5, the last
+		{new: 2, cursor: 2},            // from the start again
+	}
+	for i, c := range cycles {
+		n, err := ing.ingestPages("stub", 2, stub)
+		if n != c.new || (err != nil) != c.err {
+			t.Errorf("cycle %d: ingestPages = %d, %v; want %d new, error %v", i+1, n, err, c.new, c.err)
+		}
+		if got, _ := db.GetCursor("stub"); got != c.cursor {
+			t.Errorf("cycle %d: cursor = %d, want %d", i+1, got, c.cursor)
+		}
+	}
+	if want := []int{1, 2, 3, 4, 4, 5, 1, 2}; !slices.Equal(fetched, want) {
+		t.Errorf("fetched pages %v, want %v", fetched, want)
+	}
+}
+
+func TestRun_NekosBest(t *testing.T) {
+	db, imgDir := testSetup(t)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nekos":
+			var resp nekosBestResponse
+			for _, name := range []string{"1", "2"} {
+				resp.Results = append(resp.Results, struct {
+					URL string `json:"url"`
+				}{srv.URL + "/img/" + name})
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/img/1", "/img/2":
+			w.Write(encodePNG(t, smoothImage(int64(r.URL.Path[len(r.URL.Path)-1]), 16)))
+		default:
+			http.NotFound(w, r) // the other upstreams are down
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := newTestIngester(db, imgDir)
+	ing.waifuImURL = srv.URL + "/down"
+	ing.waifuPicsSFWURL = srv.URL + "/down"
+	ing.waifuPicsNSFWURL = srv.URL + "/down"
+	ing.nekosBestURL = srv.URL + "/nekos"
+	ing.waifuImLimiter = newAdaptiveLimiter("waifu.im", rate.Inf, 1)
+	ing.waifuPicsLimiter = newAdaptiveLimiter("waifu.pics", rate.Inf, 1)
+	ing.nekosBestLimiter = newAdaptiveLimiter("nekos.best", rate.Inf, 1)
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+
+	res, err := ing.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.New != 2 || len(res.Sources) != 5 {
+		t.Fatalf("result = %+v, want 2 new from 5 sources", res)
+	}
+	for _, sr := range res.Sources {
+		if got := sr.Error == ""; got != (sr.Source == "nekos.best") {
+			t.Errorf("source %s %s: error %q", sr.Source, sr.Category, sr.Error)
+		}
+	}
+	img, err := db.Random("sfw")
+	if err != nil || img.Source != "nekos.best" {
+		t.Errorf("stored image = %+v, %v; want source nekos.best", img, err)
+	}
+}
+
+func TestRun_CycleTimeout(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	// An upstream that hangs until the client gives up.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := New(db, imgDir, WithCycleTimeout(200*time.Millisecond))
+	ing.waifuImURL = srv.URL
+	ing.waifuPicsSFWURL = srv.URL
+	ing.waifuPicsNSFWURL = srv.URL
+	ing.nekosBestURL = srv.URL
+
+	start := time.Now()
+	res, err := ing.Run(context.Background())
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("Run took %v, want about the 200ms timeout", elapsed)
+	}
+	if !res.TimedOut {
+		t.Error("TimedOut = false, want true")
+	}
+	if len(res.Sources) != 1 || res.Sources[0].Error == "" {
+		t.Errorf("sources = %+v, want one failed source before stopping", res.Sources)
+	}
+
+	runs, err := db.Runs(10)
+	if err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	if len(runs) != 1 || !runs[0].TimedOut || runs[0].Errors != 1 {
+		t.Errorf("recorded runs = %+v, want one timed-out run with 1 error", runs)
+	}
+}
+
+func TestRun_SkipsAtTargetCount(t *testing.T) {
+	db, imgDir := testSetup(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := New(db, imgDir, WithTargetCount(2))
+	ing.waifuImURL = srv.URL
+	ing.waifuPicsSFWURL = srv.URL
+	ing.waifuPicsNSFWURL = srv.URL
+	ing.waifuImLimiter = newAdaptiveLimiter("waifu.im", rate.Inf, 1)
+	ing.waifuPicsLimiter = newAdaptiveLimiter("waifu.pics", rate.Inf, 1)
+	ing.nekosBestURL = srv.URL
+	ing.nekosBestLimiter = newAdaptiveLimiter("nekos.best", rate.Inf, 1)
+	for _, h := range []string{"a", "b"} {
+		db.Insert(&catalog.Image{Hash: h, Source: "test", SourceURL: "u", Category: "sfw", Filename: h + ".webp"})
+	}
+
+	res, err := ing.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !res.Skipped || calls.Load() != 0 {
+		t.Fatalf("at target: skipped = %v after %d upstream calls, want skipped with none", res.Skipped, calls.Load())
+	}
+	if runs, _ := db.Runs(10); len(runs) != 0 {
+		t.Errorf("skipped cycle recorded %d runs, want 0", len(runs))
+	}
+
+	// Eviction brings the count back below the target.
+	db.DeleteByHash("a")
+	res, err = ing.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Skipped || calls.Load() == 0 {
+		t.Errorf("below target: skipped = %v after %d upstream calls, want a full cycle", res.Skipped, calls.Load())
+	}
+}
+
+func TestAdaptiveLimiter_BacksOffOn429(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := New(db, imgDir)
+	l := ing.waifuImLimiter
+
+	// An isolated 429, even as the very first response, leaves the rate
+	// alone.
+	l.observe(true)
+	if got := l.Limit(); got != l.base {
+		t.Fatalf("rate after a first 429 = %v, want base %v", got, l.base)
+	}
+	for i := 0; i < 9; i++ {
+		l.observe(false)
+	}
+	if got := l.Limit(); got != l.base {
+		t.Fatalf("rate after one 429 in 10 = %v, want base %v", got, l.base)
+	}
+
+	// A burst of 429s drives the rate down to the floor.
+	for i := 0; i < 10; i++ {
+		l.observe(true)
+	}
+	low := l.Limit()
+	if low >= l.base/4 {
+		t.Fatalf("rate after 429 burst = %v, want well below %v", low, l.base)
+	}
+	if want := l.base * minRateFraction; low < want {
+		t.Errorf("rate %v fell below floor %v", low, want)
+	}
+
+	var st SourceStatus
+	for _, s := range ing.Sources() {
+		if s.Name == "waifu.im" {
+			st = s
+		}
+	}
+	if st.Rate != float64(low) || st.BaseRate != 5 || st.Throttled != 11 || st.ThrottleRatio < 0.5 {
+		t.Errorf("status = %+v", st)
+	}
+
+	// Successes restore it gradually, never beyond the base.
+	l.observe(false)
+	if got := l.Limit(); got <= low || got >= l.base {
+		t.Errorf("rate after one success = %v, want between %v and %v", got, low, l.base)
+	}
+	for i := 0; i < 20; i++ {
+		l.observe(false)
+	}
+	if got := l.Limit(); got != l.base {
+		t.Errorf("rate after recovery = %v, want %v", got, l.base)
+	}
+}
+
+func TestBackoffDuration_FixedSeed(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := New(db, imgDir, WithRand(rand.New(rand.NewSource(42))))
+
+	want := []struct {
+		attempt int
+		d       time.Duration
+	}{
+		{1, 2231278675 * time.Nanosecond},
+		{1, 2543856411 * time.Nanosecond},
+		{2, 4101878760 * time.Nanosecond},
+		{2, 4526624009 * time.Nanosecond},
+	}
+	for i, w := range want {
+		if got := ing.backoffDuration(w.attempt); got != w.d {
+			t.Errorf("call %d: backoffDuration(%d) = %v, want %v", i, w.attempt, got, w.d)
+		}
+	}
+}
+
+func TestDownloadRates(t *testing.T) {
+	rates, err := ParseDownloadRates(" waifu.pics=2.5, manual=1 ")
+	if err != nil || len(rates) != 2 || rates["waifu.pics"] != 2.5 || rates["manual"] != 1 {
+		t.Fatalf("ParseDownloadRates = %v, %v", rates, err)
+	}
+	for _, bad := range []string{"waifu.pics", "=2", "manual=0", "manual=fast"} {
+		if _, err := ParseDownloadRates(bad); err == nil {
+			t.Errorf("ParseDownloadRates(%q) succeeded, want error", bad)
+		}
+	}
+
+	db, imgDir := testSetup(t)
+	srv := serveBytes(t, encodePNG(t, smoothImage(1, 16)))
+	ing := newTestIngester(db, imgDir, WithDownloadRates(map[string]float64{"manual": 1000}))
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+
+	// A configured source gets its own limiter; others share the default.
+	if _, err := ing.processImage(context.Background(), srv.URL+"/a.png", "manual", "sfw", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ing.processImage(context.Background(), srv.URL+"/b.png", "waifu.pics", "sfw", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	requests := map[string]int64{}
+	for _, st := range ing.Sources() {
+		requests[st.Name] = st.Requests
+	}
+	if requests["download:manual"] != 1 || requests["download"] != 1 {
+		t.Errorf("download requests by limiter = %v, want 1 each for download:manual and download", requests)
+	}
+}
+
+func TestProcessImage_URLDedup(t *testing.T) {
+	for _, bad := range []string{"", "none"} {
+		if _, err := ParseURLDedup(bad); err == nil {
+			t.Errorf("ParseURLDedup(%q) succeeded, want error", bad)
+		}
+	}
+
+	data := encodePNG(t, smoothImage(1, 16))
+	for _, tt := range []struct {
+		mode URLDedup
+		// Downloads after the URL comes from waifu.im, then from
+		// waifu.pics twice.
+		downloads [3]int32
+	}{
+		{URLDedupGlobal, [3]int32{1, 1, 1}},
+		{URLDedupPerSource, [3]int32{1, 2, 2}},
+	} {
+		db, imgDir := testSetup(t)
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Write(data)
+		}))
+		defer srv.Close()
+		ing := newTestIngester(db, imgDir, WithURLDedup(tt.mode))
+		url := srv.URL + "/shared.png"
+
+		for i, source := range []string{"waifu.im", "waifu.pics", "waifu.pics"} {
+			// Only the first delivery is new.
+			n, err := ing.processImage(context.Background(), url, source, "sfw", 0, 0, nil)
+			if err != nil || (n == 1) != (i == 0) {
+				t.Fatalf("%s: delivery %d from %s = %d, %v", tt.mode, i, source, n, err)
+			}
+			if got := calls.Load(); got != tt.downloads[i] {
+				t.Errorf("%s: %d downloads after delivery %d, want %d", tt.mode, got, i, tt.downloads[i])
+			}
+		}
+		if first, _ := db.SourceURLSource(url, ""); first != "waifu.im" {
+			t.Errorf("%s: first source = %q, want waifu.im", tt.mode, first)
+		}
+		wantPics := map[URLDedup]string{URLDedupGlobal: "", URLDedupPerSource: "waifu.pics"}[tt.mode]
+		if got, _ := db.SourceURLSource(url, "waifu.pics"); got != wantPics {
+			t.Errorf("%s: waifu.pics record = %q, want %q", tt.mode, got, wantPics)
+		}
+	}
+}
+
+func TestProcessImage_NotAnImage(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ing := newTestIngester(db, imgDir)
+	for name, body := range map[string]string{
+		"html": "<!DOCTYPE html><html><body>502 Bad Gateway</body></html>",
+		"json": `{"error": "rate limited"}`,
+	} {
+		srv := serveBytes(t, []byte(body))
+		n, err := ing.processImage(context.Background(), srv.URL+"/img.webp", "test", "sfw", 0, 0, nil)
+		if n != 0 || !errors.Is(err, errNotImage) {
+			t.Errorf("%s: processImage = %d, %v, want errNotImage", name, n, err)
+		}
+	}
+	if count, _ := db.Count(); count != 0 {
+		t.Errorf("catalog holds %d images, want 0", count)
+	}
+	if entries, _ := os.ReadDir(imgDir); len(entries) != 0 {
+		t.Errorf("stored %d files, want none", len(entries))
+	}
+}
+
+func TestProcessImage_TooLarge(t *testing.T) {
+	db, imgDir := testSetup(t)
+	data := encodePNG(t, smoothImage(1, 64))
+	ing := newTestIngester(db, imgDir, WithMaxImageBytes(int64(len(data)-1)))
+
+	// Announced with Content-Length, and streamed without one.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked.png" {
+			w.Write(data[:10])
+			w.(http.Flusher).Flush()
+			w.Write(data[10:])
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data)
+	}))
+	defer srv.Close()
+	for _, path := range []string{"/sized.png", "/chunked.png"} {
+		n, err := ing.processImage(context.Background(), srv.URL+path, "test", "sfw", 0, 0, nil)
+		if n != 0 || !errors.Is(err, errImageTooLarge) {
+			t.Errorf("%s: processImage = %d, %v, want errImageTooLarge", path, n, err)
+		}
+	}
+	if entries, _ := os.ReadDir(imgDir); len(entries) != 0 {
+		t.Errorf("stored %d files, want none", len(entries))
+	}
+
+	// At the limit the image is stored.
+	ing = newTestIngester(db, imgDir, WithMaxImageBytes(int64(len(data))))
+	if n, err := ing.processImage(context.Background(), srv.URL+"/chunked.png", "test", "sfw", 0, 0, nil); n != 1 || err != nil {
+		t.Errorf("at the limit: processImage = %d, %v, want stored", n, err)
+	}
+}
+
+func TestDownloadImage_FirstByteTimeout(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	// The first request sends headers and then stalls; the retry is prompt.
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("image bytes"))
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := newTestIngester(db, imgDir, WithFirstByteTimeout(100*time.Millisecond))
+	start := time.Now()
+	data, err := ing.downloadImage(context.Background(), srv.URL, ing.downloadLimiter)
+	if err != nil {
+		t.Fatalf("downloadImage: %v", err)
+	}
+	if string(data) != "image bytes" {
+		t.Errorf("data = %q", data)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream saw %d requests, want 2", n)
+	}
+	// One backoff of at most 3s, nowhere near the 10s stall.
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("download took %v; stall was not cut short", elapsed)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	data := []byte("waifu")
+	seen := map[string]string{}
+	for algo, wantLen := range map[string]int{HashSHA256: 32, HashBLAKE3: 32, HashXXHash: 16} {
+		if err := CheckHashAlgo(algo); err != nil {
+			t.Errorf("CheckHashAlgo(%q): %v", algo, err)
+		}
+		h := contentHash(algo, data)
+		if len(h) != wantLen || h != contentHash(algo, data) {
+			t.Errorf("%s: hash %q, want %d stable hex digits", algo, h, wantLen)
+		}
+		if other, ok := seen[h]; ok {
+			t.Errorf("%s and %s agree on %q", algo, other, h)
+		}
+		seen[h] = algo
+	}
+	// Existing catalogs were filled with this exact scheme.
+	if h := contentHash(HashSHA256, data); h != "ac1163e44120bf7f7c3b54f36ea8f1a7" {
+		t.Errorf("sha256 hash = %s, changed from earlier releases", h)
+	}
+	if err := CheckHashAlgo("md5"); err == nil {
+		t.Error("CheckHashAlgo accepted md5")
+	}
+}
+
+// BenchmarkContentHash compares hashing throughput on a 4 MiB image-sized
+// buffer: go test -bench ContentHash ./internal/ingest
+func BenchmarkContentHash(b *testing.B) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, algo := range HashAlgos {
+		b.Run(algo, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				contentHash(algo, data)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for v, want := range map[string]time.Duration{
+		"":                              0,
+		"2":                             2 * time.Second,
+		"0":                             0,
+		"-5":                            0,
+		"3600":                          maxRetryAfter,
+		"soon":                          0,
+		"Fri, 02 Jan 2026 03:04:15 GMT": 10 * time.Second,
+		"Fri, 02 Jan 2026 03:00:00 GMT": 0,
+	} {
+		h := http.Header{}
+		if v != "" {
+			h.Set("Retry-After", v)
+		}
+		if got := retryAfter(h, now); got != want {
+			t.Errorf("retryAfter(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestRetryAfter_HonoredOn429(t *testing.T) {
+	// The first request of each upstream is throttled with Retry-After: 2,
+	// longer than the first exponential backoff (1s to 1.5s).
+	throttleOnce := func(t *testing.T, body []byte) *httptest.Server {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Set("Retry-After", "2")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write(body)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	t.Run("fetchWithRetry", func(t *testing.T) {
+		t.Parallel()
+		db, imgDir := testSetup(t)
+		srv := throttleOnce(t, []byte("{}"))
+		ing := newTestIngester(db, imgDir)
+		start := time.Now()
+		if _, err := ing.fetchWithRetry(context.Background(), http.MethodGet, srv.URL, nil, "test", ing.waifuImLimiter); err != nil {
+			t.Fatalf("fetchWithRetry: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 2*time.Second {
+			t.Errorf("retried after %v, want at least the 2s Retry-After", elapsed)
+		}
+	})
+	t.Run("downloadImage", func(t *testing.T) {
+		t.Parallel()
+		db, imgDir := testSetup(t)
+		srv := throttleOnce(t, []byte("image bytes"))
+		ing := newTestIngester(db, imgDir)
+		start := time.Now()
+		if _, err := ing.downloadImage(context.Background(), srv.URL, ing.downloadLimiter); err != nil {
+			t.Fatalf("downloadImage: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 2*time.Second {
+			t.Errorf("retried after %v, want at least the 2s Retry-After", elapsed)
+		}
+	})
+}
+
+func TestHostAllowed(t *testing.T) {
+	tests := []struct {
+		host    string
+		allowed []string
+		want    bool
+	}{
+		{"cdn.waifu.im", DefaultAllowedHosts, true},
+		{"i.waifu.pics", DefaultAllowedHosts, true},
+		{"waifu.im", DefaultAllowedHosts, true},
+		{"CDN.Waifu.IM.", DefaultAllowedHosts, true},
+		{"evilwaifu.im", DefaultAllowedHosts, false},
+		{"waifu.im.evil.com", DefaultAllowedHosts, false},
+		{"169.254.169.254", DefaultAllowedHosts, false},
+		{"cdn.example.com", []string{"cdn.example.com"}, true},
+		{"img.cdn.example.com", []string{"cdn.example.com"}, false},
+		{"anything.example", nil, true},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host, tt.allowed); got != tt.want {
+			t.Errorf("hostAllowed(%q, %v) = %v, want %v", tt.host, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadImage_BlockedHost(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	var calls atomic.Int32
+	img := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image bytes"))
+	}))
+	t.Cleanup(img.Close)
+	// An allowed host that redirects to one that is not.
+	redirect := httptest.NewServer(http.RedirectHandler(strings.Replace(img.URL, "127.0.0.1", "localhost", 1), http.StatusFound))
+	t.Cleanup(redirect.Close)
+
+	ing := New(db, imgDir, WithAllowedHosts([]string{"127.0.0.1"}), WithPrivateNetworks(true))
+	if _, err := ing.downloadImage(context.Background(), redirect.URL, ing.downloadLimiter); !errors.Is(err, errHostNotAllowed) {
+		t.Errorf("redirect to blocked host: err = %v, want errHostNotAllowed", err)
+	}
+
+	ing = New(db, imgDir, WithAllowedHosts([]string{".waifu.im"}))
+	if _, err := ing.downloadImage(context.Background(), img.URL, ing.downloadLimiter); !errors.Is(err, errHostNotAllowed) {
+		t.Errorf("blocked host: err = %v, want errHostNotAllowed", err)
+	}
+	if _, err := ing.downloadImage(context.Background(), "file:///etc/passwd", ing.downloadLimiter); err == nil {
+		t.Error("file URL was accepted")
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("blocked downloads reached the server %d times", n)
+	}
+}
+
+func TestDownloadImage_PrivateAddress(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("image bytes"))
+	}))
+	t.Cleanup(srv.Close)
+	// "localhost" passes the (disabled) host allowlist but resolves to loopback.
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	ing := New(db, imgDir, WithAllowedHosts(nil))
+	if _, err := ing.downloadImage(context.Background(), url, ing.downloadLimiter); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("loopback download: err = %v, want errPrivateAddress", err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("blocked download reached the server %d times", n)
+	}
+
+	ing = New(db, imgDir, WithAllowedHosts(nil), WithPrivateNetworks(true))
+	if _, err := ing.downloadImage(context.Background(), url, ing.downloadLimiter); err != nil {
+		t.Errorf("with WithPrivateNetworks: %v", err)
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.101.102.103": false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd7a:115c::1":    false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestRun_CancelKeepsCompletedDownloads(t *testing.T) {
+	db, imgDir := testSetup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images":
+			var resp waifuImResponse
+			for _, name := range []string{"1", "2", "3"} {
+				resp.Items = append(resp.Items, waifuImItem{URL: srv.URL + "/img/" + name})
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/img/1", "/img/2":
+			w.Write(encodePNG(t, smoothImage(int64(r.URL.Path[len(r.URL.Path)-1]), 16)))
+		default:
+			// The shutdown signal arrives while this download is in flight.
+			cancel()
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ing := newTestIngester(db, imgDir)
+	ing.waifuImURL = srv.URL + "/images"
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+
+	res, err := ing.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !res.Canceled || res.TimedOut || res.New != 2 {
+		t.Errorf("result = %+v, want canceled with 2 new", res)
+	}
+	if n, err := db.Count(); err != nil || n != 2 {
+		t.Errorf("catalog holds %d images (%v), want the 2 completed downloads", n, err)
+	}
+
+	runs, err := db.Runs(10)
+	if err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	if len(runs) != 1 || !runs[0].Canceled || runs[0].New != 2 {
+		t.Errorf("recorded runs = %+v, want one canceled run with 2 new", runs)
+	}
+}
+
+func TestBackfillOrigSize(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.URL.Path == "/gone.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(encodePNG(t, image.NewGray(image.Rect(0, 0, 1200, 900))))
+	}))
+	t.Cleanup(srv.Close)
+
+	rows := []*catalog.Image{
+		{Hash: "a", SourceURL: srv.URL + "/a.png", Width: 480, Height: 360},
+		{Hash: "b", SourceURL: srv.URL + "/gone.png", Width: 480, Height: 360},
+		{Hash: "c", SourceURL: srv.URL + "/c.png", Width: 480, Height: 360, OrigWidth: 640, OrigHeight: 480},
+	}
+	for _, img := range rows {
+		img.Source, img.Category, img.Filename = "test", "sfw", img.Hash+".webp"
+		if _, err := db.Insert(img); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	ing := newTestIngester(db, imgDir)
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+	report, err := ing.BackfillOrigSize(context.Background(), 2, nil)
+	if err != nil {
+		t.Fatalf("BackfillOrigSize: %v", err)
+	}
+	if report.Checked != 2 || report.Updated != 1 || report.Failed != 1 {
+		t.Errorf("report = %+v, want 2 checked, 1 updated, 1 failed", report)
+	}
+	for _, r := range ranges {
+		if !strings.HasPrefix(r, "bytes=0-") {
+			t.Errorf("probe sent Range %q, want a prefix range", r)
+		}
+	}
+
+	for hash, want := range map[string][2]int{"a": {1200, 900}, "b": {0, 0}, "c": {640, 480}} {
+		img, err := db.GetByHash(hash)
+		if err != nil {
+			t.Fatalf("GetByHash: %v", err)
+		}
+		if img.OrigWidth != want[0] || img.OrigHeight != want[1] {
+			t.Errorf("%s: orig size %dx%d, want %dx%d", hash, img.OrigWidth, img.OrigHeight, want[0], want[1])
+		}
+	}
+}
+
+func TestBackfillOrigSize_Concurrent(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	// Each source serves an image sized after its index, so a lost or
+	// crossed update shows up as a wrong size.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		fmt.Sscanf(r.URL.Path, "/%d.png", &i)
+		w.Write(encodePNG(t, image.NewGray(image.Rect(0, 0, 100+i, 200+i))))
+	}))
+	t.Cleanup(srv.Close)
+
+	const n = 60
+	for i := 0; i < n; i++ {
+		hash := fmt.Sprintf("h%02d", i)
+		_, err := db.Insert(&catalog.Image{Hash: hash, Source: "test", Category: "sfw",
+			SourceURL: fmt.Sprintf("%s/%d.png", srv.URL, i), Filename: hash + ".webp"})
+		if err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	ing := newTestIngester(db, imgDir)
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+	var last atomic.Int32
+	report, err := ing.BackfillOrigSize(context.Background(), 8, func(done, total int) {
+		if done == total {
+			last.Store(int32(done))
+		}
+	})
+	if err != nil {
+		t.Fatalf("BackfillOrigSize: %v", err)
+	}
+	if report.Updated != n || report.Failed != 0 {
+		t.Errorf("report = %+v, want %d updated", report, n)
+	}
+	if last.Load() != n {
+		t.Errorf("final progress = %d, want %d", last.Load(), n)
+	}
+	for i := 0; i < n; i++ {
+		img, err := db.GetByHash(fmt.Sprintf("h%02d", i))
+		if err != nil {
+			t.Fatalf("GetByHash: %v", err)
+		}
+		if img.OrigWidth != 100+i || img.OrigHeight != 200+i {
+			t.Errorf("%s: orig size %dx%d, want %dx%d", img.Hash, img.OrigWidth, img.OrigHeight, 100+i, 200+i)
+		}
+	}
+}
+
+func TestBackfillOrigSize_Polite(t *testing.T) {
+	db, imgDir := testSetup(t)
+	srv := serveBytes(t, encodePNG(t, image.NewGray(image.Rect(0, 0, 64, 48))))
+	const n = 5
+	for i := 0; i < n; i++ {
+		hash := fmt.Sprintf("h%d", i)
+		db.Insert(&catalog.Image{Hash: hash, Source: "test", Category: "sfw",
+			SourceURL: fmt.Sprintf("%s/%d.png", srv.URL, i), Filename: hash + ".webp"})
+	}
+
+	// Probes share the download limiter with ingest: at 20 req/sec, five
+	// cannot finish in under 200ms however many workers run.
+	ing := newTestIngester(db, imgDir)
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Limit(20), 1)
+	start := time.Now()
+	report, err := ing.BackfillOrigSize(context.Background(), n, nil)
+	if err != nil || report.Updated != n {
+		t.Fatalf("BackfillOrigSize = %+v, %v", report, err)
+	}
+	if elapsed := time.Since(start); elapsed < (n-1)*time.Second/20 {
+		t.Errorf("%d probes took %v, faster than the rate limit allows", n, elapsed)
+	}
+	if st := ing.downloadLimiter.status(); st.Requests != n {
+		t.Errorf("limiter saw %d requests, want %d", st.Requests, n)
+	}
+
+	// And the allowlist: none of these hosts is on the default one.
+	ing = New(db, imgDir)
+	db.Insert(&catalog.Image{Hash: "x", Source: "test", Category: "sfw", SourceURL: srv.URL + "/x.png", Filename: "x.webp"})
+	report, err = ing.BackfillOrigSize(context.Background(), 1, nil)
+	if err != nil || report.Checked != 1 || report.Failed != 1 {
+		t.Errorf("with the default allowlist: report %+v, %v, want the probe refused", report, err)
+	}
+}
+
+func TestProcessImage_SkipsNearDuplicate(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	// The same picture at two sizes: different bytes, same perceptual hash.
+	big := smoothImage(7, 128)
+	base := optimize.Resize(big, big.Bounds(), 40, 40)
+	uploads := map[string][]byte{
+		"/small.png": encodePNG(t, base),
+		"/big.png":   encodePNG(t, big),
+		"/other.png": encodePNG(t, smoothImage(8, 40)),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(uploads[r.URL.Path])
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		distance int
+		want     []int // stored per upload: small, big, other
+	}{
+		{DefaultNearDuplicateDistance, []int{1, 0, 1}},
+		{-1, []int{1, 1, 1}},
+	} {
+		db, imgDir := testSetup(t)
+		ing := newTestIngester(db, imgDir, WithNearDuplicateDistance(tc.distance))
+		ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+		for i, path := range []string{"/small.png", "/big.png", "/other.png"} {
+			n, err := ing.processImage(context.Background(), srv.URL+path, "test", "sfw", 0, 0, nil)
+			if err != nil {
+				t.Fatalf("distance %d: %s: %v", tc.distance, path, err)
+			}
+			if n != tc.want[i] {
+				t.Errorf("distance %d: %s stored %d, want %d", tc.distance, path, n, tc.want[i])
+			}
+		}
+	}
+
+	// The hash is recorded so later images can be compared against it.
+	ing := newTestIngester(db, imgDir)
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+	if _, err := ing.processImage(context.Background(), srv.URL+"/small.png", "test", "sfw", 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.HasSimilar(optimize.DHash(base), DefaultNearDuplicateDistance); err != nil || !ok {
+		t.Errorf("HasSimilar(stored hash) = %v, %v; want true", ok, err)
+	}
+}
+
+func TestIngestURLs(t *testing.T) {
+	db, imgDir := testSetup(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var seed int64
+		switch r.URL.Path {
+		case "/a.png":
+			seed = 1
+		case "/b.png":
+			seed = 2
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(encodePNG(t, smoothImage(seed, 16)))
+	}))
+	t.Cleanup(srv.Close)
+
+	list := strings.Join([]string{
+		"# gallery picks",
+		srv.URL + "/a.png",
+		"",
+		srv.URL + "/b.png nsfw",
+		srv.URL + "/a.png",
+		srv.URL + "/missing.png",
+		srv.URL + "/b.png Not-Valid",
+		"https://elsewhere.example/c.png",
+	}, "\n")
+	ing := newTestIngester(db, imgDir, WithAllowedHosts([]string{"127.0.0.1"}))
+	ing.downloadLimiter = newAdaptiveLimiter("download", rate.Inf, 1)
+
+	report, err := ing.IngestURLs(context.Background(), strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("IngestURLs: %v", err)
+	}
+	if report.Stored != 2 || report.Duplicate != 1 || report.Failed != 3 {
+		t.Errorf("report = %d stored, %d duplicate, %d failed; want 2, 1, 3",
+			report.Stored, report.Duplicate, report.Failed)
+	}
+	wantStatus := map[int]string{2: URLStored, 4: URLStored, 5: URLDuplicate, 6: URLFailed, 7: URLFailed, 8: URLFailed}
+	for _, r := range report.Results {
+		if r.Status != wantStatus[r.Line] {
+			t.Errorf("line %d (%s): status %q, want %q", r.Line, r.URL, r.Status, wantStatus[r.Line])
+		}
+	}
+	if !errors.Is(report.Results[len(report.Results)-1].Err, errHostNotAllowed) {
+		t.Errorf("off-list host error = %v, want errHostNotAllowed", report.Results[len(report.Results)-1].Err)
+	}
+
+	stored := 0
+	db.Each(func(img *catalog.Image) error {
+		stored++
+		if img.Source != ManualSource {
+			t.Errorf("source = %q, want %q", img.Source, ManualSource)
+		}
+		if want := map[bool]string{true: "sfw", false: "nsfw"}[strings.HasSuffix(img.SourceURL, "/a.png")]; img.Category != want {
+			t.Errorf("%s: category = %q, want %q", img.SourceURL, img.Category, want)
+		}
+		return nil
+	})
+	if stored != 2 {
+		t.Errorf("catalog has %d images, want 2", stored)
+	}
+}
@@ -0,0 +1,135 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ManualSource is the catalog source of images added with IngestURLs.
+const ManualSource = "manual"
+
+// manualCategory matches category names accepted in a URL list; the same
+// rule the server applies to ?category=.
+var manualCategory = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// URL outcomes recorded in URLResult.Status.
+const (
+	URLStored    = "stored"
+	URLDuplicate = "duplicate"
+	URLFailed    = "failed"
+)
+
+// URLResult is the outcome of one line of a URL list.
+type URLResult struct {
+	Line     int
+	URL      string
+	Category string
+	Status   string
+	Err      error // set when Status is URLFailed
+}
+
+// URLReport summarizes an IngestURLs pass.
+type URLReport struct {
+	Stored, Duplicate, Failed int
+	Results                   []URLResult
+}
+
+// IngestURLs stores the images listed in r, one per line as "URL" or
+// "URL category" (default sfw), with source ManualSource. Blank lines and
+// lines starting with # are skipped. Each image goes through the same
+// download rate limit, host checks, deduplication and optimization as
+// upstream images. A bad line or failed download is recorded in the report
+// and does not stop the pass; only a read error or ctx does.
+func (ing *Ingester) IngestURLs(ctx context.Context, r io.Reader) (*URLReport, error) {
+	report := &URLReport{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		res := URLResult{Line: line, URL: fields[0]}
+		res.Category, res.Err = urlLineCategory(fields)
+		if res.Err == nil {
+			var n int
+			n, res.Err = ing.processImage(ctx, res.URL, ManualSource, res.Category, 0, 0, nil)
+			ing.imageDone(ManualSource, res.Category, res.URL, n, res.Err)
+			if res.Err == nil && n == 0 {
+				res.Status = URLDuplicate
+			}
+		}
+
+		switch {
+		case res.Err != nil:
+			res.Status = URLFailed
+			report.Failed++
+		case res.Status == URLDuplicate:
+			report.Duplicate++
+		default:
+			res.Status = URLStored
+			report.Stored++
+		}
+		report.Results = append(report.Results, res)
+	}
+	if err := sc.Err(); err != nil {
+		return report, fmt.Errorf("ingest urls: %w", err)
+	}
+	return report, nil
+}
+
+// urlLineCategory checks the fields of a URL list line and returns its
+// category.
+func urlLineCategory(fields []string) (string, error) {
+	switch {
+	case len(fields) > 2:
+		return "", fmt.Errorf("want \"URL [category]\", got %d fields", len(fields))
+	case len(fields) == 2 && !manualCategory.MatchString(fields[1]):
+		return "", fmt.Errorf("invalid category %q", fields[1])
+	case len(fields) == 2:
+		return fields[1], nil
+	}
+	return "sfw", nil
+}
+
+// CheckURLList validates a URL list for IngestURLs without downloading
+// anything: each line must be well formed and name an absolute http(s) URL
+// whose host matches allowed (see WithAllowedHosts). It returns one error
+// per bad line, or a read error.
+func CheckURLList(r io.Reader, allowed []string) ([]error, error) {
+	var problems []error
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, err := urlLineCategory(fields); err != nil {
+			problems = append(problems, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		u, err := url.Parse(fields[0])
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Errorf("line %d: %w", line, err))
+		case u.Scheme != "http" && u.Scheme != "https":
+			problems = append(problems, fmt.Errorf("line %d: %s: want an http or https URL", line, fields[0]))
+		case u.Hostname() == "":
+			problems = append(problems, fmt.Errorf("line %d: %s: missing host", line, fields[0]))
+		case !hostAllowed(u.Hostname(), allowed):
+			problems = append(problems, fmt.Errorf("line %d: %s: %w", line, u.Hostname(), errHostNotAllowed))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return problems, fmt.Errorf("check urls: %w", err)
+	}
+	return problems, nil
+}
@@ -0,0 +1,64 @@
+package ingest
+
+// staleWrapAfter is how many pages in a row may yield no new images before
+// a paginated source's cursor goes back to page 1.
+const staleWrapAfter = 3
+
+// pageFunc ingests one page of a paginated source, numbered from 1. It
+// returns how many new images the page gave and whether the upstream has
+// pages after it.
+type pageFunc func(page int) (n int, more bool, err error)
+
+// ingestPages drives a paginated source for up to limit pages, starting
+// after the page recorded in the catalog cursor key, so that successive
+// cycles work through the upstream catalog instead of refetching its first
+// pages. The cursor is saved after every page, so an error or shutdown
+// resumes after the last page that was fully ingested. It goes back to page
+// 1 once the source reports no more pages, or after staleWrapAfter pages in
+// a row that yield no new images. It returns the new images stored.
+func (ing *Ingester) ingestPages(key string, limit int, fetch pageFunc) (int, error) {
+	last, err := ing.cat.GetCursor(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for page := last + 1; page <= last+limit; page++ {
+		n, more, err := fetch(page)
+		count += n
+		if err != nil {
+			return count, err
+		}
+
+		wrap := ing.pageStale(key, n) || !more
+		next := page
+		if wrap {
+			next = 0
+		}
+		if err := ing.cat.SetCursor(key, next); err != nil {
+			return count, err
+		}
+		if wrap {
+			break
+		}
+	}
+	return count, nil
+}
+
+// pageStale records whether the latest page under key yielded new images
+// and reports whether staleWrapAfter pages in a row have not, resetting the
+// count when they have.
+func (ing *Ingester) pageStale(key string, stored int) bool {
+	ing.staleMu.Lock()
+	defer ing.staleMu.Unlock()
+	if stored > 0 {
+		ing.stalePages[key] = 0
+		return false
+	}
+	ing.stalePages[key]++
+	if ing.stalePages[key] < staleWrapAfter {
+		return false
+	}
+	ing.stalePages[key] = 0
+	return true
+}
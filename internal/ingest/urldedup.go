@@ -0,0 +1,44 @@
+package ingest
+
+import "fmt"
+
+// URLDedup selects when a URL already delivered by a source is skipped
+// without downloading it. Either way the content hash still catches the
+// same image under a different URL.
+type URLDedup string
+
+const (
+	// URLDedupGlobal skips a URL any source has delivered. The same CDN
+	// URL often comes from both waifu.im and waifu.pics; this fetches it
+	// once, and the image stays attributed to the first source.
+	URLDedupGlobal URLDedup = "global"
+	// URLDedupPerSource skips a URL only if the same source delivered it,
+	// so a second source's copy is downloaded once and recorded against
+	// that source too, at the cost of the extra download.
+	URLDedupPerSource URLDedup = "per-source"
+)
+
+// ParseURLDedup validates a URL dedup mode name.
+func ParseURLDedup(s string) (URLDedup, error) {
+	switch m := URLDedup(s); m {
+	case URLDedupGlobal, URLDedupPerSource:
+		return m, nil
+	}
+	return "", fmt.Errorf("ingest: unknown URL dedup mode %q (want global or per-source)", s)
+}
+
+// WithURLDedup sets the URL dedup mode; the default is URLDedupGlobal.
+func WithURLDedup(m URLDedup) Option {
+	return func(ing *Ingester) { ing.urlDedup = m }
+}
+
+// seenURL reports whether srcURL was already delivered, by source alone
+// under URLDedupPerSource or by any source otherwise.
+func (ing *Ingester) seenURL(srcURL, source string) (bool, error) {
+	scope := ""
+	if ing.urlDedup == URLDedupPerSource {
+		scope = source
+	}
+	first, err := ing.cat.SourceURLSource(srcURL, scope)
+	return first != "", err
+}
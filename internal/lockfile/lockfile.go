@@ -0,0 +1,67 @@
+// Package lockfile guards a data directory against use by two processes at
+// once with an advisory lock on a file inside it.
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Name is the lock file created inside the guarded directory.
+const Name = "waifu-mirror.lock"
+
+// ErrLocked is returned by Acquire when another process holds the lock.
+var ErrLocked = errors.New("another instance is using this data dir")
+
+// Lock is a held directory lock.
+type Lock struct {
+	f *os.File
+}
+
+// Acquire takes the lock on dir without waiting. If another process holds
+// it, the error wraps ErrLocked and names that process's PID when known.
+// The lock is released by Release or when the process exits.
+func Acquire(dir string) (*Lock, error) {
+	path := filepath.Join(dir, Name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("lockfile: %w", err)
+	}
+	if err := lock(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, errWouldBlock) {
+			if pid := holder(f); pid != "" {
+				return nil, fmt.Errorf("%w (%s held by pid %s)", ErrLocked, dir, pid)
+			}
+			return nil, fmt.Errorf("%w (%s)", ErrLocked, dir)
+		}
+		return nil, fmt.Errorf("lockfile: %w", err)
+	}
+
+	// Record our PID for the error message of the next would-be holder.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release drops the lock. The file is left in place; its presence alone
+// does not mean the directory is in use.
+func (l *Lock) Release() error {
+	if err := unlock(l.f); err != nil {
+		l.f.Close()
+		return fmt.Errorf("lockfile: %w", err)
+	}
+	return l.f.Close()
+}
+
+// holder returns the PID recorded in the lock file, if any.
+func holder(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	return strings.TrimSpace(string(buf[:n]))
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package lockfile
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquireTwice(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir)
+	if err != nil {
+		t.Fatalf("first Acquire: %v", err)
+	}
+
+	_, err = Acquire(dir)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Acquire error = %v, want ErrLocked", err)
+	}
+	if !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("error %q does not name the holding pid", err)
+	}
+
+	if err := first.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	again, err := Acquire(dir)
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	again.Release()
+}
@@ -0,0 +1,124 @@
+package maintenance
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// CompactReport summarizes a Compact pass.
+type CompactReport struct {
+	Checked   int   // distinct files hashed
+	Linked    int   // files replaced by a hard link to an identical one
+	Reclaimed int64 // bytes of disk freed
+	Failed    int
+}
+
+// Compact finds catalog files with byte-identical contents and replaces all
+// but one of each set with a hard link to the survivor, so the data is
+// stored once. Rows keep their own filenames, which the catalog requires to
+// be unique, and every delete path unlinks only the row's own name; the
+// filesystem keeps the data until its last link is gone, so removing one
+// row never breaks another. Files are hashed by at most workers goroutines,
+// reporting to progress if non-nil. Unreadable files and failed links are
+// logged and counted; the pass stops only if the catalog fails.
+func Compact(cat *catalog.DB, imgDir string, workers int, progress Progress) (*CompactReport, error) {
+	seen := map[string]bool{}
+	var files []string
+	if err := cat.Each(func(img *catalog.Image) error {
+		if !seen[img.Filename] {
+			seen[img.Filename] = true
+			files = append(files, img.Filename)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("compact: %w", err)
+	}
+	slices.Sort(files) // the first file of each set is the one kept
+
+	report := &CompactReport{Checked: len(files)}
+	var mu sync.Mutex
+	byDigest := map[[sha256.Size]byte][]string{}
+	ForEach(files, workers, progress, func(filename string) {
+		sum, err := fileDigest(filepath.Join(imgDir, filename))
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Printf("compact: %s: %v", filename, err)
+			report.Failed++
+			return
+		}
+		byDigest[sum] = append(byDigest[sum], filename)
+	})
+
+	for _, names := range byDigest {
+		if len(names) < 2 {
+			continue
+		}
+		slices.Sort(names)
+		keep := filepath.Join(imgDir, names[0])
+		keepInfo, err := os.Stat(keep)
+		if err != nil {
+			log.Printf("compact: %s: %v", names[0], err)
+			report.Failed += len(names) - 1
+			continue
+		}
+		for _, name := range names[1:] {
+			path := filepath.Join(imgDir, name)
+			info, err := os.Stat(path)
+			if err == nil && os.SameFile(keepInfo, info) {
+				continue // already linked
+			}
+			if err == nil {
+				err = replaceWithLink(keep, path)
+			}
+			if err != nil {
+				log.Printf("compact: %s: %v", name, err)
+				report.Failed++
+				continue
+			}
+			report.Linked++
+			report.Reclaimed += info.Size()
+		}
+	}
+	return report, nil
+}
+
+// fileDigest returns the SHA-256 of the file at path.
+func fileDigest(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// replaceWithLink atomically replaces path with a hard link to target: the
+// link is made under a temporary name and renamed over path, so path is
+// never missing.
+func replaceWithLink(target, path string) error {
+	tmp := path + ".link.tmp"
+	os.Remove(tmp) // left over from an interrupted pass
+	if err := os.Link(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
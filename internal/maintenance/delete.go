@@ -0,0 +1,21 @@
+package maintenance
+
+import (
+	"fmt"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// DeleteMatching removes every image matching f from the catalog and from
+// imgDir, returning the removed rows. With dryRun nothing is removed and the
+// rows that would be are returned.
+func DeleteMatching(cat *catalog.DB, imgDir string, f catalog.DeleteFilter, dryRun bool) ([]*catalog.Image, error) {
+	victims, err := cat.DeleteWhere(f, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("delete: %w", err)
+	}
+	if !dryRun {
+		removeFiles(cat, imgDir, "delete", victims, nil)
+	}
+	return victims, nil
+}
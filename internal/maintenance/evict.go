@@ -0,0 +1,150 @@
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// EvictPolicy caps how many images, and how many bytes of them, the catalog
+// keeps. Zero values mean unlimited. Category caps are applied
+// independently before the global cap, count before bytes.
+type EvictPolicy struct {
+	MaxCount         int
+	CategoryMaxCount map[string]int
+	CategoryMaxBytes map[string]int64
+}
+
+// Enabled reports whether the policy caps anything.
+func (p EvictPolicy) Enabled() bool {
+	return p.MaxCount > 0 || len(p.CategoryMaxCount) > 0 || len(p.CategoryMaxBytes) > 0
+}
+
+// ParseCategoryCaps parses a comma-separated list of category=count pairs,
+// e.g. "sfw=5000,nsfw=200".
+func ParseCategoryCaps(s string) (map[string]int, error) {
+	caps, err := parseCaps(s, "count")
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(caps))
+	for c, n := range caps {
+		counts[c] = int(n)
+	}
+	return counts, nil
+}
+
+// ParseCategoryByteCaps parses a comma-separated list of category=bytes
+// pairs, e.g. "sfw=5000000000,nsfw=500000000".
+func ParseCategoryByteCaps(s string) (map[string]int64, error) {
+	return parseCaps(s, "bytes")
+}
+
+// parseCaps parses category=n pairs with positive n, naming n unit in
+// errors.
+func parseCaps(s, unit string) (map[string]int64, error) {
+	caps := map[string]int64{}
+	if strings.TrimSpace(s) == "" {
+		return caps, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		cat, n, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || cat == "" {
+			return nil, fmt.Errorf("invalid category cap %q (want category=%s)", pair, unit)
+		}
+		v, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("invalid %s in category cap %q", unit, pair)
+		}
+		caps[cat] = v
+	}
+	return caps, nil
+}
+
+// Evict applies policy to the catalog, deleting the oldest rows and then
+// their files. It returns the number of images evicted per category.
+func Evict(cat *catalog.DB, imgDir string, policy EvictPolicy) (map[string]int, error) {
+	evicted := map[string]int{}
+
+	for _, c := range slices.Sorted(maps.Keys(policy.CategoryMaxCount)) {
+		victims, err := cat.DeleteToCountByCategory(c, policy.CategoryMaxCount[c])
+		if err != nil {
+			return evicted, err
+		}
+		removeFiles(cat, imgDir, "evict", victims, evicted)
+	}
+	for _, c := range slices.Sorted(maps.Keys(policy.CategoryMaxBytes)) {
+		victims, err := cat.DeleteToBytesByCategory(c, policy.CategoryMaxBytes[c])
+		if err != nil {
+			return evicted, err
+		}
+		removeFiles(cat, imgDir, "evict", victims, evicted)
+	}
+
+	if policy.MaxCount > 0 {
+		victims, err := cat.DeleteToCount(policy.MaxCount)
+		if err != nil {
+			return evicted, err
+		}
+		removeFiles(cat, imgDir, "evict", victims, evicted)
+	}
+	return evicted, nil
+}
+
+// Prune deletes images older than maxAge and then the oldest images until
+// the catalog holds at most maxBytes, rows first and then their files and
+// thumbnails. Zero disables either limit. It returns the number of images
+// removed.
+func Prune(cat *catalog.DB, imgDir string, maxAge time.Duration, maxBytes int64) (int, error) {
+	if maxAge <= 0 && maxBytes <= 0 {
+		return 0, nil
+	}
+	victims, err := cat.Prune(maxAge, maxBytes)
+	if err != nil {
+		return 0, err
+	}
+	removeFiles(cat, imgDir, "prune", victims, nil)
+	return len(victims), nil
+}
+
+// removeFiles unlinks the files of already-deleted rows and tallies them by
+// category if tally is non-nil. A leftover file is harmless: nothing
+// references it any more. caller prefixes log messages.
+func removeFiles(cat *catalog.DB, imgDir, caller string, victims []*catalog.Image, tally map[string]int) {
+	for _, img := range victims {
+		removeFile(cat, imgDir, img.Filename, caller)
+		removeThumb(imgDir, img.Hash, caller)
+		if tally != nil {
+			tally[img.Category]++
+		}
+	}
+}
+
+// removeFile unlinks filename from imgDir unless a catalog row still
+// references it, so rows sharing a file keep it until the last of them is
+// deleted. If the count cannot be read the file is kept. caller prefixes log
+// messages.
+func removeFile(cat *catalog.DB, imgDir, filename, caller string) {
+	refs, err := cat.FileRefCount(filename)
+	if err != nil {
+		log.Printf("%s: keeping %s: %v", caller, filename, err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	path := filepath.Join(imgDir, filename)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("%s: remove %s: %v", caller, path, err)
+	}
+}
@@ -0,0 +1,224 @@
+// Package maintenance implements offline catalog and image-store passes
+// (consistency checks, repairs, thumbnail generation) run from the command
+// line rather than by the server.
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// Problem kinds reported by Fsck.
+const (
+	ProblemMissing     = "missing"
+	ProblemEmpty       = "empty"
+	ProblemUndecodable = "undecodable"
+	ProblemUnreadable  = "unreadable"
+	// ProblemDuplicateFilename marks rows sharing a file with another row.
+	// They are never removed by fix, since the file may be right for one of
+	// them; resolve by hand.
+	ProblemDuplicateFilename = "duplicate-filename"
+	// ProblemOrphan marks a file in the image directory, or a thumbnail or
+	// cached resize, that no row references. Its Hash is empty and its
+	// Filename is relative to the image directory.
+	ProblemOrphan = "orphan"
+)
+
+// orphanGrace is how old an unreferenced file must be before Fsck reports
+// it. Ingest writes each file just before inserting its row, so a younger
+// one may belong to a cycle still running.
+const orphanGrace = time.Hour
+
+// FsckProblem describes one catalog row whose file is unusable, or a file
+// without a row.
+type FsckProblem struct {
+	Hash     string
+	Filename string
+	Kind     string
+}
+
+// FsckReport summarizes a Fsck pass.
+type FsckReport struct {
+	Checked  int
+	Problems []FsckProblem
+	Removed  int
+}
+
+// Fsck checks that every catalog row points at a non-empty, decodable file
+// in imgDir that no other row points at, and that every file and thumbnail
+// in imgDir belongs to a row. With fix set, broken rows are deleted along
+// with their files and orphan files are removed; duplicate filenames are
+// only reported.
+func Fsck(cat *catalog.DB, imgDir string, fix bool) (*FsckReport, error) {
+	report := &FsckReport{}
+	byFilename := make(map[string][]string) // filename -> hashes
+	files := make(map[string]bool)
+	hashes := make(map[string]bool)
+
+	err := cat.Each(func(img *catalog.Image) error {
+		report.Checked++
+		byFilename[img.Filename] = append(byFilename[img.Filename], img.Hash)
+		files[img.Filename] = true
+		hashes[img.Hash] = true
+		if kind := checkFile(filepath.Join(imgDir, img.Filename)); kind != "" {
+			report.Problems = append(report.Problems, FsckProblem{
+				Hash: img.Hash, Filename: img.Filename, Kind: kind,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fsck: %w", err)
+	}
+	for filename, hashes := range byFilename {
+		if len(hashes) < 2 {
+			continue
+		}
+		for _, hash := range hashes {
+			report.Problems = append(report.Problems, FsckProblem{
+				Hash: hash, Filename: filename, Kind: ProblemDuplicateFilename,
+			})
+		}
+	}
+
+	orphans, err := findOrphans(imgDir, files, hashes)
+	if err != nil {
+		return report, fmt.Errorf("fsck: %w", err)
+	}
+	for _, name := range orphans {
+		report.Problems = append(report.Problems, FsckProblem{Filename: name, Kind: ProblemOrphan})
+	}
+
+	if !fix {
+		return report, nil
+	}
+	for _, p := range report.Problems {
+		switch p.Kind {
+		case ProblemDuplicateFilename:
+			continue
+		case ProblemOrphan:
+			if removeOrphan(imgDir, p.Filename, "fsck") {
+				report.Removed++
+			}
+			continue
+		}
+		// Row first: a crash between the two steps leaves an orphan file,
+		// which a later pass can still find, rather than a dangling row.
+		if err := cat.DeleteByHash(p.Hash); err != nil {
+			return report, fmt.Errorf("fsck: %w", err)
+		}
+		removeFile(cat, imgDir, p.Filename, "fsck")
+		removeThumb(imgDir, p.Hash, "fsck")
+		report.Removed++
+	}
+	return report, nil
+}
+
+// findOrphans lists the files in imgDir and its shards that are not in
+// files and the thumbnails and cached resizes whose hash is not in hashes,
+// relative to imgDir. Files modified within orphanGrace are skipped.
+func findOrphans(imgDir string, files, hashes map[string]bool) ([]string, error) {
+	cutoff := time.Now().Add(-orphanGrace)
+	var orphans []string
+	scan := func(dir string, referenced func(name string) bool) error {
+		entries, err := os.ReadDir(filepath.Join(imgDir, dir))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || referenced(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			orphans = append(orphans, filepath.Join(dir, e.Name()))
+		}
+		return nil
+	}
+	if err := scan(".", func(name string) bool { return files[name] }); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(imgDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !isShard(e.Name()) { // see LayoutSharded
+			continue
+		}
+		shard := e.Name()
+		if err := scan(shard, func(name string) bool { return files[shard+"/"+name] }); err != nil {
+			return nil, err
+		}
+	}
+	// Thumbnails used to be written here; they are cached resizes now.
+	if err := scan("thumbs", func(name string) bool { return false }); err != nil {
+		return nil, err
+	}
+	if err := scan("resized", func(name string) bool { // see ResizedPath
+		hash, _, ok := strings.Cut(name, "_")
+		return ok && strings.HasSuffix(name, outputExt()) && hashes[hash]
+	}); err != nil {
+		return nil, err
+	}
+	if err := scan("transcoded", func(name string) bool { // see TranscodedPath
+		hash, _, ok := strings.Cut(name, ".")
+		return ok && hashes[hash]
+	}); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// removeOrphan unlinks name, relative to imgDir, reporting whether it is
+// gone. caller prefixes log messages.
+func removeOrphan(imgDir, name, caller string) bool {
+	path := filepath.Join(imgDir, name)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("%s: remove %s: %v", caller, path, err)
+		return false
+	}
+	return true
+}
+
+// checkFile returns the problem kind for the file at path, or "" if it is a
+// usable image.
+func checkFile(path string) string {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ProblemMissing
+	}
+	if err != nil {
+		return ProblemUnreadable
+	}
+	if len(data) == 0 {
+		return ProblemEmpty
+	}
+	switch optimize.Sniff(data) {
+	case "":
+		return ProblemUndecodable
+	case "avif":
+		// Stored as-is; we cannot decode AVIF, so trust the header.
+		return ""
+	}
+	// Sniff matched a format we decode, so any failure is corruption;
+	// only a damaged file is worth removing.
+	if _, _, err := optimize.Decode(data); errors.Is(err, optimize.ErrCorruptImage) {
+		return ProblemUndecodable
+	}
+	return ""
+}
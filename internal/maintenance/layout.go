@@ -0,0 +1,139 @@
+package maintenance
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// Layout is how image files are arranged under the image directory.
+type Layout string
+
+const (
+	// LayoutFlat stores every image directly in the image directory as
+	// <hash>.<ext>.
+	LayoutFlat Layout = "flat"
+	// LayoutSharded stores images one level down, in a directory named
+	// after the first two hex digits of the hash, as <ab>/<hash>.<ext>, so
+	// each directory holds about 1/256 of the catalog.
+	LayoutSharded Layout = "sharded"
+)
+
+// shardLen is the number of leading hash characters naming a shard.
+const shardLen = 2
+
+// ParseLayout validates a layout name.
+func ParseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case LayoutFlat, LayoutSharded:
+		return l, nil
+	}
+	return "", fmt.Errorf("maintenance: unknown layout %q", s)
+}
+
+// Filename returns the catalog filename, relative to the image directory
+// and slash-separated, for hash stored with extension ext (".webp") in
+// layout l. The zero Layout is flat.
+func (l Layout) Filename(hash, ext string) string {
+	if l == LayoutSharded && len(hash) > shardLen {
+		return path.Join(hash[:shardLen], hash+ext)
+	}
+	return hash + ext
+}
+
+// ImageDirs returns the directories under imgDir that may hold the file for
+// hash: imgDir itself, then its shard. Lookups by hash search both, so a
+// catalog serves the same in either layout and part way through
+// MigrateLayout.
+func ImageDirs(imgDir, hash string) []string {
+	dirs := []string{imgDir}
+	if len(hash) > shardLen {
+		dirs = append(dirs, filepath.Join(imgDir, hash[:shardLen]))
+	}
+	return dirs
+}
+
+// isShard reports whether name, an entry of the image directory, could be
+// a shard: shardLen lowercase hex digits.
+func isShard(name string) bool {
+	if len(name) != shardLen {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// LayoutReport summarizes a MigrateLayout pass.
+type LayoutReport struct {
+	Checked int
+	Moved   int
+	// Failed counts files that could not be moved; their rows still point
+	// at the old name.
+	Failed int
+}
+
+// MigrateLayout moves every image file under imgDir to where layout puts
+// it and points its catalog row at the new name. Each file is renamed
+// before its row is updated, and renamed back if the update fails; a crash
+// between the two leaves a row whose file is in the other layout, which
+// the server still finds and -repair-filenames fixes. Files that cannot be
+// moved are logged and counted; the pass stops only if the catalog fails.
+// Moving to the flat layout removes the shards it empties.
+func MigrateLayout(cat *catalog.DB, imgDir string, layout Layout) (*LayoutReport, error) {
+	var imgs []*catalog.Image
+	if err := cat.Each(func(img *catalog.Image) error {
+		imgs = append(imgs, img)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("migrate layout: %w", err)
+	}
+
+	report := &LayoutReport{Checked: len(imgs)}
+	shards := map[string]bool{}
+	for _, img := range imgs {
+		want := layout.Filename(img.Hash, path.Ext(img.Filename))
+		if want == img.Filename {
+			continue
+		}
+		if dir := path.Dir(img.Filename); dir != "." {
+			shards[dir] = true
+		}
+		from, to := filepath.Join(imgDir, img.Filename), filepath.Join(imgDir, want)
+		if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+			log.Printf("migrate layout: %s: %v", img.Filename, err)
+			report.Failed++
+			continue
+		}
+		if _, err := os.Lstat(to); err == nil {
+			log.Printf("migrate layout: %s: %s already exists", img.Filename, want)
+			report.Failed++
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			log.Printf("migrate layout: %s: %v", img.Filename, err)
+			report.Failed++
+			continue
+		}
+		if err := cat.UpdateFile(img.Hash, want, img.Format); err != nil {
+			if err := os.Rename(to, from); err != nil {
+				log.Printf("migrate layout: %s: move back: %v", want, err)
+			}
+			return report, fmt.Errorf("migrate layout: %w", err)
+		}
+		report.Moved++
+	}
+
+	for dir := range shards {
+		// Fails, as meant, on shards still holding files.
+		os.Remove(filepath.Join(imgDir, dir))
+	}
+	return report, nil
+}
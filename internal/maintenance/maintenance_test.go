@@ -0,0 +1,705 @@
+package maintenance
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+func testSetup(t *testing.T) (*catalog.DB, string) {
+	t.Helper()
+	db, err := catalog.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	imgDir := filepath.Join(t.TempDir(), "images")
+	os.MkdirAll(imgDir, 0o755)
+	return db, imgDir
+}
+
+func makePNG(w, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+	return buf.Bytes()
+}
+
+// addImage inserts a catalog row for hash and, if data is non-nil, writes
+// its file.
+func addImage(t *testing.T, db *catalog.DB, imgDir, hash string, data []byte) {
+	t.Helper()
+	filename := hash + ".png"
+	if data != nil {
+		if err := os.WriteFile(filepath.Join(imgDir, filename), data, 0o644); err != nil {
+			t.Fatalf("write %s: %v", filename, err)
+		}
+	}
+	if _, err := db.Insert(&catalog.Image{
+		Hash: hash, Source: "test", SourceURL: "u", Category: "sfw",
+		Format: "png", Filename: filename,
+	}); err != nil {
+		t.Fatalf("insert %s: %v", hash, err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	addImage(t, db, imgDir, "good", makePNG(4, 4))
+	addImage(t, db, imgDir, "empty", []byte{})
+	addImage(t, db, imgDir, "garbage", []byte("<html>not an image</html>"))
+	addImage(t, db, imgDir, "missing", nil)
+
+	report, err := Fsck(db, imgDir, false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if report.Checked != 4 {
+		t.Fatalf("Checked = %d, want 4", report.Checked)
+	}
+	kinds := map[string]string{}
+	for _, p := range report.Problems {
+		kinds[p.Hash] = p.Kind
+	}
+	want := map[string]string{
+		"empty":   ProblemEmpty,
+		"garbage": ProblemUndecodable,
+		"missing": ProblemMissing,
+	}
+	if len(kinds) != len(want) {
+		t.Fatalf("problems = %v, want %v", kinds, want)
+	}
+	for hash, kind := range want {
+		if kinds[hash] != kind {
+			t.Errorf("%s: kind = %q, want %q", hash, kinds[hash], kind)
+		}
+	}
+
+	// Report-only pass must not change anything.
+	if n, _ := db.Count(); n != 4 {
+		t.Fatalf("count after dry fsck = %d, want 4", n)
+	}
+
+	report, err = Fsck(db, imgDir, true)
+	if err != nil {
+		t.Fatalf("Fsck(fix): %v", err)
+	}
+	if report.Removed != 3 {
+		t.Fatalf("Removed = %d, want 3", report.Removed)
+	}
+	if n, _ := db.Count(); n != 1 {
+		t.Fatalf("count after fsck fix = %d, want 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(imgDir, "empty.png")); !os.IsNotExist(err) {
+		t.Fatal("expected empty file to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(imgDir, "good.png")); err != nil {
+		t.Fatalf("good file removed: %v", err)
+	}
+}
+
+func TestFsck_Orphans(t *testing.T) {
+	db, imgDir := testSetup(t)
+	addImage(t, db, imgDir, "kept", makePNG(4, 4))
+	os.MkdirAll(filepath.Join(imgDir, "thumbs"), 0o755)
+	os.MkdirAll(filepath.Join(imgDir, "resized"), 0o755)
+	os.MkdirAll(filepath.Join(imgDir, "transcoded"), 0o755)
+	old := time.Now().Add(-2 * orphanGrace)
+	// thumbs/ is where thumbnails used to go; whatever is left there is stray.
+	for _, name := range []string{"stray.png", "kept.png", "thumbs/kept.webp",
+		"resized/kept_240.webp", "resized/gone_240.webp", "transcoded/kept.png", "transcoded/gone.jpeg"} {
+		path := filepath.Join(imgDir, name)
+		if name != "kept.png" {
+			os.WriteFile(path, makePNG(2, 2), 0o644)
+		}
+		os.Chtimes(path, old, old)
+	}
+	// Too new to tell from an ingest still writing it.
+	os.WriteFile(filepath.Join(imgDir, "fresh.png"), makePNG(2, 2), 0o644)
+
+	report, err := Fsck(db, imgDir, true)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	var orphans []string
+	for _, p := range report.Problems {
+		if p.Kind == ProblemOrphan {
+			orphans = append(orphans, p.Filename)
+		}
+	}
+	sort.Strings(orphans)
+	if want := []string{"resized/gone_240.webp", "stray.png", "thumbs/kept.webp", "transcoded/gone.jpeg"}; fmt.Sprint(orphans) != fmt.Sprint(want) {
+		t.Fatalf("orphans = %v, want %v", orphans, want)
+	}
+	if report.Removed != 4 {
+		t.Errorf("Removed = %d, want 4", report.Removed)
+	}
+	for name, want := range map[string]bool{
+		"stray.png": false, "thumbs/kept.webp": false, "resized/gone_240.webp": false, "transcoded/gone.jpeg": false,
+		"kept.png": true, "resized/kept_240.webp": true, "transcoded/kept.png": true,
+		"fresh.png": true,
+	} {
+		if _, err := os.Stat(filepath.Join(imgDir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, hash := range []string{"one", "two", "three"} {
+		os.WriteFile(filepath.Join(imgDir, hash+".png"), makePNG(2, 2), 0o644)
+		os.MkdirAll(filepath.Dir(ResizedPath(imgDir, hash, 240)), 0o755)
+		os.WriteFile(ResizedPath(imgDir, hash, 240), makePNG(1, 1), 0o644)
+		os.MkdirAll(filepath.Dir(TranscodedPath(imgDir, hash, "png")), 0o755)
+		os.WriteFile(TranscodedPath(imgDir, hash, "png"), makePNG(1, 1), 0o644)
+		if _, err := db.Insert(&catalog.Image{
+			Hash: hash, Source: "test", SourceURL: "u", Category: "sfw",
+			Format: "png", SizeBytes: 100, Filename: hash + ".png",
+		}); err != nil {
+			t.Fatalf("insert %s: %v", hash, err)
+		}
+	}
+
+	n, err := Prune(db, imgDir, 0, 150)
+	if err != nil || n != 2 {
+		t.Fatalf("Prune = %d, %v; want 2", n, err)
+	}
+	for hash, want := range map[string]bool{"one": false, "two": false, "three": true} {
+		if _, err := os.Stat(filepath.Join(imgDir, hash+".png")); (err == nil) != want {
+			t.Errorf("%s.png exists = %v, want %v", hash, err == nil, want)
+		}
+		if _, err := os.Stat(ResizedPath(imgDir, hash, 240)); (err == nil) != want {
+			t.Errorf("%s cached resize exists = %v, want %v", hash, err == nil, want)
+		}
+		if _, err := os.Stat(TranscodedPath(imgDir, hash, "png")); (err == nil) != want {
+			t.Errorf("%s cached transcode exists = %v, want %v", hash, err == nil, want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	db, imgDir := testSetup(t)
+	addImage(t, db, imgDir, "kept", makePNG(4, 4))
+	addImage(t, db, imgDir, "gone", nil)
+	old := time.Now().Add(-2 * orphanGrace)
+	stray := filepath.Join(imgDir, "stray.png")
+	os.WriteFile(stray, makePNG(2, 2), 0o644)
+	os.Chtimes(stray, old, old)
+
+	report, err := Reconcile(db, imgDir, true)
+	if err != nil {
+		t.Fatalf("Reconcile(dry run): %v", err)
+	}
+	if report.Checked != 2 || len(report.Dangling) != 1 || report.Dangling[0].Hash != "gone" ||
+		len(report.Orphans) != 1 || report.Orphans[0] != "stray.png" || report.Removed != 0 {
+		t.Fatalf("dry run report = %+v", report)
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Fatalf("dry run removed %s: %v", stray, err)
+	}
+	if n, _ := db.Count(); n != 2 {
+		t.Fatalf("dry run deleted rows: %d left", n)
+	}
+
+	report, err = Reconcile(db, imgDir, false)
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if report.Removed != 2 {
+		t.Errorf("Removed = %d, want 2", report.Removed)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("orphan file still present: %v", err)
+	}
+	if _, err := db.GetByHash("gone"); err == nil {
+		t.Error("row without a file still present")
+	}
+	if _, err := db.GetByHash("kept"); err != nil {
+		t.Errorf("kept row: %v", err)
+	}
+}
+
+// sharedFileDB opens a catalog in which rows aaaa (source "first") and bbbb
+// (source "second") share shared.png and cccc has its own file. The catalog
+// refuses new collisions, so the rows are written into a database from
+// before that rule existed.
+func sharedFileDB(t *testing.T) (*catalog.DB, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open raw: %v", err)
+	}
+	_, err = raw.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT UNIQUE NOT NULL,
+			source TEXT NOT NULL,
+			source_url TEXT NOT NULL,
+			category TEXT NOT NULL DEFAULT 'sfw',
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			format TEXT NOT NULL DEFAULT 'webp',
+			size_bytes INTEGER NOT NULL DEFAULT 0,
+			filename TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO images (hash, source, source_url, filename) VALUES
+			('aaaa', 'first', 'u', 'shared.png'),
+			('bbbb', 'second', 'u', 'shared.png'),
+			('cccc', 't', 'u', 'cccc.png');
+	`)
+	raw.Close()
+	if err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	db, err := catalog.Open(path)
+	if err != nil {
+		t.Fatalf("open catalog with collision: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	imgDir := filepath.Join(dir, "images")
+	os.MkdirAll(imgDir, 0o755)
+	os.WriteFile(filepath.Join(imgDir, "shared.png"), makePNG(4, 4), 0o644)
+	os.WriteFile(filepath.Join(imgDir, "cccc.png"), makePNG(4, 4), 0o644)
+	return db, imgDir
+}
+
+func TestFsck_DuplicateFilename(t *testing.T) {
+	db, imgDir := sharedFileDB(t)
+
+	report, err := Fsck(db, imgDir, true)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	dups := map[string]bool{}
+	for _, p := range report.Problems {
+		if p.Kind != ProblemDuplicateFilename || p.Filename != "shared.png" {
+			t.Errorf("unexpected problem %+v", p)
+		}
+		dups[p.Hash] = true
+	}
+	if !dups["aaaa"] || !dups["bbbb"] || len(dups) != 2 {
+		t.Errorf("duplicate rows = %v, want aaaa and bbbb", dups)
+	}
+	if report.Removed != 0 {
+		t.Errorf("Removed = %d; duplicate filenames must not be auto-fixed", report.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(imgDir, "shared.png")); err != nil {
+		t.Errorf("shared file removed: %v", err)
+	}
+}
+
+func TestDeleteMatching_SharedFile(t *testing.T) {
+	db, imgDir := sharedFileDB(t)
+	shared := filepath.Join(imgDir, "shared.png")
+	if n, err := db.FileRefCount("shared.png"); err != nil || n != 2 {
+		t.Fatalf("FileRefCount = %d, %v; want 2", n, err)
+	}
+
+	if _, err := DeleteMatching(db, imgDir, catalog.DeleteFilter{Source: "first"}, false); err != nil {
+		t.Fatalf("DeleteMatching: %v", err)
+	}
+	if n, _ := db.FileRefCount("shared.png"); n != 1 {
+		t.Errorf("FileRefCount after one delete = %d, want 1", n)
+	}
+	img, err := db.GetByHash("bbbb")
+	if err != nil {
+		t.Fatalf("surviving row: %v", err)
+	}
+	if kind := checkFile(filepath.Join(imgDir, img.Filename)); kind != "" {
+		t.Errorf("surviving row's file is %s; a shared file was unlinked too early", kind)
+	}
+
+	if _, err := DeleteMatching(db, imgDir, catalog.DeleteFilter{Source: "second"}, false); err != nil {
+		t.Fatalf("DeleteMatching: %v", err)
+	}
+	if _, err := os.Stat(shared); !os.IsNotExist(err) {
+		t.Errorf("shared file still present after its last row was deleted (%v)", err)
+	}
+}
+
+func TestParseCategoryCaps(t *testing.T) {
+	caps, err := ParseCategoryCaps("sfw=5000, nsfw=200")
+	if err != nil {
+		t.Fatalf("ParseCategoryCaps: %v", err)
+	}
+	if caps["sfw"] != 5000 || caps["nsfw"] != 200 || len(caps) != 2 {
+		t.Fatalf("caps = %v", caps)
+	}
+
+	for _, bad := range []string{"sfw", "sfw=", "=3", "nsfw=-1", "sfw=abc"} {
+		if _, err := ParseCategoryCaps(bad); err == nil {
+			t.Errorf("ParseCategoryCaps(%q): expected error", bad)
+		}
+		if _, err := ParseCategoryByteCaps(bad); err == nil {
+			t.Errorf("ParseCategoryByteCaps(%q): expected error", bad)
+		}
+	}
+	byteCaps, err := ParseCategoryByteCaps("sfw=5000000000")
+	if err != nil || byteCaps["sfw"] != 5_000_000_000 {
+		t.Fatalf("ParseCategoryByteCaps = %v, %v", byteCaps, err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for i := 0; i < 4; i++ {
+		for _, c := range []string{"sfw", "nsfw"} {
+			hash := fmt.Sprintf("%s%d", c, i)
+			os.WriteFile(filepath.Join(imgDir, hash+".webp"), []byte("x"), 0o644)
+			db.Insert(&catalog.Image{
+				Hash: hash, Source: "test", SourceURL: "u", Category: c, Filename: hash + ".webp",
+			})
+		}
+	}
+
+	// Global cap only.
+	evicted, err := Evict(db, imgDir, EvictPolicy{MaxCount: 6})
+	if err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if evicted["sfw"]+evicted["nsfw"] != 2 {
+		t.Fatalf("global eviction = %v, want 2 total", evicted)
+	}
+
+	// Per-category cap leaves the other category alone.
+	evicted, err = Evict(db, imgDir, EvictPolicy{CategoryMaxCount: map[string]int{"nsfw": 1}})
+	if err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if evicted["sfw"] != 0 || evicted["nsfw"] != 2 {
+		t.Fatalf("category eviction = %v, want nsfw:2 only", evicted)
+	}
+
+	stats, _ := db.Stats()
+	if stats.SFWCount != 3 || stats.NSFWCount != 1 {
+		t.Fatalf("counts = %d sfw, %d nsfw; want 3, 1", stats.SFWCount, stats.NSFWCount)
+	}
+	if _, err := os.Stat(filepath.Join(imgDir, "nsfw1.webp")); !os.IsNotExist(err) {
+		t.Fatal("expected evicted file to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(imgDir, "nsfw3.webp")); err != nil {
+		t.Fatalf("newest nsfw file removed: %v", err)
+	}
+}
+
+func TestEvict_CategoryBytes(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for i := 0; i < 4; i++ {
+		for _, c := range []string{"sfw", "nsfw"} {
+			hash := fmt.Sprintf("%s%d", c, i)
+			os.WriteFile(filepath.Join(imgDir, hash+".webp"), []byte("x"), 0o644)
+			db.Insert(&catalog.Image{
+				Hash: hash, Source: "test", SourceURL: "u", Category: c, Filename: hash + ".webp",
+				SizeBytes: 100,
+			})
+		}
+	}
+
+	// 250 bytes keeps the two newest sfw images and no nsfw ones go.
+	evicted, err := Evict(db, imgDir, EvictPolicy{CategoryMaxBytes: map[string]int64{"sfw": 250}})
+	if err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if evicted["sfw"] != 2 || evicted["nsfw"] != 0 {
+		t.Fatalf("evicted = %v, want sfw:2 only", evicted)
+	}
+	for name, want := range map[string]bool{"sfw0.webp": false, "sfw1.webp": false, "sfw2.webp": true, "sfw3.webp": true} {
+		if _, err := os.Stat(filepath.Join(imgDir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+	stats, _ := db.Stats()
+	if stats.SFWCount != 2 || stats.NSFWCount != 4 {
+		t.Fatalf("counts = %d sfw, %d nsfw; want 2, 4", stats.SFWCount, stats.NSFWCount)
+	}
+}
+
+func TestRepairFilenames(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	// Row says .webp but the file was left as .png.
+	os.WriteFile(filepath.Join(imgDir, "moved.png"), makePNG(2, 2), 0o644)
+	db.Insert(&catalog.Image{
+		Hash: "moved", Source: "test", SourceURL: "u", Category: "sfw",
+		Format: "webp", Filename: "moved.webp",
+	})
+	// Two candidates: ambiguous.
+	os.WriteFile(filepath.Join(imgDir, "twice.png"), []byte("x"), 0o644)
+	os.WriteFile(filepath.Join(imgDir, "twice.jpg"), []byte("x"), 0o644)
+	db.Insert(&catalog.Image{
+		Hash: "twice", Source: "test", SourceURL: "u", Category: "sfw", Filename: "twice.webp",
+	})
+	// Nothing on disk.
+	addImage(t, db, imgDir, "gone", nil)
+	// Already consistent.
+	addImage(t, db, imgDir, "fine", makePNG(2, 2))
+
+	report, err := RepairFilenames(db, imgDir)
+	if err != nil {
+		t.Fatalf("RepairFilenames: %v", err)
+	}
+	if report.Checked != 4 {
+		t.Fatalf("Checked = %d, want 4", report.Checked)
+	}
+	if report.Repaired["moved"] != "moved.png" || len(report.Repaired) != 1 {
+		t.Fatalf("Repaired = %v", report.Repaired)
+	}
+	if _, ok := report.Unrepairable["twice"]; !ok {
+		t.Fatalf("expected twice to be unrepairable: %v", report.Unrepairable)
+	}
+	if _, ok := report.Unrepairable["gone"]; !ok {
+		t.Fatalf("expected gone to be unrepairable: %v", report.Unrepairable)
+	}
+
+	// The repaired row now passes fsck.
+	fsck, err := Fsck(db, imgDir, false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	for _, p := range fsck.Problems {
+		if p.Hash == "moved" {
+			t.Fatalf("repaired row still has problem %q", p.Kind)
+		}
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	db, imgDir := testSetup(t)
+	pngs := map[string][]byte{"aa11": makePNG(2, 2), "bb22": makePNG(3, 3)}
+	for hash, data := range pngs {
+		addImage(t, db, imgDir, hash, data)
+	}
+	// A file in a shard that no row references.
+	old := time.Now().Add(-2 * orphanGrace)
+	stray := filepath.Join(imgDir, "cc", "cc33.png")
+	os.MkdirAll(filepath.Dir(stray), 0o755)
+	os.WriteFile(stray, makePNG(2, 2), 0o644)
+	os.Chtimes(stray, old, old)
+
+	report, err := MigrateLayout(db, imgDir, LayoutSharded)
+	if err != nil {
+		t.Fatalf("MigrateLayout: %v", err)
+	}
+	if report.Checked != 2 || report.Moved != 2 || report.Failed != 0 {
+		t.Fatalf("report = %+v, want 2 checked, 2 moved", report)
+	}
+	for hash, data := range pngs {
+		img, err := db.GetByHash(hash)
+		if err != nil {
+			t.Fatalf("GetByHash %s: %v", hash, err)
+		}
+		if want := LayoutSharded.Filename(hash, ".png"); img.Filename != want {
+			t.Errorf("%s filename = %q, want %q", hash, img.Filename, want)
+		}
+		if got, err := os.ReadFile(filepath.Join(imgDir, img.Filename)); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: sharded file differs (err %v)", hash, err)
+		}
+		if _, err := os.Stat(filepath.Join(imgDir, hash+".png")); err == nil {
+			t.Errorf("%s: flat file still present", hash)
+		}
+	}
+
+	// fsck reads the sharded rows and still finds the stray.
+	fsck, err := Fsck(db, imgDir, false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if len(fsck.Problems) != 1 || fsck.Problems[0].Kind != ProblemOrphan ||
+		fsck.Problems[0].Filename != filepath.Join("cc", "cc33.png") {
+		t.Fatalf("fsck problems = %+v, want only the stray orphan", fsck.Problems)
+	}
+
+	// A row left pointing at its flat name is repaired to the shard.
+	if err := db.UpdateFile("aa11", "aa11.png", "png"); err != nil {
+		t.Fatalf("UpdateFile: %v", err)
+	}
+	repair, err := RepairFilenames(db, imgDir)
+	if err != nil {
+		t.Fatalf("RepairFilenames: %v", err)
+	}
+	if got := repair.Repaired["aa11"]; got != "aa/aa11.png" {
+		t.Fatalf("repaired aa11 to %q, want aa/aa11.png", got)
+	}
+
+	if report, err := MigrateLayout(db, imgDir, LayoutSharded); err != nil || report.Moved != 0 {
+		t.Fatalf("second MigrateLayout = %+v, %v; want nothing moved", report, err)
+	}
+
+	// Back to flat: the emptied shards go, the one with the stray stays.
+	if report, err := MigrateLayout(db, imgDir, LayoutFlat); err != nil || report.Moved != 2 {
+		t.Fatalf("MigrateLayout flat = %+v, %v; want 2 moved", report, err)
+	}
+	for hash := range pngs {
+		if _, err := os.Stat(filepath.Join(imgDir, hash+".png")); err != nil {
+			t.Errorf("%s: flat file missing: %v", hash, err)
+		}
+		if _, err := os.Stat(filepath.Join(imgDir, hash[:2])); err == nil {
+			t.Errorf("%s: empty shard not removed", hash)
+		}
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("stray file: %v", err)
+	}
+}
+
+func TestPrune_Sharded(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, hash := range []string{"aa01", "bb02"} {
+		filename := LayoutSharded.Filename(hash, ".png")
+		os.MkdirAll(filepath.Join(imgDir, hash[:shardLen]), 0o755)
+		os.WriteFile(filepath.Join(imgDir, filename), makePNG(2, 2), 0o644)
+		os.MkdirAll(filepath.Dir(ResizedPath(imgDir, hash, 240)), 0o755)
+		os.WriteFile(ResizedPath(imgDir, hash, 240), makePNG(1, 1), 0o644)
+		os.MkdirAll(filepath.Dir(TranscodedPath(imgDir, hash, "png")), 0o755)
+		os.WriteFile(TranscodedPath(imgDir, hash, "png"), makePNG(1, 1), 0o644)
+		if _, err := db.Insert(&catalog.Image{
+			Hash: hash, Source: "test", SourceURL: "u", Category: "sfw",
+			Format: "png", SizeBytes: 100, Filename: filename,
+		}); err != nil {
+			t.Fatalf("insert %s: %v", hash, err)
+		}
+	}
+
+	n, err := Prune(db, imgDir, 0, 150)
+	if err != nil || n != 1 {
+		t.Fatalf("Prune = %d, %v; want 1", n, err)
+	}
+	for hash, want := range map[string]bool{"aa01": false, "bb02": true} {
+		for _, path := range []string{
+			filepath.Join(imgDir, LayoutSharded.Filename(hash, ".png")),
+			ResizedPath(imgDir, hash, 240),
+			TranscodedPath(imgDir, hash, "png"),
+		} {
+			if _, err := os.Stat(path); (err == nil) != want {
+				t.Errorf("%s exists = %v, want %v", path, err == nil, want)
+			}
+		}
+	}
+}
+
+func TestPregenThumbs(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	addImage(t, db, imgDir, "wide", makePNG(400, 200))
+	addImage(t, db, imgDir, "small", makePNG(20, 40))
+	addImage(t, db, imgDir, "missing", nil)
+
+	report, err := PregenThumbs(db, imgDir, 2, nil)
+	if err != nil {
+		t.Fatalf("PregenThumbs: %v", err)
+	}
+	if report.Checked != 3 || report.Generated != 1 || report.Current != 1 || report.Failed != 1 {
+		t.Fatalf("report = %+v, want 3 checked, 1 generated, 1 current, 1 failed", report)
+	}
+
+	data, err := os.ReadFile(ResizedPath(imgDir, "wide", ThumbSize))
+	if err != nil {
+		t.Fatalf("read thumb: %v", err)
+	}
+	img, _, err := optimize.Decode(data)
+	if err != nil {
+		t.Fatalf("decode thumb: %v", err)
+	}
+	if got, want := img.Bounds().Size(), image.Pt(128, 64); got != want {
+		t.Errorf("thumb is %v, want %v", got, want)
+	}
+	// The server serves images this narrow as stored.
+	if _, err := os.Stat(ResizedPath(imgDir, "small", ThumbSize)); !os.IsNotExist(err) {
+		t.Errorf("thumb written for an image narrower than ThumbSize: %v", err)
+	}
+
+	// A second pass finds everything current; touching a source regenerates.
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(imgDir, "wide.png"), future, future)
+	report, err = PregenThumbs(db, imgDir, 2, nil)
+	if err != nil {
+		t.Fatalf("second PregenThumbs: %v", err)
+	}
+	if report.Generated != 1 || report.Current != 1 {
+		t.Errorf("second report = %+v, want 1 generated, 1 current", report)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db, imgDir := testSetup(t)
+	same := makePNG(16, 16)
+	addImage(t, db, imgDir, "a", same)
+	addImage(t, db, imgDir, "b", same)
+	addImage(t, db, imgDir, "c", makePNG(8, 8))
+
+	report, err := Compact(db, imgDir, 2, nil)
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if report.Checked != 3 || report.Linked != 1 || report.Failed != 0 || report.Reclaimed != int64(len(same)) {
+		t.Errorf("report = %+v, want 3 checked, 1 linked, %d bytes reclaimed", report, len(same))
+	}
+	a, _ := os.Stat(filepath.Join(imgDir, "a.png"))
+	b, _ := os.Stat(filepath.Join(imgDir, "b.png"))
+	if !os.SameFile(a, b) {
+		t.Error("identical files were not linked")
+	}
+
+	// A second pass finds nothing left to do.
+	if report, err := Compact(db, imgDir, 2, nil); err != nil || report.Linked != 0 {
+		t.Errorf("second pass = %+v, %v; want nothing linked", report, err)
+	}
+
+	// Deleting one row's file leaves the other intact.
+	if err := os.Remove(filepath.Join(imgDir, "a.png")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(imgDir, "b.png")); err != nil || !bytes.Equal(data, same) {
+		t.Errorf("b.png after removing a.png: %v", err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	var dones []int
+	ForEach(items, 8, func(done, total int) {
+		mu.Lock()
+		dones = append(dones, done)
+		mu.Unlock()
+		if total != len(items) {
+			t.Errorf("progress total = %d, want %d", total, len(items))
+		}
+	}, func(i int) {
+		mu.Lock()
+		seen[i] = true
+		mu.Unlock()
+	})
+
+	if len(seen) != len(items) {
+		t.Errorf("processed %d distinct items, want %d", len(seen), len(items))
+	}
+	sort.Ints(dones)
+	for i, d := range dones {
+		if d != i+1 {
+			t.Fatalf("progress counts %v, want 1..%d once each", dones, len(items))
+		}
+	}
+}
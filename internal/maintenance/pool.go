@@ -0,0 +1,53 @@
+package maintenance
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Progress is called after each item of a maintenance pass with the number
+// of items finished so far and the total. Calls may come from several
+// goroutines but done never repeats.
+type Progress func(done, total int)
+
+// LogProgress returns a Progress that logs "name: N of M" roughly every 5%
+// and at the end.
+func LogProgress(name string) Progress {
+	return func(done, total int) {
+		step := max(total/20, 1)
+		if done%step == 0 || done == total {
+			log.Printf("%s: %d of %d", name, done, total)
+		}
+	}
+}
+
+// ForEach calls fn for every item using at most workers goroutines (values
+// below 1 mean the number of CPUs), reporting to progress if it is non-nil.
+// fn must be safe to call concurrently; catalog methods are.
+func ForEach[T any](items []T, workers int, progress Progress, fn func(T)) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	var done atomic.Int64
+	jobs := make(chan T)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(items)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				fn(item)
+				if progress != nil {
+					progress(int(done.Add(1)), len(items))
+				}
+			}
+		}()
+	}
+	for _, item := range items {
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// ReconcileReport summarizes a Reconcile pass.
+type ReconcileReport struct {
+	Checked  int              // catalog rows
+	Orphans  []string         // files no row references, relative to imgDir
+	Dangling []*catalog.Image // rows whose file is missing
+	Removed  int              // orphan files and dangling rows removed
+}
+
+// Reconcile brings imgDir and the catalog back in step: it removes files and
+// thumbnails no row references, which an ingest that crashed after writing
+// leaves behind, and deletes rows whose file is gone. Unlike Fsck it does not
+// decode images, so it is cheap enough to run often. Files younger than
+// orphanGrace are left alone. With dryRun nothing is removed and the report
+// lists what would be.
+func Reconcile(cat *catalog.DB, imgDir string, dryRun bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+	hashes := make(map[string]bool)
+	err := cat.Each(func(img *catalog.Image) error {
+		report.Checked++
+		hashes[img.Hash] = true
+		_, err := os.Stat(filepath.Join(imgDir, img.Filename))
+		if errors.Is(err, fs.ErrNotExist) {
+			report.Dangling = append(report.Dangling, img)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+	names, err := cat.AllFilenames()
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+	files := make(map[string]bool, len(names))
+	for _, name := range names {
+		files[name] = true
+	}
+	report.Orphans, err = findOrphans(imgDir, files, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	for _, img := range report.Dangling {
+		if err := cat.DeleteByHash(img.Hash); err != nil {
+			return report, fmt.Errorf("reconcile: %w", err)
+		}
+		removeThumb(imgDir, img.Hash, "reconcile")
+		report.Removed++
+	}
+	for _, name := range report.Orphans {
+		if removeOrphan(imgDir, name, "reconcile") {
+			report.Removed++
+		}
+	}
+	return report, nil
+}
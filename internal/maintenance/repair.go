@@ -0,0 +1,80 @@
+package maintenance
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// RepairReport summarizes a RepairFilenames pass.
+type RepairReport struct {
+	Checked int
+	// Repaired maps hash to the filename the row now points at.
+	Repaired map[string]string
+	// Unrepairable maps hash to the reason no single candidate was found.
+	Unrepairable map[string]string
+}
+
+// RepairFilenames reconciles catalog filenames with disk after an
+// interrupted operation: for every row whose file is missing it looks for
+// <hash>.* in imgDir and in the hash's shard (see ImageDirs) and, if
+// exactly one file matches, updates the row's filename and format to match
+// it.
+func RepairFilenames(cat *catalog.DB, imgDir string) (*RepairReport, error) {
+	report := &RepairReport{
+		Repaired:     map[string]string{},
+		Unrepairable: map[string]string{},
+	}
+
+	var broken []*catalog.Image
+	err := cat.Each(func(img *catalog.Image) error {
+		report.Checked++
+		if _, err := os.Stat(filepath.Join(imgDir, img.Filename)); err != nil {
+			broken = append(broken, img)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("repair: %w", err)
+	}
+
+	for _, img := range broken {
+		var matches []string
+		for _, dir := range ImageDirs(imgDir, img.Hash) {
+			m, _ := filepath.Glob(filepath.Join(dir, img.Hash+".*"))
+			matches = append(matches, m...)
+		}
+		switch len(matches) {
+		case 0:
+			report.Unrepairable[img.Hash] = "no file on disk"
+			continue
+		case 1:
+		default:
+			report.Unrepairable[img.Hash] = fmt.Sprintf("%d candidate files", len(matches))
+			continue
+		}
+
+		filename, err := filepath.Rel(imgDir, matches[0])
+		if err != nil {
+			return report, fmt.Errorf("repair: %w", err)
+		}
+		filename = filepath.ToSlash(filename)
+		if err := cat.UpdateFile(img.Hash, filename, formatFromExt(filename)); err != nil {
+			return report, fmt.Errorf("repair: %w", err)
+		}
+		report.Repaired[img.Hash] = filename
+	}
+	return report, nil
+}
+
+// formatFromExt maps a stored filename's extension to a catalog format name.
+func formatFromExt(filename string) string {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	if ext == "jpg" {
+		return "jpeg"
+	}
+	return ext
+}
@@ -0,0 +1,147 @@
+package maintenance
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// ThumbSize is the width, in pixels, of a generated thumbnail. Thumbnails
+// are stored as the server's cached ?w= resize of that width, so it must be
+// one of the widths the server caches on disk.
+const ThumbSize = 128
+
+// ResizedPath returns where the server caches hash resized to width w
+// under imgDir. These take the extension of optimize.OutputFormat and are
+// removed along with the image.
+func ResizedPath(imgDir, hash string, w int) string {
+	return filepath.Join(imgDir, "resized", hash+"_"+strconv.Itoa(w)+outputExt())
+}
+
+// outputExt is the file extension of what optimize.Encode produces.
+func outputExt() string {
+	return "." + optimize.OutputFormat()
+}
+
+// TranscodedPath returns where the server caches hash re-encoded in format
+// ("png" or "jpeg") under imgDir. These too are removed along with the
+// image.
+func TranscodedPath(imgDir, hash, format string) string {
+	return filepath.Join(imgDir, "transcoded", hash+"."+format)
+}
+
+// ThumbReport summarizes a PregenThumbs pass.
+type ThumbReport struct {
+	Checked   int
+	Generated int
+	// Current counts thumbnails not older than their source and images no
+	// wider than ThumbSize, which need none.
+	Current int
+	Failed  int
+}
+
+// PregenThumbs generates a ThumbSize thumbnail for every catalog image wider
+// than that which lacks one or whose source file is newer than its
+// thumbnail, so the server answers ?w=ThumbSize from disk. It runs at
+// most workers encodes at once (values below 1 mean the number of CPUs) and
+// reporting to progress if non-nil. Images whose source cannot be read or
+// decoded are counted as failed and left for Fsck to report.
+func PregenThumbs(cat *catalog.DB, imgDir string, workers int, progress Progress) (*ThumbReport, error) {
+	if err := os.MkdirAll(filepath.Dir(ResizedPath(imgDir, "", ThumbSize)), 0o755); err != nil {
+		return nil, err
+	}
+
+	var imgs []*catalog.Image
+	if err := cat.Each(func(img *catalog.Image) error {
+		imgs = append(imgs, img)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	report := &ThumbReport{Checked: len(imgs)}
+	var mu sync.Mutex
+	tally := func(count *int) {
+		mu.Lock()
+		*count++
+		mu.Unlock()
+	}
+	ForEach(imgs, workers, progress, func(img *catalog.Image) {
+		generated, err := pregenThumb(cat, imgDir, img)
+		switch {
+		case err != nil:
+			log.Printf("thumbs: %s: %v", img.Filename, err)
+			tally(&report.Failed)
+		case generated:
+			tally(&report.Generated)
+		default:
+			tally(&report.Current)
+		}
+	})
+	return report, nil
+}
+
+// pregenThumb writes the thumbnail for img, and records it as a variant as
+// the server would, unless a current one exists or img is no wider than
+// ThumbSize, which the server serves as stored.
+func pregenThumb(cat *catalog.DB, imgDir string, img *catalog.Image) (bool, error) {
+	src := filepath.Join(imgDir, img.Filename)
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	dst := ResizedPath(imgDir, img.Hash, ThumbSize)
+	if info, err := os.Stat(dst); err == nil && !srcInfo.ModTime().After(info.ModTime()) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return false, err
+	}
+	if c, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && c.Width <= ThumbSize {
+		return false, nil
+	}
+	// The same encode as the server's plain ?w= resize.
+	thumb, w, h, err := optimize.ForTerminal(data, ThumbSize)
+	if err != nil {
+		return false, err
+	}
+
+	// Write via a temp file so a concurrent reader never sees a partial thumb.
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, thumb, 0o644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	v := catalog.Variant{Width: w, Height: h, SizeBytes: int64(len(thumb)), Format: optimize.OutputFormat()}
+	if err := cat.PutVariant(img.Hash, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeThumb deletes the cached resizes, thumbnails among them, and
+// transcodes for hash, if any, in whatever format they were written.
+func removeThumb(imgDir, hash, caller string) {
+	resized, _ := filepath.Glob(filepath.Join(filepath.Dir(ResizedPath(imgDir, "", 0)), hash+"_*"))
+	transcoded, _ := filepath.Glob(TranscodedPath(imgDir, hash, "*"))
+	for _, path := range slices.Concat(resized, transcoded) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("%s: remove %s: %v", caller, path, err)
+		}
+	}
+}
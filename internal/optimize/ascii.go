@@ -0,0 +1,75 @@
+package optimize
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"strconv"
+)
+
+// asciiRamp orders characters from least to most ink, so bright pixels get
+// dense characters on the usual dark terminal background.
+const asciiRamp = " .:-=+*#%@"
+
+// asciiCellAspect is how many times taller than wide a terminal cell is.
+const asciiCellAspect = 2
+
+// ASCIIRows returns the number of text rows EncodeASCII renders an image
+// with bounds b into at cols columns, keeping its aspect ratio.
+func ASCIIRows(b image.Rectangle, cols int) int {
+	if b.Dx() <= 0 {
+		return 0
+	}
+	return max(1, (b.Dy()*cols+b.Dx()*asciiCellAspect/2)/(b.Dx()*asciiCellAspect))
+}
+
+// EncodeASCII renders img as cols columns of ASCII art, one line per row,
+// mapping each cell's luminance onto a character ramp. Transparent areas
+// come out blank.
+func EncodeASCII(img image.Image, cols int) ([]byte, error) {
+	return encodeASCII(img, cols, false)
+}
+
+// EncodeASCIIColor is EncodeASCII with each character colored by its cell
+// through 24-bit ANSI escapes, for terminals that support truecolor.
+func EncodeASCIIColor(img image.Image, cols int) ([]byte, error) {
+	return encodeASCII(img, cols, true)
+}
+
+func encodeASCII(img image.Image, cols int, truecolor bool) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("optimize: ascii art of an empty image")
+	}
+	if cols < 1 {
+		return nil, errors.New("optimize: ascii art needs at least one column")
+	}
+	rows := ASCIIRows(b, cols)
+	cells := Resize(img, b, cols, rows)
+
+	var buf bytes.Buffer
+	for y := range rows {
+		for x := range cols {
+			c := color.NRGBAModel.Convert(cells.At(x, y)).(color.NRGBA)
+			// Premultiply so transparency fades to the background.
+			lum := int(luma(c)) * int(c.A) / 255
+			ch := asciiRamp[lum*len(asciiRamp)/256]
+			if truecolor && ch != ' ' {
+				buf.WriteString("\x1b[38;2;")
+				buf.WriteString(strconv.Itoa(int(c.R)))
+				buf.WriteByte(';')
+				buf.WriteString(strconv.Itoa(int(c.G)))
+				buf.WriteByte(';')
+				buf.WriteString(strconv.Itoa(int(c.B)))
+				buf.WriteByte('m')
+			}
+			buf.WriteByte(ch)
+		}
+		if truecolor {
+			buf.WriteString("\x1b[0m")
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
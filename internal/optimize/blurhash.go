@@ -0,0 +1,117 @@
+package optimize
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// Blurhash component counts, horizontal and vertical. 4x3 gives a
+// 28-character string.
+const (
+	blurhashX = 4
+	blurhashY = 3
+)
+
+// blurhashSamples bounds how many pixels Blurhash looks at per axis; the
+// result only holds a few low frequencies, so a grid of samples is enough.
+const blurhashSamples = 64
+
+// base83 is the blurhash digit alphabet.
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash encodes img as a blurhash (https://blurha.sh) with 4x3
+// components, a short string clients decode into a blurred placeholder.
+// Pixels are sampled on a grid as in DominantColor; alpha is ignored.
+func Blurhash(img image.Image) (string, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return "", errors.New("optimize: blurhash of an empty image")
+	}
+	stepX := max(b.Dx()/blurhashSamples, 1)
+	stepY := max(b.Dy()/blurhashSamples, 1)
+
+	var factors [blurhashX * blurhashY][3]float64
+	var n int
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		fy := math.Pi * float64(y-b.Min.Y) / float64(b.Dy())
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			fx := math.Pi * float64(x-b.Min.X) / float64(b.Dx())
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			r, g, bl := srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)
+			for j := range blurhashY {
+				cy := math.Cos(fy * float64(j))
+				for i := range blurhashX {
+					basis := math.Cos(fx*float64(i)) * cy
+					f := &factors[j*blurhashX+i]
+					f[0] += basis * r
+					f[1] += basis * g
+					f[2] += basis * bl
+				}
+			}
+			n++
+		}
+	}
+	for k := range factors {
+		scale := 2 / float64(n)
+		if k == 0 {
+			scale = 1 / float64(n)
+		}
+		for c := range factors[k] {
+			factors[k][c] *= scale
+		}
+	}
+
+	var sb strings.Builder
+	writeBase83(&sb, (blurhashX-1)+(blurhashY-1)*9, 1)
+
+	ac := factors[1:]
+	var maxAC float64
+	for _, f := range ac {
+		maxAC = max(maxAC, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+	}
+	quantMax := int(max(0, min(82, math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantMax+1) / 166
+	writeBase83(&sb, quantMax, 1)
+
+	dc := factors[0]
+	writeBase83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		writeBase83(&sb, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return sb.String(), nil
+}
+
+// writeBase83 appends v as exactly length base83 digits.
+func writeBase83(sb *strings.Builder, v, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := v / int(math.Pow(83, float64(i))) % 83
+		sb.WriteByte(base83[digit])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow is |v|^exp with the sign of v.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,66 @@
+package optimize
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// dominantSamples bounds how many pixels DominantColor looks at per axis.
+const dominantSamples = 64
+
+// DominantColor returns the most common color of img. Pixels are sampled on
+// a grid, bucketed at 4 bits per channel so near-identical shades count
+// together, and the winning bucket's pixels are averaged. Transparent pixels
+// are ignored; a fully transparent image yields black.
+func DominantColor(img image.Image) color.RGBA {
+	b := img.Bounds()
+	stepX := max(b.Dx()/dominantSamples, 1)
+	stepY := max(b.Dy()/dominantSamples, 1)
+
+	type bucket struct{ n, r, g, b int }
+	var buckets [4096]bucket
+	best := -1
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			i := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk := &buckets[i]
+			bk.n++
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			if best < 0 || bk.n > buckets[best].n {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return color.RGBA{A: 255}
+	}
+	bk := buckets[best]
+	return color.RGBA{uint8(bk.r / bk.n), uint8(bk.g / bk.n), uint8(bk.b / bk.n), 255}
+}
+
+// HexColor formats c as "#rrggbb", ignoring alpha.
+func HexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// ParseHexColor parses "#rrggbb" (the # is optional) into an opaque color.
+func ParseHexColor(s string) (color.RGBA, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) != 6 {
+		return color.RGBA{}, fmt.Errorf("optimize: color %q is not #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("optimize: color %q is not #rrggbb", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
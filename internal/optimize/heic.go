@@ -0,0 +1,19 @@
+//go:build heic
+
+package optimize
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/gen2brain/heic"
+)
+
+// HEICSupported reports whether this build can decode HEIC/HEIF input.
+const HEICSupported = true
+
+// decodeHEIC decodes the first frame of a HEIC/HEIF image. The decoder is
+// pure Go (WASM under wazero) and uses a system libheif when one is found.
+func decodeHEIC(data []byte) (image.Image, error) {
+	return heic.Decode(bytes.NewReader(data))
+}
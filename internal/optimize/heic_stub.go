@@ -0,0 +1,12 @@
+//go:build !heic
+
+package optimize
+
+import "image"
+
+// HEICSupported reports whether this build can decode HEIC/HEIF input.
+const HEICSupported = false
+
+func decodeHEIC(data []byte) (image.Image, error) {
+	return nil, errHEICUnsupported
+}
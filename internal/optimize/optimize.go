@@ -1,24 +1,84 @@
 // Package optimize resizes and converts images for optimal terminal rendering.
 // Target format is WebP at max 480px width (portrait) or 480px height (landscape).
 // 24-bit color is preserved for halfblocks/Kitty protocol rendering.
+//
+// HEIC/HEIF input is only decoded when built with the heic tag
+// (go build -tags heic); other builds reject it with a clear error.
 package optimize
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 
 	"github.com/chai2010/webp"
+	"golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
 )
 
+// DefaultQuality is the WebP quality used for stored and re-encoded images.
+const DefaultQuality = 85
+
+// CheckQuality reports whether q is a usable lossy quality, 1 to 100.
+func CheckQuality(q int) error {
+	if q < 1 || q > 100 {
+		return fmt.Errorf("optimize: quality %d out of range 1-100", q)
+	}
+	return nil
+}
+
+// DefaultMaxWidth is the width stored images are scaled down to.
+const DefaultMaxWidth = 480
+
+// Settings selects the output encoding and resampling used by
+// ForTerminalWith. The zero value is not valid; start from DefaultSettings.
+type Settings struct {
+	Format       string // "webp", "png" or "jpeg"; "" means OutputFormat()
+	Quality      int    // lossy quality 1-100; ignored for png
+	Interpolator string // "catmullrom", "bilinear", "approxbilinear" or "nearest"
+}
+
+// DefaultSettings are the settings used by ForTerminal.
+var DefaultSettings = Settings{Quality: DefaultQuality, Interpolator: "catmullrom"}
+
+// interpolators maps Settings.Interpolator names to scalers.
+var interpolators = map[string]draw.Scaler{
+	"catmullrom":     draw.CatmullRom,
+	"bilinear":       draw.BiLinear,
+	"approxbilinear": draw.ApproxBiLinear,
+	"nearest":        draw.NearestNeighbor,
+}
+
 // ForTerminal resizes an image to fit within maxWidth pixels (maintaining
-// aspect ratio) and encodes as WebP. Returns the encoded bytes, final
-// width, final height, and any error.
+// aspect ratio) and encodes as WebP (or the Probe fallback format). Returns
+// the encoded bytes, final width, final height, and any error.
 func ForTerminal(data []byte, maxWidth int) ([]byte, int, int, error) {
+	return ForTerminalWith(data, maxWidth, DefaultSettings)
+}
+
+// ForTerminalWith is ForTerminal with explicit output settings. An
+// out-of-range quality is an error for lossy formats.
+func ForTerminalWith(data []byte, maxWidth int, s Settings) ([]byte, int, int, error) {
+	scaler, ok := interpolators[s.Interpolator]
+	if !ok {
+		return nil, 0, 0, fmt.Errorf("optimize: unknown interpolator %q", s.Interpolator)
+	}
+	format := s.Format
+	if format == "" {
+		format = OutputFormat()
+	}
+	if format != "png" {
+		if err := CheckQuality(s.Quality); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
 	// Decode the input image.
 	img, _, err := decodeImage(data)
 	if err != nil {
@@ -37,21 +97,132 @@ func ForTerminal(data []byte, maxWidth int) ([]byte, int, int, error) {
 		newH = int(float64(origH) * ratio)
 	}
 
-	// Resize using high-quality Catmull-Rom interpolation.
 	dst := image.NewRGBA(image.Rect(0, 0, newW, newH))
-	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	scaler.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	out, err := EncodeAs(dst, format, s.Quality)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return out, newW, newH, nil
+}
+
+// Errors returned by Decode, ForTerminal and the other decoding
+// functions, matchable with errors.Is.
+var (
+	// ErrCorruptImage means data looks like a format we decode, going by
+	// its magic bytes, but is truncated or damaged, as a file cut short by
+	// a crash mid-write is.
+	ErrCorruptImage = errors.New("corrupt image")
+	// ErrUnsupportedFormat means data is in no format we can decode, e.g.
+	// AVIF, or HEIC in a build without the heic tag.
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+)
+
+// Decode decodes image bytes in any supported input format, returning the
+// image and the detected format name. A failure wraps ErrCorruptImage or
+// ErrUnsupportedFormat.
+func Decode(data []byte) (image.Image, string, error) {
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("optimize: decode: %w", err)
+	}
+	return img, format, nil
+}
+
+// Encode encodes img as WebP at DefaultQuality, or in the fallback format
+// chosen by Probe if WebP encoding is unavailable.
+func Encode(img image.Image) ([]byte, error) {
+	return EncodeAs(img, OutputFormat(), DefaultQuality)
+}
 
-	// Encode as WebP.
+// EncodeAs encodes img in format ("webp", "png" or "jpeg") at quality.
+func EncodeAs(img image.Image, format string, quality int) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := webp.Encode(&buf, dst, &webp.Options{Quality: 85}); err != nil {
-		return nil, 0, 0, fmt.Errorf("optimize: encode webp: %w", err)
+	var err error
+	switch format {
+	case "webp":
+		err = encodeWebP(&buf, img, quality)
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	default:
+		return nil, fmt.Errorf("optimize: unknown output format %q", format)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("optimize: encode %s: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Sniff reports the image format indicated by the leading magic bytes of
+// data ("webp", "png", "jpeg", "gif" or "avif"), or "" if none match. It is a
+// cheap sanity check for stored files, not a full decode.
+func Sniff(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case len(data) >= 12 && string(data[4:12]) == "ftypavif":
+		return "avif"
+	}
+	return ""
+}
+
+// errHEICUnsupported is returned for HEIC/HEIF input in builds without the
+// heic tag.
+var errHEICUnsupported = fmt.Errorf("%w: HEIC not supported in this build (rebuild with -tags heic)", ErrUnsupportedFormat)
+
+// heicBrands are the ISOBMFF major brands identifying HEIC/HEIF files.
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true, "hevc": true, "hevx": true,
+}
+
+// isHEIC reports whether data starts with a HEIC/HEIF file-type box.
+func isHEIC(data []byte) bool {
+	return len(data) >= 12 && string(data[4:8]) == "ftyp" && heicBrands[string(data[8:12])]
+}
 
-	return buf.Bytes(), newW, newH, nil
+// encodeWebP is the WebP encoder, swappable so tests can simulate a build
+// without one.
+//
+// Only quality is tunable. chai2010/webp encodes through libwebp's simple
+// WebPEncodeRGBA API, which fixes the compression method (effort) at the
+// library default of 4, so there is no speed-for-size knob to expose.
+var encodeWebP = func(w io.Writer, img image.Image, quality int) error {
+	return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
 }
 
-// decodeImage tries multiple image formats.
+// decodeImage decodes data with decodeAny and turns JPEGs upright according
+// to their EXIF orientation, which the decoder ignores.
 func decodeImage(data []byte) (image.Image, string, error) {
+	img, format, err := decodeAny(data)
+	if err == nil && format == "jpeg" {
+		img = orient(img, Orientation(data))
+	}
+	return img, format, err
+}
+
+// decodeAny tries multiple image formats.
+func decodeAny(data []byte) (image.Image, string, error) {
+	if isHEIC(data) {
+		img, err := decodeHEIC(data)
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return nil, "", err
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: heic: %v", ErrCorruptImage, err)
+		}
+		return img, "heic", nil
+	}
+
 	r := bytes.NewReader(data)
 
 	// Try standard formats first.
@@ -59,6 +230,7 @@ func decodeImage(data []byte) (image.Image, string, error) {
 	if err == nil {
 		return img, format, nil
 	}
+	stdErr := err
 
 	// Try WebP.
 	r.Reset(data)
@@ -83,5 +255,22 @@ func decodeImage(data []byte) (image.Image, string, error) {
 		return img, "gif", nil
 	}
 
-	return nil, "", fmt.Errorf("unsupported image format")
+	r.Reset(data)
+	if img, err = bmp.Decode(r); err == nil {
+		return img, "bmp", nil
+	}
+
+	r.Reset(data)
+	if img, err = tiff.Decode(r); err == nil {
+		return img, "tiff", nil
+	}
+
+	// Nothing decoded it. If the magic bytes name a format we handle, the
+	// file is damaged rather than foreign.
+	switch format := Sniff(data); format {
+	case "", "avif":
+		return nil, "", ErrUnsupportedFormat
+	default:
+		return nil, "", fmt.Errorf("%w: %s: %v", ErrCorruptImage, format, stdErr)
+	}
 }
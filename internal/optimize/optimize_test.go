@@ -3,11 +3,19 @@ package optimize
 import (
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/chai2010/webp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 func makePNG(w, h int) []byte {
@@ -81,3 +89,538 @@ func TestForTerminal_InvalidData(t *testing.T) {
 		t.Fatal("expected error for invalid image data")
 	}
 }
+
+func TestForTerminalWith_Formats(t *testing.T) {
+	input := makePNG(200, 100)
+	for _, format := range []string{"webp", "png", "jpeg"} {
+		s := Settings{Format: format, Quality: 75, Interpolator: "bilinear"}
+		out, w, h, err := ForTerminalWith(input, 100, s)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if w != 100 || h != 50 {
+			t.Errorf("%s: got %dx%d, want 100x50", format, w, h)
+		}
+		if got := Sniff(out); got != format {
+			t.Errorf("%s: output sniffs as %q", format, got)
+		}
+	}
+
+	if _, _, _, err := ForTerminalWith(input, 100, Settings{Format: "bmp", Interpolator: "nearest"}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if _, _, _, err := ForTerminalWith(input, 100, Settings{Format: "webp", Interpolator: "lanczos"}); err == nil {
+		t.Error("expected error for unknown interpolator")
+	}
+	for _, q := range []int{0, 101} {
+		if _, _, _, err := ForTerminalWith(input, 100, Settings{Format: "webp", Quality: q, Interpolator: "nearest"}); err == nil {
+			t.Errorf("expected error for quality %d", q)
+		}
+	}
+}
+
+func TestForTerminal_BMPAndTIFF(t *testing.T) {
+	src, err := png.Decode(bytes.NewReader(makePNG(600, 300)))
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	encoders := map[string]func(io.Writer, image.Image) error{
+		"bmp":  bmp.Encode,
+		"tiff": func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) },
+	}
+	for name, encode := range encoders {
+		var buf bytes.Buffer
+		if err := encode(&buf, src); err != nil {
+			t.Fatalf("encode %s: %v", name, err)
+		}
+
+		_, format, err := Decode(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Decode %s: %v", name, err)
+		}
+		if format != name {
+			t.Errorf("Decode %s reported format %q", name, format)
+		}
+
+		out, w, h, err := ForTerminal(buf.Bytes(), 480)
+		if err != nil {
+			t.Fatalf("ForTerminal %s: %v", name, err)
+		}
+		if w != 480 || h != 240 || Sniff(out) != "webp" {
+			t.Errorf("%s: got %dx%d %q, want 480x240 webp", name, w, h, Sniff(out))
+		}
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	webpData, err := EncodeAs(image.NewRGBA(image.Rect(0, 0, 64, 64)), "webp", DefaultQuality)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	pngData := makePNG(64, 64)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"truncated webp", webpData[:len(webpData)/2], ErrCorruptImage},
+		{"webp header only", webpData[:16], ErrCorruptImage},
+		{"truncated png", pngData[:len(pngData)/2], ErrCorruptImage},
+		{"garbage", []byte("not an image at all"), ErrUnsupportedFormat},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), ErrUnsupportedFormat},
+	}
+	for _, tt := range tests {
+		_, _, err := Decode(tt.data)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Decode error = %v, want %v", tt.name, err, tt.want)
+		}
+		if _, _, _, err := ForTerminal(tt.data, 100); !errors.Is(err, tt.want) {
+			t.Errorf("%s: ForTerminal error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecode_HEIC(t *testing.T) {
+	// testdata/tiny.heic comes from github.com/gen2brain/heic (MIT).
+	data, err := os.ReadFile("testdata/tiny.heic")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	if !HEICSupported {
+		if _, _, err := Decode(data); !errors.Is(err, errHEICUnsupported) || !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Decode error = %v, want errHEICUnsupported", err)
+		}
+		t.Skip("HEIC support not compiled in (build with -tags heic)")
+	}
+
+	_, format, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if format != "heic" {
+		t.Errorf("format = %q, want heic", format)
+	}
+	out, _, _, err := ForTerminal(data, 480)
+	if err != nil {
+		t.Fatalf("ForTerminal: %v", err)
+	}
+	if Sniff(out) != "webp" {
+		t.Errorf("output sniffs as %q, want webp", Sniff(out))
+	}
+}
+
+func TestWatermark_Corner(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.RGBA{R: 40, G: 120, B: 200, A: 255})
+		}
+	}
+
+	out := Watermark(src, "waifu-mirror", BottomRight)
+	if out.Bounds().Dx() != 200 || out.Bounds().Dy() != 100 {
+		t.Fatalf("watermark changed dimensions to %v", out.Bounds())
+	}
+
+	changed := func(r image.Rectangle) int {
+		var n int
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if out.At(x, y) != src.At(x, y) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	if n := changed(image.Rect(100, 70, 200, 100)); n == 0 {
+		t.Fatal("expected bottom-right corner to differ from input")
+	}
+	if n := changed(image.Rect(0, 0, 100, 30)); n != 0 {
+		t.Fatalf("top-left corner changed in %d pixels, want 0", n)
+	}
+
+	// The source image must not be modified.
+	if src.At(195, 95) != (color.RGBA{R: 40, G: 120, B: 200, A: 255}) {
+		t.Fatal("Watermark modified its input")
+	}
+}
+
+func TestSniff(t *testing.T) {
+	webpData, _, _, err := ForTerminal(makePNG(16, 16), 480)
+	if err != nil {
+		t.Fatalf("ForTerminal: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"png", makePNG(4, 4), "png"},
+		{"webp", webpData, "webp"},
+		{"empty", nil, ""},
+		{"truncated riff", []byte("RIFF"), ""},
+		{"html", []byte("<!DOCTYPE html><html></html>"), ""},
+	}
+	for _, tt := range tests {
+		if got := Sniff(tt.data); got != tt.want {
+			t.Errorf("Sniff(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProbe_FallsBackWithoutWebP(t *testing.T) {
+	orig := encodeWebP
+	t.Cleanup(func() {
+		encodeWebP = orig
+		Probe()
+	})
+
+	if got := Probe(); got != "webp" {
+		t.Fatalf("Probe with working WebP = %q", got)
+	}
+
+	encodeWebP = func(io.Writer, image.Image, int) error { return errors.New("webp disabled") }
+	if got := Probe(); got != "png" {
+		t.Fatalf("Probe without WebP = %q, want png", got)
+	}
+	if OutputFormat() != "png" {
+		t.Errorf("OutputFormat = %q, want png", OutputFormat())
+	}
+
+	out, _, _, err := ForTerminal(makePNG(10, 10), 480)
+	if err != nil {
+		t.Fatalf("ForTerminal: %v", err)
+	}
+	if Sniff(out) != "png" {
+		t.Errorf("ForTerminal output sniffs as %q, want png", Sniff(out))
+	}
+}
+
+func TestResizePlan(t *testing.T) {
+	tests := []struct {
+		name       string
+		w, h       int // source
+		boxW, boxH int
+		fit        Fit
+		upscale    bool
+		src        image.Rectangle
+		outW, outH int
+	}{
+		{"contain landscape", 400, 200, 100, 100, FitContain, false, image.Rect(0, 0, 400, 200), 100, 50},
+		{"contain width only", 400, 200, 100, 0, FitContain, false, image.Rect(0, 0, 400, 200), 100, 50},
+		{"contain height only", 400, 200, 0, 50, FitContain, false, image.Rect(0, 0, 400, 200), 100, 50},
+		{"contain never upscales", 40, 20, 100, 100, FitContain, false, image.Rect(0, 0, 40, 20), 40, 20},
+		{"cover landscape", 400, 200, 100, 100, FitCover, false, image.Rect(100, 0, 300, 200), 100, 100},
+		{"cover portrait", 200, 400, 100, 50, FitCover, false, image.Rect(0, 150, 200, 250), 100, 50},
+		{"cover small source", 60, 30, 100, 100, FitCover, false, image.Rect(15, 0, 45, 30), 30, 30},
+		{"contain upscale", 40, 20, 100, 100, FitContain, true, image.Rect(0, 0, 40, 20), 100, 50},
+		{"contain upscale height only", 40, 20, 0, 60, FitContain, true, image.Rect(0, 0, 40, 20), 120, 60},
+		{"cover upscale", 60, 30, 100, 100, FitCover, true, image.Rect(15, 0, 45, 30), 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, w, h := ResizePlan(image.Rect(0, 0, tt.w, tt.h), tt.boxW, tt.boxH, tt.fit, tt.upscale)
+			if src != tt.src || w != tt.outW || h != tt.outH {
+				t.Errorf("got %v %dx%d, want %v %dx%d", src, w, h, tt.src, tt.outW, tt.outH)
+			}
+		})
+	}
+}
+
+func TestResize_SubRectangle(t *testing.T) {
+	// Left half red, right half blue: a crop of the right half is all blue.
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 50 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	out := Resize(img, image.Rect(50, 0, 100, 50), 20, 20)
+	if b := out.Bounds(); b.Dx() != 20 || b.Dy() != 20 {
+		t.Fatalf("size = %v, want 20x20", b)
+	}
+	if r, _, bl, _ := out.At(10, 10).RGBA(); r != 0 || bl == 0 {
+		t.Errorf("center pixel = %v, want blue", out.At(10, 10))
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	// Two thirds pink with slight noise, one third blue.
+	img := image.NewRGBA(image.Rect(0, 0, 90, 90))
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 90; x++ {
+			c := color.RGBA{0x20, 0x40, 0xf0, 255}
+			if x < 60 {
+				c = color.RGBA{0xf0 + uint8(x%3), 0x10, 0xa0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	// The pink bucket wins and its shades are averaged.
+	if got := HexColor(DominantColor(img)); got != "#f110a0" {
+		t.Errorf("DominantColor = %s, want #f110a0", got)
+	}
+
+	if got := DominantColor(image.NewNRGBA(image.Rect(0, 0, 4, 4))); got != (color.RGBA{A: 255}) {
+		t.Errorf("DominantColor(transparent) = %v, want black", got)
+	}
+}
+
+func TestGrayscaleAndSepia(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(5, 5, 37, 37))
+	for y := 5; y < 37; y++ {
+		for x := 5; x < 37; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 7), 200, uint8(x * 6)})
+		}
+	}
+
+	gray := Grayscale(img)
+	if b := gray.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Fatalf("Grayscale bounds = %v, want 32x32", b)
+	}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := gray.(*image.NRGBA).NRGBAAt(x, y)
+			if c.R != c.G || c.G != c.B {
+				t.Fatalf("Grayscale pixel (%d,%d) = %v, want R == G == B", x, y, c)
+			}
+			if want := img.NRGBAAt(x+5, y+5).A; c.A != want {
+				t.Fatalf("Grayscale pixel (%d,%d) alpha = %d, want %d", x, y, c.A, want)
+			}
+		}
+	}
+	// White stays white, pure blue goes dark.
+	if c := color.NRGBAModel.Convert(Grayscale(solid(color.NRGBA{255, 255, 255, 255})).At(0, 0)); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("Grayscale(white) = %v", c)
+	}
+	if c := color.NRGBAModel.Convert(Grayscale(solid(color.NRGBA{0, 0, 255, 255})).At(0, 0)).(color.NRGBA); c.R != 29 {
+		t.Errorf("Grayscale(blue) = %v, want luma 29", c)
+	}
+
+	// Sepia is warm: red >= green >= blue, and saturates white.
+	sep := Sepia(img).(*image.NRGBA)
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if c := sep.NRGBAAt(x, y); c.R < c.G || c.G < c.B {
+				t.Fatalf("Sepia pixel (%d,%d) = %v, want R >= G >= B", x, y, c)
+			}
+		}
+	}
+	if c := color.NRGBAModel.Convert(Sepia(solid(color.NRGBA{255, 255, 255, 255})).At(0, 0)); c != (color.NRGBA{255, 255, 239, 255}) {
+		t.Errorf("Sepia(white) = %v, want {255 255 239 255}", c)
+	}
+}
+
+// solid returns a 1x1 image of c.
+func solid(c color.NRGBA) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, c)
+	return img
+}
+
+func TestEncodeASCII(t *testing.T) {
+	// Black on the left, white on the right, 200x100.
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 100; x < 200; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	for _, cols := range []int{1, 8, 80} {
+		out, err := EncodeASCII(img, cols)
+		if err != nil {
+			t.Fatalf("EncodeASCII(%d): %v", cols, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		// Cells are twice as tall as wide: 2:1 pixels at 2:1 cells.
+		wantRows := max(1, cols/4)
+		if got := ASCIIRows(img.Bounds(), cols); got != wantRows {
+			t.Errorf("ASCIIRows(%d) = %d, want %d", cols, got, wantRows)
+		}
+		if len(lines) != wantRows {
+			t.Fatalf("EncodeASCII(%d): %d rows, want %d", cols, len(lines), wantRows)
+		}
+		for i, line := range lines {
+			if len(line) != cols {
+				t.Fatalf("EncodeASCII(%d): row %d has %d columns", cols, i, len(line))
+			}
+		}
+		if cols == 80 && (lines[0][0] != ' ' || lines[0][79] != '@') {
+			t.Errorf("EncodeASCII(80) row 0 = %q, want blank to @", lines[0])
+		}
+	}
+
+	out, err := EncodeASCIIColor(img, 20)
+	if err != nil {
+		t.Fatalf("EncodeASCIIColor: %v", err)
+	}
+	if !strings.Contains(string(out), "\x1b[38;2;255;255;255m@") || strings.Count(string(out), "\n") != 5 {
+		t.Errorf("EncodeASCIIColor output = %q", out)
+	}
+
+	if _, err := EncodeASCII(img, 0); err == nil {
+		t.Error("EncodeASCII(0 cols) succeeded, want error")
+	}
+	if _, err := EncodeASCII(image.NewRGBA(image.Rectangle{}), 80); err == nil {
+		t.Error("EncodeASCII(empty image) succeeded, want error")
+	}
+}
+
+func TestBlurhash(t *testing.T) {
+	// Red rising left to right, green top to bottom.
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / 31), uint8(y * 255 / 31), 128, 255})
+		}
+	}
+	got, err := Blurhash(img)
+	if err != nil {
+		t.Fatalf("Blurhash: %v", err)
+	}
+	// Component counts, AC scale and average color; the AC digits may
+	// differ in rounding between platforms.
+	if len(got) != 28 || !strings.HasPrefix(got, "L$Het8") {
+		t.Errorf("Blurhash = %q, want 28 characters starting L$Het8", got)
+	}
+
+	if _, err := Blurhash(image.NewRGBA(image.Rect(0, 0, 0, 0))); err == nil {
+		t.Error("Blurhash of an empty image succeeded")
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	for s, want := range map[string]color.RGBA{
+		"#ff00aa": {0xff, 0x00, 0xaa, 255},
+		"FF00AA":  {0xff, 0x00, 0xaa, 255},
+	} {
+		if got, err := ParseHexColor(s); err != nil || got != want {
+			t.Errorf("ParseHexColor(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "#fff", "#gg0000", "#ff00aa00"} {
+		if _, err := ParseHexColor(s); err == nil {
+			t.Errorf("ParseHexColor(%q) succeeded, want error", s)
+		}
+	}
+}
+
+// orientedJPEG encodes a w x h JPEG, red on the left half and blue on the
+// right, with an EXIF orientation tag o in the given TIFF byte order.
+func orientedJPEG(t *testing.T, w, h, o int, order binary.AppendByteOrder) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := []byte("MM\x00\x2a")
+	if order == binary.LittleEndian {
+		tiff = []byte("II\x2a\x00")
+	}
+	tiff = order.AppendUint32(tiff, 8)                  // IFD0 offset
+	tiff = order.AppendUint16(tiff, 1)                  // one entry
+	tiff = order.AppendUint16(tiff, exifOrientationTag) // tag
+	tiff = order.AppendUint16(tiff, 3)                  // SHORT
+	tiff = order.AppendUint32(tiff, 1)                  // count
+	tiff = order.AppendUint16(tiff, uint16(o))          // value, padded
+	tiff = order.AppendUint16(tiff, 0)
+	tiff = order.AppendUint32(tiff, 0) // no next IFD
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+
+	data := buf.Bytes()
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(app1)+2))
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+func TestOrientation(t *testing.T) {
+	for o := 1; o <= 8; o++ {
+		for _, order := range []binary.AppendByteOrder{binary.BigEndian, binary.LittleEndian} {
+			if got := Orientation(orientedJPEG(t, 8, 4, o, order)); got != o {
+				t.Errorf("Orientation(%d, %v) = %d", o, order, got)
+			}
+		}
+	}
+	oriented := orientedJPEG(t, 8, 4, 6, binary.BigEndian)
+	app1Len := 2 + int(binary.BigEndian.Uint16(oriented[4:]))
+	for name, data := range map[string][]byte{
+		"png":       makePNG(8, 4),
+		"no exif":   append(oriented[:2:2], oriented[2+app1Len:]...),
+		"truncated": oriented[:20],
+		"bad value": orientedJPEG(t, 8, 4, 9, binary.BigEndian),
+	} {
+		if got := Orientation(data); got != 1 {
+			t.Errorf("Orientation(%s) = %d, want 1", name, got)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image whose top-left pixel is marked, and where it ends up.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, color.RGBA{R: 255, A: 255})
+	corners := map[int]image.Point{
+		1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1},
+		5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2},
+	}
+	for o, at := range corners {
+		dst := orient(src, o)
+		wantSize := image.Pt(3, 2)
+		if o >= 5 {
+			wantSize = image.Pt(2, 3)
+		}
+		if got := dst.Bounds().Size(); got != wantSize {
+			t.Errorf("orientation %d: size %v, want %v", o, got, wantSize)
+			continue
+		}
+		if r, _, _, _ := dst.At(at.X, at.Y).RGBA(); r == 0 {
+			t.Errorf("orientation %d: marked pixel not at %v", o, at)
+		}
+	}
+}
+
+func TestForTerminal_EXIFOrientation(t *testing.T) {
+	// Orientation 6: stored 40x20 but shown turned clockwise, 20x40, with
+	// the stored left (red) half on top.
+	data := orientedJPEG(t, 40, 20, 6, binary.BigEndian)
+	out, w, h, err := ForTerminal(data, DefaultMaxWidth)
+	if err != nil {
+		t.Fatalf("ForTerminal: %v", err)
+	}
+	if w != 20 || h != 40 {
+		t.Fatalf("ForTerminal size = %dx%d, want 20x40", w, h)
+	}
+	img, _, err := Decode(out)
+	if err != nil {
+		t.Fatalf("decode output: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("output is %v, want 20x40", b)
+	}
+	top := color.RGBAModel.Convert(img.At(10, 5)).(color.RGBA)
+	bottom := color.RGBAModel.Convert(img.At(10, 35)).(color.RGBA)
+	if top.R < 200 || top.B > 60 || bottom.B < 200 || bottom.R > 60 {
+		t.Errorf("top %v, bottom %v; want red over blue", top, bottom)
+	}
+}
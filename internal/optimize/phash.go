@@ -0,0 +1,33 @@
+package optimize
+
+import (
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// DHash returns a 64-bit difference hash of img: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its right
+// neighbour. Re-encoded, slightly resized or lightly cropped copies of an
+// image hash within a few bits of each other; compare with HammingDistance.
+func DHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// HammingDistance is the number of bits in which a and b differ.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
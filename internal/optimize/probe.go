@@ -0,0 +1,52 @@
+package optimize
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"sync/atomic"
+)
+
+// outputFormat is the format produced by Encode and ForTerminal.
+// It starts as WebP and only changes if Probe finds WebP encoding broken.
+var outputFormat atomic.Value
+
+func init() { outputFormat.Store("webp") }
+
+// probeOrder lists output formats in order of preference.
+var probeOrder = []string{"webp", "png"}
+
+// OutputFormat returns the format Encode currently produces.
+func OutputFormat() string {
+	return outputFormat.Load().(string)
+}
+
+// Probe encodes a 1×1 test image in each preferred format and makes the first
+// that works the output format, so a build whose WebP encoder is missing or
+// broken degrades to PNG instead of failing every encode. It returns the
+// chosen format. Call it once at startup, before images are encoded.
+func Probe() string {
+	test := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	test.Set(0, 0, color.White)
+	for _, format := range probeOrder {
+		if _, err := EncodeAs(test, format, DefaultQuality); err != nil {
+			log.Printf("WARNING: optimize: %s encoding unavailable: %v", format, err)
+			continue
+		}
+		if format != probeOrder[0] {
+			log.Printf("WARNING: optimize: falling back to %s output; images will be larger", format)
+		}
+		outputFormat.Store(format)
+		return format
+	}
+	return OutputFormat()
+}
+
+// DecodeFormats lists the input formats this build can decode.
+func DecodeFormats() []string {
+	formats := []string{"webp", "png", "jpeg", "gif", "bmp", "tiff"}
+	if HEICSupported {
+		formats = append(formats, "heic")
+	}
+	return formats
+}
@@ -0,0 +1,69 @@
+package optimize
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Fit selects how an image is fitted into a target box.
+type Fit string
+
+const (
+	// FitContain scales the whole image to fit inside the box, keeping its
+	// aspect ratio. The result may be smaller than the box in one dimension.
+	FitContain Fit = "contain"
+	// FitCover scales and center-crops the image to fill the box exactly.
+	FitCover Fit = "cover"
+)
+
+// ResizePlan computes how to fit an image with bounds b into a boxW x boxH
+// box: the source sub-rectangle to use and the output size. For FitContain
+// a zero boxW or boxH leaves that dimension unconstrained; FitCover needs
+// both.
+//
+// Unless upscale is set, images are never scaled up, so the output can be
+// smaller than the box; for FitCover it keeps the box's aspect ratio.
+// Upscaling interpolates: the result is smoother than scaling left to a
+// browser, but has no more detail than the stored image.
+func ResizePlan(b image.Rectangle, boxW, boxH int, fit Fit, upscale bool) (src image.Rectangle, w, h int) {
+	sw, sh := b.Dx(), b.Dy()
+	if fit == FitCover && boxW > 0 && boxH > 0 {
+		// Crop the largest centered region with the box's aspect ratio.
+		cw, ch := sw, sh
+		if sw*boxH > sh*boxW {
+			cw = max(1, sh*boxW/boxH)
+		} else {
+			ch = max(1, sw*boxH/boxW)
+		}
+		x0 := b.Min.X + (sw-cw)/2
+		y0 := b.Min.Y + (sh-ch)/2
+		src = image.Rect(x0, y0, x0+cw, y0+ch)
+		if cw < boxW && !upscale {
+			return src, cw, ch
+		}
+		return src, boxW, boxH
+	}
+
+	scale := 1.0
+	if upscale && (boxW > 0 || boxH > 0) {
+		scale = math.Inf(1)
+	}
+	if boxW > 0 {
+		scale = min(scale, float64(boxW)/float64(sw))
+	}
+	if boxH > 0 {
+		scale = min(scale, float64(boxH)/float64(sh))
+	}
+	w = max(1, int(math.Round(float64(sw)*scale)))
+	h = max(1, int(math.Round(float64(sh)*scale)))
+	return b, w, h
+}
+
+// Resize scales the src sub-rectangle of img to a new w x h image.
+func Resize(img image.Image, src image.Rectangle, w, h int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Over, nil)
+	return dst
+}
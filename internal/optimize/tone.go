@@ -0,0 +1,51 @@
+package optimize
+
+import (
+	"image"
+	"image/color"
+)
+
+// Grayscale returns a copy of img with every pixel replaced by its luma
+// (ITU-R 601, as color.GrayModel), keeping alpha. R, G and B of the result
+// are equal.
+func Grayscale(img image.Image) image.Image {
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		y := luma(c)
+		return color.NRGBA{y, y, y, c.A}
+	})
+}
+
+// Sepia returns a copy of img toned brown with the common sepia matrix,
+// keeping alpha.
+func Sepia(img image.Image) image.Image {
+	return mapPixels(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return color.NRGBA{
+			clamp8(0.393*r + 0.769*g + 0.189*b),
+			clamp8(0.349*r + 0.686*g + 0.168*b),
+			clamp8(0.272*r + 0.534*g + 0.131*b),
+			c.A,
+		}
+	})
+}
+
+// mapPixels returns a copy of img with fn applied to every pixel.
+func mapPixels(img image.Image, fn func(color.NRGBA) color.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			dst.SetNRGBA(x-b.Min.X, y-b.Min.Y, fn(c))
+		}
+	}
+	return dst
+}
+
+func luma(c color.NRGBA) uint8 {
+	return uint8((19595*uint32(c.R) + 38470*uint32(c.G) + 7471*uint32(c.B) + 1<<15) >> 16)
+}
+
+func clamp8(v float64) uint8 {
+	return uint8(min(255, v+0.5))
+}
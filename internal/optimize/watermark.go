@@ -0,0 +1,73 @@
+package optimize
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Corner selects which corner of the image a watermark is drawn in.
+type Corner int
+
+const (
+	BottomRight Corner = iota
+	BottomLeft
+	TopRight
+	TopLeft
+)
+
+// watermarkPad is the gap in pixels between the watermark and the image edge.
+const watermarkPad = 4
+
+// ParseCorner parses a corner name such as "bottom-right" or "top-left".
+func ParseCorner(s string) (Corner, error) {
+	switch s {
+	case "bottom-right", "":
+		return BottomRight, nil
+	case "bottom-left":
+		return BottomLeft, nil
+	case "top-right":
+		return TopRight, nil
+	case "top-left":
+		return TopLeft, nil
+	}
+	return 0, fmt.Errorf("optimize: unknown corner %q", s)
+}
+
+// Watermark returns a copy of img with text drawn in the given corner over a
+// translucent backing box so it stays legible on light and dark art. The
+// source image is not modified.
+func Watermark(img image.Image, text string, pos Corner) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	if text == "" {
+		return dst
+	}
+
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: dst, Src: image.White, Face: face}
+	textW := d.MeasureString(text).Ceil()
+	metrics := face.Metrics()
+	textH := metrics.Height.Ceil()
+
+	x, y := watermarkPad, watermarkPad
+	if pos == BottomRight || pos == TopRight {
+		x = dst.Bounds().Dx() - textW - watermarkPad
+	}
+	if pos == BottomRight || pos == BottomLeft {
+		y = dst.Bounds().Dy() - textH - watermarkPad
+	}
+
+	box := image.Rect(x-2, y-2, x+textW+2, y+textH+2).Intersect(dst.Bounds())
+	draw.Draw(dst, box, image.NewUniform(color.RGBA{A: 160}), image.Point{}, draw.Over)
+
+	d.Dot = fixed.P(x, y+metrics.Ascent.Ceil())
+	d.DrawString(text)
+	return dst
+}
@@ -0,0 +1,79 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"strconv"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// upperHalf is drawn in the foreground color over the background color, so
+// one character cell shows two pixels stacked.
+const upperHalf = "▀"
+
+// HalfBlockRows returns the number of text rows HalfBlocks renders an image
+// with bounds b into at cols columns. Terminal cells are about twice as tall
+// as wide and each holds two pixels stacked, so the pixels stay square.
+func HalfBlockRows(b image.Rectangle, cols int) int {
+	if b.Dx() <= 0 {
+		return 0
+	}
+	return max(1, (b.Dy()*cols+b.Dx())/(2*b.Dx()))
+}
+
+// HalfBlocks renders img as cols columns of upper half block characters
+// with 24-bit ANSI colors, the top pixel of each cell as the foreground and
+// the bottom one as the background. It works in any truecolor terminal,
+// with no graphics protocol. Transparent areas come out black.
+func HalfBlocks(img image.Image, cols int) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("render: half blocks of an empty image")
+	}
+	if cols < 1 {
+		return nil, errors.New("render: half blocks need at least one column")
+	}
+	rows := HalfBlockRows(b, cols)
+	px := img
+	if b.Dx() != cols || b.Dy() != 2*rows {
+		px = optimize.Resize(img, b, cols, 2*rows)
+	}
+	pb := px.Bounds()
+
+	var buf bytes.Buffer
+	for y := range rows {
+		var fg, bg color.RGBA
+		for x := range cols {
+			top := rgb(px.At(pb.Min.X+x, pb.Min.Y+2*y))
+			bottom := rgb(px.At(pb.Min.X+x, pb.Min.Y+2*y+1))
+			// Colors carry over within a line, so repeats are left out.
+			if x == 0 || top != fg {
+				writeColor(&buf, "38", top)
+			}
+			if x == 0 || bottom != bg {
+				writeColor(&buf, "48", bottom)
+			}
+			fg, bg = top, bottom
+			buf.WriteString(upperHalf)
+		}
+		buf.WriteString("\x1b[0m\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// rgb returns c over black, as 8-bit channels.
+func rgb(c color.Color) color.RGBA {
+	r, g, b, _ := c.RGBA()
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}
+}
+
+// writeColor writes an SGR sequence setting the foreground (layer "38") or
+// background ("48") to c.
+func writeColor(buf *bytes.Buffer, layer string, c color.RGBA) {
+	buf.WriteString("\x1b[" + layer + ";2;")
+	buf.WriteString(strconv.Itoa(int(c.R)) + ";" + strconv.Itoa(int(c.G)) + ";" + strconv.Itoa(int(c.B)))
+	buf.WriteByte('m')
+}
@@ -0,0 +1,47 @@
+package render
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/draw"
+	"strconv"
+)
+
+// kittyChunk is the most base64 payload one Kitty graphics escape may
+// carry; longer images are sent in several.
+const kittyChunk = 4096
+
+// Kitty encodes img in the Kitty terminal graphics protocol, also spoken by
+// WezTerm: raw 32-bit RGBA, base64 encoded and split over APC escapes of at
+// most 4096 payload bytes. The terminal displays the image at the cursor
+// and, with q=2, sends no reply that would end up in the shell's input.
+func Kitty(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("render: kitty graphics of an empty image")
+	}
+	rgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	payload := base64.StdEncoding.EncodeToString(rgba.Pix)
+
+	var buf bytes.Buffer
+	for first := true; first || payload != ""; first = false {
+		n := min(len(payload), kittyChunk)
+		chunk := payload[:n]
+		payload = payload[n:]
+		buf.WriteString("\x1b_G")
+		if first {
+			buf.WriteString("a=T,f=32,q=2,s=" + strconv.Itoa(b.Dx()) + ",v=" + strconv.Itoa(b.Dy()) + ",")
+		}
+		if payload != "" {
+			buf.WriteString("m=1;")
+		} else {
+			buf.WriteString("m=0;")
+		}
+		buf.WriteString(chunk)
+		buf.WriteString("\x1b\\")
+	}
+	return buf.Bytes(), nil
+}
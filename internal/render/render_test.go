@@ -0,0 +1,139 @@
+package render
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestSixel(t *testing.T) {
+	// 4x7: black on the left half, white on the right; the seventh row
+	// starts a second band.
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 7))
+	for y := 0; y < 7; y++ {
+		for x := 0; x < 4; x++ {
+			c := color.NRGBA{A: 255}
+			if x >= 2 {
+				c = color.NRGBA{255, 255, 255, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	got, err := Sixel(img)
+	if err != nil {
+		t.Fatalf("Sixel: %v", err)
+	}
+	want := "\x1bP0;1;0q\"1;1;4;7" +
+		"#0;2;0;0;0#255;2;100;100;100" +
+		"#0~~$#255??~~$" +
+		"-#0@@$#255??@@$" +
+		"\x1b\\"
+	if string(got) != want {
+		t.Errorf("Sixel =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestSixel_RunsAndTransparency(t *testing.T) {
+	// One row: 10 red pixels, then 2 transparent ones.
+	img := image.NewNRGBA(image.Rect(0, 0, 12, 1))
+	for x := 0; x < 10; x++ {
+		img.SetNRGBA(x, 0, color.NRGBA{255, 0, 0, 255})
+	}
+	got, err := Sixel(img)
+	if err != nil {
+		t.Fatalf("Sixel: %v", err)
+	}
+	s := string(got)
+	// A run of ten is compressed, and the transparent tail is not drawn.
+	if !strings.Contains(s, "!10@$") || strings.Count(s, "#") != 2 {
+		t.Errorf("Sixel = %q, want one color drawn as a run of 10", s)
+	}
+
+	if _, err := Sixel(image.NewNRGBA(image.Rectangle{})); err == nil {
+		t.Error("Sixel(empty image) succeeded, want error")
+	}
+}
+
+func TestKitty(t *testing.T) {
+	// 64x64 RGBA is 16384 bytes, 21848 in base64: five full chunks and a
+	// short one.
+	img := image.NewNRGBA(image.Rect(10, 10, 74, 74))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	got, err := Kitty(img)
+	if err != nil {
+		t.Fatalf("Kitty: %v", err)
+	}
+	escapes := strings.Split(strings.TrimSuffix(string(got), "\x1b\\"), "\x1b\\")
+	if len(escapes) != 6 {
+		t.Fatalf("got %d escapes, want 6", len(escapes))
+	}
+	var payload strings.Builder
+	for i, e := range escapes {
+		control, data, ok := strings.Cut(strings.TrimPrefix(e, "\x1b_G"), ";")
+		if !ok || !strings.HasPrefix(e, "\x1b_G") {
+			t.Fatalf("escape %d = %.30q..., want an APC graphics command", i, e)
+		}
+		wantControl := "m=1"
+		switch i {
+		case 0:
+			wantControl = "a=T,f=32,q=2,s=64,v=64,m=1"
+		case len(escapes) - 1:
+			wantControl = "m=0"
+		}
+		if control != wantControl {
+			t.Errorf("escape %d control = %q, want %q", i, control, wantControl)
+		}
+		if i < len(escapes)-1 && len(data) != kittyChunk {
+			t.Errorf("escape %d carries %d bytes, want %d", i, len(data), kittyChunk)
+		}
+		payload.WriteString(data)
+	}
+	pix, err := base64.StdEncoding.DecodeString(payload.String())
+	if err != nil || !bytes.Equal(pix, img.Pix) {
+		t.Errorf("payload does not decode to the image's pixels (%v)", err)
+	}
+
+	// A small image fits one escape.
+	got, _ = Kitty(image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	if want := "\x1b_Ga=T,f=32,q=2,s=1,v=1,m=0;AAAAAA==\x1b\\"; string(got) != want {
+		t.Errorf("Kitty(1x1) = %q, want %q", got, want)
+	}
+}
+
+func TestHalfBlocks(t *testing.T) {
+	// 2x2: red over blue on the left, green over blue on the right, whose
+	// repeated background is not written again.
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 255, 0, 255})
+	img.SetNRGBA(0, 1, color.NRGBA{0, 0, 255, 255})
+	img.SetNRGBA(1, 1, color.NRGBA{0, 0, 255, 255})
+	got, err := HalfBlocks(img, 2)
+	if err != nil {
+		t.Fatalf("HalfBlocks: %v", err)
+	}
+	want := "\x1b[38;2;255;0;0m\x1b[48;2;0;0;255m▀" +
+		"\x1b[38;2;0;255;0m▀" +
+		"\x1b[0m\n"
+	if string(got) != want {
+		t.Errorf("HalfBlocks =\n%q\nwant\n%q", got, want)
+	}
+
+	// A 200x100 image at 40 columns keeps its shape: 10 rows of 40 cells.
+	got, err = HalfBlocks(image.NewNRGBA(image.Rect(0, 0, 200, 100)), 40)
+	if err != nil {
+		t.Fatalf("HalfBlocks: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if len(lines) != 10 || strings.Count(lines[0], "▀") != 40 {
+		t.Errorf("got %d rows of %d cells, want 10 of 40", len(lines), strings.Count(lines[0], "▀"))
+	}
+	if _, err := HalfBlocks(image.NewNRGBA(image.Rectangle{}), 40); err == nil {
+		t.Error("HalfBlocks(empty image) succeeded, want error")
+	}
+}
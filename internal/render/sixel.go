@@ -0,0 +1,119 @@
+// Package render encodes images as terminal graphics escape sequences, so a
+// client can pipe a response straight into a capable terminal without an
+// image library of its own. Encoders take an already decoded and sized
+// image.Image.
+package render
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"slices"
+)
+
+// sixelOpaque is the alpha at or above which a pixel is drawn; others are
+// left to the terminal background.
+const sixelOpaque = 0x80
+
+// Sixel encodes img as a DEC Sixel sequence. Colors are dithered to the
+// 256-color Plan 9 palette, which every Sixel terminal can hold.
+func Sixel(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("render: sixel of an empty image")
+	}
+	w, h := b.Dx(), b.Dy()
+	pal := image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9)
+	draw.FloydSteinberg.Draw(pal, pal.Bounds(), img, b.Min)
+	opaque := func(x, y int) bool {
+		_, _, _, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+		return a>>8 >= sixelOpaque
+	}
+
+	var buf bytes.Buffer
+	// P2=1: pixels left unset keep the background, so transparency works.
+	buf.WriteString("\x1bP0;1;0q")
+	fmt.Fprintf(&buf, "\"1;1;%d;%d", w, h)
+
+	used := make([]bool, len(palette.Plan9))
+	for y := range h {
+		for x := range w {
+			if opaque(x, y) {
+				used[pal.ColorIndexAt(x, y)] = true
+			}
+		}
+	}
+	for i, ok := range used {
+		if ok {
+			c := color.NRGBAModel.Convert(palette.Plan9[i]).(color.NRGBA)
+			fmt.Fprintf(&buf, "#%d;2;%d;%d;%d", i, percent(c.R), percent(c.G), percent(c.B))
+		}
+	}
+
+	// Each band is six pixel rows; every color present in it is drawn in
+	// its own pass over the band, returning to its start with "$".
+	bands := make(map[uint8][]byte)
+	for y0 := 0; y0 < h; y0 += 6 {
+		clear(bands)
+		for dy := 0; dy < 6 && y0+dy < h; dy++ {
+			for x := range w {
+				if !opaque(x, y0+dy) {
+					continue
+				}
+				i := pal.ColorIndexAt(x, y0+dy)
+				if bands[i] == nil {
+					bands[i] = make([]byte, w)
+				}
+				bands[i][x] |= 1 << dy
+			}
+		}
+		if y0 > 0 {
+			buf.WriteByte('-')
+		}
+		indexes := make([]uint8, 0, len(bands))
+		for i := range bands {
+			indexes = append(indexes, i)
+		}
+		slices.Sort(indexes)
+		for _, i := range indexes {
+			fmt.Fprintf(&buf, "#%d", i)
+			writeSixels(&buf, bands[i])
+			buf.WriteByte('$')
+		}
+	}
+	buf.WriteString("\x1b\\")
+	return buf.Bytes(), nil
+}
+
+// writeSixels writes one color's pass over a band, run-length encoding
+// repeats and dropping trailing blanks.
+func writeSixels(buf *bytes.Buffer, bits []byte) {
+	end := len(bits)
+	for end > 0 && bits[end-1] == 0 {
+		end--
+	}
+	for x := 0; x < end; {
+		n := 1
+		for x+n < end && bits[x+n] == bits[x] {
+			n++
+		}
+		ch := '?' + bits[x]
+		if n > 3 {
+			fmt.Fprintf(buf, "!%d%c", n, ch)
+		} else {
+			for range n {
+				buf.WriteByte(ch)
+			}
+		}
+		x += n
+	}
+}
+
+// percent scales a color channel to the 0-100 range Sixel uses.
+func percent(v uint8) int {
+	return (int(v)*100 + 127) / 255
+}
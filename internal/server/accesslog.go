@@ -0,0 +1,69 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// WithAccessLog logs every request to logger as it completes, with method,
+// path, status, bytes and latency fields. Nil, the default, logs nothing.
+func WithAccessLog(logger *slog.Logger) Option {
+	return func(c *config) { c.accessLog = logger }
+}
+
+// logRequests writes the WithAccessLog entries.
+func logRequests(cfg *config, h http.Handler) http.Handler {
+	if cfg.accessLog == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		cfg.accessLog.LogAttrs(r.Context(), slog.LevelInfo, "http request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.n),
+			slog.Duration("latency", time.Since(start)))
+	})
+}
+
+// statusWriter records the status and body size of a response. It passes
+// Flush through for the event streams.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
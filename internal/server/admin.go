@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+)
+
+// requireAuth wraps h so it only runs for requests carrying the configured
+// bearer token. Without a configured token the endpoint is disabled.
+func requireAuth(cfg *config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.authToken == "" {
+			http.Error(w, "admin API disabled: no auth token configured", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(cfg.authToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="waifu-mirror"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// exportHandler streams catalog rows newer than ?since=<id> as NDJSON. The
+// X-Export-Max-Id header carries the highest ID at the start of the export;
+// rows inserted while streaming may follow it and are safe to re-import.
+func exportHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since int64
+		if s := r.URL.Query().Get("since"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "since must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			since = n
+		}
+
+		maxID, err := cat.MaxID()
+		if err != nil {
+			slog.Error("export", "err", err)
+			http.Error(w, "export error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Export-Max-Id", strconv.FormatInt(maxID, 10))
+		if err := cat.ExportSince(since, w); err != nil {
+			// Headers are already sent; the truncated stream is the signal.
+			slog.Error("export", "err", err)
+		}
+	}
+}
+
+// imagePatch is the JSON body accepted by PATCH /api/image/{hash}.
+type imagePatch struct {
+	Category *string `json:"category"`
+}
+
+// patchImageHandler updates mutable metadata of one image and responds with
+// the updated row. Only known categories are accepted.
+func patchImageHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := r.PathValue("hash")
+		if hash == "" || !validHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+
+		var patch imagePatch
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&patch); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if patch.Category == nil {
+			http.Error(w, "nothing to update", http.StatusBadRequest)
+			return
+		}
+
+		category := *patch.Category
+		known := false
+		if validCategory.MatchString(category) {
+			var err error
+			if known, err = cat.CategoryExists(category); err != nil {
+				slog.Error("patch image", "err", err)
+				http.Error(w, "catalog error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !known {
+			http.Error(w, "unknown category", http.StatusBadRequest)
+			return
+		}
+
+		if err := cat.UpdateCategory(hash, category); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "image not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("patch image", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+		img, err := cat.GetByHash(hash)
+		if err != nil {
+			slog.Error("patch image", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(img)
+	}
+}
+
+// deleteRequest is the JSON body accepted by POST /api/admin/delete. At
+// least one of source, category and older_than must be set; max_views only
+// narrows them.
+type deleteRequest struct {
+	Source    string    `json:"source"`
+	Category  string    `json:"category"`
+	MaxViews  *int      `json:"max_views"`
+	OlderThan time.Time `json:"older_than"` // RFC 3339
+	DryRun    bool      `json:"dry_run"`
+}
+
+// deleteResponse reports the images a bulk delete removed, or would remove
+// for a dry run.
+type deleteResponse struct {
+	Count  int      `json:"count"`
+	DryRun bool     `json:"dry_run"`
+	Hashes []string `json:"hashes"`
+}
+
+// deleteHandler removes every image matching a filter, rows and files.
+func deleteHandler(cat *catalog.DB, imgDir string, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req deleteRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		filter := catalog.DeleteFilter{
+			Source:    req.Source,
+			Category:  req.Category,
+			MaxViews:  req.MaxViews,
+			OlderThan: req.OlderThan,
+		}
+		victims, err := maintenance.DeleteMatching(cat, imgDir, filter, req.DryRun)
+		if err != nil {
+			if errors.Is(err, catalog.ErrEmptyFilter) {
+				http.Error(w, "at least one of source, category or older_than is required", http.StatusBadRequest)
+				return
+			}
+			slog.Error("delete", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+		if !req.DryRun && len(victims) > 0 {
+			slog.Info("delete: removed images", "count", len(victims))
+			if cfg.warm != nil {
+				if err := cfg.warm.Reload(); err != nil {
+					slog.Error("delete: warm set", "err", err)
+				}
+			}
+		}
+
+		resp := deleteResponse{Count: len(victims), DryRun: req.DryRun, Hashes: []string{}}
+		for _, img := range victims {
+			resp.Hashes = append(resp.Hashes, img.Hash)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Limits for GET /api/admin/runs.
+const (
+	defaultRunsLimit = 50
+	maxRunsLimit     = 1000
+)
+
+// runsHandler lists recent ingest runs, newest first, with ?limit=<n>.
+func runsHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultRunsLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxRunsLimit {
+				http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		runs, err := cat.Runs(limit)
+		if err != nil {
+			slog.Error("runs", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runs)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// etag returns the strong entity tag for the image hash served with rp, tn,
+// format and cfg's watermark. An untransformed image's tag is its hash; a
+// transformed one appends a digest of everything that shapes the output.
+func etag(hash string, rp resizeParams, tn tone, format string, cfg *config) string {
+	if !rp.active() && tn == "" && format == "" && cfg.watermark == "" {
+		return `"` + hash + `"`
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%d\x00%s\x00%t\x00%s\x00%s\x00%d\x00%s\x00%s",
+		rp.w, rp.h, rp.fit, rp.upscale, tn, cfg.watermark, cfg.watermarkCorner, optimize.OutputFormat(), format)
+	return fmt.Sprintf(`"%s-%016x"`, hash, h.Sum64())
+}
+
+// uncacheable drops the validators and caching a handler set before
+// learning it cannot serve the image, so the error it answers instead is
+// not cached in its place.
+func uncacheable(w http.ResponseWriter) {
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// notModified reports whether r's conditional headers show the client
+// already holds the representation tagged tag and last modified at modTime.
+// If-None-Match takes precedence over If-Modified-Since (RFC 9110 13.2.2)
+// and is compared weakly, as GET allows.
+func notModified(r *http.Request, tag string, modTime time.Time) bool {
+	if inm := r.Header.Values("If-None-Match"); len(inm) > 0 {
+		for _, t := range strings.Split(strings.Join(inm, ","), ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have whole seconds.
+	return !modTime.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// dailyHandler serves the image of the day. Unlike /api/random every client
+// gets the same image for a category until midnight UTC, so the response
+// may be cached until then; X-Daily-Date names the UTC day it is for.
+func dailyHandler(cat *catalog.DB, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		category, ok := categoryParam(w, r, cat, cfg)
+		if !ok {
+			return
+		}
+		now := time.Now().UTC()
+		img, err := cat.Daily(category, now)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("no images available in category %q", category), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			slog.Error("daily", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+
+		rollover := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		w.Header().Set("X-Daily-Date", now.Format(time.DateOnly))
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(rollover.Sub(now).Seconds())))
+		w.Header().Set("Expires", rollover.Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newRandomResponse(img))
+	}
+}
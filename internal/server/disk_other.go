@@ -0,0 +1,10 @@
+//go:build !unix
+
+package server
+
+import "errors"
+
+// diskUsage is not implemented on this platform; health omits the report.
+func diskUsage(path string) (*diskReport, error) {
+	return nil, errors.New("disk usage not supported on this platform")
+}
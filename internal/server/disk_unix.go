@@ -0,0 +1,21 @@
+//go:build unix
+
+package server
+
+import "golang.org/x/sys/unix"
+
+// diskUsage reports the filesystem holding path. Free counts only blocks
+// available to unprivileged users, which is what ingest will see.
+func diskUsage(path string) (*diskReport, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	total := uint64(st.Blocks) * bsize
+	return &diskReport{
+		TotalBytes: total,
+		FreeBytes:  uint64(st.Bavail) * bsize,
+		UsedBytes:  total - uint64(st.Bfree)*bsize,
+	}, nil
+}
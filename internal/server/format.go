@@ -0,0 +1,20 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+)
+
+// parseFormat reads ?format=, an encoding for clients that cannot render
+// the stored one: "png" or "jpeg" ("jpg" is accepted too). The empty
+// string keeps the stored bytes, or optimize's output format if the image
+// is transformed otherwise.
+func parseFormat(q url.Values) (string, error) {
+	switch f := q.Get("format"); f {
+	case "", "png", "jpeg":
+		return f, nil
+	case "jpg":
+		return "jpeg", nil
+	}
+	return "", errors.New("format must be png or jpeg")
+}
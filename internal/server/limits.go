@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Default request limits. Nothing the API serves needs more than a hash or a
+// short query string in the URL, and no endpoint takes a large body.
+const (
+	DefaultMaxURLLength = 2048
+	DefaultMaxBodyBytes = 1 << 20
+)
+
+// WithRequestLimits caps the request URI length and body size. Zero disables
+// the corresponding limit. Handlers created without it use
+// DefaultMaxURLLength and DefaultMaxBodyBytes.
+func WithRequestLimits(maxURLLength int, maxBodyBytes int64) Option {
+	return func(c *config) {
+		c.maxURLLength = maxURLLength
+		c.maxBodyBytes = maxBodyBytes
+	}
+}
+
+// limitRequests rejects requests whose URI or declared body exceeds the
+// configured limits with 414 and 413 respectively. Bodies without a declared
+// length are wrapped in http.MaxBytesReader, so a handler reading past the
+// limit gets an *http.MaxBytesError and should answer 413.
+func limitRequests(cfg *config, h http.Handler) http.Handler {
+	if cfg.maxBodyBytes > 0 {
+		h = http.MaxBytesHandler(h, cfg.maxBodyBytes)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.maxURLLength > 0 && len(r.RequestURI) > cfg.maxURLLength {
+			http.Error(w, "request URI too long", http.StatusRequestURITooLong)
+			return
+		}
+		if cfg.maxBodyBytes > 0 && r.ContentLength > cfg.maxBodyBytes {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WithMaxConcurrentRequests caps how many requests are handled at once.
+// Requests beyond n get 503 with Retry-After instead of queueing, so a burst
+// cannot pile up goroutines, catalog queries and file reads. /api/health,
+// /metrics and the long-lived event streams are exempt. Zero means unlimited.
+func WithMaxConcurrentRequests(n int) Option {
+	return func(c *config) { c.maxConcurrent = n }
+}
+
+// concurrencyExempt reports whether path bypasses the concurrency cap:
+// health checks and metric scrapes must answer under load, and event streams
+// would otherwise hold a slot for as long as the client stays connected.
+func concurrencyExempt(path string) bool {
+	return path == "/api/health" || path == "/metrics" || path == "/api/events" || strings.HasPrefix(path, "/api/ingest/events")
+}
+
+// limitConcurrency enforces the WithMaxConcurrentRequests cap.
+func limitConcurrency(cfg *config, h http.Handler) http.Handler {
+	if cfg.maxConcurrent <= 0 {
+		return h
+	}
+	slots := make(chan struct{}, cfg.maxConcurrent)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if concurrencyExempt(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-slots }()
+		h.ServeHTTP(w, r)
+	})
+}
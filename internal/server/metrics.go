@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors served on /metrics. Every handler
+// built by New has its own registry, so several can live in one process.
+// Handlers update the counters as they answer; the catalog gauge is read
+// only when scraped.
+type metrics struct {
+	reg            *prometheus.Registry
+	imagesServed   prometheus.Counter
+	imageBytes     prometheus.Counter
+	randomRequests *prometheus.CounterVec
+	notFound       prometheus.Counter
+
+	transforms         prometheus.Counter
+	transformCacheHits prometheus.Counter
+}
+
+func newMetrics(cat *catalog.DB) *metrics {
+	m := &metrics{
+		reg: prometheus.NewRegistry(),
+		imagesServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "waifu_mirror_images_served_total",
+			Help: "Images served by /api/image.",
+		}),
+		imageBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "waifu_mirror_image_bytes_served_total",
+			Help: "Image bytes served by /api/image, after any transform.",
+		}),
+		randomRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "waifu_mirror_random_requests_total",
+			Help: "Random picks requested from /api/random and /api/random.txt, by known category.",
+		}, []string{"category"}),
+		notFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "waifu_mirror_not_found_total",
+			Help: "Requests answered 404 for a missing image, unknown category or no color match.",
+		}),
+		transforms: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "waifu_mirror_transforms_total",
+			Help: "Images decoded, transformed and re-encoded by /api/image.",
+		}),
+		transformCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "waifu_mirror_transform_cache_hits_total",
+			Help: "/api/image transforms served from the in-memory transform cache.",
+		}),
+	}
+	m.reg.MustRegister(
+		m.imagesServed, m.imageBytes, m.randomRequests, m.notFound,
+		m.transforms, m.transformCacheHits,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "waifu_mirror_catalog_bytes",
+			Help: "Total size of the stored images.",
+		}, func() float64 {
+			stats, err := cat.Stats()
+			if err != nil {
+				slog.Error("metrics", "err", err)
+				return math.NaN()
+			}
+			return float64(stats.TotalBytes)
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler serves the registry in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{})
+}
+
+// served counts one image response of n bytes.
+func (m *metrics) served(n int) {
+	m.imagesServed.Inc()
+	m.imageBytes.Add(float64(n))
+}
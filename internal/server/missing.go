@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// MissingFileBehavior selects how /api/image answers for a catalog image
+// whose file is missing or corrupt, e.g. while -fsck has yet to clean up.
+// Hashes the catalog does not know always get 404.
+type MissingFileBehavior string
+
+const (
+	// MissingNotFound answers 404.
+	MissingNotFound MissingFileBehavior = "404"
+	// MissingRandom serves a random image of the same category instead, so
+	// slideshows keep going.
+	MissingRandom MissingFileBehavior = "random"
+	// MissingFallback serves the image set with WithMissingFileBehavior.
+	MissingFallback MissingFileBehavior = "fallback"
+)
+
+// ParseMissingFileBehavior validates a behavior name.
+func ParseMissingFileBehavior(s string) (MissingFileBehavior, error) {
+	switch b := MissingFileBehavior(s); b {
+	case MissingNotFound, MissingRandom, MissingFallback:
+		return b, nil
+	}
+	return "", fmt.Errorf("server: unknown missing file behavior %q", s)
+}
+
+// WithMissingFileBehavior sets what /api/image serves in place of a missing
+// file. fallback holds the stored-format image bytes served by
+// MissingFallback; without it that behavior answers 404. Substitutes carry
+// an X-Image-Substituted header naming the behavior, plus
+// X-Image-Substitute-Hash for a random one, and are never cached.
+func WithMissingFileBehavior(b MissingFileBehavior, fallback []byte) Option {
+	return func(c *config) {
+		c.missingFile = b
+		c.fallbackImage = fallback
+	}
+}
+
+// substituteTries bounds how many random picks MissingRandom tries before
+// giving up, in case the replacements are missing too.
+const substituteTries = 3
+
+// serveMissing handles a request for hash, whose file could not be read,
+// according to the configured behavior. It returns the substitute image, or
+// writes a 404 and returns ok == false.
+func serveMissing(w http.ResponseWriter, r *http.Request, cat *catalog.DB, imgDir, hash string, cfg *config) (f imageFile, ok bool) {
+	if cfg.missingFile == MissingRandom || cfg.missingFile == MissingFallback {
+		if img, err := cat.GetByHash(hash); err == nil {
+			if f, ok = substitute(w, cat, imgDir, img, cfg); ok {
+				f.substitute = true
+				return f, true
+			}
+		}
+	}
+	cfg.metrics.notFound.Inc()
+	http.NotFound(w, r)
+	return imageFile{}, false
+}
+
+// substitute picks the image served in place of img and sets the headers
+// announcing it.
+func substitute(w http.ResponseWriter, cat *catalog.DB, imgDir string, img *catalog.Image, cfg *config) (imageFile, bool) {
+	if cfg.missingFile == MissingFallback {
+		if len(cfg.fallbackImage) == 0 {
+			return imageFile{}, false
+		}
+		w.Header().Set("X-Image-Substituted", string(MissingFallback))
+		return imageFile{name: "fallback", data: cfg.fallbackImage, ctype: contentType("", cfg.fallbackImage)}, true
+	}
+	for range substituteTries {
+		sub, err := cat.RandomExcept(img.Category, img.Hash)
+		if err != nil {
+			return imageFile{}, false
+		}
+		if f, err := loadImageFile(cat, imgDir, sub.Hash, ""); err == nil {
+			w.Header().Set("X-Image-Substituted", string(MissingRandom))
+			w.Header().Set("X-Image-Substitute-Hash", sub.Hash)
+			return f, true
+		}
+	}
+	return imageFile{}, false
+}
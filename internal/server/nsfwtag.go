@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// nsfwCategory is the category WithNSFWTag restricts.
+const nsfwCategory = "nsfw"
+
+// WithNSFWTag restricts the nsfw category to tailnet peers carrying tag:
+// random picks, listings and the image of the day for it, and every
+// endpoint serving one of its images by hash, answer 403 to other peers,
+// and to any peer that cannot be identified, which without WithPeers is
+// every one. Listings across all categories still include nsfw rows; only
+// their content is gated. An empty tag leaves nsfw open.
+func WithNSFWTag(tag string) Option {
+	return func(c *config) { c.nsfwTag = tag }
+}
+
+// nsfwByCategory gates h on the peer's tag when the category query
+// parameter names the nsfw category.
+func nsfwByCategory(cfg *config, h http.HandlerFunc) http.HandlerFunc {
+	if cfg.nsfwTag == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("category") == nsfwCategory && !peerTagged(w, r, cfg) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// nsfwByHash gates h on the peer's tag when the image named in the path is
+// in the nsfw category. Hashes the catalog does not know are left to h.
+func nsfwByHash(cat *catalog.DB, cfg *config, h http.HandlerFunc) http.HandlerFunc {
+	if cfg.nsfwTag == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := r.PathValue("hash")
+		if hash == "" {
+			hash, _ = imagePathHash(r.URL.Path)
+		}
+		if validHash(hash) {
+			img, err := cat.GetByHash(hash)
+			if err == nil && img.Category == nsfwCategory && !peerTagged(w, r, cfg) {
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// peerTagged reports whether the peer behind r carries cfg.nsfwTag. If not,
+// it writes a 403.
+func peerTagged(w http.ResponseWriter, r *http.Request, cfg *config) bool {
+	peer, err := peerOf(r, cfg)
+	if err != nil && !errors.Is(err, errNoPeers) {
+		slog.Warn("nsfw tag: whois", "addr", r.RemoteAddr, "err", err)
+	}
+	if err != nil || !slices.Contains(peer.Tags, cfg.nsfwTag) {
+		http.Error(w, fmt.Sprintf("nsfw requires a device tagged %s", cfg.nsfwTag), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Peer is the tailnet identity behind a request.
+type Peer struct {
+	User string   // login name, or the node name for a tagged device
+	Tags []string // Tailscale ACL tags, e.g. "tag:nsfw"; none for a user's device
+}
+
+// PeerResolver looks up the peer connecting from remoteAddr (ip:port), as
+// tsnet's LocalClient().WhoIs reports it.
+type PeerResolver func(ctx context.Context, remoteAddr string) (Peer, error)
+
+// WithPeers identifies the tailnet peer behind each request, for
+// WithNSFWTag and for per-user history in /api/random. Without it, as on a
+// plain or Funnel listener, every request is anonymous.
+func WithPeers(resolve PeerResolver) Option {
+	return func(c *config) { c.resolvePeer = resolve }
+}
+
+// errNoPeers is returned by peerOf without WithPeers.
+var errNoPeers = errors.New("peer identity unavailable")
+
+// peerOf resolves the peer behind r.
+func peerOf(r *http.Request, cfg *config) (Peer, error) {
+	if cfg.resolvePeer == nil {
+		return Peer{}, errNoPeers
+	}
+	return cfg.resolvePeer(r.Context(), r.RemoteAddr)
+}
+
+// peerUser returns the user behind r, or "" if it cannot be told, in which
+// case callers fall back to behavior shared by everyone.
+func peerUser(r *http.Request, cfg *config) string {
+	if cfg.resolvePeer == nil {
+		return ""
+	}
+	peer, err := peerOf(r, cfg)
+	if err != nil {
+		slog.Warn("peer: whois", "addr", r.RemoteAddr, "err", err)
+		return ""
+	}
+	return peer.User
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+	"github.com/Jesssullivan/waifu-mirror/internal/render"
+)
+
+// renderer turns a decoded stored image into text a terminal displays, such
+// as ASCII art or a graphics escape sequence.
+type renderer struct {
+	// variant distinguishes this output from other options' in the ETag.
+	variant string
+	render  func(img image.Image) ([]byte, error)
+}
+
+// renderParser builds the renderer asked for by a request's query, or
+// returns an error worth a 400.
+type renderParser func(q url.Values) (renderer, error)
+
+// renderHandler serves GET /api/{kind}/{hash}: the stored image decoded
+// once, passed to the renderer parsed from the query, and returned as
+// text/plain, ready to pipe into a terminal. Missing files are handled as
+// for /api/image, and like it the output is tagged for conditional requests.
+func renderHandler(cat *catalog.DB, imgDir string, cfg *config, kind string, parse renderParser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := r.PathValue("hash")
+		if hash == "" || !validHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		rd, err := parse(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, ok := cfg.warm.lookup(hash, "")
+		if !ok {
+			if f, ok = readImageFile(w, r, cat, imgDir, hash, "", cfg); !ok {
+				return
+			}
+		}
+		if !f.substitute {
+			tag := fmt.Sprintf(`"%s-%s-%s"`, hash, kind, rd.variant)
+			w.Header().Set("ETag", tag)
+			if !f.modTime.IsZero() {
+				w.Header().Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			if notModified(r, tag, f.modTime) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		var out []byte
+		poolErr := cfg.transforms.Do(r.Context(), func() {
+			var img image.Image
+			if img, _, err = optimize.Decode(f.data); err == nil {
+				out, err = rd.render(img)
+			}
+		})
+		if poolErr != nil {
+			uncacheable(w)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server busy", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			transformFailed(w, hash, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+		w.Write(out)
+	}
+}
+
+// Bounds and default for the cols query parameter of the text renderings,
+// /api/ascii/{hash} and /api/halfblocks/{hash}.
+const (
+	minTextCols     = 8
+	maxTextCols     = 400
+	defaultTextCols = 80
+)
+
+// parseCols reads ?cols= for the text renderings.
+func parseCols(q url.Values) (int, error) {
+	s := q.Get("cols")
+	if s == "" {
+		return defaultTextCols, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < minTextCols || n > maxTextCols {
+		return 0, fmt.Errorf("cols must be an integer between %d and %d", minTextCols, maxTextCols)
+	}
+	return n, nil
+}
+
+// parseASCII reads ?cols=80[&color=1] for /api/ascii/{hash}: the image as
+// ASCII art for terminals without any graphics protocol, with 24-bit ANSI
+// colors if color=1.
+func parseASCII(q url.Values) (renderer, error) {
+	cols, err := parseCols(q)
+	if err != nil {
+		return renderer{}, err
+	}
+	var truecolor bool
+	if s := q.Get("color"); s != "" {
+		on, err := strconv.ParseBool(s)
+		if err != nil {
+			return renderer{}, errors.New("color must be a boolean")
+		}
+		truecolor = on
+	}
+	return renderer{
+		variant: fmt.Sprintf("%d-%t", cols, truecolor),
+		render: func(img image.Image) ([]byte, error) {
+			if truecolor {
+				return optimize.EncodeASCIIColor(img, cols)
+			}
+			return optimize.EncodeASCII(img, cols)
+		},
+	}, nil
+}
+
+// parseHalfBlocks reads ?cols=80 for /api/halfblocks/{hash}: the image as
+// colored half block characters, for truecolor terminals without a graphics
+// protocol.
+func parseHalfBlocks(q url.Values) (renderer, error) {
+	cols, err := parseCols(q)
+	if err != nil {
+		return renderer{}, err
+	}
+	return renderer{
+		variant: strconv.Itoa(cols),
+		render: func(img image.Image) ([]byte, error) {
+			return render.HalfBlocks(img, cols)
+		},
+	}, nil
+}
+
+// resizedRenderer returns a parser for graphics protocol endpoints such as
+// /api/sixel/{hash} and /api/kitty/{hash}: it reads the resize parameters
+// of /api/image (?w=, ?h=, ?fit=, ?allow_upscale=) and encodes the resized
+// image with encode.
+func resizedRenderer(encode func(image.Image) ([]byte, error)) renderParser {
+	return func(q url.Values) (renderer, error) {
+		rp, err := parseResize(q)
+		if err != nil {
+			return renderer{}, err
+		}
+		return renderer{
+			variant: rp.String(),
+			render: func(img image.Image) ([]byte, error) {
+				return encode(rp.apply(img))
+			},
+		}, nil
+	}
+}
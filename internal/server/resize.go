@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"net/url"
+	"strconv"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// Bounds for the w and h query parameters of /api/image/{hash}.
+const (
+	minResizeDim = 16
+	maxResizeDim = 2048
+)
+
+// resizeParams is a serve-time resize requested with ?w=, ?h=, ?fit= and
+// ?allow_upscale=. The zero value means no resize.
+type resizeParams struct {
+	w, h    int
+	fit     optimize.Fit
+	upscale bool // only with allow_upscale=1: adds bandwidth, not detail
+}
+
+func (p resizeParams) active() bool { return p.w > 0 || p.h > 0 }
+
+// apply returns img resized as p asks, or img itself if p is the zero value.
+func (p resizeParams) apply(img image.Image) image.Image {
+	if !p.active() {
+		return img
+	}
+	src, w, h := optimize.ResizePlan(img.Bounds(), p.w, p.h, p.fit, p.upscale)
+	return optimize.Resize(img, src, w, h)
+}
+
+// String identifies p in ETags and cache keys.
+func (p resizeParams) String() string {
+	return fmt.Sprintf("%dx%d-%s-%t", p.w, p.h, p.fit, p.upscale)
+}
+
+// widthOnly reports whether p is a plain ?w= downscale, the resize whose
+// results are cached on disk.
+func (p resizeParams) widthOnly() bool { return p.w > 0 && p.h == 0 && !p.upscale }
+
+// storedWidth returns the width of the image in data, or 0 if its header
+// cannot be read.
+func storedWidth(data []byte) int {
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	return c.Width
+}
+
+// parseResize reads the resize query parameters. fit defaults to contain
+// and, when given, requires both w and h.
+func parseResize(q url.Values) (resizeParams, error) {
+	var p resizeParams
+	for _, d := range []struct {
+		name string
+		dst  *int
+	}{{"w", &p.w}, {"h", &p.h}} {
+		s := q.Get(d.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < minResizeDim || n > maxResizeDim {
+			return p, fmt.Errorf("%s must be an integer between %d and %d", d.name, minResizeDim, maxResizeDim)
+		}
+		*d.dst = n
+	}
+
+	switch fit := q.Get("fit"); fit {
+	case "":
+		p.fit = optimize.FitContain
+	case string(optimize.FitContain), string(optimize.FitCover):
+		if p.w == 0 || p.h == 0 {
+			return p, errors.New("fit requires both w and h")
+		}
+		p.fit = optimize.Fit(fit)
+	default:
+		return p, fmt.Errorf("unknown fit %q (want cover or contain)", fit)
+	}
+
+	if s := q.Get("allow_upscale"); s != "" {
+		up, err := strconv.ParseBool(s)
+		if err != nil {
+			return p, errors.New("allow_upscale must be a boolean")
+		}
+		p.upscale = up
+	}
+	return p, nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// resizedWidths are the widths at which a plain ?w= downscale is cached on
+// disk, so an image has at most this many copies there however many widths
+// clients ask for. Other widths are resized afresh or from the memory
+// cache. maintenance.ThumbSize must be among them: -pregen-thumbs fills
+// its cache ahead of time.
+var resizedWidths = []int{64, 128, 256, 320, 480, 640, 800, 1024, 1280, 1600, 1920, 2048}
+
+// diskCachePath returns where the response to a request for hash is cached
+// on disk, or "" if it is not cached. Only a plain ?w= downscale to one of
+// resizedWidths or a plain ?format= transcode of a stored image is: without
+// a color filter or watermark the bytes depend on nothing but the hash and
+// the width or format, so the file never goes stale. Maintenance removes it
+// along with the image.
+func diskCachePath(imgDir, hash string, rp resizeParams, tn tone, format string, f imageFile, cfg *config) string {
+	if tn != "" || cfg.watermark != "" || f.substitute {
+		return ""
+	}
+	switch {
+	case format == "" && rp.widthOnly() && slices.Contains(resizedWidths, rp.w):
+		return maintenance.ResizedPath(imgDir, hash, rp.w)
+	case format != "" && !rp.active():
+		return maintenance.TranscodedPath(imgDir, hash, format)
+	}
+	return ""
+}
+
+// readResized returns the cached resize at path, or nil on a miss.
+func readResized(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || optimize.Sniff(data) == "" {
+		return nil
+	}
+	return data
+}
+
+// storeResized caches data at path, a resize or transcode. It writes
+// through a temp file so a concurrent request never reads a partial file;
+// the temp name starts with a dot, so if a crash leaves it behind Fsck sees
+// an orphan. Failures are only logged, as the response does not depend on
+// them; ok reports whether the file was stored.
+func storeResized(path string, data []byte) (ok bool) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("resize cache", "err", err)
+		return false
+	}
+	base := filepath.Base(path)
+	tmp, err := os.CreateTemp(dir, "."+strings.TrimSuffix(base, filepath.Ext(base))+"-*.tmp")
+	if err != nil {
+		slog.Error("resize cache", "err", err)
+		return false
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Error("resize cache", "err", err)
+		return false
+	}
+	return true
+}
+
+// variantItem is one entry of GET /api/image/{hash}/variants.
+type variantItem struct {
+	catalog.Variant
+	URL string `json:"url"`
+}
+
+// variantsHandler lists the cached downscales of an image, so clients can
+// request a width that is served straight from disk.
+func variantsHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := r.PathValue("hash")
+		if !validHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		variants, err := cat.Variants(hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("variants", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+		items := make([]variantItem, 0, len(variants))
+		for _, v := range variants {
+			items = append(items, variantItem{Variant: v, URL: "/api/image/" + hash + "?w=" + strconv.Itoa(v.Width)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// servedFlushSize is how many pending images make ServedLog flush without
+// waiting for Run's next tick.
+const servedFlushSize = 512
+
+// ServedLog collects when images are served, for /api/random?fresh=1, and
+// how often, for the warm set, and writes them to the catalog in batches,
+// so serving an image never waits on a catalog write.
+type ServedLog struct {
+	cat *catalog.DB
+
+	mu      sync.Mutex
+	pending map[string]catalog.Served
+}
+
+// NewServedLog creates an empty log writing to cat. Call Run to flush it
+// periodically and Flush before exiting.
+func NewServedLog(cat *catalog.DB) *ServedLog {
+	return &ServedLog{cat: cat, pending: map[string]catalog.Served{}}
+}
+
+// WithServedLog records served images in l. Handlers created without it get
+// a private log, flushed only when it fills up or before a fresh pick.
+func WithServedLog(l *ServedLog) Option {
+	return func(c *config) { c.served = l }
+}
+
+// mark notes that the image hash was served just now. view counts it as
+// viewed: image bytes were sent, not just a random pick pointing at them.
+func (l *ServedLog) mark(hash string, view bool) {
+	l.mu.Lock()
+	s := l.pending[hash]
+	s.At = time.Now()
+	if view {
+		s.Views++
+	}
+	l.pending[hash] = s
+	full := len(l.pending) >= servedFlushSize
+	l.mu.Unlock()
+	if full {
+		go l.flushLogged()
+	}
+}
+
+// Flush writes the pending serve times and views to the catalog. On failure
+// they stay pending for the next Flush.
+func (l *ServedLog) Flush() error {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = map[string]catalog.Served{}
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := l.cat.MarkServedAt(pending)
+	if err != nil {
+		l.mu.Lock()
+		for hash, s := range pending {
+			if newer, ok := l.pending[hash]; ok {
+				s.At = newer.At
+				s.Views += newer.Views
+			}
+			l.pending[hash] = s
+		}
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// flushLogged is Flush for callers that can only log the error.
+func (l *ServedLog) flushLogged() {
+	if err := l.Flush(); err != nil {
+		slog.Error("mark served", "err", err)
+	}
+}
+
+// Run flushes the log every interval until ctx is done.
+func (l *ServedLog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.flushLogged()
+		}
+	}
+}
@@ -2,118 +2,983 @@
 //
 // Endpoints:
 //
-//	GET /api/random?category=sfw     Random image metadata
-//	GET /api/image/:hash             Serve optimized image bytes
-//	GET /api/health                  Service health + catalog stats
+//	GET /api/random?category=sfw     Random image metadata (404 for an
+//	                                 unknown category, 503 if it is empty);
+//	                                 unless fresh, tag, balance or near_color
+//	                                 is given, a tailnet user identified with
+//	                                 WithPeers is not shown their own recent
+//	                                 picks
+//	    &balance=source              Pick a source uniformly first
+//	    &near_color=%23rrggbb        Pick among images whose dominant color
+//	                                 is close; 404 if none is
+//	    &tag=maid                    Require the tag (repeatable); 400 for an
+//	                                 unknown one
+//	    &redirect=1                  Answer with a 302 to the image, not JSON
+//	    &fresh=1                     Pick among the images served least
+//	                                 recently by /api/random and /api/image
+//	GET /api/random.txt?category=sfw Absolute image URL as one line of text
+//	GET /api/daily?category=sfw      Image of the day: the same metadata as
+//	                                 /api/random, but one image per category
+//	                                 per UTC day, with the date in X-Daily-Date
+//	                                 and caching allowed until midnight UTC
+//	                                 (404 for an unknown category, 503 if it
+//	                                 is empty)
+//	GET /api/list?category=sfw&limit=50&offset=0
+//	                                 Page of image metadata in ID order plus
+//	                                 the total count (limit 1-200)
+//	GET /api/info/:hash              Full catalog metadata of one image, with
+//	                                 source URL and tags, for attribution
+//	GET /api/hashes?category=sfw     Every image hash, one per line in hash
+//	                                 order, for clients syncing a local cache
+//	                                 (all categories without category)
+//	GET /api/image/:hash             Serve optimized image bytes (an optional
+//	                                 .webp, .avif or .png suffix is accepted;
+//	                                 ?w=&h= scale down (a lone w at one of a
+//	                                 few common widths is cached on disk; one
+//	                                 at or beyond the image's own width serves
+//	                                 it as stored), fit=cover crops to
+//	                                 fill w x h, fit=contain fits inside;
+//	                                 allow_upscale=1 also scales up, which
+//	                                 smooths but adds no detail;
+//	                                 grayscale=1 or sepia=1 recolors;
+//	                                 format=png or jpeg re-encodes for clients
+//	                                 without WebP (cached on disk); a catalog
+//	                                 image whose file is missing may be
+//	                                 replaced, see WithMissingFileBehavior;
+//	                                 ETag and Last-Modified are set,
+//	                                 If-None-Match/If-Modified-Since get 304
+//	                                 and Range gets 206)
+//	GET /api/image/:hash/variants    Widths cached on disk, as JSON
+//	                                 {width, height, size_bytes, format, url}
+//	                                 entries; [] if there are none
+//	GET /api/ascii/:hash?cols=80     The image as text/plain ASCII art, cols
+//	                                 8-400 wide; color=1 adds 24-bit ANSI
+//	                                 colors
+//	GET /api/halfblocks/:hash?cols=80
+//	                                 The image as ▀ characters with 24-bit
+//	                                 ANSI colors, two pixels per cell
+//	GET /api/sixel/:hash?w=480       The image as a DEC Sixel sequence in
+//	                                 text/plain, resized with the w, h, fit
+//	                                 and allow_upscale parameters of
+//	                                 /api/image
+//	GET /api/kitty/:hash?w=480       The same in the Kitty graphics protocol
+//	                                 (Kitty, WezTerm)
+//	GET /api/health                  Service health, catalog stats, disk usage
+//	GET /api/catalog/stats           Size and dimension percentiles, counts
+//	                                 by source and format (cached for 1m)
+//	GET /api/formats                 Output format in use and decodable inputs
+//	GET /api/sources                 Effective upstream request rates and
+//	                                 recent 429 ratios
+//	PATCH /api/image/:hash           Update image metadata, e.g.
+//	                                 {"category":"nsfw"} (auth)
+//	GET /api/export?since=<id>       NDJSON catalog rows newer than id (auth)
+//	GET /api/admin/runs?limit=50     Recent ingest runs, newest first (auth)
+//	POST /api/admin/delete           Delete images matching a JSON filter:
+//	                                 source, category, max_views, older_than
+//	                                 (RFC 3339), dry_run (auth)
+//	GET /api/events                  NDJSON stream of newly ingested images
+//	GET /api/ingest/events           SSE stream of ingest cycle progress
+//	GET /metrics                     Prometheus metrics: images and bytes
+//	                                 served, random picks by category, 404s,
+//	                                 transforms and transform cache hits,
+//	                                 catalog size
+//
+// A method an endpoint does not take gets a JSON 405 with an Allow header
+// listing the ones it does; OPTIONS gets that header alone.
+//
+// Endpoints marked (auth) require "Authorization: Bearer <token>" and are
+// disabled unless a token is configured with WithAuthToken.
+//
+// With WithNSFWTag, requests for the nsfw category or for one of its images
+// are refused with 403 unless the tailnet peer carries the configured tag.
 package server
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/events"
+	"github.com/Jesssullivan/waifu-mirror/internal/ingest"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+	"github.com/Jesssullivan/waifu-mirror/internal/render"
 )
 
+// Option configures optional handler behavior.
+type Option func(*config)
+
+// config holds the settings applied by Options.
+type config struct {
+	watermark       string
+	watermarkCorner optimize.Corner
+	transforms      *TransformPool
+	transformCache  *TransformCache
+	authToken       string
+	events          *events.Bus
+	evictPolicy     maintenance.EvictPolicy
+	maxURLLength    int
+	maxBodyBytes    int64
+	warm            *WarmSet
+	sources         func() []ingest.SourceStatus
+	nearColorDist   float64
+	maxConcurrent   int
+	missingFile     MissingFileBehavior
+	fallbackImage   []byte
+	nsfwTag         string
+	resolvePeer     PeerResolver
+	accessLog       *slog.Logger
+	served          *ServedLog
+	metrics         *metrics
+}
+
+// WithWatermark overlays text on every image served by the handler. The
+// overlay is applied at serve time; stored images are never modified.
+func WithWatermark(text string, pos optimize.Corner) Option {
+	return func(c *config) {
+		c.watermark = text
+		c.watermarkCorner = pos
+	}
+}
+
+// WithTransformPool runs serve-time image transformations on p. Handlers
+// created without it get a private pool sized to the number of CPUs.
+func WithTransformPool(p *TransformPool) Option {
+	return func(c *config) { c.transforms = p }
+}
+
+// WithAuthToken enables the admin endpoints for requests bearing token.
+func WithAuthToken(token string) Option {
+	return func(c *config) { c.authToken = token }
+}
+
+// WithEvents enables the streaming endpoints, fed from bus.
+func WithEvents(bus *events.Bus) Option {
+	return func(c *config) { c.events = bus }
+}
+
+// WithEvictPolicy reports the eviction thresholds in /api/health. It does not
+// evict anything itself.
+func WithEvictPolicy(p maintenance.EvictPolicy) Option {
+	return func(c *config) { c.evictPolicy = p }
+}
+
+// WithSources enables /api/sources, reporting the upstream rate limits
+// returned by fn (typically Ingester.Sources).
+func WithSources(fn func() []ingest.SourceStatus) Option {
+	return func(c *config) { c.sources = fn }
+}
+
+// DefaultNearColorDistance is how far, in RGB units, an image's dominant
+// color may be from ?near_color= by default.
+const DefaultNearColorDistance = 64
+
+// WithNearColorDistance sets how far, as Euclidean distance in RGB (0 to
+// about 441), an image's dominant color may be from ?near_color= on
+// /api/random.
+func WithNearColorDistance(d float64) Option {
+	return func(c *config) { c.nearColorDist = d }
+}
+
 // New creates an HTTP handler for the waifu mirror API.
-func New(cat *catalog.DB, imgDir string) http.Handler {
+func New(cat *catalog.DB, imgDir string, opts ...Option) http.Handler {
+	cfg := &config{
+		maxURLLength:  DefaultMaxURLLength,
+		maxBodyBytes:  DefaultMaxBodyBytes,
+		nearColorDist: DefaultNearColorDistance,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.transforms == nil {
+		cfg.transforms = NewTransformPool(0)
+	}
+	if cfg.served == nil {
+		cfg.served = NewServedLog(cat)
+	}
+	cfg.metrics = newMetrics(cat)
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /api/random", randomHandler(cat))
-	mux.HandleFunc("GET /api/image/", imageHandler(cat, imgDir))
-	mux.HandleFunc("GET /api/health", healthHandler(cat))
+	mux.HandleFunc("GET /api/random", nsfwByCategory(cfg, randomHandler(cat, cfg)))
+	mux.HandleFunc("GET /api/random.txt", nsfwByCategory(cfg, randomTextHandler(cat, cfg)))
+	mux.HandleFunc("GET /api/daily", nsfwByCategory(cfg, dailyHandler(cat, cfg)))
+	mux.HandleFunc("GET /api/list", nsfwByCategory(cfg, listHandler(cat)))
+	mux.HandleFunc("GET /api/hashes", nsfwByCategory(cfg, hashesHandler(cat)))
+	mux.HandleFunc("GET /api/info/{hash}", nsfwByHash(cat, cfg, infoHandler(cat)))
+	mux.HandleFunc("GET /api/image", imageHandler(cat, imgDir, cfg))
+	mux.HandleFunc("GET /api/image/", nsfwByHash(cat, cfg, imageHandler(cat, imgDir, cfg)))
+	mux.HandleFunc("GET /api/image/{hash}/variants", nsfwByHash(cat, cfg, variantsHandler(cat)))
+	mux.HandleFunc("GET /api/ascii/{hash}", nsfwByHash(cat, cfg, renderHandler(cat, imgDir, cfg, "ascii", parseASCII)))
+	mux.HandleFunc("GET /api/halfblocks/{hash}", nsfwByHash(cat, cfg, renderHandler(cat, imgDir, cfg, "halfblocks", parseHalfBlocks)))
+	mux.HandleFunc("GET /api/sixel/{hash}", nsfwByHash(cat, cfg, renderHandler(cat, imgDir, cfg, "sixel", resizedRenderer(render.Sixel))))
+	mux.HandleFunc("GET /api/kitty/{hash}", nsfwByHash(cat, cfg, renderHandler(cat, imgDir, cfg, "kitty", resizedRenderer(render.Kitty))))
+	mux.HandleFunc("GET /api/health", healthHandler(cat, imgDir, cfg))
+	mux.HandleFunc("GET /api/catalog/stats", catalogStatsHandler(cat))
+	mux.HandleFunc("GET /api/formats", formatsHandler())
+	mux.HandleFunc("GET /api/sources", sourcesHandler(cfg.sources))
+	mux.HandleFunc("PATCH /api/image/{hash}", requireAuth(cfg, patchImageHandler(cat)))
+	mux.HandleFunc("GET /api/export", requireAuth(cfg, exportHandler(cat)))
+	mux.HandleFunc("GET /api/admin/runs", requireAuth(cfg, runsHandler(cat)))
+	mux.HandleFunc("POST /api/admin/delete", requireAuth(cfg, deleteHandler(cat, imgDir, cfg)))
+	mux.HandleFunc("GET /api/events", firehoseHandler(cfg.events))
+	mux.HandleFunc("GET /api/ingest/events", ingestEventsHandler(cfg.events))
+	mux.Handle("GET /metrics", cfg.metrics.handler())
 
-	return mux
+	return logRequests(cfg, limitRequests(cfg, limitConcurrency(cfg, allowMethods(mux))))
 }
 
-// randomResponse is the JSON body for GET /api/random.
+// randomResponse is the JSON body for GET /api/random and /api/daily.
 type randomResponse struct {
-	URL    string `json:"url"`
-	ID     string `json:"id"`
-	Width  int    `json:"width"`
-	Height int    `json:"height"`
-	Hash   string `json:"hash"`
+	URL        string `json:"url"`
+	ID         string `json:"id"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	OrigWidth  int    `json:"orig_width,omitempty"` // upstream size before resizing
+	OrigHeight int    `json:"orig_height,omitempty"`
+	Hash       string `json:"hash"`
+	Color      string `json:"dominant_color,omitempty"`
+	Blurhash   string `json:"blurhash,omitempty"`
 }
 
-func randomHandler(cat *catalog.DB) http.HandlerFunc {
+// validCategory matches well-formed category names.
+var validCategory = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// randomHandler picks a random image. Unknown categories get 404 so callers
+// can tell them apart from known categories that are merely empty (503).
+// With ?redirect=1 it redirects to the image bytes instead, for
+// "curl -L"; the chosen category travels in X-Image-Category so access logs
+// and clients can still see it.
+func randomHandler(cat *catalog.DB, cfg *config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		category := r.URL.Query().Get("category")
-		if category == "" {
-			category = "sfw"
+		var redirect bool
+		if s := r.URL.Query().Get("redirect"); s != "" {
+			var err error
+			if redirect, err = strconv.ParseBool(s); err != nil {
+				http.Error(w, "redirect must be a boolean", http.StatusBadRequest)
+				return
+			}
+		}
+		img, ok := pickRandom(w, r, cat, cfg)
+		if !ok {
+			return
 		}
-		if category != "sfw" && category != "nsfw" {
-			http.Error(w, "category must be sfw or nsfw", http.StatusBadRequest)
+		cfg.served.mark(img.Hash, false)
+		if redirect {
+			w.Header().Set("X-Image-Category", img.Category)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, "/api/image/"+img.Hash, http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newRandomResponse(img))
+	}
+}
+
+func newRandomResponse(img *catalog.Image) randomResponse {
+	return randomResponse{
+		URL:        "/api/image/" + img.Hash,
+		ID:         filepath.Base(img.Filename),
+		Width:      img.Width,
+		Height:     img.Height,
+		OrigWidth:  img.OrigWidth,
+		OrigHeight: img.OrigHeight,
+		Hash:       img.Hash,
+		Color:      img.DominantColor,
+		Blurhash:   img.Blurhash,
+	}
+}
+
+// randomTextHandler is randomHandler for shell scripts: the response is just
+// the absolute image URL on one line.
+func randomTextHandler(cat *catalog.DB, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		img, ok := pickRandom(w, r, cat, cfg)
+		if !ok {
 			return
 		}
+		cfg.served.mark(img.Hash, false)
 
-		img, err := cat.Random(category)
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s://%s/api/image/%s\n", scheme, r.Host, img.Hash)
+	}
+}
+
+// pickRandom validates the category, tag, balance, near_color and fresh query
+// parameters and picks an image. A plain pick avoids what the requesting
+// tailnet user, if known, has seen lately, and every pick goes into that
+// user's history. On failure it writes the error response and returns
+// ok == false.
+func pickRandom(w http.ResponseWriter, r *http.Request, cat *catalog.DB, cfg *config) (*catalog.Image, bool) {
+	user := peerUser(r, cfg)
+	img, ok := pickImage(w, r, cat, cfg, user)
+	if ok && user != "" {
+		if err := cat.RecordUserView(user, img.Hash); err != nil {
+			slog.Error("user view", "err", err)
+		}
+	}
+	return img, ok
+}
+
+// pickImage does the picking for pickRandom.
+func pickImage(w http.ResponseWriter, r *http.Request, cat *catalog.DB, cfg *config, user string) (*catalog.Image, bool) {
+	category, ok := categoryParam(w, r, cat, cfg)
+	if !ok {
+		return nil, false
+	}
+	cfg.metrics.randomRequests.WithLabelValues(category).Inc()
+
+	var fresh bool
+	if s := r.URL.Query().Get("fresh"); s != "" {
+		var err error
+		if fresh, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "fresh must be a boolean", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if fresh {
+		q := r.URL.Query()
+		if q.Has("tag") || q.Has("balance") || q.Has("near_color") {
+			http.Error(w, "fresh cannot be combined with tag, balance or near_color", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	if tags, ok := r.URL.Query()["tag"]; ok {
+		return pickTagged(w, r, cat, category, tags)
+	}
+	if s := r.URL.Query().Get("near_color"); s != "" {
+		return pickNearColor(w, cat, cfg, category, s)
+	}
+
+	var img *catalog.Image
+	var err error
+	switch r.URL.Query().Get("balance") {
+	case "":
+		switch {
+		case fresh:
+			// Freshness is only as good as the recorded serve times.
+			cfg.served.flushLogged()
+			img, err = cat.RandomFresh(category)
+		case user != "":
+			img, err = cat.RandomForUser(category, user)
+		default:
+			img, err = cat.Random(category)
+		}
+	case "source":
+		img, err = cat.RandomBalancedBySource(category)
+	default:
+		http.Error(w, "balance must be source", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("random", "err", err)
+		http.Error(w, fmt.Sprintf("no images available in category %q", category), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return img, true
+}
+
+// categoryParam returns the category query parameter, sfw by default. A
+// malformed name gets 400 and a category the catalog does not know 404, in
+// which case ok is false.
+func categoryParam(w http.ResponseWriter, r *http.Request, cat *catalog.DB, cfg *config) (category string, ok bool) {
+	category = r.URL.Query().Get("category")
+	if category == "" {
+		category = "sfw"
+	}
+	if !validCategory.MatchString(category) {
+		http.Error(w, "invalid category name", http.StatusBadRequest)
+		return "", false
+	}
+	known, err := cat.CategoryExists(category)
+	if err != nil {
+		slog.Error("category", "err", err)
+		http.Error(w, "catalog error", http.StatusInternalServerError)
+		return "", false
+	}
+	if !known {
+		cfg.metrics.notFound.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown category"})
+		return "", false
+	}
+	return category, true
+}
+
+// validTag matches well-formed tag names. Tags are stored lowercased.
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// pickTagged picks an image in category carrying every one of tags. Tags
+// cannot be combined with balance or near_color.
+func pickTagged(w http.ResponseWriter, r *http.Request, cat *catalog.DB, category string, tags []string) (*catalog.Image, bool) {
+	if r.URL.Query().Has("balance") || r.URL.Query().Has("near_color") {
+		http.Error(w, "tag cannot be combined with balance or near_color", http.StatusBadRequest)
+		return nil, false
+	}
+	for _, tag := range tags {
+		if !validTag.MatchString(tag) {
+			http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+			return nil, false
+		}
+		known, err := cat.TagExists(tag)
 		if err != nil {
-			log.Printf("random: %v", err)
-			http.Error(w, "no images available", http.StatusServiceUnavailable)
+			slog.Error("random", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return nil, false
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("unknown tag %q", tag), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	img, err := cat.RandomByTag(category, tags...)
+	if err != nil {
+		slog.Error("random", "err", err)
+		http.Error(w, fmt.Sprintf("no images in category %q match tags %s", category, strings.Join(tags, ", ")), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return img, true
+}
+
+// Bounds for the limit query parameter of /api/list.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// listItem is one image in a GET /api/list response.
+type listItem struct {
+	Hash      string    `json:"hash"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+	Blurhash  string    `json:"blurhash,omitempty"`
+}
+
+// infoHandler responds with the catalog row of one image, tags included.
+func infoHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := r.PathValue("hash")
+		if !validHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		img, err := cat.GetByHash(hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			img.Tags, err = cat.ImageTags(img.ID)
+		}
+		if err != nil {
+			slog.Error("info", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(img)
+	}
+}
+
+// hashesHandler streams the hashes of the images in ?category=, or of every
+// image without it.
+func hashesHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		category := r.URL.Query().Get("category")
+		if category != "" && !validCategory.MatchString(category) {
+			http.Error(w, "invalid category name", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := cat.StreamHashes(category, w); err != nil {
+			// Headers may already be sent; the truncated stream is the signal.
+			slog.Error("hashes", "err", err)
+		}
+	}
+}
+
+// listResponse is the JSON body for GET /api/list. Total counts every image
+// in the category, so clients can work out the number of pages.
+type listResponse struct {
+	Images []listItem `json:"images"`
+	Total  int        `json:"total"`
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+}
+
+// listHandler pages through the catalog in ID order. Without ?category= it
+// lists every category.
+func listHandler(cat *catalog.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		category := q.Get("category")
+		if category != "" && !validCategory.MatchString(category) {
+			http.Error(w, "invalid category name", http.StatusBadRequest)
 			return
 		}
+		limit := defaultListLimit
+		if s := q.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxListLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		var offset int
+		if s := q.Get("offset"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			offset = n
+		}
 
-		resp := randomResponse{
-			URL:    "/api/image/" + img.Hash,
-			ID:     img.Filename,
-			Width:  img.Width,
-			Height: img.Height,
-			Hash:   img.Hash,
+		total, err := cat.CountCategory(category)
+		if err != nil {
+			slog.Error("list", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
+		}
+		imgs, err := cat.List(category, limit, offset)
+		if err != nil {
+			slog.Error("list", "err", err)
+			http.Error(w, "catalog error", http.StatusInternalServerError)
+			return
 		}
 
+		resp := listResponse{Images: make([]listItem, 0, len(imgs)), Total: total, Limit: limit, Offset: offset}
+		for _, img := range imgs {
+			resp.Images = append(resp.Images, listItem{
+				Hash:      img.Hash,
+				Width:     img.Width,
+				Height:    img.Height,
+				Source:    img.Source,
+				CreatedAt: img.CreatedAt,
+				Blurhash:  img.Blurhash,
+			})
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	}
 }
 
-func imageHandler(cat *catalog.DB, imgDir string) http.HandlerFunc {
+// pickNearColor is pickRandom for ?near_color=. Finding nothing close
+// enough is a 404, like an unknown category: retrying will not help.
+func pickNearColor(w http.ResponseWriter, cat *catalog.DB, cfg *config, category, hex string) (*catalog.Image, bool) {
+	target, err := optimize.ParseHexColor(hex)
+	if err != nil {
+		http.Error(w, "near_color must be #rrggbb", http.StatusBadRequest)
+		return nil, false
+	}
+	img, err := cat.RandomNearColor(category, target, cfg.nearColorDist)
+	if errors.Is(err, catalog.ErrNoneNear) {
+		cfg.metrics.notFound.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no image near that color"})
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("random", "err", err)
+		http.Error(w, "catalog error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return img, true
+}
+
+func imageHandler(cat *catalog.DB, imgDir string, cfg *config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract hash from path: /api/image/{hash}
-		hash := strings.TrimPrefix(r.URL.Path, "/api/image/")
+		hash, ext := imagePathHash(r.URL.Path)
 		if hash == "" {
 			http.Error(w, "missing image hash", http.StatusBadRequest)
 			return
 		}
 
-		// Sanitize: only allow hex characters.
-		for _, c := range hash {
-			if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
-				http.Error(w, "invalid hash", http.StatusBadRequest)
+		if !validHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		rp, err := parseResize(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tn, err := parseTone(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format, err := parseFormat(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, ok := cfg.warm.lookup(hash, ext)
+		if !ok {
+			if f, ok = readImageFile(w, r, cat, imgDir, hash, ext, cfg); !ok {
+				return
+			}
+		}
+		name, data, ctype := f.name, f.data, f.ctype
+		if rp.widthOnly() {
+			// Downscales never scale up, so a width at or beyond the
+			// stored one is the stored image: serve and tag it as such.
+			if sw := storedWidth(data); sw > 0 && rp.w >= sw {
+				rp = resizeParams{}
+			}
+		}
+		if format == optimize.Sniff(data) && !rp.active() && tn == "" && cfg.watermark == "" {
+			format = "" // already stored that way
+		}
+
+		if !f.substitute {
+			// Stored files are named by content hash, so the hash (plus
+			// any transform) identifies the bytes served for good.
+			tag := etag(hash, rp, tn, format, cfg)
+			w.Header().Set("ETag", tag)
+			if !f.modTime.IsZero() {
+				w.Header().Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			if notModified(r, tag, f.modTime) {
+				w.WriteHeader(http.StatusNotModified)
 				return
 			}
+		} else {
+			// The file may be back, or the row gone, on the next request.
+			w.Header().Set("Cache-Control", "no-store")
 		}
 
-		// Look for the image file.
-		pattern := filepath.Join(imgDir, hash+".*")
-		matches, _ := filepath.Glob(pattern)
-		if len(matches) == 0 {
-			http.NotFound(w, r)
-			return
+		transforming := rp.active() || tn != "" || format != "" || cfg.watermark != ""
+		outFormat := format
+		if outFormat == "" {
+			outFormat = optimize.OutputFormat()
+		}
+		cachePath := diskCachePath(imgDir, hash, rp, tn, format, f, cfg)
+		resizing := cachePath != "" && format == "" // a plain ?w=
+		// Substitutes are another image's bytes, so only a real file's
+		// transforms go in the memory cache, keyed like its ETag.
+		var memKey string
+		if transforming && cachePath == "" && !f.substitute {
+			memKey = etag(hash, rp, tn, format, cfg)
+		}
+		if cached := readResized(cachePath); cached != nil {
+			name, data, ctype = filepath.Base(cachePath), cached, contentType(cachePath, cached)
+		} else if cached, ok := cfg.transformCache.get(memKey, f.modTime); ok {
+			name, data = hash+"."+outFormat, cached
+			ctype = contentTypes["."+outFormat]
+			cfg.metrics.transformCacheHits.Inc()
+		} else if transforming {
+			var vw, vh int // size of a resize cached on disk
+			poolErr := cfg.transforms.Do(r.Context(), func() {
+				if resizing {
+					// Like a plain ?w=, ForTerminal never scales up.
+					data, vw, vh, err = optimize.ForTerminal(data, rp.w)
+				} else {
+					data, err = transform(data, rp, tn, format, cfg)
+				}
+			})
+			if poolErr != nil {
+				uncacheable(w)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "server busy", http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				transformFailed(w, hash, err)
+				return
+			}
+			cfg.metrics.transforms.Inc()
+			if cachePath != "" {
+				if storeResized(cachePath, data) && resizing {
+					v := catalog.Variant{Width: vw, Height: vh, SizeBytes: int64(len(data)), Format: optimize.OutputFormat()}
+					if err := cat.PutVariant(hash, v); err != nil {
+						slog.Error("resize cache", "err", err)
+					}
+				}
+			} else if memKey != "" {
+				cfg.transformCache.put(memKey, f.modTime, data)
+			}
+			name = hash + "." + outFormat
+			ctype = contentTypes["."+outFormat]
 		}
 
-		data, err := os.ReadFile(matches[0])
-		if err != nil {
-			http.Error(w, "read error", http.StatusInternalServerError)
-			return
+		w.Header().Set("Content-Type", ctype)
+		// ServeContent answers Range and If-Range and always sets
+		// Content-Length, which some embedded clients need: they reject
+		// chunked responses.
+		cw := &countingWriter{ResponseWriter: w}
+		modTime := f.modTime
+		if f.substitute {
+			// As above: no Last-Modified, and no 304 for If-Modified-Since.
+			modTime = time.Time{}
 		}
+		http.ServeContent(cw, r, name, modTime, bytes.NewReader(data))
+		cfg.metrics.served(cw.n)
+		if !f.substitute {
+			cfg.served.mark(hash, true)
+		}
+	}
+}
+
+// imagePathHash splits an /api/image/{hash}[.ext] path into the hash and the
+// optional extension. Both /api/image and /api/image/ lack a hash.
+func imagePathHash(path string) (hash, ext string) {
+	hash = strings.TrimPrefix(strings.TrimPrefix(path, "/api/image"), "/")
+	for _, e := range requestExts {
+		if strings.HasSuffix(hash, e) {
+			return strings.TrimSuffix(hash, e), e
+		}
+	}
+	return hash, ""
+}
 
-		w.Header().Set("Content-Type", "image/webp")
-		w.Header().Set("Cache-Control", "public, max-age=86400")
-		w.Write(data)
+// countingWriter counts the body bytes written through it, which for a
+// range request is less than the whole image.
+type countingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += n
+	return n, err
+}
+
+// imageFile is an image loaded to answer /api/image.
+type imageFile struct {
+	name       string // file name, e.g. abc123.webp
+	data       []byte
+	ctype      string
+	modTime    time.Time // of the stored file; zero if unknown
+	substitute bool      // served in place of a missing file
+}
+
+// readImageFile loads the stored file for hash, preferring ext when given.
+// If the file is missing or corrupt it answers as the configured
+// MissingFileBehavior says, which may substitute another image. On failure
+// it writes the error response and returns ok == false.
+func readImageFile(w http.ResponseWriter, r *http.Request, cat *catalog.DB, imgDir, hash, ext string, cfg *config) (f imageFile, ok bool) {
+	f, err := loadImageFile(cat, imgDir, hash, ext)
+	switch {
+	case errors.Is(err, errNoImageFile):
+		return serveMissing(w, r, cat, imgDir, hash, cfg)
+	case err != nil:
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return imageFile{}, false
 	}
+	return f, true
+}
+
+// errNoImageFile is returned by loadImageFile when hash has no usable file.
+var errNoImageFile = errors.New("no usable image file")
+
+// loadImageFile reads the stored file for hash, preferring ext when given.
+// The catalog row names the file; only if there is no row, the file is not
+// where it says, or ext asks for another extension are both layouts
+// searched.
+func loadImageFile(cat *catalog.DB, imgDir, hash, ext string) (imageFile, error) {
+	path := ""
+	img, err := cat.GetByHash(hash)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return imageFile{}, err
+	case ext == "" || filepath.Ext(img.Filename) == ext:
+		p := filepath.Join(imgDir, filepath.FromSlash(img.Filename))
+		if _, err := os.Stat(p); err == nil {
+			path = p
+		}
+	}
+	if path == "" {
+		path = findImageFile(imgDir, hash, ext)
+	}
+	if path == "" {
+		return imageFile{}, errNoImageFile
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return imageFile{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return imageFile{}, err
+	}
+	if optimize.Sniff(data) == "" {
+		// Likely a zero-byte or truncated write left by a crash; serving
+		// it would show a broken image. -fsck removes such files.
+		slog.Error("image: stored file is empty or corrupt; run -fsck", "hash", hash, "file", filepath.Base(path), "size", len(data))
+		return imageFile{}, errNoImageFile
+	}
+	return imageFile{name: filepath.Base(path), data: data, ctype: contentType(path, data), modTime: info.ModTime()}, nil
+}
+
+// findImageFile looks for the file of hash in either layout, preferring
+// ext when given, for rows whose filename is out of date. It returns "" if
+// there is none.
+func findImageFile(imgDir, hash, ext string) string {
+	dirs := maintenance.ImageDirs(imgDir, hash)
+	path := ""
+	if ext != "" {
+		for _, dir := range dirs {
+			if _, err := os.Stat(filepath.Join(dir, hash+ext)); err == nil {
+				path = filepath.Join(dir, hash+ext)
+				break
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if path != "" {
+			break
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, hash+".*")); len(matches) > 0 {
+			path = matches[0]
+		}
+	}
+	return path
+}
+
+// maxHashLen is the longest hash accepted in a request: a full SHA-256 in
+// hex. Stored hashes are at most half that.
+const maxHashLen = 64
+
+// validHash reports whether hash is safe to use in a file path: lowercase
+// hex characters only, and no longer than any stored hash could be.
+func validHash(hash string) bool {
+	if len(hash) > maxHashLen {
+		return false
+	}
+	for _, c := range hash {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestExts are the file extensions accepted on /api/image/{hash}.
+var requestExts = []string{".webp", ".avif", ".png"}
+
+// contentTypes maps stored file extensions to MIME types.
+var contentTypes = map[string]string{
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+}
+
+// contentType returns the MIME type for a stored image file. The content
+// decides, since a file written by an older version may carry the wrong
+// extension (original PNG or JPEG bytes named .webp); the extension is only
+// a fallback, then WebP, which is what ingest writes.
+func contentType(path string, data []byte) string {
+	if format := optimize.Sniff(data); format != "" {
+		return contentTypes["."+format]
+	}
+	if ct, ok := contentTypes[filepath.Ext(path)]; ok {
+		return ct
+	}
+	return "image/webp"
+}
+
+// transform decodes a stored image, resizes it and applies the color filter
+// as requested, overlays the configured watermark, and re-encodes it in
+// format, or with optimize.Encode if format is empty. Callers cache results;
+// see diskCachePath and TransformCache.
+func transform(data []byte, rp resizeParams, tn tone, format string, cfg *config) ([]byte, error) {
+	img, _, err := optimize.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	img = tn.apply(rp.apply(img))
+	if cfg.watermark != "" {
+		img = optimize.Watermark(img, cfg.watermark, cfg.watermarkCorner)
+	}
+	if format == "" {
+		return optimize.Encode(img)
+	}
+	return optimize.EncodeAs(img, format, optimize.DefaultQuality)
 }
 
 type healthResponse struct {
-	Status    string        `json:"status"`
-	SFWCount  int           `json:"sfw_count"`
-	NSFWCount int           `json:"nsfw_count"`
-	TotalMB   float64       `json:"total_mb"`
+	Status    string          `json:"status"`
+	SFWCount  int             `json:"sfw_count"`
+	NSFWCount int             `json:"nsfw_count"`
+	TotalMB   float64         `json:"total_mb"`
+	Disk      *diskReport     `json:"disk,omitempty"`
+	Eviction  *evictionReport `json:"eviction,omitempty"`
+}
+
+// formatsResponse is the JSON body for GET /api/formats.
+type formatsResponse struct {
+	Output string   `json:"output"`
+	Decode []string `json:"decode"`
+}
+
+func formatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(formatsResponse{
+			Output: optimize.OutputFormat(),
+			Decode: optimize.DecodeFormats(),
+		})
+	}
 }
 
-func healthHandler(cat *catalog.DB) http.HandlerFunc {
+// sourcesHandler reports the effective rate of each upstream limiter.
+func sourcesHandler(fn func() []ingest.SourceStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fn == nil {
+			http.Error(w, "source stats not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fn())
+	}
+}
+
+// diskReport describes the filesystem holding the image directory.
+type diskReport struct {
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+}
+
+// evictionReport echoes the configured eviction caps.
+type evictionReport struct {
+	MaxCount         int              `json:"max_count,omitempty"`
+	CategoryMaxCount map[string]int   `json:"category_max_count,omitempty"`
+	CategoryMaxBytes map[string]int64 `json:"category_max_bytes,omitempty"`
+}
+
+func healthHandler(cat *catalog.DB, imgDir string, cfg *config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		stats, err := cat.Stats()
 		if err != nil {
@@ -127,6 +992,17 @@ func healthHandler(cat *catalog.DB) http.HandlerFunc {
 			NSFWCount: stats.NSFWCount,
 			TotalMB:   float64(stats.TotalBytes) / (1024 * 1024),
 		}
+		// A failed stat is not a health failure; just leave the report out.
+		if disk, err := diskUsage(imgDir); err == nil {
+			resp.Disk = disk
+		}
+		if p := cfg.evictPolicy; p.Enabled() {
+			resp.Eviction = &evictionReport{
+				MaxCount:         p.MaxCount,
+				CategoryMaxCount: p.CategoryMaxCount,
+				CategoryMaxBytes: p.CategoryMaxBytes,
+			}
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
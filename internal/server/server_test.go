@@ -1,14 +1,33 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/events"
+	"github.com/Jesssullivan/waifu-mirror/internal/ingest"
+	"github.com/Jesssullivan/waifu-mirror/internal/maintenance"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
 )
 
 func testSetup(t *testing.T) (*catalog.DB, string) {
@@ -45,6 +64,33 @@ func TestHealthEndpoint(t *testing.T) {
 	if resp.Status != "ok" {
 		t.Fatalf("status = %q, want ok", resp.Status)
 	}
+	if resp.Eviction != nil {
+		t.Errorf("eviction = %+v, want omitted without a policy", resp.Eviction)
+	}
+}
+
+func TestHealthEndpoint_DiskAndEviction(t *testing.T) {
+	db, imgDir := testSetup(t)
+	policy := maintenance.EvictPolicy{MaxCount: 100, CategoryMaxCount: map[string]int{"nsfw": 10}}
+	handler := New(db, imgDir, WithEvictPolicy(policy))
+
+	req := httptest.NewRequest("GET", "/api/health", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var resp healthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode health: %v", err)
+	}
+	if resp.Disk == nil {
+		t.Fatal("disk report missing")
+	}
+	if resp.Disk.TotalBytes == 0 || resp.Disk.FreeBytes > resp.Disk.TotalBytes {
+		t.Errorf("implausible disk report: %+v", resp.Disk)
+	}
+	if resp.Eviction == nil || resp.Eviction.MaxCount != 100 || resp.Eviction.CategoryMaxCount["nsfw"] != 10 {
+		t.Errorf("eviction = %+v", resp.Eviction)
+	}
 }
 
 func TestRandomEndpoint_Empty(t *testing.T) {
@@ -67,6 +113,7 @@ func TestRandomEndpoint_WithImages(t *testing.T) {
 	db.Insert(&catalog.Image{
 		Hash: "testhash", Source: "test", SourceURL: "https://example.com",
 		Category: "sfw", Width: 480, Height: 680, Filename: "testhash.webp",
+		Blurhash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
 	})
 
 	handler := New(db, imgDir)
@@ -89,13 +136,420 @@ func TestRandomEndpoint_WithImages(t *testing.T) {
 	if resp.Width != 480 {
 		t.Fatalf("width = %d, want 480", resp.Width)
 	}
+	if resp.Blurhash != "LEHV6nWB2yk8pyo0adR*.7kCMdnj" {
+		t.Errorf("blurhash = %q, want the stored one", resp.Blurhash)
+	}
+}
+
+func TestInfoEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	db.Insert(&catalog.Image{
+		Hash: "abc123", Source: "waifu.im", SourceURL: "https://cdn.waifu.im/1.png", Category: "sfw",
+		Width: 400, Height: 200, SizeBytes: 1234, Filename: "abc123.webp", Tags: []string{"maid", "Genshin"},
+	})
+	handler := New(db, imgDir)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/api/info/abc123")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	var img catalog.Image
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if img.Source != "waifu.im" || img.SourceURL != "https://cdn.waifu.im/1.png" || img.Width != 400 ||
+		img.SizeBytes != 1234 || img.CreatedAt.IsZero() || strings.Join(img.Tags, ",") != "Genshin,maid" {
+		t.Errorf("info = %+v", img)
+	}
+
+	for path, code := range map[string]int{
+		"/api/info/def456": http.StatusNotFound,
+		"/api/info/XYZ":    http.StatusBadRequest,
+	} {
+		if w := get(path); w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+	}
+}
+
+func TestHashesEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, hash := range []string{"b1", "a1"} {
+		db.Insert(&catalog.Image{Hash: hash, Source: "test", SourceURL: "https://example.com", Category: "sfw", Filename: hash + ".webp"})
+	}
+	db.Insert(&catalog.Image{Hash: "c1", Source: "test", SourceURL: "https://example.com", Category: "nsfw", Filename: "c1.webp"})
+	handler := New(db, imgDir)
+
+	for query, want := range map[string]string{
+		"?category=sfw": "a1\nb1\n",
+		"":              "a1\nb1\nc1\n",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/hashes"+query, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%q: status %d, body %q, want %q", query, w.Code, w.Body.String(), want)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%q: content-type = %q", query, ct)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/hashes?category=../x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid category: status %d, want 400", w.Code)
+	}
+}
+
+func TestListEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for i := 0; i < 5; i++ {
+		db.Insert(&catalog.Image{
+			Hash: "a" + strconv.Itoa(i), Source: "test", SourceURL: "https://example.com",
+			Category: "sfw", Width: 100 + i, Height: 200, Filename: "a" + strconv.Itoa(i) + ".webp",
+			Blurhash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		})
+	}
+	db.Insert(&catalog.Image{
+		Hash: "b0", Source: "test", SourceURL: "https://example.com",
+		Category: "nsfw", Filename: "b0.webp",
+	})
+	handler := New(db, imgDir)
+
+	req := httptest.NewRequest("GET", "/api/list?category=sfw&limit=2&offset=3", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list returned %d, want 200", w.Code)
+	}
+	var resp listResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	if resp.Total != 5 {
+		t.Errorf("total = %d, want 5", resp.Total)
+	}
+	if len(resp.Images) != 2 || resp.Images[0].Hash != "a3" || resp.Images[1].Hash != "a4" {
+		t.Fatalf("images = %+v, want a3 and a4", resp.Images)
+	}
+	if resp.Images[0].Width != 103 || resp.Images[0].CreatedAt.IsZero() || resp.Images[0].Blurhash == "" {
+		t.Errorf("image metadata = %+v", resp.Images[0])
+	}
+
+	req = httptest.NewRequest("GET", "/api/list", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	resp = listResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Total != 6 || len(resp.Images) != 6 || resp.Offset != 0 {
+		t.Errorf("unfiltered list = %d %+v, want all 6 images", w.Code, resp)
+	}
+
+	for _, q := range []string{"limit=0", "limit=201", "limit=x", "offset=-1", "category=Bad!"} {
+		req := httptest.NewRequest("GET", "/api/list?"+q, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("list?%s returned %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestRandomEndpoint_NearColor(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for hash, c := range map[string]string{"pink": "#ff00aa", "pinkish": "#f010a0", "blue": "#2040f0", "unknown": ""} {
+		db.Insert(&catalog.Image{
+			Hash: hash, Source: "test", SourceURL: "u", Category: "sfw",
+			Filename: hash + ".webp", DominantColor: c,
+		})
+	}
+	handler := New(db, imgDir, WithNearColorDistance(40))
+
+	seen := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?near_color=%23ff00aa", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("near_color returned %d, want 200", w.Code)
+		}
+		var resp randomResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		seen[resp.Hash] = true
+	}
+	if len(seen) != 2 || !seen["pink"] || !seen["pinkish"] {
+		t.Errorf("picked %v, want only pink and pinkish", seen)
+	}
+
+	for q, want := range map[string]int{
+		"near_color=%2300ff00":               http.StatusNotFound,
+		"near_color=green":                   http.StatusBadRequest,
+		"near_color=%23ff00aa&category=nsfw": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?"+q, nil))
+		if w.Code != want {
+			t.Errorf("random?%s returned %d, want %d", q, w.Code, want)
+		}
+	}
+}
+
+func TestRandomEndpoint_Tags(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for hash, tags := range map[string][]string{
+		"maid":         {"maid"},
+		"maid-uniform": {"maid", "uniform"},
+		"selfie":       {"selfie"},
+	} {
+		db.Insert(&catalog.Image{
+			Hash: hash, Source: "test", SourceURL: "u", Category: "sfw",
+			Filename: hash + ".webp", Tags: tags,
+		})
+	}
+	handler := New(db, imgDir)
+
+	seen := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?tag=maid&tag=uniform", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("tag=maid&tag=uniform returned %d, want 200", w.Code)
+		}
+		var resp randomResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		seen[resp.Hash] = true
+	}
+	if len(seen) != 1 || !seen["maid-uniform"] {
+		t.Errorf("picked %v, want only maid-uniform", seen)
+	}
+
+	for q, want := range map[string]int{
+		"tag=maid":                      http.StatusOK,
+		"tag=":                          http.StatusBadRequest,
+		"tag=Maid!":                     http.StatusBadRequest,
+		"tag=glasses":                   http.StatusBadRequest,
+		"tag=maid&tag=glasses":          http.StatusBadRequest,
+		"tag=maid&tag=selfie":           http.StatusServiceUnavailable,
+		"tag=maid&category=nsfw":        http.StatusServiceUnavailable,
+		"tag=maid&balance=source":       http.StatusBadRequest,
+		"tag=maid&near_color=%23ff00aa": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?"+q, nil))
+		if w.Code != want {
+			t.Errorf("random?%s returned %d, want %d", q, w.Code, want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	data := []byte("RIFF\x14\x00\x00\x00WEBPfake-webp-image-data")
+	os.WriteFile(filepath.Join(imgDir, "abc123.webp"), data, 0o644)
+	db.Insert(&catalog.Image{
+		Hash: "abc123", Source: "test", SourceURL: "u", Category: "sfw",
+		Filename: "abc123.webp", SizeBytes: 4096,
+	})
+	handler := New(db, imgDir)
+
+	for _, path := range []string{"/api/random", "/api/random.txt", "/api/image/abc123", "/api/image/ffff", "/api/random?category=nope"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d, want 200", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"waifu_mirror_images_served_total 1",
+		"waifu_mirror_image_bytes_served_total " + strconv.Itoa(len(data)),
+		`waifu_mirror_random_requests_total{category="sfw"} 2`,
+		"waifu_mirror_not_found_total 2",
+		"waifu_mirror_catalog_bytes 4096",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestRandomEndpoint_Redirect(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?redirect=1", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "no images available") {
+		t.Fatalf("empty catalog returned %d %q, want 503 with a message", w.Code, w.Body.String())
+	}
+
+	db.Insert(&catalog.Image{Hash: "abc123", Source: "test", SourceURL: "u", Category: "nsfw", Filename: "abc123.webp"})
+	for _, v := range []string{"1", "true"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?category=nsfw&redirect="+v, nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("redirect=%s returned %d, want 302", v, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "/api/image/abc123" {
+			t.Errorf("Location = %q, want /api/image/abc123", loc)
+		}
+		if c := w.Header().Get("X-Image-Category"); c != "nsfw" {
+			t.Errorf("X-Image-Category = %q, want nsfw", c)
+		}
+	}
+
+	// redirect=0 keeps the JSON response; nonsense is rejected.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?category=nsfw&redirect=0", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("redirect=0 returned %d %q, want JSON", w.Code, w.Header().Get("Content-Type"))
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random?redirect=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("redirect=maybe returned %d, want 400", w.Code)
+	}
+}
+
+func TestRandomEndpoint_Fresh(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for i := range 6 {
+		h := "fresh" + strconv.Itoa(i)
+		db.Insert(&catalog.Image{Hash: h, Source: "test", SourceURL: "u", Category: "sfw", Filename: h + ".webp"})
+	}
+	handler := New(db, imgDir)
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	var last string
+	for range 10 {
+		w := get("/api/random?fresh=1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("fresh returned %d, want 200", w.Code)
+		}
+		var resp randomResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode random: %v", err)
+		}
+		if resp.Hash == last {
+			t.Fatalf("consecutive fresh picks both returned %s", last)
+		}
+		last = resp.Hash
+	}
+
+	for _, q := range []string{"fresh=maybe", "fresh=1&balance=source", "fresh=1&tag=maid"} {
+		if w := get("/api/random?" + q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestImageEndpoint_ServedLog(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, h := range []string{"abc0", "abc1"} {
+		os.WriteFile(filepath.Join(imgDir, h+".webp"), []byte("RIFF\x14\x00\x00\x00WEBPfake-webp-image-data"), 0o644)
+		db.Insert(&catalog.Image{Hash: h, Source: "test", SourceURL: "u", Category: "sfw", Filename: h + ".webp"})
+	}
+	served := NewServedLog(db)
+	handler := New(db, imgDir, WithServedLog(served))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/image/abc0", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("image returned %d, want 200", w.Code)
+	}
+
+	// With two images a fresh pick is always the least recently served.
+	img, err := db.RandomFresh("sfw")
+	if err != nil {
+		t.Fatalf("random fresh: %v", err)
+	}
+	if img.Hash != "abc0" {
+		t.Fatalf("before flush, fresh pick = %s, want abc0 (not yet written)", img.Hash)
+	}
+	if err := served.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if img, err = db.RandomFresh("sfw"); err != nil {
+		t.Fatalf("random fresh: %v", err)
+	}
+	if img.Hash != "abc1" {
+		t.Fatalf("after flush, fresh pick = %s, want abc1", img.Hash)
+	}
+}
+
+func TestRandomEndpoint_PerUser(t *testing.T) {
+	db, imgDir := testSetup(t)
+	hashes := []string{"user0", "user1", "user2", "user3"}
+	for _, h := range hashes {
+		db.Insert(&catalog.Image{Hash: h, Source: "test", SourceURL: "u", Category: "sfw", Filename: h + ".webp"})
+	}
+	users := map[string]string{"100.64.0.1": "alice@example.com", "100.64.0.2": "bob@example.com"}
+	resolve := func(ctx context.Context, remoteAddr string) (Peer, error) {
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		return Peer{User: users[host]}, nil
+	}
+	handler := New(db, imgDir, WithPeers(resolve))
+	pick := func(addr string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/random", nil)
+		req.RemoteAddr = addr + ":41641"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("random from %s returned %d", addr, w.Code)
+		}
+		var resp randomResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Hash
+	}
+
+	// Alice has seen the first two images lately, Bob the last two.
+	for _, h := range hashes[:2] {
+		db.RecordUserView("alice@example.com", h)
+	}
+	for _, h := range hashes[2:] {
+		db.RecordUserView("bob@example.com", h)
+	}
+	if h := pick("100.64.0.1"); h != hashes[2] && h != hashes[3] {
+		t.Errorf("alice got %s, seen lately", h)
+	}
+	if h := pick("100.64.0.2"); h != hashes[0] && h != hashes[1] {
+		t.Errorf("bob got %s, seen lately", h)
+	}
+
+	// Picks join the user's own history: with half the category left out,
+	// no user sees one of their two previous picks.
+	for _, addr := range []string{"100.64.0.1", "100.64.0.2"} {
+		var prev []string
+		for range 10 {
+			h := pick(addr)
+			if slices.Contains(prev, h) {
+				t.Fatalf("%s got %s again within two picks", users[addr], h)
+			}
+			prev = append(prev, h)
+			prev = prev[max(0, len(prev)-2):]
+		}
+	}
+	// An unidentified peer gets ordinary picks.
+	pick("100.64.0.9")
 }
 
 func TestRandomEndpoint_BadCategory(t *testing.T) {
 	db, imgDir := testSetup(t)
 	handler := New(db, imgDir)
 
-	req := httptest.NewRequest("GET", "/api/random?category=invalid", nil)
+	req := httptest.NewRequest("GET", "/api/random?category=Not+Valid!", nil)
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 
@@ -104,11 +558,52 @@ func TestRandomEndpoint_BadCategory(t *testing.T) {
 	}
 }
 
+func TestRandomEndpoint_UnknownCategory(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir)
+
+	req := httptest.NewRequest("GET", "/api/random?category=foo", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown category returned %d, want 404", w.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body["error"] != "unknown category" {
+		t.Fatalf("error = %q, want unknown category", body["error"])
+	}
+}
+
+func TestRandomEndpoint_KnownButEmptyCategory(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir)
+
+	// Once a category has been seen it stays known after its images go.
+	db.Insert(&catalog.Image{Hash: "gone", Source: "test", Category: "foo", Filename: "gone.webp"})
+	if err := db.DeleteByHash("gone"); err != nil {
+		t.Fatalf("DeleteByHash: %v", err)
+	}
+
+	for _, category := range []string{"nsfw", "foo"} {
+		req := httptest.NewRequest("GET", "/api/random?category="+category, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("empty %s returned %d, want 503", category, w.Code)
+		}
+	}
+}
+
 func TestImageEndpoint(t *testing.T) {
 	db, imgDir := testSetup(t)
 
-	// Write a fake image file.
-	imgData := []byte("fake-webp-image-data")
+	// Write a fake image file (valid WebP header, fake payload).
+	imgData := []byte("RIFF\x14\x00\x00\x00WEBPfake-webp-image-data")
 	os.WriteFile(filepath.Join(imgDir, "abc123.webp"), imgData, 0o644)
 
 	db.Insert(&catalog.Image{
@@ -133,6 +628,176 @@ func TestImageEndpoint(t *testing.T) {
 	}
 }
 
+func TestImageEndpoint_ShardedLayout(t *testing.T) {
+	db, imgDir := testSetup(t)
+	imgData := []byte("RIFF\x14\x00\x00\x00WEBPfake-webp-image-data")
+	filename := maintenance.LayoutSharded.Filename("abc123", ".webp")
+	os.MkdirAll(filepath.Join(imgDir, "ab"), 0o755)
+	os.WriteFile(filepath.Join(imgDir, filename), imgData, 0o644)
+	db.Insert(&catalog.Image{
+		Hash: "abc123", Source: "test", SourceURL: "https://example.com",
+		Category: "sfw", Filename: filename,
+	})
+	handler := New(db, imgDir)
+
+	for _, path := range []string{"/api/image/abc123", "/api/image/abc123.webp"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != string(imgData) {
+			t.Fatalf("%s: %d %q, want the sharded file", path, w.Code, w.Body.String())
+		}
+	}
+
+	// The random pick's id stays the bare file name.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/random", nil))
+	var resp randomResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.ID != "abc123.webp" {
+		t.Fatalf("id = %q, want abc123.webp", resp.ID)
+	}
+
+	// The row's filename wins over a stray file in the other layout...
+	stray := []byte("RIFF\x14\x00\x00\x00WEBPstray-flat-file-data")
+	os.WriteFile(filepath.Join(imgDir, "abc123.webp"), stray, 0o644)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/image/abc123", nil))
+	if w.Body.String() != string(imgData) {
+		t.Fatalf("served %q, want the file the row names", w.Body.String())
+	}
+	// ...and a file moved since is still found.
+	os.Remove(filepath.Join(imgDir, filename))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/image/abc123", nil))
+	if w.Code != http.StatusOK || w.Body.String() != string(stray) {
+		t.Fatalf("moved file: %d %q, want the flat file", w.Code, w.Body.String())
+	}
+}
+
+func TestImageEndpoint_ConditionalGet(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 40, 20)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(imgDir, "abc123.webp"), modTime, modTime)
+	handler := New(db, imgDir)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/image/abc123")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("plain GET returned %d with %d bytes, want 200 and the image", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("ETag"); got != `"abc123"` {
+		t.Errorf("ETag = %s, want \"abc123\"", got)
+	}
+	if got := w.Header().Get("Last-Modified"); got != modTime.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q, want %q", got, modTime.Format(http.TimeFormat))
+	}
+
+	tests := []struct {
+		name, header, value string
+		want                int
+	}{
+		{"matching tag", "If-None-Match", `"abc123"`, http.StatusNotModified},
+		{"tag in list", "If-None-Match", `"other", W/"abc123"`, http.StatusNotModified},
+		{"star", "If-None-Match", "*", http.StatusNotModified},
+		{"other tag", "If-None-Match", `"other"`, http.StatusOK},
+		{"not modified since", "If-Modified-Since", modTime.Format(http.TimeFormat), http.StatusNotModified},
+		{"modified since", "If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+		{"bad date", "If-Modified-Since", "yesterday", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := get("/api/image/abc123", tt.header, tt.value)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") == "") {
+			t.Errorf("%s: 304 with %d body bytes and ETag %q", tt.name, w.Body.Len(), w.Header().Get("ETag"))
+		}
+	}
+
+	// If-None-Match wins over a matching If-Modified-Since.
+	req := httptest.NewRequest("GET", "/api/image/abc123", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("mismatched tag with fresh date: status %d, want 200", w.Code)
+	}
+
+	// A resized variant is a different representation.
+	w = get("/api/image/abc123?w=20")
+	resized := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || resized == "" || resized == `"abc123"` {
+		t.Fatalf("resized: status %d, ETag %s; want 200 and a tag of its own", w.Code, resized)
+	}
+	if w := get("/api/image/abc123?w=20", "If-None-Match", `"abc123"`); w.Code != http.StatusOK {
+		t.Errorf("resized with the original's tag: status %d, want 200", w.Code)
+	}
+	if w := get("/api/image/abc123?w=20", "If-None-Match", resized); w.Code != http.StatusNotModified {
+		t.Errorf("resized with its own tag: status %d, want 304", w.Code)
+	}
+}
+
+func TestImageEndpoint_Range(t *testing.T) {
+	db, imgDir := testSetup(t)
+	data := writeTestWebP(t, imgDir, "abc123", 64, 64)
+	handler := New(db, imgDir)
+
+	req := httptest.NewRequest("GET", "/api/image/abc123", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want 206", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data[:10]) {
+		t.Errorf("body = %q, want first 10 bytes %q", w.Body.Bytes(), data[:10])
+	}
+	if got, want := w.Header().Get("Content-Range"), "bytes 0-9/"+strconv.Itoa(len(data)); got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if got := w.Header().Get("Content-Length"); got != "10" {
+		t.Errorf("Content-Length = %q, want 10", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/webp" {
+		t.Errorf("Content-Type = %q, want image/webp", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	// A stale If-Range validator gets the whole image.
+	req = httptest.NewRequest("GET", "/api/image/abc123", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("If-Range", `"stale"`)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("stale If-Range: status %d, %d bytes; want 200 with all %d", w.Code, w.Body.Len(), len(data))
+	}
+
+	// Past the end of the file.
+	req = httptest.NewRequest("GET", "/api/image/abc123", nil)
+	req.Header.Set("Range", "bytes="+strconv.Itoa(len(data))+"-")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: status %d, want 416", w.Code)
+	}
+}
+
 func TestImageEndpoint_NotFound(t *testing.T) {
 	db, imgDir := testSetup(t)
 	handler := New(db, imgDir)
@@ -159,4 +824,1614 @@ func TestImageEndpoint_InvalidHash(t *testing.T) {
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("invalid hash returned %d, want 400", w.Code)
 	}
+
+	for path, want := range map[string]string{
+		"/api/image":                            "missing image hash",
+		"/api/image/":                           "missing image hash",
+		"/api/image/.webp":                      "missing image hash",
+		"/api/image/" + strings.Repeat("a", 65): "invalid hash",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != want {
+			t.Errorf("%s: %d %q, want 400 %q", path[:min(len(path), 20)], w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestRandomEndpoint_BalanceBySource(t *testing.T) {
+	db, imgDir := testSetup(t)
+	db.Insert(&catalog.Image{
+		Hash: "aa", Source: "waifu.im", SourceURL: "u", Category: "sfw", Filename: "aa.webp",
+	})
+	handler := New(db, imgDir)
+
+	req := httptest.NewRequest("GET", "/api/random?balance=source", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("balance=source returned %d, want 200", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/random?balance=bogus", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("balance=bogus returned %d, want 400", w.Code)
+	}
+}
+
+func TestImageEndpoint_Extension(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	webpData := []byte("RIFF\x14\x00\x00\x00WEBPfake-webp-image-data")
+	pngData := []byte("\x89PNG\r\n\x1a\nfake-png-image-data")
+	os.WriteFile(filepath.Join(imgDir, "abc123.webp"), webpData, 0o644)
+	os.WriteFile(filepath.Join(imgDir, "abc123.png"), pngData, 0o644)
+	os.WriteFile(filepath.Join(imgDir, "def456.webp"), webpData, 0o644)
+	// Original JPEG bytes kept under a .webp name by an older ingest.
+	jpegData := []byte("\xff\xd8\xff\xe0fake-jpeg-image-data")
+	os.WriteFile(filepath.Join(imgDir, "0dd1ab.webp"), jpegData, 0o644)
+
+	handler := New(db, imgDir)
+
+	tests := []struct {
+		path     string
+		wantBody []byte
+		wantType string
+	}{
+		{"/api/image/abc123.webp", webpData, "image/webp"},
+		{"/api/image/abc123.png", pngData, "image/png"},
+		// No PNG stored: fall back to the stored format.
+		{"/api/image/def456.png", webpData, "image/webp"},
+		{"/api/image/def456.avif", webpData, "image/webp"},
+		{"/api/image/def456", webpData, "image/webp"},
+		// The content, not the extension, decides the type.
+		{"/api/image/0dd1ab", jpegData, "image/jpeg"},
+		{"/api/image/0dd1ab.webp", jpegData, "image/jpeg"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d, want 200", tt.path, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.wantType {
+			t.Fatalf("%s content-type = %q, want %q", tt.path, got, tt.wantType)
+		}
+		if w.Body.String() != string(tt.wantBody) {
+			t.Fatalf("%s body mismatch", tt.path)
+		}
+	}
+
+	// Unknown extensions are not stripped and fail hash validation.
+	req := httptest.NewRequest("GET", "/api/image/abc123.exe", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown extension returned %d, want 400", w.Code)
+	}
+}
+
+// writeTestWebP stores a real w×h WebP image under imgDir as hash.webp.
+func writeTestWebP(t *testing.T, imgDir, hash string, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	data, err := optimize.Encode(img)
+	if err != nil {
+		t.Fatalf("encode test webp: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(imgDir, hash+".webp"), data, 0o644); err != nil {
+		t.Fatalf("write test webp: %v", err)
+	}
+	return data
+}
+
+func TestImageEndpoint_Fit(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 400, 200)
+	handler := New(db, imgDir)
+
+	tests := []struct {
+		query      string
+		code       int
+		outW, outH int
+	}{
+		{"w=100&h=100&fit=cover", http.StatusOK, 100, 100},
+		{"w=100&h=100&fit=contain", http.StatusOK, 100, 50},
+		{"w=100&h=100", http.StatusOK, 100, 50},
+		{"w=200", http.StatusOK, 200, 100},
+		{"w=800", http.StatusOK, 400, 200},
+		{"w=800&allow_upscale=1", http.StatusOK, 800, 400},
+		{"w=800&allow_upscale=0", http.StatusOK, 400, 200},
+		{"w=1000&h=1000&fit=cover", http.StatusOK, 200, 200},
+		{"w=1000&h=1000&fit=cover&allow_upscale=1", http.StatusOK, 1000, 1000},
+		{"w=800&allow_upscale=yes", http.StatusBadRequest, 0, 0},
+		{"w=100&fit=cover", http.StatusBadRequest, 0, 0},
+		{"h=100&fit=contain", http.StatusBadRequest, 0, 0},
+		{"w=100&h=100&fit=stretch", http.StatusBadRequest, 0, 0},
+		{"w=0", http.StatusBadRequest, 0, 0},
+		{"w=abc", http.StatusBadRequest, 0, 0},
+		{"w=99999", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/image/abc123?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.query, w.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		img, _, err := optimize.Decode(w.Body.Bytes())
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.query, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != tt.outW || b.Dy() != tt.outH {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.query, b.Dx(), b.Dy(), tt.outW, tt.outH)
+		}
+	}
+}
+
+func TestImageEndpoint_Tone(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 200, 100)
+	handler := New(db, imgDir)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/image/abc123?"+query, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	// Lossy output re-derives RGB from YUV, so neutral pixels may drift by
+	// a step or two.
+	const slack = 3
+	neutral := func(c color.NRGBA) bool {
+		lo, hi := min(c.R, c.G, c.B), max(c.R, c.G, c.B)
+		return hi-lo <= slack
+	}
+
+	for _, query := range []string{"grayscale=1", "grayscale=true&w=50"} {
+		w := get(query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", query, w.Code)
+		}
+		img, _, err := optimize.Decode(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: decode: %v", query, err)
+		}
+		b := img.Bounds()
+		if query == "grayscale=true&w=50" && (b.Dx() != 50 || b.Dy() != 25) {
+			t.Errorf("%s: got %dx%d, want 50x25", query, b.Dx(), b.Dy())
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); !neutral(c) {
+					t.Fatalf("%s: pixel (%d,%d) = %v, want gray", query, x, y, c)
+				}
+			}
+		}
+	}
+
+	// The source has blue well above red and green; sepia flips that.
+	w := get("sepia=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("sepia: status %d, want 200", w.Code)
+	}
+	img, _, err := optimize.Decode(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("sepia: decode: %v", err)
+	}
+	if c := color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA); c.R <= c.B {
+		t.Errorf("sepia pixel = %v, want red above blue", c)
+	}
+
+	// Filters change the ETag; an off switch does not.
+	plain := get("").Header().Get("ETag")
+	gray := get("grayscale=1").Header().Get("ETag")
+	if gray == plain || gray == get("sepia=1").Header().Get("ETag") {
+		t.Errorf("ETags plain %s, grayscale %s not distinct", plain, gray)
+	}
+	if got := get("grayscale=0").Header().Get("ETag"); got != plain {
+		t.Errorf("grayscale=0 ETag = %s, want %s", got, plain)
+	}
+
+	for _, query := range []string{"grayscale=yes", "sepia=2", "grayscale=1&sepia=1"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestASCIIEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 200, 100)
+	handler := New(db, imgDir)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	for _, tt := range []struct {
+		query      string
+		cols, rows int
+	}{
+		{"", 80, 20},
+		{"?cols=40", 40, 10},
+	} {
+		w := get("/api/ascii/abc123" + tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d, want 200", tt.query, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%q: content-type = %q, want text/plain", tt.query, ct)
+		}
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		if len(lines) != tt.rows || len(lines[0]) != tt.cols {
+			t.Errorf("%q: got %d rows of %d, want %d of %d", tt.query, len(lines), len(lines[0]), tt.rows, tt.cols)
+		}
+	}
+
+	w := get("/api/ascii/abc123?color=1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\x1b[38;2;") {
+		t.Errorf("color=1: status %d, body without truecolor escapes", w.Code)
+	}
+	if tag := w.Header().Get("ETag"); tag == "" || tag == get("/api/ascii/abc123").Header().Get("ETag") {
+		t.Errorf("color=1 ETag %q not distinct", tag)
+	}
+
+	for path, code := range map[string]int{
+		"/api/ascii/abc123?cols=4":    http.StatusBadRequest,
+		"/api/ascii/abc123?cols=9999": http.StatusBadRequest,
+		"/api/ascii/abc123?color=red": http.StatusBadRequest,
+		"/api/ascii/ABC":              http.StatusBadRequest,
+		"/api/ascii/def456":           http.StatusNotFound,
+	} {
+		if w := get(path); w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+	}
+}
+
+func TestImageEndpoint_TransformCache(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 400, 200)
+	cache := NewTransformCache(1 << 20)
+	handler := New(db, imgDir, WithTransformCache(cache))
+	get := func(query string) []byte {
+		req := httptest.NewRequest("GET", "/api/image/abc123?"+query, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", query, w.Code)
+		}
+		return w.Body.Bytes()
+	}
+	metric := func(name string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if v, ok := strings.CutPrefix(line, name+" "); ok {
+				return v
+			}
+		}
+		return ""
+	}
+
+	first := get("w=100&h=100&fit=cover")
+	second := get("w=100&h=100&fit=cover")
+	if !bytes.Equal(first, second) {
+		t.Error("repeated transform returned different bytes")
+	}
+	if n := metric("waifu_mirror_transforms_total"); n != "1" {
+		t.Errorf("transforms after a repeat = %s, want 1 (no second encode)", n)
+	}
+	if n := metric("waifu_mirror_transform_cache_hits_total"); n != "1" {
+		t.Errorf("cache hits = %s, want 1", n)
+	}
+
+	// Other parameters are other entries.
+	get("w=100&h=100&fit=contain")
+	if n := metric("waifu_mirror_transforms_total"); n != "2" {
+		t.Errorf("transforms after a new variant = %s, want 2", n)
+	}
+
+	// A changed source file invalidates its results.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(imgDir, "abc123.webp"), later, later)
+	get("w=100&h=100&fit=cover")
+	if n := metric("waifu_mirror_transforms_total"); n != "3" {
+		t.Errorf("transforms after the source changed = %s, want 3", n)
+	}
+}
+
+func TestTransformCache_Evicts(t *testing.T) {
+	c := NewTransformCache(10)
+	var mod time.Time
+	c.put("a", mod, []byte("aaaa"))
+	c.put("b", mod, []byte("bbbb"))
+	c.get("a", mod) // a is now the most recently used
+	c.put("c", mod, []byte("cccc"))
+	if _, ok := c.get("b", mod); ok {
+		t.Error("least recently used entry b survived")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key, mod); !ok {
+			t.Errorf("entry %s evicted", key)
+		}
+	}
+	c.put("big", mod, make([]byte, 11))
+	if _, ok := c.get("big", mod); ok || c.size != 8 {
+		t.Errorf("oversized entry stored; size %d", c.size)
+	}
+	if _, ok := (*TransformCache)(nil).get("a", mod); ok {
+		t.Error("nil cache hit")
+	}
+}
+
+func TestImageEndpoint_ResizeCache(t *testing.T) {
+	db, imgDir := testSetup(t)
+	stored := writeTestWebP(t, imgDir, "abc123", 400, 200)
+	handler := New(db, imgDir)
+	get := func(h http.Handler, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/image/abc123?"+query, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", query, w.Code)
+		}
+		return w
+	}
+
+	// A miss resizes and stores the result.
+	w := get(handler, "w=128")
+	img, _, err := optimize.Decode(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 128 || b.Dy() != 64 {
+		t.Errorf("got %dx%d, want 128x64", b.Dx(), b.Dy())
+	}
+	path := maintenance.ResizedPath(imgDir, "abc123", 128)
+	cached, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(cached, w.Body.Bytes()) {
+		t.Fatalf("cached file %s does not hold the response: %v", path, err)
+	}
+
+	// A hit serves the file as is: swap in a marker image to tell.
+	marker := writeTestWebP(t, t.TempDir(), "marker", 7, 7)
+	os.WriteFile(path, marker, 0o644)
+	w = get(handler, "w=128")
+	if !bytes.Equal(w.Body.Bytes(), marker) {
+		t.Errorf("second request did not serve the cached file")
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(marker)) {
+		t.Errorf("Content-Length = %s, want %d", got, len(marker))
+	}
+
+	// Anything beyond a plain width is transformed afresh and not stored.
+	get(handler, "w=120&h=120")
+	get(handler, "w=120&grayscale=1")
+	get(handler, "w=120&allow_upscale=1")
+	get(New(db, imgDir, WithWatermark("wm", optimize.BottomRight)), "w=120")
+	// So are widths off the cached set, and those at or beyond the stored
+	// width are the stored image.
+	for width := 150; width < 170; width++ {
+		get(handler, "w="+strconv.Itoa(width))
+	}
+	for width := 400; width < 420; width++ {
+		if w := get(handler, "w="+strconv.Itoa(width)); !bytes.Equal(w.Body.Bytes(), stored) {
+			t.Fatalf("w=%d: did not serve the stored image", width)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("resize cache holds %d files, want 1", len(entries))
+	}
+}
+
+func TestImageEndpoint_PregeneratedThumb(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 400, 200)
+	db.Insert(&catalog.Image{Hash: "abc123", Source: "test", SourceURL: "u",
+		Category: "sfw", Width: 400, Height: 200, Filename: "abc123.webp"})
+	if _, err := maintenance.PregenThumbs(db, imgDir, 1, nil); err != nil {
+		t.Fatalf("PregenThumbs: %v", err)
+	}
+	thumb, err := os.ReadFile(maintenance.ResizedPath(imgDir, "abc123", maintenance.ThumbSize))
+	if err != nil {
+		t.Fatalf("read thumb: %v", err)
+	}
+	handler := New(db, imgDir)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/image/abc123?w="+strconv.Itoa(maintenance.ThumbSize), nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), thumb) {
+		t.Fatalf("w=%d: status %d, did not serve the pregenerated thumbnail", maintenance.ThumbSize, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "waifu_mirror_transforms_total 0") {
+		t.Error("serving the pregenerated thumbnail ran a transform")
+	}
+}
+
+func TestImageEndpoint_Format(t *testing.T) {
+	db, imgDir := testSetup(t)
+	stored := writeTestWebP(t, imgDir, "abc123", 400, 200)
+	handler := New(db, imgDir)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/image/abc123"+query, nil))
+		return w
+	}
+
+	for query, want := range map[string]string{"?format=png": "png", "?format=jpeg": "jpeg", "?format=jpg": "jpeg"} {
+		w := get(query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", query, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/"+want || optimize.Sniff(w.Body.Bytes()) != want {
+			t.Errorf("%s: content-type %q, body sniffs as %q, want %s", query, ct, optimize.Sniff(w.Body.Bytes()), want)
+		}
+		cached, err := os.ReadFile(maintenance.TranscodedPath(imgDir, "abc123", want))
+		if err != nil || !bytes.Equal(cached, w.Body.Bytes()) {
+			t.Errorf("%s: transcode not cached on disk: %v", query, err)
+		}
+	}
+
+	// Without format, or asking for the stored one, the stored bytes are
+	// served; with other transforms the result is not stored.
+	if w := get(""); !bytes.Equal(w.Body.Bytes(), stored) {
+		t.Error("no format: did not serve the stored bytes")
+	}
+	w := get("?format=png&w=100")
+	if img, format, err := optimize.Decode(w.Body.Bytes()); err != nil || format != "png" || img.Bounds().Dx() != 100 {
+		t.Errorf("format=png&w=100: got %s, %v", format, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(imgDir, "transcoded")); len(entries) != 2 {
+		t.Errorf("transcode cache holds %d files, want 2", len(entries))
+	}
+	if w := get("?format=gif"); w.Code != http.StatusBadRequest {
+		t.Errorf("format=gif: status %d, want 400", w.Code)
+	}
+	if a, b := get("?format=png").Header().Get("ETag"), get("?format=jpeg").Header().Get("ETag"); a == b {
+		t.Errorf("png and jpeg share ETag %q", a)
+	}
+}
+
+func TestVariantsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 400, 200)
+	db.Insert(&catalog.Image{Hash: "abc123", Source: "test", SourceURL: "https://example.com",
+		Category: "sfw", Width: 400, Height: 200, Filename: "abc123.webp"})
+	handler := New(db, imgDir)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	variants := func() []variantItem {
+		t.Helper()
+		w := get("/api/image/abc123/variants")
+		var items []variantItem
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &items) != nil {
+			t.Fatalf("variants: status %d, body %q", w.Code, w.Body.String())
+		}
+		return items
+	}
+
+	if items := variants(); items == nil || len(items) != 0 {
+		t.Fatalf("before any resize: %+v, want []", items)
+	}
+
+	// A cached downscale is listed; a width beyond the image is not.
+	resized := get("/api/image/abc123?w=128")
+	get("/api/image/abc123?w=800")
+	want := []variantItem{{
+		Variant: catalog.Variant{Width: 128, Height: 64, SizeBytes: int64(resized.Body.Len()), Format: optimize.OutputFormat()},
+		URL:     "/api/image/abc123?w=128",
+	}}
+	if items := variants(); len(items) != 1 || items[0] != want[0] {
+		t.Errorf("variants = %+v, want %+v", items, want)
+	}
+
+	for path, code := range map[string]int{
+		"/api/image/def456/variants": http.StatusNotFound,
+		"/api/image/XYZ/variants":    http.StatusBadRequest,
+	} {
+		if w := get(path); w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+	}
+}
+
+func TestGraphicsEndpoints(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 200, 100)
+	handler := New(db, imgDir)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	for query, size := range map[string]string{"": "200;100", "?w=50": "50;25"} {
+		w := get("/api/sixel/abc123" + query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d, want 200", query, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%q: content-type = %q", query, ct)
+		}
+		body := w.Body.String()
+		if !strings.HasPrefix(body, "\x1bP0;1;0q\"1;1;"+size+"#") || !strings.HasSuffix(body, "\x1b\\") {
+			t.Errorf("%q: body %.40q... is not a %s Sixel sequence", query, body, size)
+		}
+	}
+	if a, b := get("/api/sixel/abc123").Header().Get("ETag"), get("/api/sixel/abc123?w=50").Header().Get("ETag"); a == "" || a == b {
+		t.Errorf("ETags %q and %q not distinct", a, b)
+	}
+
+	w := get("/api/kitty/abc123?w=50")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "\x1b_Ga=T,f=32,q=2,s=50,v=25,m=1;") {
+		t.Errorf("kitty: status %d, body %.40q...", w.Code, w.Body.String())
+	}
+	if w := get("/api/kitty/def456"); w.Code != http.StatusNotFound {
+		t.Errorf("kitty for an unknown hash: status %d, want 404", w.Code)
+	}
+
+	w = get("/api/halfblocks/abc123?cols=20")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "\n") != 5 || strings.Count(w.Body.String(), "▀") != 100 {
+		t.Errorf("halfblocks: status %d, body %.40q..., want 5 rows of 20 cells", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("halfblocks: content-type = %q", ct)
+	}
+
+	for path, code := range map[string]int{
+		"/api/sixel/abc123?w=1":         http.StatusBadRequest,
+		"/api/sixel/abc123?fit=x":       http.StatusBadRequest,
+		"/api/sixel/XYZ":                http.StatusBadRequest,
+		"/api/sixel/def456":             http.StatusNotFound,
+		"/api/halfblocks/abc123?cols=2": http.StatusBadRequest,
+	} {
+		if w := get(path); w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+	}
+}
+
+func TestTransformPool_BoundedConcurrency(t *testing.T) {
+	pool := NewTransformPool(2)
+
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := pool.Do(context.Background(), func() {
+				n := atomic.AddInt32(&active, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&active, -1)
+			})
+			if err != nil {
+				t.Errorf("Do: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Fatalf("peak concurrency = %d, want <= 2", peak)
+	}
+}
+
+func TestImageEndpoint_TransformConcurrency(t *testing.T) {
+	db, imgDir := testSetup(t)
+	writeTestWebP(t, imgDir, "abc123", 64, 64)
+
+	pool := NewTransformPool(2)
+	handler := New(db, imgDir, WithWatermark("test", optimize.BottomRight), WithTransformPool(pool))
+
+	var wg sync.WaitGroup
+	var ok, busy int32
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/api/image/abc123", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			switch w.Code {
+			case http.StatusOK:
+				atomic.AddInt32(&ok, 1)
+			case http.StatusServiceUnavailable:
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("503 without Retry-After")
+				}
+				atomic.AddInt32(&busy, 1)
+			default:
+				t.Errorf("unexpected status %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if ok == 0 {
+		t.Fatal("no transform requests succeeded")
+	}
+
+	// With every queue slot taken, further requests are rejected.
+	for i := 0; i < cap(pool.pending); i++ {
+		pool.pending <- struct{}{}
+	}
+	req := httptest.NewRequest("GET", "/api/image/abc123", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("saturated pool returned %d, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After on 503")
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, h := range []string{"aa", "bb", "cc"} {
+		db.Insert(&catalog.Image{
+			Hash: h, Source: "test", SourceURL: "u", Category: "sfw", Filename: h + ".webp",
+		})
+	}
+
+	// Disabled without a configured token.
+	req := httptest.NewRequest("GET", "/api/export", nil)
+	w := httptest.NewRecorder()
+	New(db, imgDir).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("export without token configured returned %d, want 403", w.Code)
+	}
+
+	handler := New(db, imgDir, WithAuthToken("secret"))
+
+	req = httptest.NewRequest("GET", "/api/export", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("export with bad token returned %d, want 401", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/export?since=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export returned %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("X-Export-Max-Id"); got != "3" {
+		t.Fatalf("X-Export-Max-Id = %q, want 3", got)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("export returned %d rows, want 2: %q", len(lines), w.Body.String())
+	}
+	var img catalog.Image
+	if err := json.Unmarshal([]byte(lines[0]), &img); err != nil {
+		t.Fatalf("decode export row: %v", err)
+	}
+	if img.Hash != "bb" {
+		t.Fatalf("first exported hash = %q, want bb", img.Hash)
+	}
+
+	req = httptest.NewRequest("GET", "/api/export?since=-1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("negative since returned %d, want 400", w.Code)
+	}
+}
+
+func TestImageEndpoint_EmptyOrCorruptFile(t *testing.T) {
+	db, imgDir := testSetup(t)
+	os.WriteFile(filepath.Join(imgDir, "abc123.webp"), nil, 0o644)
+	os.WriteFile(filepath.Join(imgDir, "def456.webp"), []byte("<html>oops</html>"), 0o644)
+	handler := New(db, imgDir)
+
+	for _, hash := range []string{"abc123", "def456"} {
+		req := httptest.NewRequest("GET", "/api/image/"+hash, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code == http.StatusOK {
+			t.Fatalf("%s: served a broken file with 200 (%d bytes)", hash, w.Body.Len())
+		}
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s: returned %d, want 404", hash, w.Code)
+		}
+	}
+}
+
+func TestImageEndpoint_UndecodableTransform(t *testing.T) {
+	db, imgDir := testSetup(t)
+	full := writeTestWebP(t, imgDir, "abc123", 64, 64)
+	// Cut short as by a crash mid-write: the magic bytes still pass the
+	// load-time check, but the data does not decode.
+	os.WriteFile(filepath.Join(imgDir, "abc123.webp"), full[:len(full)/2], 0o644)
+	// AVIF is stored as-is and cannot be decoded at all.
+	os.WriteFile(filepath.Join(imgDir, "def456.avif"), []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), 0o644)
+	handler := New(db, imgDir)
+
+	for path, code := range map[string]int{
+		"/api/image/abc123?w=32":        http.StatusInternalServerError,
+		"/api/image/abc123?grayscale=1": http.StatusInternalServerError,
+		"/api/sixel/abc123":             http.StatusInternalServerError,
+		"/api/image/def456?w=32":        http.StatusUnprocessableEntity,
+		"/api/ascii/def456":             http.StatusUnprocessableEntity,
+		"/api/image/def456":             http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+		// An error must not be cached in place of the image.
+		if code != http.StatusOK && (w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("ETag") != "") {
+			t.Errorf("%s: error sent with Cache-Control %q, ETag %q", path,
+				w.Header().Get("Cache-Control"), w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestImageEndpoint_MissingFileBehavior(t *testing.T) {
+	db, imgDir := testSetup(t)
+	present := []byte("RIFF\x14\x00\x00\x00WEBPpresent-image-data")
+	os.WriteFile(filepath.Join(imgDir, "bbbb.webp"), present, 0o644)
+	for _, hash := range []string{"aaaa", "bbbb"} { // aaaa's file is missing
+		db.Insert(&catalog.Image{
+			Hash: hash, Source: "test", SourceURL: "u", Category: "sfw", Filename: hash + ".webp",
+		})
+	}
+	fallback := []byte("RIFF\x14\x00\x00\x00WEBPfallback-image")
+
+	tests := []struct {
+		behavior    MissingFileBehavior
+		fallback    []byte
+		code        int
+		body        []byte
+		substituted string
+	}{
+		{MissingNotFound, nil, http.StatusNotFound, nil, ""},
+		{MissingRandom, nil, http.StatusOK, present, "random"},
+		{MissingFallback, fallback, http.StatusOK, fallback, "fallback"},
+		{MissingFallback, nil, http.StatusNotFound, nil, ""},
+	}
+	for _, tt := range tests {
+		handler := New(db, imgDir, WithMissingFileBehavior(tt.behavior, tt.fallback))
+		for _, hash := range []string{"aaaa", "cccc"} { // cccc is not in the catalog
+			req := httptest.NewRequest("GET", "/api/image/"+hash, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			code, substituted := tt.code, tt.substituted
+			if hash == "cccc" {
+				code, substituted = http.StatusNotFound, ""
+			}
+			if w.Code != code {
+				t.Errorf("%s %s: status %d, want %d", tt.behavior, hash, w.Code, code)
+				continue
+			}
+			if got := w.Header().Get("X-Image-Substituted"); got != substituted {
+				t.Errorf("%s %s: X-Image-Substituted = %q, want %q", tt.behavior, hash, got, substituted)
+			}
+			if code != http.StatusOK {
+				continue
+			}
+			if !bytes.Equal(w.Body.Bytes(), tt.body) {
+				t.Errorf("%s %s: served the wrong image", tt.behavior, hash)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("%s %s: Cache-Control = %q, want no-store", tt.behavior, hash, cc)
+			}
+			if tag := w.Header().Get("ETag"); tag != "" {
+				t.Errorf("%s %s: substitute has ETag %s", tt.behavior, hash, tag)
+			}
+			if lm := w.Header().Get("Last-Modified"); lm != "" {
+				t.Errorf("%s %s: substitute has Last-Modified %s", tt.behavior, hash, lm)
+			}
+		}
+	}
+
+	handler := New(db, imgDir, WithMissingFileBehavior(MissingRandom, nil))
+	req := httptest.NewRequest("GET", "/api/image/aaaa", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Image-Substitute-Hash"); got != "bbbb" {
+		t.Errorf("X-Image-Substitute-Hash = %q, want bbbb", got)
+	}
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("substitute with If-Modified-Since: status %d, want 200", w.Code)
+	}
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	bus := events.NewBus()
+	srv := httptest.NewServer(New(db, imgDir, WithEvents(bus)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/events")
+	if err != nil {
+		t.Fatalf("GET /api/events: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("events returned %d, want 200", resp.StatusCode)
+	}
+
+	// The subscription is registered before headers are flushed, so events
+	// published now reach this client.
+	bus.Publish(events.TopicImages, "image", &catalog.Image{Hash: "abc123", Category: "sfw"})
+
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read event: %v", err)
+	}
+	var ev struct {
+		Type string        `json:"type"`
+		Data catalog.Image `json:"data"`
+	}
+	if err := json.Unmarshal(line, &ev); err != nil {
+		t.Fatalf("decode event %q: %v", line, err)
+	}
+	if ev.Type != "image" || ev.Data.Hash != "abc123" {
+		t.Fatalf("event = %+v", ev)
+	}
+
+	// Closing the bus (server shutdown) ends the stream.
+	bus.Close()
+	done := make(chan struct{})
+	go func() {
+		bufio.NewReader(resp.Body).ReadBytes('\n')
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream did not end after bus close")
+	}
+}
+
+func TestIngestEventsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	bus := events.NewBus()
+	srv := httptest.NewServer(New(db, imgDir, WithEvents(bus)))
+	defer srv.Close()
+
+	// Two concurrent subscribers both see the event.
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/api/ingest/events")
+		if err != nil {
+			t.Fatalf("GET /api/ingest/events: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("content-type = %q, want text/event-stream", ct)
+		}
+		readers = append(readers, bufio.NewReader(resp.Body))
+	}
+
+	bus.Publish(events.TopicIngest, "cycle_complete", map[string]int{"new": 3})
+	// Image events are a different topic and must not appear here.
+	bus.Publish(events.TopicImages, "image", "ignored")
+	bus.Publish(events.TopicIngest, "cycle_start", map[string]int{})
+
+	for i, rd := range readers {
+		var lines []string
+		for len(lines) < 6 {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatalf("subscriber %d: read: %v", i, err)
+			}
+			lines = append(lines, strings.TrimRight(line, "\n"))
+		}
+		want := []string{
+			"event: cycle_complete", `data: {"new":3}`, "",
+			"event: cycle_start", "data: {}", "",
+		}
+		for j := range want {
+			if lines[j] != want[j] {
+				t.Fatalf("subscriber %d line %d = %q, want %q", i, j, lines[j], want[j])
+			}
+		}
+	}
+}
+
+func TestImageEndpoint_ContentLength(t *testing.T) {
+	db, imgDir := testSetup(t)
+	webpData := writeTestWebP(t, imgDir, "abc123", 32, 32)
+	pngData := []byte("\x89PNG\r\n\x1a\nfake-png-image-data")
+	os.WriteFile(filepath.Join(imgDir, "def456.png"), pngData, 0o644)
+
+	// Use a real server so the response goes through net/http's framing.
+	plain := httptest.NewServer(New(db, imgDir))
+	defer plain.Close()
+	marked := httptest.NewServer(New(db, imgDir, WithWatermark("wm", optimize.BottomRight)))
+	defer marked.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		wantLen int
+	}{
+		{"webp", plain.URL + "/api/image/abc123", len(webpData)},
+		{"original png", plain.URL + "/api/image/def456", len(pngData)},
+		{"transformed", marked.URL + "/api/image/abc123", -1},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(tt.url)
+		if err != nil {
+			t.Fatalf("%s: GET: %v", tt.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.name, resp.StatusCode)
+		}
+		if len(resp.TransferEncoding) > 0 {
+			t.Fatalf("%s: unexpected transfer-encoding %v", tt.name, resp.TransferEncoding)
+		}
+		cl := resp.Header.Get("Content-Length")
+		if cl == "" {
+			t.Fatalf("%s: missing Content-Length", tt.name)
+		}
+		if cl != strconv.Itoa(len(body)) {
+			t.Fatalf("%s: Content-Length = %s, body is %d bytes", tt.name, cl, len(body))
+		}
+		if tt.wantLen >= 0 && len(body) != tt.wantLen {
+			t.Fatalf("%s: body is %d bytes, want %d", tt.name, len(body), tt.wantLen)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir, WithRequestLimits(64, 16))
+
+	req := httptest.NewRequest("GET", "/api/image/"+strings.Repeat("a", 64), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("long URI returned %d, want 414", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/health", strings.NewReader(strings.Repeat("x", 17)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body returned %d, want 413", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/health", strings.NewReader("small"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("small request returned %d, want 200", w.Code)
+	}
+
+	// A body without a declared length is cut off while it is read.
+	var readErr error
+	limited := limitRequests(&config{maxBodyBytes: 16}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+	req = httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader(strings.Repeat("x", 17))))
+	req.ContentLength = -1
+	limited.ServeHTTP(httptest.NewRecorder(), req)
+	var maxErr *http.MaxBytesError
+	if !errors.As(readErr, &maxErr) {
+		t.Errorf("read error = %v, want *http.MaxBytesError", readErr)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	const limit, total = 3, 20
+	release := make(chan struct{})
+	var inFlight, peak atomic.Int32
+	h := limitConcurrency(&config{maxConcurrent: limit}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		if r.URL.Path != "/api/health" {
+			<-release
+		}
+	}))
+
+	codes := make(chan int, total)
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/api/random", nil))
+			if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+			codes <- w.Code
+		}()
+	}
+
+	// Every request beyond the cap is turned away while the first ones block.
+	rejected := 0
+	for rejected < total-limit {
+		select {
+		case code := <-codes:
+			if code != http.StatusServiceUnavailable {
+				t.Fatalf("request finished with %d while others were blocked", code)
+			}
+			rejected++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d requests rejected, want %d", rejected, total-limit)
+		}
+	}
+
+	// Health checks still get through while the cap is reached.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("health returned %d under load, want 200", w.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("admitted request returned %d, want 200", code)
+		}
+	}
+	if p := peak.Load(); p > limit+1 { // +1 for the health check
+		t.Errorf("peak concurrency %d, want at most %d", p, limit+1)
+	}
+}
+
+func TestPatchImageCategory(t *testing.T) {
+	db, imgDir := testSetup(t)
+	db.Insert(&catalog.Image{Hash: "abc123", Source: "test", SourceURL: "u", Category: "sfw", Filename: "abc123.webp"})
+	handler := New(db, imgDir, WithAuthToken("secret"))
+
+	patch := func(hash, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/api/image/"+hash, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := patch("abc123", `{"category":"nsfw"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch returned %d: %s", w.Code, w.Body)
+	}
+	var img catalog.Image
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if img.Hash != "abc123" || img.Category != "nsfw" {
+		t.Errorf("response = %+v, want abc123 in nsfw", img)
+	}
+	if got, _ := db.GetByHash("abc123"); got == nil || got.Category != "nsfw" {
+		t.Errorf("catalog row = %+v, want category nsfw", got)
+	}
+
+	if w := patch("def456", `{"category":"nsfw"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown hash returned %d, want 404", w.Code)
+	}
+	for _, body := range []string{`{"category":"never-seen"}`, `{"category":"Bad Name"}`, `{}`, `{"colour":"red"}`} {
+		if w := patch("abc123", body); w.Code != http.StatusBadRequest {
+			t.Errorf("body %s returned %d, want 400", body, w.Code)
+		}
+	}
+
+	// Still auth-gated.
+	req := httptest.NewRequest("PATCH", "/api/image/abc123", strings.NewReader(`{"category":"sfw"}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated patch returned %d, want 401", w.Code)
+	}
+}
+
+func TestAdminDelete(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, img := range []*catalog.Image{
+		{Hash: "aa01", Source: "waifu.pics", Category: "sfw"},
+		{Hash: "aa02", Source: "waifu.pics", Category: "nsfw"},
+		{Hash: "aa03", Source: "waifu.im", Category: "sfw"},
+	} {
+		img.SourceURL, img.Filename = "u", img.Hash+".webp"
+		db.Insert(img)
+		os.WriteFile(filepath.Join(imgDir, img.Filename), []byte("x"), 0o644)
+	}
+	handler := New(db, imgDir, WithAuthToken("secret"))
+
+	del := func(body string) (int, deleteResponse) {
+		req := httptest.NewRequest("POST", "/api/admin/delete", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp deleteResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	for _, body := range []string{`{}`, `{"dry_run":true}`, `{"views":0}`, `{"max_views":0}`, `{"max_views":1000}`, `not json`} {
+		if code, _ := del(body); code != http.StatusBadRequest {
+			t.Errorf("body %s returned %d, want 400", body, code)
+		}
+	}
+	if n, _ := db.Count(); n != 3 {
+		t.Fatalf("rejected bodies deleted rows: %d left", n)
+	}
+
+	code, resp := del(`{"source":"waifu.pics","max_views":0,"dry_run":true}`)
+	if code != http.StatusOK || resp.Count != 2 || !resp.DryRun {
+		t.Fatalf("dry run = %d %+v, want 2 matches", code, resp)
+	}
+	if n, _ := db.Count(); n != 3 {
+		t.Fatalf("dry run deleted rows: %d left", n)
+	}
+
+	code, resp = del(`{"source":"waifu.pics","category":"sfw"}`)
+	if code != http.StatusOK || resp.Count != 1 || resp.Hashes[0] != "aa01" {
+		t.Fatalf("delete = %d %+v, want aa01 removed", code, resp)
+	}
+	if _, err := db.GetByHash("aa01"); err == nil {
+		t.Error("row aa01 still in catalog")
+	}
+	if _, err := os.Stat(filepath.Join(imgDir, "aa01.webp")); !os.IsNotExist(err) {
+		t.Errorf("file aa01.webp not removed: %v", err)
+	}
+	if n, _ := db.Count(); n != 2 {
+		t.Errorf("%d rows left, want 2", n)
+	}
+
+	// Still auth-gated.
+	req := httptest.NewRequest("POST", "/api/admin/delete", strings.NewReader(`{"source":"waifu.im"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated delete returned %d, want 401", w.Code)
+	}
+}
+
+func TestWarmSet(t *testing.T) {
+	db, imgDir := testSetup(t)
+	small := writeTestWebP(t, imgDir, "aa11", 4, 4)
+	db.Insert(&catalog.Image{Hash: "aa11", Source: "test", Category: "sfw", Filename: "aa11.webp"})
+	big := writeTestWebP(t, imgDir, "bb22", 64, 64)
+	db.Insert(&catalog.Image{Hash: "bb22", Source: "test", Category: "sfw", Filename: "bb22.webp"})
+
+	// Room for the small image only.
+	if len(small) >= len(big) {
+		t.Fatalf("fixture sizes: small %d, big %d", len(small), len(big))
+	}
+	ws := NewWarmSet(db, imgDir, "sfw", 10, int64(len(big)-1))
+	if err := ws.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	handler := New(db, imgDir, WithWarmSet(ws))
+
+	// With the files gone, only warm images can still be served.
+	os.Remove(filepath.Join(imgDir, "aa11.webp"))
+	os.Remove(filepath.Join(imgDir, "bb22.webp"))
+
+	for path, want := range map[string]int{
+		"/api/image/aa11":      http.StatusOK,
+		"/api/image/aa11.webp": http.StatusOK,
+		"/api/image/aa11.png":  http.StatusNotFound, // other extensions go to disk
+		"/api/image/bb22":      http.StatusNotFound, // over the byte cap
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s returned %d, want %d", path, w.Code, want)
+			continue
+		}
+		if want == http.StatusOK && !bytes.Equal(w.Body.Bytes(), small) {
+			t.Errorf("%s body differs from the warmed file", path)
+		}
+	}
+}
+
+func TestWarmSet_MostViewed(t *testing.T) {
+	db, imgDir := testSetup(t)
+	hashes := []string{"cc01", "cc02", "cc03", "cc04", "cc05"}
+	for _, h := range hashes {
+		writeTestWebP(t, imgDir, h, 4, 4)
+		db.Insert(&catalog.Image{Hash: h, Source: "test", Category: "sfw", Filename: h + ".webp"})
+	}
+	served := NewServedLog(db)
+	handler := New(db, imgDir, WithServedLog(served))
+	for range 3 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/image/cc04", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("image returned %d, want 200", w.Code)
+		}
+	}
+	// Random picks point at images without sending them; they are not views.
+	for range 5 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/random", nil))
+	}
+	if err := served.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	ws := NewWarmSet(db, imgDir, "sfw", 1, 0)
+	if err := ws.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, ok := ws.lookup("cc04", ""); !ok {
+		t.Error("warm set of one does not hold the only viewed image")
+	}
+}
+
+func TestCatalogStatsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for i := 1; i <= 4; i++ {
+		db.Insert(&catalog.Image{
+			Hash: "s" + strconv.Itoa(i), Source: "test", SourceURL: "u", Category: "sfw",
+			Width: 100, Height: 100, Format: "webp", SizeBytes: int64(i) * 100,
+			Filename: "s" + strconv.Itoa(i) + ".webp",
+		})
+	}
+	handler := New(db, imgDir)
+
+	get := func() catalog.Distribution {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/catalog/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("catalog stats returned %d, want 200", w.Code)
+		}
+		var dist catalog.Distribution
+		if err := json.Unmarshal(w.Body.Bytes(), &dist); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return dist
+	}
+
+	dist := get()
+	if dist.Count != 4 || dist.Size.P50 != 200 || dist.Size.Max != 400 || dist.BySource["test"] != 4 {
+		t.Fatalf("stats = %+v", dist)
+	}
+
+	// Within the TTL the cached result is served.
+	db.Insert(&catalog.Image{
+		Hash: "s5", Source: "test", SourceURL: "u", Category: "sfw", Filename: "s5.webp",
+	})
+	if dist := get(); dist.Count != 4 {
+		t.Errorf("count after insert = %d, want cached 4", dist.Count)
+	}
+}
+
+func TestFormatsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	req := httptest.NewRequest("GET", "/api/formats", nil)
+	w := httptest.NewRecorder()
+	New(db, imgDir).ServeHTTP(w, req)
+
+	var resp formatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Output != optimize.OutputFormat() || len(resp.Decode) == 0 {
+		t.Errorf("formats = %+v", resp)
+	}
+}
+
+func TestSourcesEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+
+	req := httptest.NewRequest("GET", "/api/sources", nil)
+	w := httptest.NewRecorder()
+	New(db, imgDir).ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("without WithSources returned %d, want 404", w.Code)
+	}
+
+	ing := ingest.New(db, imgDir)
+	w = httptest.NewRecorder()
+	New(db, imgDir, WithSources(ing.Sources)).ServeHTTP(w, req)
+	var resp []ingest.SourceStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(resp) == 0 || resp[0].Name == "" || resp[0].Rate != resp[0].BaseRate {
+		t.Errorf("sources = %+v", resp)
+	}
+}
+
+func TestRandomTextEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir)
+
+	req := httptest.NewRequest("GET", "http://mirror.example:8420/api/random.txt", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("empty catalog returned %d, want 503", w.Code)
+	}
+
+	db.Insert(&catalog.Image{Hash: "abc123", Source: "test", SourceURL: "u", Category: "sfw", Filename: "abc123.webp"})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("random.txt returned %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if got, want := w.Body.String(), "http://mirror.example:8420/api/image/abc123\n"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+
+	req = httptest.NewRequest("GET", "/api/random.txt?category=Bad!", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad category returned %d, want 400", w.Code)
+	}
+}
+
+func TestDailyEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	if w := get("/api/daily"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("empty catalog returned %d, want 503", w.Code)
+	}
+	if w := get("/api/daily?category=nope"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown category returned %d, want 404", w.Code)
+	}
+	if w := get("/api/daily?category=Bad!"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad category returned %d, want 400", w.Code)
+	}
+
+	for i := range 20 {
+		h := "daily" + strconv.Itoa(i)
+		db.Insert(&catalog.Image{Hash: h, Source: "test", SourceURL: "u", Category: "sfw", Filename: h + ".webp"})
+	}
+	var first string
+	for i := range 5 {
+		w := get("/api/daily?category=sfw")
+		if w.Code != http.StatusOK {
+			t.Fatalf("daily returned %d", w.Code)
+		}
+		var resp randomResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode daily: %v", err)
+		}
+		if i == 0 {
+			first = resp.Hash
+		} else if resp.Hash != first {
+			t.Fatalf("daily changed from %s to %s within a day", first, resp.Hash)
+		}
+		if got, want := w.Header().Get("X-Daily-Date"), time.Now().UTC().Format(time.DateOnly); got != want {
+			t.Errorf("X-Daily-Date = %q, want %q", got, want)
+		}
+		if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "max-age=") {
+			t.Errorf("Cache-Control = %q, want a max-age", cc)
+		}
+	}
+}
+
+func TestNSFWTag(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for _, img := range []*catalog.Image{
+		{Hash: "aaa111", Source: "test", SourceURL: "u", Category: "sfw", Filename: "aaa111.webp"},
+		{Hash: "bbb222", Source: "test", SourceURL: "u", Category: "nsfw", Filename: "bbb222.webp"},
+	} {
+		db.Insert(img)
+		writeTestWebP(t, imgDir, img.Hash, 8, 8)
+	}
+	peers := map[string][]string{
+		"100.64.0.1": {"tag:nsfw", "tag:server"},
+		"100.64.0.2": {"tag:server"},
+		"100.64.0.3": nil, // a user's device
+	}
+	resolve := func(ctx context.Context, remoteAddr string) (Peer, error) {
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		tags, ok := peers[host]
+		if !ok {
+			return Peer{}, errors.New("no such peer")
+		}
+		return Peer{User: host, Tags: tags}, nil
+	}
+	handler := New(db, imgDir, WithPeers(resolve), WithNSFWTag("tag:nsfw"))
+
+	tests := []struct {
+		peer, url string
+		want      int
+	}{
+		{"100.64.0.1", "/api/random?category=nsfw", http.StatusOK},
+		{"100.64.0.1", "/api/image/bbb222", http.StatusOK},
+		{"100.64.0.1", "/api/info/bbb222", http.StatusOK},
+		{"100.64.0.2", "/api/random?category=nsfw", http.StatusForbidden},
+		{"100.64.0.2", "/api/daily?category=nsfw", http.StatusForbidden},
+		{"100.64.0.2", "/api/list?category=nsfw", http.StatusForbidden},
+		{"100.64.0.3", "/api/image/bbb222.webp", http.StatusForbidden},
+		{"100.64.0.3", "/api/info/bbb222", http.StatusForbidden},
+		{"100.64.0.3", "/api/ascii/bbb222", http.StatusForbidden},
+		{"100.64.0.9", "/api/image/bbb222", http.StatusForbidden},
+		{"100.64.0.3", "/api/random?category=sfw", http.StatusOK},
+		{"100.64.0.3", "/api/image/aaa111", http.StatusOK},
+		{"100.64.0.9", "/api/image/aaa111", http.StatusOK},
+		{"100.64.0.3", "/api/image/ccc333", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.RemoteAddr = tt.peer + ":41641"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s from %s returned %d, want %d", tt.url, tt.peer, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	db, imgDir := testSetup(t)
+	var buf bytes.Buffer
+	handler := New(db, imgDir, WithAccessLog(slog.New(slog.NewJSONHandler(&buf, nil))))
+
+	for _, url := range []string{"/api/random?category=sfw", "/api/image/abc123"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	type entry struct {
+		Method  string `json:"method"`
+		Path    string `json:"path"`
+		Status  int    `json:"status"`
+		Latency int64  `json:"latency"` // nanoseconds
+	}
+	var entries []entry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decode log line: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d access log entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Method != "GET" || e.Path != "/api/random" || e.Status != http.StatusServiceUnavailable {
+		t.Errorf("first entry = %+v, want GET /api/random 503", e)
+	}
+	if e := entries[1]; e.Path != "/api/image/abc123" || e.Status != http.StatusNotFound || e.Latency <= 0 {
+		t.Errorf("second entry = %+v, want /api/image/abc123 404 with a latency", e)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	db, imgDir := testSetup(t)
+	handler := New(db, imgDir)
+
+	tests := []struct {
+		method, url string
+		allow       string
+	}{
+		{"POST", "/api/random", "GET, HEAD, OPTIONS"},
+		{"DELETE", "/api/image/abc123", "GET, HEAD, PATCH, OPTIONS"},
+		{"GET", "/api/admin/delete", "POST, OPTIONS"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s returned %d, want 405", tt.method, tt.url, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow = %q, want %q", tt.method, tt.url, got, tt.allow)
+		}
+		var body struct {
+			Error string   `json:"error"`
+			Allow []string `json:"allow"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: body %q is not JSON: %v", tt.method, tt.url, w.Body, err)
+			continue
+		}
+		if body.Error != "method not allowed" || strings.Join(body.Allow, ", ") != tt.allow {
+			t.Errorf("%s %s: body = %+v", tt.method, tt.url, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/api/image/abc123", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, HEAD, PATCH, OPTIONS" {
+		t.Errorf("OPTIONS returned %d with Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	for _, method := range []string{"POST", "OPTIONS"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/api/nope", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s of an unknown path returned %d, want 404", method, w.Code)
+		}
+	}
+}
+
+func TestRunsEndpoint(t *testing.T) {
+	db, imgDir := testSetup(t)
+	for i := 0; i < 3; i++ {
+		db.InsertRun(&catalog.Run{Started: time.Now(), New: i})
+	}
+	handler := New(db, imgDir, WithAuthToken("secret"))
+
+	get := func(url, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/api/admin/runs", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated runs returned %d, want 401", w.Code)
+	}
+	if w := get("/api/admin/runs?limit=0", "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0 returned %d, want 400", w.Code)
+	}
+
+	w := get("/api/admin/runs?limit=2", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("runs returned %d", w.Code)
+	}
+	var runs []catalog.Run
+	if err := json.Unmarshal(w.Body.Bytes(), &runs); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(runs) != 2 || runs[0].New != 2 {
+		t.Errorf("runs = %+v, want the 2 newest", runs)
+	}
 }
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+)
+
+// catalogStatsTTL is how long GET /api/catalog/stats reuses a computed
+// distribution. The catalog only changes in bulk during ingest, so slightly
+// stale numbers are fine.
+const catalogStatsTTL = time.Minute
+
+// catalogStatsHandler serves the catalog's size and source distribution,
+// recomputing it at most once per catalogStatsTTL.
+func catalogStatsHandler(cat *catalog.DB) http.HandlerFunc {
+	var (
+		mu      sync.Mutex
+		cached  *catalog.Distribution
+		expires time.Time
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if cached == nil || time.Now().After(expires) {
+			dist, err := cat.Distribution()
+			if err != nil {
+				mu.Unlock()
+				slog.Error("catalog stats", "err", err)
+				http.Error(w, "stats error", http.StatusInternalServerError)
+				return
+			}
+			cached, expires = dist, time.Now().Add(catalogStatsTTL)
+		}
+		dist := cached
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=60")
+		json.NewEncoder(w).Encode(dist)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"image"
+	"net/url"
+	"strconv"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// tone is a serve-time color filter requested with ?grayscale=1 or
+// ?sepia=1. The zero value leaves colors alone.
+type tone string
+
+const (
+	toneGrayscale tone = "grayscale"
+	toneSepia     tone = "sepia"
+)
+
+// parseTone reads the color filter query parameters; at most one may be set.
+func parseTone(q url.Values) (tone, error) {
+	var t tone
+	for _, name := range []tone{toneGrayscale, toneSepia} {
+		s := q.Get(string(name))
+		if s == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(s)
+		if err != nil {
+			return "", errors.New(string(name) + " must be a boolean")
+		}
+		if !on {
+			continue
+		}
+		if t != "" {
+			return "", errors.New("grayscale and sepia are exclusive")
+		}
+		t = name
+	}
+	return t, nil
+}
+
+// apply returns img with the filter applied.
+func (t tone) apply(img image.Image) image.Image {
+	switch t {
+	case toneGrayscale:
+		return optimize.Grayscale(img)
+	case toneSepia:
+		return optimize.Sepia(img)
+	}
+	return img
+}
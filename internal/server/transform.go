@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// errPoolFull is returned when a transform cannot even be queued.
+var errPoolFull = errors.New("transform queue full")
+
+// transformQueueFactor bounds how many transforms may wait per worker before
+// new requests are rejected outright.
+const transformQueueFactor = 4
+
+// TransformPool bounds concurrent serve-time image transformations (decode,
+// re-encode) so a burst of requests queues instead of oversubscribing CPU and
+// memory. A single pool can be shared by several handlers.
+type TransformPool struct {
+	workers chan struct{} // held while a transform runs
+	pending chan struct{} // held while a transform runs or waits
+}
+
+// NewTransformPool creates a pool running at most workers transforms at
+// once. Values below 1 default to the number of CPUs.
+func NewTransformPool(workers int) *TransformPool {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return &TransformPool{
+		workers: make(chan struct{}, workers),
+		pending: make(chan struct{}, workers*(1+transformQueueFactor)),
+	}
+}
+
+// Do runs fn once a worker is free. It returns errPoolFull without running
+// fn if the queue is already at its bound, or ctx.Err() if ctx is done
+// while waiting.
+func (p *TransformPool) Do(ctx context.Context, fn func()) error {
+	select {
+	case p.pending <- struct{}{}:
+	default:
+		return errPoolFull
+	}
+	defer func() { <-p.pending }()
+
+	select {
+	case p.workers <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.workers }()
+
+	fn()
+	return nil
+}
+
+// transformFailed answers a request whose serve-time transform of the stored
+// image for hash failed: 422 if the image is in a format that cannot be
+// decoded (stored as-is, e.g. AVIF), 500 otherwise. A corrupt file, e.g.
+// truncated by a crash, is logged for -fsck to clean up. Neither answer
+// may be cached.
+func transformFailed(w http.ResponseWriter, hash string, err error) {
+	uncacheable(w)
+	switch {
+	case errors.Is(err, optimize.ErrUnsupportedFormat):
+		http.Error(w, "stored image format cannot be transformed", http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, optimize.ErrCorruptImage):
+		slog.Error("image: stored file is corrupt; run -fsck", "hash", hash, "err", err)
+	default:
+		slog.Error("image: transform", "hash", hash, "err", err)
+	}
+	http.Error(w, "transform error", http.StatusInternalServerError)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TransformCache keeps the encoded results of recent serve-time transforms
+// in memory, so a popular variant such as ?w=240&fit=cover or ?grayscale=1
+// is encoded once rather than on every request. Entries are evicted least
+// recently used first once their bytes exceed the limit. Keys include the
+// watermark, so handlers with different settings can share one cache.
+type TransformCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	entries *list.List // of *transformEntry, most recently used first
+	byKey   map[string]*list.Element
+}
+
+// transformEntry is one cached result.
+type transformEntry struct {
+	key     string
+	modTime time.Time // of the source file the result was made from
+	data    []byte
+}
+
+// NewTransformCache creates a cache holding at most maxBytes of results.
+func NewTransformCache(maxBytes int64) *TransformCache {
+	return &TransformCache{
+		maxBytes: maxBytes,
+		entries:  list.New(),
+		byKey:    make(map[string]*list.Element),
+	}
+}
+
+// WithTransformCache serves repeated /api/image transforms from c. Plain
+// ?w= resizes are cached on disk instead and skip it.
+func WithTransformCache(c *TransformCache) Option {
+	return func(cfg *config) { cfg.transformCache = c }
+}
+
+// get returns the result cached under key if it was made from a source file
+// last modified at modTime; a result from an older file is dropped. It is
+// safe to call on a nil TransformCache.
+func (c *TransformCache) get(key string, modTime time.Time) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*transformEntry)
+	if !e.modTime.Equal(modTime) {
+		c.remove(el)
+		return nil, false
+	}
+	c.entries.MoveToFront(el)
+	return e.data, true
+}
+
+// put stores data under key, evicting old entries to stay within the limit.
+// Results larger than the whole cache are not stored. It is safe to call on
+// a nil TransformCache.
+func (c *TransformCache) put(key string, modTime time.Time, data []byte) {
+	if c == nil || int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.byKey[key]; ok {
+		c.remove(el)
+	}
+	c.byKey[key] = c.entries.PushFront(&transformEntry{key: key, modTime: modTime, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.remove(c.entries.Back())
+	}
+}
+
+// remove drops el. c.mu must be held.
+func (c *TransformCache) remove(el *list.Element) {
+	e := c.entries.Remove(el).(*transformEntry)
+	delete(c.byKey, e.key)
+	c.size -= int64(len(e.data))
+}
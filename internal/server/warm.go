@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Jesssullivan/waifu-mirror/internal/catalog"
+	"github.com/Jesssullivan/waifu-mirror/internal/optimize"
+)
+
+// WarmSet keeps the bytes of a small, fixed set of images in memory so the
+// handful of images a client requests over and over never touch the disk.
+// Unlike a general cache its size is chosen up front, which keeps RSS
+// predictable. The set is chosen by Reload and replaced wholesale.
+type WarmSet struct {
+	cat      *catalog.DB
+	imgDir   string
+	category string
+	count    int
+	maxBytes int64
+
+	mu     sync.RWMutex
+	images map[string]warmImage
+}
+
+// warmImage is one image held by a WarmSet.
+type warmImage struct {
+	imageFile
+	ext string
+}
+
+// NewWarmSet creates an empty warm set holding up to count images from
+// category, most viewed first, and at most maxBytes of image data in total
+// (0 = no byte limit). Call Reload to fill it.
+func NewWarmSet(cat *catalog.DB, imgDir, category string, count int, maxBytes int64) *WarmSet {
+	return &WarmSet{cat: cat, imgDir: imgDir, category: category, count: count, maxBytes: maxBytes}
+}
+
+// WithWarmSet serves images in ws from memory.
+func WithWarmSet(ws *WarmSet) Option {
+	return func(c *config) { c.warm = ws }
+}
+
+// Reload picks a fresh set of images and swaps it in. Images that would push
+// the set past its byte limit, or whose files are unreadable, are skipped.
+func (ws *WarmSet) Reload() error {
+	imgs, err := ws.cat.MostViewed(ws.category, ws.count)
+	if err != nil {
+		return err
+	}
+
+	images := make(map[string]warmImage, len(imgs))
+	var total int64
+	for _, img := range imgs {
+		path := filepath.Join(ws.imgDir, img.Filename)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || optimize.Sniff(data) == "" {
+			continue
+		}
+		if ws.maxBytes > 0 && total+int64(len(data)) > ws.maxBytes {
+			continue
+		}
+		total += int64(len(data))
+		images[img.Hash] = warmImage{
+			imageFile: imageFile{name: filepath.Base(path), data: data, ctype: contentType(path, data), modTime: info.ModTime()},
+			ext:       filepath.Ext(path),
+		}
+	}
+
+	ws.mu.Lock()
+	ws.images = images
+	ws.mu.Unlock()
+	slog.Info("warm set loaded", "category", ws.category, "count", len(images), "bytes", total)
+	return nil
+}
+
+// Run reloads the set every interval until ctx is done.
+func (ws *WarmSet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ws.Reload(); err != nil {
+				slog.Error("warm set: reload", "err", err)
+			}
+		}
+	}
+}
+
+// lookup returns the warm bytes for hash. A request for a specific extension
+// only matches an image stored with that extension. It is safe to call on a
+// nil WarmSet.
+func (ws *WarmSet) lookup(hash, ext string) (imageFile, bool) {
+	if ws == nil {
+		return imageFile{}, false
+	}
+	ws.mu.RLock()
+	img, ok := ws.images[hash]
+	ws.mu.RUnlock()
+	if !ok || (ext != "" && ext != img.ext) {
+		return imageFile{}, false
+	}
+	return img.imageFile, true
+}